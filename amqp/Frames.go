@@ -0,0 +1,235 @@
+package amqp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const protocolHeader = "AMQP\x00\x00\x09\x01"
+
+// frame types
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+)
+
+const frameEnd = 0xCE
+
+// maximum size of a frame offered to clients
+const frameMax = 128 * 1024
+
+// method ids are the class id in the upper and the method id in the lower half
+const (
+	connectionStart   = 10<<16 | 10
+	connectionStartOk = 10<<16 | 11
+	connectionTune    = 10<<16 | 30
+	connectionTuneOk  = 10<<16 | 31
+	connectionOpen    = 10<<16 | 40
+	connectionOpenOk  = 10<<16 | 41
+	connectionClose   = 10<<16 | 50
+	connectionCloseOk = 10<<16 | 51
+	channelOpen       = 20<<16 | 10
+	channelOpenOk     = 20<<16 | 11
+	channelFlow       = 20<<16 | 20
+	channelFlowOk     = 20<<16 | 21
+	channelClose      = 20<<16 | 40
+	channelCloseOk    = 20<<16 | 41
+	exchangeDeclare   = 40<<16 | 10
+	exchangeDeclareOk = 40<<16 | 11
+	exchangeDelete    = 40<<16 | 20
+	exchangeDeleteOk  = 40<<16 | 21
+	queueDeclare      = 50<<16 | 10
+	queueDeclareOk    = 50<<16 | 11
+	queueBind         = 50<<16 | 20
+	queueBindOk       = 50<<16 | 21
+	queueUnbind       = 50<<16 | 50
+	queueUnbindOk     = 50<<16 | 51
+	basicQos          = 60<<16 | 10
+	basicQosOk        = 60<<16 | 11
+	basicPublish      = 60<<16 | 40
+	basicReturn       = 60<<16 | 50
+	basicAck          = 60<<16 | 80
+	basicNack         = 60<<16 | 120
+	confirmSelect     = 85<<16 | 10
+	confirmSelectOk   = 85<<16 | 11
+)
+
+const basicClass = 60
+
+// reply codes
+const (
+	replyContentTooLarge = 311
+	replyNoRoute         = 312
+	replyNotFound        = 404
+	replySyntaxError     = 502
+	replyChannelError    = 504
+	replyUnexpectedFrame = 505
+	replyNotImplemented  = 540
+)
+
+var errMalformedFrame = errors.New("malformed frame")
+
+type frame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+func readFrame(r *bufio.Reader) (*frame, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[3:])
+	if size > frameMax {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the maximum of %d bytes", size, frameMax)
+	}
+
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if payload[size] != frameEnd {
+		return nil, errMalformedFrame
+	}
+	return &frame{kind: header[0], channel: binary.BigEndian.Uint16(header[1:]), payload: payload[:size]}, nil
+}
+
+func writeFrame(w *bufio.Writer, kind byte, channel uint16, payload []byte) error {
+	header := make([]byte, 7)
+	header[0] = kind
+	binary.BigEndian.PutUint16(header[1:], channel)
+	binary.BigEndian.PutUint32(header[3:], uint32(len(payload)))
+	w.Write(header)
+	w.Write(payload)
+	w.WriteByte(frameEnd)
+	return w.Flush()
+}
+
+// decoder reads the arguments of a method, the first error sticks. Bits are
+// packed into octets, so a bit following other bits is read from the same octet.
+type decoder struct {
+	data []byte
+	err  error
+	// octet of the last bit read and the position of the next bit in it
+	bits    byte
+	nextBit uint
+}
+
+func (d *decoder) take(n int) []byte {
+	d.nextBit = 0
+	if d.err != nil || n < 0 || len(d.data) < n {
+		d.err = errMalformedFrame
+		// large enough for any fixed size field, lengths are read from the frame
+		return make([]byte, 8)
+	}
+	value := d.data[:n]
+	d.data = d.data[n:]
+	return value
+}
+
+func (d *decoder) octet() byte {
+	return d.take(1)[0]
+}
+
+func (d *decoder) short() uint16 {
+	return binary.BigEndian.Uint16(d.take(2))
+}
+
+func (d *decoder) long() uint32 {
+	return binary.BigEndian.Uint32(d.take(4))
+}
+
+func (d *decoder) longlong() uint64 {
+	return binary.BigEndian.Uint64(d.take(8))
+}
+
+func (d *decoder) shortstr() string {
+	return string(d.take(int(d.octet())))
+}
+
+func (d *decoder) longstr() string {
+	return string(d.take(int(d.long())))
+}
+
+// table skips a field table, the arguments of declarations aren't used
+func (d *decoder) table() {
+	d.take(int(d.long()))
+}
+
+func (d *decoder) bit() bool {
+	if d.nextBit == 0 || d.nextBit == 8 {
+		d.bits = d.take(1)[0]
+	}
+	value := d.bits&(1<<d.nextBit) != 0
+	d.nextBit++
+	return value
+}
+
+// encoder writes the arguments of a method
+type encoder struct {
+	data []byte
+}
+
+func newMethod(method uint32) *encoder {
+	e := &encoder{}
+	e.long(method)
+	return e
+}
+
+func (e *encoder) octet(value byte) {
+	e.data = append(e.data, value)
+}
+
+func (e *encoder) short(value uint16) {
+	e.data = append(e.data, byte(value>>8), byte(value))
+}
+
+func (e *encoder) long(value uint32) {
+	e.data = append(e.data, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func (e *encoder) longlong(value uint64) {
+	e.long(uint32(value >> 32))
+	e.long(uint32(value))
+}
+
+func (e *encoder) shortstr(value string) {
+	e.octet(byte(len(value)))
+	e.data = append(e.data, value...)
+}
+
+func (e *encoder) longstr(value string) {
+	e.long(uint32(len(value)))
+	e.data = append(e.data, value...)
+}
+
+// table writes a field table of strings, booleans and nested tables
+func (e *encoder) table(fields map[string]interface{}) {
+	table := &encoder{}
+	for name, value := range fields {
+		table.shortstr(name)
+		switch v := value.(type) {
+		case string:
+			table.octet('S')
+			table.longstr(v)
+		case bool:
+			table.octet('t')
+			if v {
+				table.octet(1)
+			} else {
+				table.octet(0)
+			}
+		case map[string]interface{}:
+			table.octet('F')
+			table.table(v)
+		}
+	}
+	e.long(uint32(len(table.data)))
+	e.data = append(e.data, table.data...)
+}
@@ -0,0 +1,100 @@
+package amqp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		input   string
+		kind    byte
+		channel uint16
+		payload string
+		err     error
+	}{
+		{"\x08\x00\x00\x00\x00\x00\x00\xce", frameHeartbeat, 0, "", nil},
+		{"\x01\x00\x05\x00\x00\x00\x03abc\xce", frameMethod, 5, "abc", nil},
+		// the frame has to end with the frame end octet
+		{"\x01\x00\x05\x00\x00\x00\x03abcd", 0, 0, "", errMalformedFrame},
+		// the size is checked before the payload is allocated
+		{"\x03\x00\x01\xff\xff\xff\xff", 0, 0, "", fmt.Errorf("frame of 4294967295 bytes exceeds the maximum of %d bytes", frameMax)},
+		{"\x03\x00\x01\x00\x02\x00\x01", 0, 0, "", fmt.Errorf("frame of 131073 bytes exceeds the maximum of %d bytes", frameMax)},
+		{"\x01\x00\x05\x00\x00\x00\x03ab", 0, 0, "", io.ErrUnexpectedEOF},
+		{"\x01\x00\x05", 0, 0, "", io.ErrUnexpectedEOF},
+		{"", 0, 0, "", io.EOF},
+	}
+
+	for _, test := range tests {
+		f, err := readFrame(bufio.NewReader(strings.NewReader(test.input)))
+		if fmt.Sprint(err) != fmt.Sprint(test.err) {
+			t.Errorf("readFrame(%q) returned %v instead of %v", test.input, err, test.err)
+			continue
+		}
+		if err == nil && (f.kind != test.kind || f.channel != test.channel || string(f.payload) != test.payload) {
+			t.Errorf("readFrame(%q) returned %d %d %q instead of %d %d %q", test.input, f.kind, f.channel, f.payload, test.kind, test.channel, test.payload)
+		}
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	for _, size := range []int{0, 1, frameMax} {
+		payload := bytes.Repeat([]byte{'a'}, size)
+		var buffer bytes.Buffer
+		if err := writeFrame(bufio.NewWriter(&buffer), frameBody, 7, payload); err != nil {
+			t.Fatalf("writeFrame failed: %s", err.Error())
+		}
+		f, err := readFrame(bufio.NewReader(&buffer))
+		if err != nil || f.kind != frameBody || f.channel != 7 || !bytes.Equal(f.payload, payload) {
+			t.Errorf("frame with a payload of %d bytes didn't survive the round trip: %v", size, err)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	e := newMethod(basicPublish)
+	e.short(0)
+	e.shortstr("exchange")
+	e.shortstr("key")
+	// mandatory and immediate share an octet
+	e.octet(1)
+	e.longlong(1 << 40)
+	e.longstr("text")
+	e.table(map[string]interface{}{"flag": true})
+
+	d := &decoder{data: e.data}
+	method, _, exchange, routingKey := d.long(), d.short(), d.shortstr(), d.shortstr()
+	mandatory, immediate := d.bit(), d.bit()
+	size, text := d.longlong(), d.longstr()
+	d.table()
+	if d.err != nil || method != basicPublish || exchange != "exchange" || routingKey != "key" || !mandatory || immediate || size != 1<<40 || text != "text" {
+		t.Fatalf("decoded %d %q %q %t %t %d %q, %v", method, exchange, routingKey, mandatory, immediate, size, text, d.err)
+	}
+	if len(d.data) != 0 {
+		t.Fatalf("%d bytes left after decoding", len(d.data))
+	}
+
+	malformed := []string{
+		"",
+		"\x00",
+		// a long string claiming more bytes than left
+		"\x00\x00\x00\x05abc",
+		// a long string claiming 4GiB, which must not be allocated
+		"\xff\xff\xff\xff",
+		// a long string claiming more than fits into an int32
+		"\x80\x00\x00\x00abc",
+	}
+	for _, data := range malformed {
+		d := &decoder{data: []byte(data)}
+		d.longstr()
+		// the first error sticks, even if there were enough bytes for an octet
+		d.octet()
+		if d.err != errMalformedFrame {
+			t.Errorf("decoding %q returned %v", data, d.err)
+		}
+	}
+}
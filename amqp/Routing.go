@@ -0,0 +1,123 @@
+package amqp
+
+import (
+	"strings"
+	"sync"
+)
+
+// router keeps the exchanges and bindings declared by clients. Queues are
+// pipelines, a message routed to a queue is pushed to the pipeline of the
+// same id. Like the rest of the AMQP state it only lives in memory.
+type router struct {
+	mutex sync.RWMutex
+	// types of the declared exchanges
+	exchanges map[string]string
+	bindings  map[string][]binding
+}
+
+type binding struct {
+	queue      string
+	routingKey string
+}
+
+func newRouter() *router {
+	return &router{
+		exchanges: make(map[string]string),
+		bindings:  make(map[string][]binding),
+	}
+}
+
+func (r *router) declareExchange(name string, kind string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.exchanges[name] = kind
+}
+
+func (r *router) exchangeExists(name string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	_, ok := r.exchanges[name]
+	return ok
+}
+
+func (r *router) deleteExchange(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.exchanges, name)
+	delete(r.bindings, name)
+}
+
+func (r *router) bind(exchange string, queue string, routingKey string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, b := range r.bindings[exchange] {
+		if b.queue == queue && b.routingKey == routingKey {
+			return
+		}
+	}
+	r.bindings[exchange] = append(r.bindings[exchange], binding{queue: queue, routingKey: routingKey})
+}
+
+func (r *router) unbind(exchange string, queue string, routingKey string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	bindings := r.bindings[exchange][:0]
+	for _, b := range r.bindings[exchange] {
+		if b.queue != queue || b.routingKey != routingKey {
+			bindings = append(bindings, b)
+		}
+	}
+	r.bindings[exchange] = bindings
+}
+
+// route returns the queues bound to the exchange that match the routing key,
+// the second result tells whether the exchange has bindings at all
+func (r *router) route(exchange string, routingKey string) ([]string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	bindings := r.bindings[exchange]
+	var queues []string
+	seen := make(map[string]bool)
+	for _, b := range bindings {
+		matches := false
+		switch r.exchanges[exchange] {
+		case "fanout":
+			matches = true
+		case "topic":
+			matches = topicMatches(strings.Split(b.routingKey, "."), strings.Split(routingKey, "."))
+		default:
+			matches = b.routingKey == routingKey
+		}
+		if matches && !seen[b.queue] {
+			seen[b.queue] = true
+			queues = append(queues, b.queue)
+		}
+	}
+	return queues, len(bindings) > 0
+}
+
+// topicMatches matches the words of a routing key against a binding pattern,
+// where * stands for one word and # for any number of words
+func topicMatches(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+}
@@ -0,0 +1,585 @@
+package amqp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// heartbeat interval offered to clients
+const heartbeat = 60 * time.Second
+
+// maximum size of a message, just like the payload of a datapoint
+const maxMessageSize = 16 * 1024 * 1024
+
+// how long a pipeline is known to exist without asking the backend again
+const pipelineCacheTimeout = time.Minute
+
+// Server accepts AMQP 0-9-1 publishers and pushes their messages to
+// pipelines. A message published to the default exchange is pushed to the
+// pipeline named by the routing key, just like RabbitMQ delivers it to the
+// queue of that name. Messages published to other exchanges follow the
+// bindings declared for them, if there are none the routing key or the name
+// of the exchange is taken as pipeline. With publisher confirms a message is
+// acknowledged once it is stored and negatively acknowledged if storing it
+// failed.
+type Server struct {
+	Backend backend.Backend
+	router  *router
+}
+
+func NewServer(b backend.Backend) *Server {
+	return &Server{Backend: b, router: newRouter()}
+}
+
+func (s *Server) ListenAndServe(bind string) error {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// amqpError closes the channel or the connection with the reply code
+type amqpError struct {
+	code   uint16
+	text   string
+	method uint32
+}
+
+func (e *amqpError) Error() string {
+	return fmt.Sprintf("%d %s", e.code, e.text)
+}
+
+type connection struct {
+	server     *Server
+	conn       net.Conn
+	reader     *bufio.Reader
+	writer     *bufio.Writer
+	writeMutex sync.Mutex
+	// negotiated with the client
+	frameMax  uint32
+	heartbeat time.Duration
+	channels  map[uint16]*channel
+	// pipelines known to exist and when that was checked
+	pipelines map[string]time.Time
+}
+
+type channel struct {
+	confirm     bool
+	deliveryTag uint64
+	// closed by the server, waiting for the client to confirm
+	closing bool
+	// the message whose content is being received
+	publication *publication
+}
+
+type publication struct {
+	exchange   string
+	routingKey string
+	mandatory  bool
+	header     bool
+	size       uint64
+	body       []byte
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &connection{
+		server:    s,
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		writer:    bufio.NewWriter(conn),
+		frameMax:  frameMax,
+		channels:  make(map[uint16]*channel),
+		pipelines: make(map[string]time.Time),
+	}
+
+	if err := c.open(); err != nil {
+		log.Println("Error opening amqp connection:", err.Error())
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if c.heartbeat > 0 {
+		go c.sendHeartbeats(done)
+	}
+
+	for {
+		if c.heartbeat > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(3 * c.heartbeat))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		f, err := readFrame(c.reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Error reading amqp frame:", err.Error())
+			}
+			return
+		}
+
+		closed, err := c.handle(f)
+		if e, ok := err.(*amqpError); ok {
+			log.Println("Closing amqp connection:", e.Error())
+			c.close(e)
+			return
+		}
+		if err != nil {
+			log.Println("Error handling amqp frame:", err.Error())
+			return
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// open runs the handshake up to the opening of the virtual host
+func (c *connection) open() error {
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	header := make([]byte, len(protocolHeader))
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	if string(header) != protocolHeader {
+		// tell the client which protocol is spoken
+		c.writer.WriteString(protocolHeader)
+		c.writer.Flush()
+		return errors.New("unsupported protocol")
+	}
+
+	start := newMethod(connectionStart)
+	start.octet(0)
+	start.octet(9)
+	start.table(map[string]interface{}{
+		"product": "Turbine",
+		"capabilities": map[string]interface{}{
+			"publisher_confirms": true,
+			"basic.nack":         true,
+		},
+	})
+	start.longstr("PLAIN AMQPLAIN")
+	start.longstr("en_US")
+	if err := c.method(0, start); err != nil {
+		return err
+	}
+
+	// there is no authentication, the credentials are ignored
+	if _, err := c.expect(connectionStartOk); err != nil {
+		return err
+	}
+
+	tune := newMethod(connectionTune)
+	tune.short(2047)
+	tune.long(frameMax)
+	tune.short(uint16(heartbeat / time.Second))
+	if err := c.method(0, tune); err != nil {
+		return err
+	}
+	d, err := c.expect(connectionTuneOk)
+	if err != nil {
+		return err
+	}
+	d.short()
+	if max := d.long(); max > 0 && max < c.frameMax {
+		c.frameMax = max
+	}
+	c.heartbeat = time.Duration(d.short()) * time.Second
+
+	if _, err := c.expect(connectionOpen); err != nil {
+		return err
+	}
+	openOk := newMethod(connectionOpenOk)
+	openOk.shortstr("")
+	return c.method(0, openOk)
+}
+
+// expect reads the next method on the connection channel, which has to be
+// the given one
+func (c *connection) expect(method uint32) (*decoder, error) {
+	for {
+		f, err := readFrame(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if f.kind == frameHeartbeat {
+			continue
+		}
+
+		d := &decoder{data: f.payload}
+		if f.kind != frameMethod || f.channel != 0 || d.long() != method {
+			return nil, fmt.Errorf("expected method %d.%d", method>>16, method&0xFFFF)
+		}
+		return d, d.err
+	}
+}
+
+func (c *connection) sendHeartbeats(done chan struct{}) {
+	ticker := time.NewTicker(c.heartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write(frameHeartbeat, 0, nil); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// handle handles a frame, it returns true once the connection is closed
+func (c *connection) handle(f *frame) (bool, error) {
+	switch {
+	case f.kind == frameHeartbeat:
+		return false, nil
+	case f.channel == 0:
+		d := &decoder{data: f.payload}
+		method := d.long()
+		if f.kind == frameMethod && method == connectionClose {
+			return true, c.method(0, newMethod(connectionCloseOk))
+		}
+		if f.kind == frameMethod && method == connectionCloseOk {
+			return true, nil
+		}
+		return false, &amqpError{code: replyUnexpectedFrame, text: "UNEXPECTED_FRAME", method: method}
+	}
+
+	ch := c.channels[f.channel]
+	if ch == nil {
+		d := &decoder{data: f.payload}
+		if f.kind != frameMethod || d.long() != channelOpen {
+			return false, &amqpError{code: replyChannelError, text: "CHANNEL_ERROR - channel not open"}
+		}
+		c.channels[f.channel] = &channel{}
+		openOk := newMethod(channelOpenOk)
+		openOk.longstr("")
+		return false, c.method(f.channel, openOk)
+	}
+
+	var err error
+	switch f.kind {
+	case frameMethod:
+		err = c.handleMethod(f.channel, ch, &decoder{data: f.payload})
+	case frameHeader:
+		err = c.handleHeader(f.channel, ch, &decoder{data: f.payload})
+	case frameBody:
+		err = c.handleBody(f.channel, ch, f.payload)
+	default:
+		err = &amqpError{code: replyUnexpectedFrame, text: "UNEXPECTED_FRAME"}
+	}
+	return false, err
+}
+
+func (c *connection) handleMethod(id uint16, ch *channel, d *decoder) error {
+	method := d.long()
+	if ch.closing {
+		// everything but the confirmation of the close is discarded
+		if method == channelCloseOk {
+			delete(c.channels, id)
+		}
+		return nil
+	}
+	if ch.publication != nil {
+		return &amqpError{code: replyUnexpectedFrame, text: "UNEXPECTED_FRAME - expected content", method: method}
+	}
+
+	var reply *encoder
+	switch method {
+	case channelFlow:
+		reply = newMethod(channelFlowOk)
+		if d.bit() {
+			reply.octet(1)
+		} else {
+			reply.octet(0)
+		}
+	case channelClose:
+		delete(c.channels, id)
+		reply = newMethod(channelCloseOk)
+	case exchangeDeclare:
+		d.short()
+		exchange := d.shortstr()
+		kind := d.shortstr()
+		passive := d.bit()
+		d.bit()
+		d.bit()
+		d.bit()
+		noWait := d.bit()
+		d.table()
+		if passive && exchange != "" && !c.server.router.exchangeExists(exchange) {
+			return c.closeChannel(id, ch, replyNotFound, "NOT_FOUND - no exchange '"+exchange+"'", method)
+		}
+		if !passive {
+			c.server.router.declareExchange(exchange, kind)
+		}
+		if !noWait {
+			reply = newMethod(exchangeDeclareOk)
+		}
+	case exchangeDelete:
+		d.short()
+		exchange := d.shortstr()
+		d.bit()
+		noWait := d.bit()
+		c.server.router.deleteExchange(exchange)
+		if !noWait {
+			reply = newMethod(exchangeDeleteOk)
+		}
+	case queueDeclare:
+		d.short()
+		queue := d.shortstr()
+		for i := 0; i < 4; i++ {
+			d.bit()
+		}
+		noWait := d.bit()
+		d.table()
+		if d.err == nil && !c.pipelineExists(queue) {
+			return c.closeChannel(id, ch, replyNotFound, "NOT_FOUND - no pipeline '"+queue+"'", method)
+		}
+		if !noWait {
+			reply = newMethod(queueDeclareOk)
+			reply.shortstr(queue)
+			reply.long(0)
+			reply.long(0)
+		}
+	case queueBind:
+		d.short()
+		queue := d.shortstr()
+		exchange := d.shortstr()
+		routingKey := d.shortstr()
+		noWait := d.bit()
+		d.table()
+		if d.err == nil && !c.pipelineExists(queue) {
+			return c.closeChannel(id, ch, replyNotFound, "NOT_FOUND - no pipeline '"+queue+"'", method)
+		}
+		c.server.router.bind(exchange, queue, routingKey)
+		if !noWait {
+			reply = newMethod(queueBindOk)
+		}
+	case queueUnbind:
+		d.short()
+		queue := d.shortstr()
+		exchange := d.shortstr()
+		routingKey := d.shortstr()
+		d.table()
+		c.server.router.unbind(exchange, queue, routingKey)
+		reply = newMethod(queueUnbindOk)
+	case basicQos:
+		// there are no consumers, so there is nothing to limit
+		reply = newMethod(basicQosOk)
+	case confirmSelect:
+		ch.confirm = true
+		if !d.bit() {
+			reply = newMethod(confirmSelectOk)
+		}
+	case basicPublish:
+		d.short()
+		ch.publication = &publication{exchange: d.shortstr(), routingKey: d.shortstr(), mandatory: d.bit()}
+	default:
+		return c.closeChannel(id, ch, replyNotImplemented, "NOT_IMPLEMENTED - the listener only accepts publishers", method)
+	}
+
+	if d.err != nil {
+		return &amqpError{code: replySyntaxError, text: "SYNTAX_ERROR", method: method}
+	}
+	if reply != nil {
+		return c.method(id, reply)
+	}
+	return nil
+}
+
+func (c *connection) handleHeader(id uint16, ch *channel, d *decoder) error {
+	if ch.closing {
+		return nil
+	}
+	p := ch.publication
+	if p == nil || p.header {
+		return &amqpError{code: replyUnexpectedFrame, text: "UNEXPECTED_FRAME - unexpected content header"}
+	}
+
+	// the properties of the message aren't kept
+	d.short()
+	d.short()
+	p.size = d.longlong()
+	p.header = true
+	if d.err != nil {
+		return &amqpError{code: replySyntaxError, text: "SYNTAX_ERROR"}
+	}
+	if p.size > maxMessageSize {
+		ch.publication = nil
+		return c.closeChannel(id, ch, replyContentTooLarge, "CONTENT_TOO_LARGE", basicPublish)
+	}
+
+	if p.size == 0 {
+		return c.publish(id, ch)
+	}
+	p.body = make([]byte, 0, p.size)
+	return nil
+}
+
+func (c *connection) handleBody(id uint16, ch *channel, payload []byte) error {
+	if ch.closing {
+		return nil
+	}
+	p := ch.publication
+	if p == nil || !p.header || uint64(len(p.body)+len(payload)) > p.size {
+		return &amqpError{code: replyUnexpectedFrame, text: "UNEXPECTED_FRAME - unexpected content body"}
+	}
+
+	p.body = append(p.body, payload...)
+	if uint64(len(p.body)) == p.size {
+		return c.publish(id, ch)
+	}
+	return nil
+}
+
+// publish pushes the completely received message to the pipelines it is
+// routed to
+func (c *connection) publish(id uint16, ch *channel) error {
+	p := ch.publication
+	ch.publication = nil
+	if ch.confirm {
+		ch.deliveryTag++
+	}
+
+	pipelines := c.route(p.exchange, p.routingKey)
+	if len(pipelines) == 0 && p.mandatory {
+		if err := c.returnMessage(id, p); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	for _, pipelineId := range pipelines {
+		// with confirms the message is only acknowledged once it is stored
+		if _, err = c.server.Backend.PushDatapoint(pipelineId, string(p.body), ch.confirm); err != nil {
+			log.Printf("Error pushing amqp message to pipeline %s: %s", pipelineId, err.Error())
+			break
+		}
+	}
+
+	if !ch.confirm {
+		return nil
+	}
+	confirmation := newMethod(basicAck)
+	if err != nil {
+		confirmation = newMethod(basicNack)
+	}
+	confirmation.longlong(ch.deliveryTag)
+	confirmation.octet(0)
+	return c.method(id, confirmation)
+}
+
+// route resolves the pipelines of a message, see Server
+func (c *connection) route(exchange string, routingKey string) []string {
+	if exchange != "" {
+		queues, bound := c.server.router.route(exchange, routingKey)
+		if bound {
+			return queues
+		}
+		if !c.pipelineExists(routingKey) {
+			routingKey = exchange
+		}
+	}
+	if c.pipelineExists(routingKey) {
+		return []string{routingKey}
+	}
+	return nil
+}
+
+func (c *connection) pipelineExists(id string) bool {
+	if id == "" {
+		return false
+	}
+	if checked, ok := c.pipelines[id]; ok && time.Since(checked) < pipelineCacheTimeout {
+		return true
+	}
+	if _, err := c.server.Backend.GetPipeline(id); err != nil {
+		return false
+	}
+	c.pipelines[id] = time.Now()
+	return true
+}
+
+// returnMessage hands an unroutable mandatory message back to the publisher
+func (c *connection) returnMessage(id uint16, p *publication) error {
+	returned := newMethod(basicReturn)
+	returned.short(replyNoRoute)
+	returned.shortstr("NO_ROUTE")
+	returned.shortstr(p.exchange)
+	returned.shortstr(p.routingKey)
+	if err := c.method(id, returned); err != nil {
+		return err
+	}
+
+	header := &encoder{}
+	header.short(basicClass)
+	header.short(0)
+	header.longlong(uint64(len(p.body)))
+	header.short(0)
+	if err := c.write(frameHeader, id, header.data); err != nil {
+		return err
+	}
+
+	// the frame header and end take 8 bytes of the maximum frame size
+	for body := p.body; len(body) > 0; {
+		size := len(body)
+		if max := int(c.frameMax) - 8; size > max {
+			size = max
+		}
+		if err := c.write(frameBody, id, body[:size]); err != nil {
+			return err
+		}
+		body = body[size:]
+	}
+	return nil
+}
+
+// closeChannel closes the channel because of an error of the client
+func (c *connection) closeChannel(id uint16, ch *channel, code uint16, text string, method uint32) error {
+	ch.closing = true
+	closing := newMethod(channelClose)
+	closing.short(code)
+	closing.shortstr(text)
+	closing.short(uint16(method >> 16))
+	closing.short(uint16(method))
+	return c.method(id, closing)
+}
+
+// close closes the connection because of an error of the client
+func (c *connection) close(e *amqpError) {
+	closing := newMethod(connectionClose)
+	closing.short(e.code)
+	closing.shortstr(e.text)
+	closing.short(uint16(e.method >> 16))
+	closing.short(uint16(e.method))
+	c.method(0, closing)
+}
+
+func (c *connection) method(channel uint16, method *encoder) error {
+	return c.write(frameMethod, channel, method.data)
+}
+
+func (c *connection) write(kind byte, channel uint16, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return writeFrame(c.writer, kind, channel, payload)
+}
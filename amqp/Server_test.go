@@ -0,0 +1,214 @@
+package amqp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"net"
+	"testing"
+	"time"
+)
+
+// how long a test waits for a frame
+const testTimeout = 5 * time.Second
+
+// testClient speaks AMQP to a connection served over a pipe
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	served chan struct{}
+}
+
+// dial runs the handshake without heartbeats and opens channel 1
+func dial(t *testing.T, s *Server) *testClient {
+	client, server := net.Pipe()
+	c := &testClient{t: t, conn: client, reader: bufio.NewReader(client), writer: bufio.NewWriter(client), served: make(chan struct{})}
+	go func() {
+		s.serve(server)
+		close(c.served)
+	}()
+
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	c.writer.WriteString(protocolHeader)
+	c.writer.Flush()
+	c.expect(0, connectionStart)
+	startOk := newMethod(connectionStartOk)
+	startOk.table(nil)
+	startOk.shortstr("PLAIN")
+	startOk.longstr("\x00guest\x00guest")
+	startOk.shortstr("en_US")
+	c.send(frameMethod, 0, startOk.data)
+	c.expect(0, connectionTune)
+	tuneOk := newMethod(connectionTuneOk)
+	tuneOk.short(2047)
+	tuneOk.long(frameMax)
+	tuneOk.short(0)
+	c.send(frameMethod, 0, tuneOk.data)
+	open := newMethod(connectionOpen)
+	open.shortstr("/")
+	open.shortstr("")
+	open.octet(0)
+	c.send(frameMethod, 0, open.data)
+	c.expect(0, connectionOpenOk)
+
+	channelOpen := newMethod(channelOpen)
+	channelOpen.shortstr("")
+	c.send(frameMethod, 1, channelOpen.data)
+	c.expect(1, channelOpenOk)
+	return c
+}
+
+func (c *testClient) send(kind byte, channel uint16, payload []byte) {
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if err := writeFrame(c.writer, kind, channel, payload); err != nil {
+		c.t.Fatalf("Sending frame %d failed: %s", kind, err.Error())
+	}
+}
+
+func (c *testClient) read() (*frame, error) {
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	return readFrame(c.reader)
+}
+
+// expect reads the next method, which has to be the given one on the channel
+func (c *testClient) expect(channel uint16, method uint32) *decoder {
+	f, err := c.read()
+	if err != nil {
+		c.t.Fatalf("expected method %d.%d but reading failed: %s", method>>16, method&0xFFFF, err.Error())
+	}
+	d := &decoder{data: f.payload}
+	if actual := d.long(); f.kind != frameMethod || f.channel != channel || actual != method {
+		c.t.Fatalf("expected method %d.%d on channel %d but got frame %d with method %d.%d on channel %d", method>>16, method&0xFFFF, channel, f.kind, actual>>16, actual&0xFFFF, f.channel)
+	}
+	return d
+}
+
+func (c *testClient) confirmSelect() {
+	selectMethod := newMethod(confirmSelect)
+	selectMethod.octet(0)
+	c.send(frameMethod, 1, selectMethod.data)
+	c.expect(1, confirmSelectOk)
+}
+
+// publish sends the message in a single body frame to the default exchange
+func (c *testClient) publish(routingKey string, body string) {
+	publish := newMethod(basicPublish)
+	publish.short(0)
+	publish.shortstr("")
+	publish.shortstr(routingKey)
+	publish.octet(0)
+	c.send(frameMethod, 1, publish.data)
+	c.header(uint64(len(body)))
+	c.send(frameBody, 1, []byte(body))
+}
+
+func (c *testClient) header(size uint64) {
+	header := &encoder{}
+	header.short(basicClass)
+	header.short(0)
+	header.longlong(size)
+	header.short(0)
+	c.send(frameHeader, 1, header.data)
+}
+
+func (c *testClient) close() {
+	c.conn.Close()
+	<-c.served
+}
+
+// failingBackend fails to store any datapoint
+type failingBackend struct {
+	backend.Backend
+}
+
+func (b failingBackend) PushDatapoint(pipelineId string, value string, ack bool) (int64, error) {
+	return 0, errors.New("disk full")
+}
+
+func createPipeline(t *testing.T, b backend.Backend) *backend.Pipeline {
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "amqp"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	return pipeline
+}
+
+func TestPublishConfirms(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := createPipeline(t, b)
+	c := dial(t, NewServer(b))
+	defer c.close()
+	c.confirmSelect()
+
+	for tag := uint64(1); tag <= 2; tag++ {
+		c.publish(pipeline.Id, fmt.Sprintf("Message %d", tag))
+		if d := c.expect(1, basicAck); d.longlong() != tag {
+			t.Fatalf("expected the acknowledgement of message %d", tag)
+		}
+	}
+	datapoints, err := b.PopDatapoint(pipeline.Id, "reader", backend.PopLimit{})
+	if err != nil || fmt.Sprint(datapoints) != "[Message 1 Message 2]" {
+		t.Fatalf("expected the published messages but got %q, %v", datapoints, err)
+	}
+}
+
+// TestPublishNack verifies that messages the backend failed to store are
+// negatively acknowledged
+func TestPublishNack(t *testing.T) {
+	b := failingBackend{Backend: backend.NewMemoryBackend()}
+	pipeline := createPipeline(t, b)
+	c := dial(t, NewServer(b))
+	defer c.close()
+	c.confirmSelect()
+
+	c.publish(pipeline.Id, "Message")
+	if d := c.expect(1, basicNack); d.longlong() != 1 {
+		t.Fatal("expected the negative acknowledgement of message 1")
+	}
+}
+
+func TestContentTooLarge(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := createPipeline(t, b)
+	c := dial(t, NewServer(b))
+	defer c.close()
+
+	publish := newMethod(basicPublish)
+	publish.short(0)
+	publish.shortstr("")
+	publish.shortstr(pipeline.Id)
+	publish.octet(0)
+	c.send(frameMethod, 1, publish.data)
+	c.header(maxMessageSize + 1)
+	if d := c.expect(1, channelClose); d.short() != replyContentTooLarge {
+		t.Fatal("expected the channel to be closed with CONTENT_TOO_LARGE")
+	}
+}
+
+// TestOversizedFrame verifies that frames larger than negotiated end the
+// connection before their payload is read
+func TestOversizedFrame(t *testing.T) {
+	c := dial(t, NewServer(backend.NewMemoryBackend()))
+	defer c.close()
+
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	c.writer.Write([]byte{frameBody, 0, 1, 0xff, 0xff, 0xff, 0xff})
+	c.writer.Flush()
+	if f, err := c.read(); err == nil {
+		t.Fatalf("expected the connection to be closed but got frame %d", f.kind)
+	}
+}
+
+func TestUnexpectedFrame(t *testing.T) {
+	c := dial(t, NewServer(backend.NewMemoryBackend()))
+	defer c.close()
+
+	// content without a publication
+	c.send(frameBody, 1, []byte("body"))
+	if d := c.expect(0, connectionClose); d.short() != replyUnexpectedFrame {
+		t.Fatal("expected the connection to be closed with UNEXPECTED_FRAME")
+	}
+}
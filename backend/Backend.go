@@ -1,6 +1,17 @@
 package backend
 
-import ()
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrPipelineNotFound = errors.New("pipeline not found")
+var ErrInvalidOffset = errors.New("offset beyond the last datapoint")
+var ErrConsumerNotFound = errors.New("consumer not found")
+var ErrConsumerExists = errors.New("consumer already exists")
+var ErrInvalidSeek = errors.New("invalid seek position")
+var ErrLeaseNotFound = errors.New("lease not found")
 
 type Backend interface {
 	GetPipelines() ([]Pipeline, error)
@@ -11,8 +22,60 @@ type Backend interface {
 
 	RetrievePipelineStatistic(id string) (*PipelineStatistic, error)
 
-	PopDatapoint(id string, consumerId string) ([]string, error)
-	PushDatapoint(pipelineId string, value string) (int64, error)
+	// LeaseDatapoints hands the next datapoints of the consumer to one of its
+	// members for the visibility timeout. Expired leases are handed out again
+	// before any new datapoints, nil is returned if there is nothing to lease.
+	LeaseDatapoints(id string, consumerId string, memberId string, limit PopLimit, timeout time.Duration) (*Lease, error)
+	// AckLease acknowledges a lease, the consumer pointer moves forward over
+	// all datapoints whose leases are acknowledged
+	AckLease(id string, consumerId string, leaseId string) error
+	// NackLease hands the lease back for redelivery, which is delayed by a
+	// backoff growing with the deliveries of the lease
+	NackLease(id string, consumerId string, leaseId string) error
+
+	GetConsumers(pipelineId string) ([]Consumer, error)
+	// CreateConsumer registers a consumer starting at the beginning of the
+	// pipeline, consumers are also created implicitly by their first read
+	CreateConsumer(pipelineId string, consumerId string) (*Consumer, error)
+	DeleteConsumer(pipelineId string, consumerId string) (bool, error)
+	// SeekConsumer moves the consumer pointer, so that the next read starts at
+	// the position given by the seek
+	SeekConsumer(pipelineId string, consumerId string, seek Seek) (*Consumer, error)
+
+	PopDatapoint(id string, consumerId string, limit PopLimit) ([]string, error)
+	// PeekDatapoints returns the next datapoints of the consumer together with
+	// their offsets, without moving the consumer pointer
+	PeekDatapoints(id string, consumerId string, limit PopLimit) ([]OffsetDatapoint, error)
+	// CommitOffset moves the consumer pointer forward to the offset of the last
+	// datapoint the consumer processed, committing an older offset does nothing
+	CommitOffset(id string, consumerId string, offset int64) error
+	// ReadDatapoints returns the datapoints following the offset within the
+	// limit, independent of any consumer
+	ReadDatapoints(id string, offset int64, limit PopLimit) ([]OffsetDatapoint, error)
+	// DatapointOffsets returns the offset of the last datapoint removed from the
+	// head of the pipeline and the offset of the last datapoint stored, the
+	// datapoints in between can be read
+	DatapointOffsets(id string) (int64, int64, error)
+	// PushDatapoint appends the value to the pipeline and returns its index.
+	// Backends storing datapoints asynchronously return 0 right away, unless
+	// ack is set, in which case they wait until the datapoint is stored.
+	PushDatapoint(pipelineId string, value string, ack bool) (int64, error)
+	// PushDatapoints appends all values at once and returns the indexes of the
+	// first and the last one, or zeros just like PushDatapoint
+	PushDatapoints(pipelineId string, values []string, ack bool) (int64, int64, error)
+
+	// ApplyRetention removes the datapoints the policy no longer retains from
+	// the head of the pipeline and returns how many were removed
+	ApplyRetention(pipelineId string, policy RetentionPolicy) (int64, error)
+
+	// Subscribe returns a channel signalled whenever datapoints are stored in
+	// the pipeline, see Broker
+	Subscribe(pipelineId string) chan struct{}
+	Unsubscribe(pipelineId string, notifications chan struct{})
+
+	// Status reports the state of the storage and the writers, see ReadStatus
+	// for the status including the pipelines
+	Status() (*Status, error)
 }
 
 type Pipeline struct {
@@ -21,11 +84,90 @@ type Pipeline struct {
 	Description       string            `json:"description"`
 	PipelineStatistic PipelineStatistic `json:"statistic"`
 	Consumers         []Consumer        `json:"consumers"`
+	Retention         *RetentionPolicy  `json:"retention,omitempty"`
+	DeadLetter        *DeadLetterPolicy `json:"dead_letter,omitempty"`
+}
+
+// ValidatePipeline checks the settings of a pipeline sent by a client before
+// it is stored under the id, e.g. that its dead letter pipeline exists
+func ValidatePipeline(b Backend, id string, pipeline *Pipeline) error {
+	if pipeline.Retention != nil {
+		if err := pipeline.Retention.Validate(); err != nil {
+			return err
+		}
+	}
+	if pipeline.DeadLetter != nil {
+		if err := pipeline.DeadLetter.Validate(); err != nil {
+			return err
+		}
+		if id != "" && pipeline.DeadLetter.Pipeline == id {
+			return errors.New("a pipeline can't be its own dead letter pipeline")
+		}
+		if _, err := b.GetPipeline(pipeline.DeadLetter.Pipeline); err != nil {
+			return fmt.Errorf("unknown dead letter pipeline \"%s\"", pipeline.DeadLetter.Pipeline)
+		}
+	}
+	return nil
+}
+
+// DeadLetterPolicy moves datapoints that were leased more than MaxDeliveries
+// times without being acknowledged into another pipeline
+type DeadLetterPolicy struct {
+	// id of the dead letter pipeline
+	Pipeline      string `json:"pipeline"`
+	MaxDeliveries int64  `json:"max_deliveries"`
+}
+
+func (p DeadLetterPolicy) Validate() error {
+	if p.Pipeline == "" {
+		return errors.New("missing dead letter pipeline")
+	}
+	if p.MaxDeliveries < 1 {
+		return errors.New("max deliveries must be at least 1")
+	}
+	return nil
 }
 
 type Consumer struct {
 	Id             string `json:"id"`
 	UnreadElements int64  `json:"unread_elements"`
+	// offset of the last datapoint read by the consumer
+	Offset int64 `json:"offset"`
+}
+
+const (
+	SeekBeginning = "beginning"
+	SeekEnd       = "end"
+	SeekOffset    = "offset"
+	SeekTimestamp = "timestamp"
+)
+
+// Seek describes where a consumer continues reading. Seeking to an offset
+// makes the datapoint at that offset the next one read, seeking to a timestamp
+// the first datapoint stored at or after that time.
+type Seek struct {
+	// one of beginning, end, offset or timestamp
+	Position  string    `json:"position" xml:"position"`
+	Offset    int64     `json:"offset,omitempty" xml:"offset,omitempty"`
+	Timestamp time.Time `json:"timestamp,omitempty" xml:"timestamp,omitempty"`
+}
+
+func (s Seek) Validate() error {
+	switch s.Position {
+	case SeekBeginning, SeekEnd:
+		return nil
+	case SeekOffset:
+		if s.Offset < 1 {
+			return ErrInvalidOffset
+		}
+		return nil
+	case SeekTimestamp:
+		if s.Timestamp.IsZero() {
+			return errors.New("missing timestamp to seek to")
+		}
+		return nil
+	}
+	return ErrInvalidSeek
 }
 
 type PipelineStatisticElement struct {
@@ -39,7 +181,106 @@ type PipelineStatistic struct {
 	Statistics []PipelineStatisticElement `json:"statistics"`
 }
 
+// RetentionPolicy limits how long datapoints are kept. Datapoints are removed
+// from the head of a pipeline once any of the limits is exceeded, a zero
+// value disables the limit.
+type RetentionPolicy struct {
+	// maximum age of a datapoint in seconds
+	MaxAge        int64 `json:"max_age"`
+	MaxDatapoints int64 `json:"max_datapoints"`
+	// maximum size of all datapoints of the pipeline in bytes
+	MaxBytes int64 `json:"max_bytes"`
+	// remove datapoints as soon as every consumer has read them
+	DeleteConsumed bool `json:"delete_consumed"`
+}
+
+func (p RetentionPolicy) IsEmpty() bool {
+	return p.MaxAge == 0 && p.MaxDatapoints == 0 && p.MaxBytes == 0 && !p.DeleteConsumed
+}
+
+func (p RetentionPolicy) Validate() error {
+	if p.MaxAge < 0 || p.MaxDatapoints < 0 || p.MaxBytes < 0 {
+		return errors.New("retention limits must not be negative")
+	}
+	return nil
+}
+
+// DefaultPopMax is the amount of datapoints a pop returns at most unless
+// limited otherwise
+const DefaultPopMax = 10
+
+// PopLimit limits the datapoints returned by a single pop
+type PopLimit struct {
+	// maximum amount of datapoints, DefaultPopMax if zero
+	Max int64
+	// maximum size of all payloads in bytes, unlimited if zero. The first
+	// datapoint is returned even if it is larger on its own.
+	MaxBytes int64
+}
+
+func (l PopLimit) max() int64 {
+	if l.Max <= 0 {
+		return DefaultPopMax
+	}
+	return l.Max
+}
+
+// fits reports whether a datapoint of the given size may be added to the
+// count datapoints of bytes already taken
+func (l PopLimit) fits(count int64, bytes int64, size int64) bool {
+	return count < l.max() && (count == 0 || l.MaxBytes <= 0 || bytes+size <= l.MaxBytes)
+}
+
 type Datapoint struct {
 	PipelineId string `json:"id"`
 	Value      string `json:"payload"`
+	// the payloads of a batch, which are stored at once instead of Value
+	Values []string `json:"-" xml:"-"`
+	// receives the outcome of the write if the producer waits for it
+	Result chan PushResult `json:"-" xml:"-"`
+}
+
+func (d *Datapoint) payloads() []string {
+	if d.Values != nil {
+		return d.Values
+	}
+	return []string{d.Value}
+}
+
+// OffsetDatapoint is a datapoint together with its offset, the index of the
+// datapoint within the pipeline
+type OffsetDatapoint struct {
+	Offset int64  `json:"offset" xml:"offset"`
+	Value  string `json:"payload" xml:"payload"`
+	// how often the datapoint was delivered as part of a lease
+	Deliveries int64 `json:"deliveries,omitempty" xml:"deliveries,omitempty"`
+}
+
+// Lease hands datapoints to one member of a consumer until it expires. Leases
+// which aren't acknowledged before are handed out to the next member asking.
+type Lease struct {
+	Id      string    `json:"id" xml:"id"`
+	Member  string    `json:"member" xml:"member"`
+	Expires time.Time `json:"expires" xml:"expires"`
+	// how often the datapoints were delivered, the highest count if they differ
+	Deliveries int64             `json:"deliveries" xml:"deliveries"`
+	Datapoints []OffsetDatapoint `json:"datapoints" xml:"datapoints"`
+}
+
+// DatapointRange holds the indexes of the first and the last datapoint of a batch
+type DatapointRange struct {
+	First int64 `json:"first" xml:"first"`
+	Last  int64 `json:"last" xml:"last"`
+}
+
+// PushResult reports the index of a stored datapoint, the last one of a batch,
+// or why storing it failed
+type PushResult struct {
+	Index int64
+	Err   error
+}
+
+// formatDate formats the day used as suffix of the daily statistic keys, e.g. 2015-02-17
+func formatDate(t time.Time) string {
+	return fmt.Sprintf("%d-%02d-%02d", t.Year(), t.Month(), t.Day())
 }
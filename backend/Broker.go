@@ -0,0 +1,65 @@
+package backend
+
+import (
+	"sync"
+)
+
+// Broker notifies the subscribers of a pipeline about pushed datapoints. It
+// only signals that there is something new to read, the subscribers read the
+// datapoints through their consumer just like any other consumer.
+type Broker struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[chan struct{}]bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{subscribers: make(map[string]map[chan struct{}]bool)}
+}
+
+// Subscribe returns a channel signalled whenever datapoints are pushed to the
+// pipeline. Signals don't queue up, a subscriber busy reading gets a single
+// one for everything pushed in the meantime.
+func (b *Broker) Subscribe(pipelineId string) chan struct{} {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	notifications := make(chan struct{}, 1)
+	if b.subscribers[pipelineId] == nil {
+		b.subscribers[pipelineId] = make(map[chan struct{}]bool)
+	}
+	b.subscribers[pipelineId][notifications] = true
+	return notifications
+}
+
+func (b *Broker) Unsubscribe(pipelineId string, notifications chan struct{}) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscribers[pipelineId], notifications)
+	if len(b.subscribers[pipelineId]) == 0 {
+		delete(b.subscribers, pipelineId)
+	}
+}
+
+// Publish signals all subscribers of the pipeline without ever blocking the
+// writer calling it
+func (b *Broker) Publish(pipelineId string) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for notifications := range b.subscribers[pipelineId] {
+		select {
+		case notifications <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"log"
+	"time"
+)
+
+// the delay of the first redelivery after a nack, doubled with every delivery
+const redeliveryBackoff = time.Second
+
+const maxRedeliveryBackoff = 5 * time.Minute
+
+// redeliveryDelay returns how long a nacked lease waits for its redelivery
+func redeliveryDelay(deliveries int64) time.Duration {
+	delay := redeliveryBackoff
+	for i := int64(1); i < deliveries && delay < maxRedeliveryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRedeliveryBackoff {
+		delay = maxRedeliveryBackoff
+	}
+	return delay
+}
+
+// LeaseWithDeadLetter leases datapoints like Backend.LeaseDatapoints, but
+// moves datapoints delivered more often than the dead letter policy of the
+// pipeline allows into the dead letter pipeline instead of handing them out.
+// The other datapoints of the lease are handed out with the moved ones still
+// part of the lease, so acknowledging it acknowledges them as well. Datapoints
+// are pushed before they are acknowledged, so a datapoint may end up in the
+// dead letter pipeline twice, but it is never lost. Datapoints are only moved
+// once a member leases again.
+func LeaseWithDeadLetter(b Backend, pipelineId string, consumerId string, memberId string, limit PopLimit, timeout time.Duration) (*Lease, error) {
+	var policy *DeadLetterPolicy
+	for {
+		lease, err := b.LeaseDatapoints(pipelineId, consumerId, memberId, limit, timeout)
+		if err != nil || lease == nil || lease.Deliveries <= 1 {
+			return lease, err
+		}
+
+		// only redeliveries may exceed the policy, so the pipeline is read lazily
+		if policy == nil {
+			pipeline, err := b.GetPipeline(pipelineId)
+			if err != nil {
+				return nil, err
+			}
+			if pipeline.DeadLetter == nil {
+				return lease, nil
+			}
+			policy = pipeline.DeadLetter
+		}
+		if lease.Deliveries <= policy.MaxDeliveries {
+			return lease, nil
+		}
+
+		// datapoints leased together may have been delivered a different number
+		// of times, e.g. fresh ones next to redelivered ones
+		var moved []string
+		kept := []OffsetDatapoint{}
+		var deliveries int64
+		for _, datapoint := range lease.Datapoints {
+			if datapoint.Deliveries > policy.MaxDeliveries {
+				moved = append(moved, datapoint.Value)
+				continue
+			}
+			kept = append(kept, datapoint)
+			if datapoint.Deliveries > deliveries {
+				deliveries = datapoint.Deliveries
+			}
+		}
+		if len(moved) > 0 {
+			if _, _, err := b.PushDatapoints(policy.Pipeline, moved, true); err != nil {
+				return nil, err
+			}
+			log.Printf("Moved %d datapoints of pipeline %s to dead letter pipeline %s after more than %d deliveries", len(moved), pipelineId, policy.Pipeline, policy.MaxDeliveries)
+		}
+
+		if len(kept) > 0 {
+			lease.Datapoints = kept
+			lease.Deliveries = deliveries
+			return lease, nil
+		}
+		if err := b.AckLease(pipelineId, consumerId, lease.Id); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package backend
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSegmentSize is the size in bytes after which the FileBackend starts a
+// new segment of a pipeline log
+const DefaultSegmentSize = 64 * 1024 * 1024
+
+// the header of a record is its payload length, a crc32 checksum over timestamp
+// and payload and the timestamp in unix nanoseconds
+const recordHeaderSize = 16
+
+// indexEntrySize is the size of one entry of a segment index, the position of a
+// record within the segment
+const indexEntrySize = 8
+
+// maxPayloadSize bounds the payload of a record, no listener accepts larger
+// datapoints
+const maxPayloadSize = 64 * 1024 * 1024
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// FileBackend stores the pipelines on the local disk. Each pipeline gets its
+// own directory containing the pipeline definition, the consumer pointers, the
+// statistics and the datapoint log, which is split into append only segments:
+//
+//	<directory>/<pipeline>/pipeline.json
+//	<directory>/<pipeline>/consumers.json
+//	<directory>/<pipeline>/statistics.json
+//	<directory>/<pipeline>/firstdatapoint.json
+//	<directory>/<pipeline>/00000000000000000001.log
+//	<directory>/<pipeline>/00000000000000000001.index
+//
+// Segments are named after the index of their first datapoint. The index file
+// of a segment holds the position of every datapoint within the segment.
+// Retention removes a segment once all of its datapoints are expired. The
+// statistics aren't written with every push, the datapoints pushed after they
+// were saved last are counted from the log on startup.
+type FileBackend struct {
+	*logBackend
+}
+
+func NewFileBackend(directory string, segmentSize int64) (FileBackend, error) {
+	storage := fileStorage{directory: directory, segmentSize: segmentSize}
+	backend := FileBackend{newLogBackend(storage)}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return backend, err
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return backend, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		id, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			log.Printf("Skipping unknown directory \"%s\" in %s", entry.Name(), directory)
+			continue
+		}
+
+		pipeline := &Pipeline{}
+		found, err := readJSONFile(filepath.Join(directory, entry.Name(), "pipeline.json"), pipeline)
+		if err != nil {
+			return backend, err
+		}
+		if found {
+			backend.pipelines[id] = pipeline
+		}
+
+		stream, err := backend.stream(id)
+		if err != nil {
+			return backend, err
+		}
+		if _, err := readJSONFile(filepath.Join(directory, entry.Name(), "consumers.json"), &stream.consumers); err != nil {
+			return backend, err
+		}
+		if _, err := readJSONFile(filepath.Join(directory, entry.Name(), "statistics.json"), &stream.statistics); err != nil {
+			return backend, err
+		}
+		stream.countUnsaved()
+	}
+
+	return backend, nil
+}
+
+type fileStorage struct {
+	directory   string
+	segmentSize int64
+}
+
+// pipelineDirectory returns the directory of the pipeline, escaping the id so
+// that it can't point outside of the data directory
+func (s fileStorage) pipelineDirectory(id string) (string, error) {
+	if id == "" || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid pipeline id \"%s\"", id)
+	}
+	return filepath.Join(s.directory, url.PathEscape(id)), nil
+}
+
+func (s fileStorage) openLog(pipelineId string) (datapointLog, error) {
+	directory, err := s.pipelineDirectory(pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	return openFileLog(directory, s.segmentSize)
+}
+
+func (s fileStorage) savePipeline(pipeline *Pipeline) error {
+	directory, err := s.pipelineDirectory(pipeline.Id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(directory, "pipeline.json"), pipeline)
+}
+
+func (s fileStorage) deletePipeline(id string) error {
+	directory, err := s.pipelineDirectory(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(directory, "pipeline.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s fileStorage) saveConsumers(pipelineId string, consumers map[string]int64) error {
+	directory, err := s.pipelineDirectory(pipelineId)
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(directory, "consumers.json"), consumers)
+}
+
+func (s fileStorage) saveStatistics(pipelineId string, statistics map[string]int64) error {
+	directory, err := s.pipelineDirectory(pipelineId)
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(directory, "statistics.json"), statistics)
+}
+
+func (s fileStorage) deleteStream(pipelineId string) error {
+	directory, err := s.pipelineDirectory(pipelineId)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(directory)
+}
+
+// writeJSONFile replaces the file atomically, so that a crash never leaves a
+// partially written file behind
+func writeJSONFile(path string, obj interface{}) error {
+	content, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readJSONFile decodes the file into obj, reporting false if it doesn't exist
+func readJSONFile(path string, obj interface{}) (bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(content, obj)
+}
+
+type fileLog struct {
+	directory   string
+	segmentSize int64
+	first       int64
+	segments    []*segment
+}
+
+type segment struct {
+	// index of the first datapoint within the segment
+	base      int64
+	path      string
+	log       *os.File
+	index     *os.File
+	positions []int64
+	size      int64
+}
+
+func openFileLog(directory string, segmentSize int64) (*fileLog, error) {
+	fileLog := &fileLog{directory: directory, segmentSize: segmentSize}
+
+	logFiles, err := filepath.Glob(filepath.Join(directory, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	var bases []int64
+	for _, logFile := range logFiles {
+		base, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(logFile), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Sort(int64s(bases))
+
+	for _, base := range bases {
+		segment, err := openSegment(directory, base)
+		if err != nil {
+			fileLog.close()
+			return nil, err
+		}
+		fileLog.segments = append(fileLog.segments, segment)
+	}
+
+	if len(fileLog.segments) > 0 {
+		fileLog.first = fileLog.segments[0].base - 1
+	}
+	var removed int64
+	if _, err := readJSONFile(filepath.Join(directory, "firstdatapoint.json"), &removed); err != nil {
+		fileLog.close()
+		return nil, err
+	}
+	if removed > fileLog.first {
+		// finish removing segments in case of a crash during retention
+		if err := fileLog.removeUntil(removed); err != nil {
+			fileLog.close()
+			return nil, err
+		}
+	}
+
+	return fileLog, nil
+}
+
+func segmentPath(directory string, base int64, extension string) string {
+	return filepath.Join(directory, fmt.Sprintf("%020d%s", base, extension))
+}
+
+// openSegment opens the log and index of a segment, recovering both from a
+// crash in the middle of an append. Records after the last valid one are cut
+// off and the index is rebuilt for records that were not indexed yet.
+func openSegment(directory string, base int64) (*segment, error) {
+	logFile, err := os.OpenFile(segmentPath(directory, base, ".log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(segmentPath(directory, base, ".index"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	segment := &segment{base: base, path: segmentPath(directory, base, ""), log: logFile, index: indexFile}
+
+	logInfo, err := logFile.Stat()
+	if err != nil {
+		segment.close()
+		return nil, err
+	}
+	indexContent, err := ioutil.ReadAll(indexFile)
+	if err != nil {
+		segment.close()
+		return nil, err
+	}
+
+	for i := 0; i+indexEntrySize <= len(indexContent); i += indexEntrySize {
+		position := int64(binary.BigEndian.Uint64(indexContent[i:]))
+		if position >= logInfo.Size() {
+			break
+		}
+		segment.positions = append(segment.positions, position)
+	}
+
+	// verify the last indexed record and everything written after it
+	position := int64(0)
+	if len(segment.positions) > 0 {
+		position = segment.positions[len(segment.positions)-1]
+		segment.positions = segment.positions[:len(segment.positions)-1]
+	}
+	for position < logInfo.Size() {
+		_, length, err := segment.readRecord(position, logInfo.Size())
+		if err != nil {
+			log.Printf("Truncating segment %s at position %d: %s", segmentPath(directory, base, ".log"), position, err.Error())
+			break
+		}
+		segment.positions = append(segment.positions, position)
+		position += length
+	}
+	segment.size = position
+
+	if err := logFile.Truncate(segment.size); err != nil {
+		segment.close()
+		return nil, err
+	}
+	if err := segment.writeIndex(); err != nil {
+		segment.close()
+		return nil, err
+	}
+
+	return segment, nil
+}
+
+// readTimestamp reads the timestamp from the header of the record at the position
+func (s *segment) readTimestamp(position int64) (time.Time, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := s.log.ReadAt(header, position); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16]))), nil
+}
+
+// recordSize returns the length of the i-th record of the segment
+func (s *segment) recordSize(i int64) int64 {
+	if i+1 < int64(len(s.positions)) {
+		return s.positions[i+1] - s.positions[i]
+	}
+	return s.size - s.positions[i]
+}
+
+// readRecord reads the payload of the record at the position and returns it
+// together with the length of the whole record. The record has to end before
+// the end of the segment, a corrupt length isn't allocated.
+func (s *segment) readRecord(position int64, end int64) (string, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := s.log.ReadAt(header, position); err != nil {
+		if err == io.EOF {
+			return "", 0, errCorruptRecord
+		}
+		return "", 0, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxPayloadSize || length > end-position-recordHeaderSize {
+		return "", 0, errCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := s.log.ReadAt(payload, position+recordHeaderSize); err != nil {
+		if err == io.EOF {
+			return "", 0, errCorruptRecord
+		}
+		return "", 0, err
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[8:16])
+	crc.Write(payload)
+	if crc.Sum32() != checksum {
+		return "", 0, errCorruptRecord
+	}
+
+	return string(payload), recordHeaderSize + length, nil
+}
+
+func (s *segment) writeIndex() error {
+	content := make([]byte, len(s.positions)*indexEntrySize)
+	for i, position := range s.positions {
+		binary.BigEndian.PutUint64(content[i*indexEntrySize:], uint64(position))
+	}
+	if _, err := s.index.WriteAt(content, 0); err != nil {
+		return err
+	}
+	return s.index.Truncate(int64(len(content)))
+}
+
+// append writes the records of all values with a single write and sync
+func (s *segment) append(values []string, timestamp time.Time) error {
+	size := 0
+	for _, value := range values {
+		if len(value) > maxPayloadSize {
+			return fmt.Errorf("datapoint of %d bytes exceeds the maximum of %d bytes", len(value), maxPayloadSize)
+		}
+		size += recordHeaderSize + len(value)
+	}
+
+	records := make([]byte, size)
+	positions := make([]int64, len(values))
+	offset := 0
+	for i, value := range values {
+		record := records[offset : offset+recordHeaderSize+len(value)]
+		binary.BigEndian.PutUint32(record[0:4], uint32(len(value)))
+		binary.BigEndian.PutUint64(record[8:16], uint64(timestamp.UnixNano()))
+		copy(record[recordHeaderSize:], value)
+		binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+		positions[i] = s.size + int64(offset)
+		offset += len(record)
+	}
+
+	if _, err := s.log.WriteAt(records, s.size); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+
+	// the index is rebuilt on startup in case it misses entries, so there is
+	// no need to sync it on every append
+	entries := make([]byte, len(positions)*indexEntrySize)
+	for i, position := range positions {
+		binary.BigEndian.PutUint64(entries[i*indexEntrySize:], uint64(position))
+	}
+	if _, err := s.index.WriteAt(entries, int64(len(s.positions)*indexEntrySize)); err != nil {
+		return err
+	}
+
+	s.positions = append(s.positions, positions...)
+	s.size += int64(size)
+	return nil
+}
+
+func (s *segment) last() int64 {
+	return s.base + int64(len(s.positions)) - 1
+}
+
+func (s *segment) close() error {
+	err := s.log.Close()
+	if indexErr := s.index.Close(); err == nil {
+		err = indexErr
+	}
+	return err
+}
+
+// remove closes the segment and deletes its files
+func (s *segment) remove() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path + ".log"); err != nil {
+		return err
+	}
+	return os.Remove(s.path + ".index")
+}
+
+func (l *fileLog) firstDatapoint() int64 { return l.first }
+
+func (l *fileLog) currentDatapoint() int64 {
+	if len(l.segments) == 0 {
+		return l.first
+	}
+	if last := l.segments[len(l.segments)-1].last(); last > l.first {
+		return last
+	}
+	return l.first
+}
+
+// append adds a batch to the last segment as a whole, so a segment may grow
+// beyond the segment size
+func (l *fileLog) append(values []string, timestamp time.Time) (int64, error) {
+	if len(l.segments) == 0 || l.segments[len(l.segments)-1].size >= l.segmentSize {
+		segment, err := openSegment(l.directory, l.currentDatapoint()+1)
+		if err != nil {
+			return 0, err
+		}
+		l.segments = append(l.segments, segment)
+	}
+
+	segment := l.segments[len(l.segments)-1]
+	if err := segment.append(values, timestamp); err != nil {
+		return 0, err
+	}
+	return segment.last(), nil
+}
+
+// locate returns the segment holding the datapoint and its position within it
+func (l *fileLog) locate(index int64) (*segment, int64, error) {
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].base > index }) - 1
+	if i < 0 || index <= l.first || index > l.segments[i].last() {
+		return nil, 0, fmt.Errorf("datapoint %d is not available", index)
+	}
+	return l.segments[i], index - l.segments[i].base, nil
+}
+
+func (l *fileLog) read(index int64) (string, error) {
+	segment, i, err := l.locate(index)
+	if err != nil {
+		return "", err
+	}
+	value, _, err := segment.readRecord(segment.positions[i], segment.size)
+	return value, err
+}
+
+func (l *fileLog) timestamp(index int64) (time.Time, error) {
+	segment, i, err := l.locate(index)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return segment.readTimestamp(segment.positions[i])
+}
+
+func (l *fileLog) datapointSize(index int64) (int64, error) {
+	segment, i, err := l.locate(index)
+	if err != nil {
+		return 0, err
+	}
+	return segment.recordSize(i), nil
+}
+
+func (l *fileLog) size() int64 {
+	var size int64
+	for _, segment := range l.segments {
+		size += segment.size
+	}
+	// datapoints removed from a segment still in use don't count
+	if len(l.segments) > 0 && l.first >= l.segments[0].base {
+		first := l.segments[0]
+		if l.first > first.last() {
+			size -= first.size
+		} else {
+			size -= first.positions[l.first-first.base+1]
+		}
+	}
+	return size
+}
+
+func (l *fileLog) removeUntil(index int64) error {
+	if err := writeJSONFile(filepath.Join(l.directory, "firstdatapoint.json"), index); err != nil {
+		return err
+	}
+	l.first = index
+
+	for len(l.segments) > 0 && l.segments[0].last() <= index {
+		if err := l.segments[0].remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+func (l *fileLog) close() error {
+	var err error
+	for _, segment := range l.segments {
+		if closeErr := segment.close(); err == nil {
+			err = closeErr
+		}
+	}
+	l.segments = nil
+	return err
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,659 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/satori/go.uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+// logBackend implements the Backend interface on top of a datapoint log per
+// pipeline. It mirrors the Redis key layout: a datapoint counter per pipeline,
+// a first datapoint pointer, one pointer per consumer and a daily intake
+// counter. Where the log and the metadata live is up to the logStorage.
+type logBackend struct {
+	mutex     sync.RWMutex
+	storage   logStorage
+	pipelines map[string]*Pipeline
+	streams   map[string]*logStream
+	broker    *Broker
+}
+
+// logStorage keeps the pipeline definitions, the consumer pointers and the
+// statistics and opens the datapoint log of a pipeline.
+type logStorage interface {
+	openLog(pipelineId string) (datapointLog, error)
+	savePipeline(pipeline *Pipeline) error
+	deletePipeline(id string) error
+	saveConsumers(pipelineId string, consumers map[string]int64) error
+	saveStatistics(pipelineId string, statistics map[string]int64) error
+	deleteStream(pipelineId string) error
+}
+
+// datapointLog is the append only list of datapoints of one pipeline. Indexes
+// start with 1, the first datapoint pointer holds the index of the last
+// datapoint removed from the log.
+type datapointLog interface {
+	firstDatapoint() int64
+	currentDatapoint() int64
+	// append adds the values in order and returns the index of the last one
+	append(values []string, timestamp time.Time) (int64, error)
+	read(index int64) (string, error)
+	timestamp(index int64) (time.Time, error)
+	// datapointSize returns the bytes used by the datapoint
+	datapointSize(index int64) (int64, error)
+	// size returns the bytes used by all datapoints in the log
+	size() int64
+	// removeUntil removes all datapoints up to and including the index
+	removeUntil(index int64) error
+	close() error
+}
+
+// how often the statistics are saved at most, datapoints pushed in between
+// are counted again from the log on startup
+const statisticsInterval = time.Second
+
+type logStream struct {
+	log        datapointLog
+	consumers  map[string]int64
+	statistics map[string]int64
+	// when the statistics were saved last
+	statisticsSaved time.Time
+	// outstanding leases per consumer, which are lost on restart so that all
+	// unacknowledged datapoints are handed out again
+	leases map[string]*leaseGroup
+}
+
+func newLogBackend(storage logStorage) *logBackend {
+	return &logBackend{
+		storage:   storage,
+		pipelines: make(map[string]*Pipeline),
+		streams:   make(map[string]*logStream),
+		broker:    NewBroker(),
+	}
+}
+
+// stream returns the stream of the pipeline, creating it on first use just
+// like Redis creates keys on first write. Callers must hold the write lock.
+func (b *logBackend) stream(id string) (*logStream, error) {
+	stream, ok := b.streams[id]
+	if !ok {
+		log, err := b.storage.openLog(id)
+		if err != nil {
+			return nil, err
+		}
+		stream = &logStream{log: log, consumers: make(map[string]int64), statistics: make(map[string]int64), leases: make(map[string]*leaseGroup)}
+		b.streams[id] = stream
+	}
+	return stream, nil
+}
+
+func (b *logBackend) GetPipelines() ([]Pipeline, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	var pipelines []Pipeline
+	for _, stored := range b.pipelines {
+		pipeline := *stored
+		pipeline.PipelineStatistic = *b.pipelineStatistic(pipeline.Id)
+		pipelines = append(pipelines, pipeline)
+	}
+	sort.Sort(pipelinesById(pipelines))
+
+	return pipelines, nil
+}
+
+func (b *logBackend) CreatePipeline(pipeline *Pipeline) (*Pipeline, error) {
+	if pipeline.Id == "" {
+		id := fmt.Sprintf("%s", uuid.NewV4())
+		pipeline.Id = id
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stored := *pipeline
+	stored.PipelineStatistic = PipelineStatistic{}
+	stored.Consumers = nil
+	if err := b.storage.savePipeline(&stored); err != nil {
+		return nil, err
+	}
+	b.pipelines[pipeline.Id] = &stored
+
+	return pipeline, nil
+}
+
+func (b *logBackend) GetPipeline(id string) (*Pipeline, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	stored, ok := b.pipelines[id]
+	if !ok {
+		return nil, ErrPipelineNotFound
+	}
+
+	readPipeline := *stored
+	readPipeline.PipelineStatistic = *b.pipelineStatistic(id)
+
+	if stream, ok := b.streams[id]; ok {
+		readPipeline.Consumers = stream.consumerList()
+	}
+
+	return &readPipeline, nil
+}
+
+// countUnsaved adds the datapoints pushed after the statistics were saved
+// last. Every datapoint is counted, so the statistics add up to the index of
+// the last datapoint counted. A datapoint already removed by retention is
+// counted for the day of the datapoint following it.
+func (s *logStream) countUnsaved() {
+	counted := int64(0)
+	for _, intake := range s.statistics {
+		counted += intake
+	}
+
+	day := formatDate(time.Now())
+	for index := s.log.currentDatapoint(); index > counted; index-- {
+		if timestamp, err := s.log.timestamp(index); err == nil {
+			day = formatDate(timestamp)
+		}
+		s.statistics[day]++
+	}
+}
+
+func (s *logStream) consumer(consumerId string) Consumer {
+	pointer := s.pointer(consumerId)
+	return Consumer{Id: consumerId, UnreadElements: s.log.currentDatapoint() - pointer, Offset: pointer}
+}
+
+func (s *logStream) consumerList() []Consumer {
+	var consumers []Consumer
+	for consumerId := range s.consumers {
+		consumers = append(consumers, s.consumer(consumerId))
+	}
+	sort.Sort(consumersById(consumers))
+	return consumers
+}
+
+func (b *logBackend) GetConsumers(pipelineId string) ([]Consumer, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if _, ok := b.pipelines[pipelineId]; !ok {
+		return nil, ErrPipelineNotFound
+	}
+	if stream, ok := b.streams[pipelineId]; ok {
+		return stream.consumerList(), nil
+	}
+	return nil, nil
+}
+
+func (b *logBackend) CreateConsumer(pipelineId string, consumerId string) (*Consumer, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, err := b.pipelineStream(pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := stream.consumers[consumerId]; ok {
+		return nil, ErrConsumerExists
+	}
+
+	if err := b.moveConsumer(pipelineId, stream, consumerId, stream.log.firstDatapoint()); err != nil {
+		return nil, err
+	}
+	consumer := stream.consumer(consumerId)
+	return &consumer, nil
+}
+
+func (b *logBackend) DeleteConsumer(pipelineId string, consumerId string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, err := b.pipelineStream(pipelineId)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := stream.consumers[consumerId]; !ok {
+		return false, ErrConsumerNotFound
+	}
+
+	delete(stream.consumers, consumerId)
+	delete(stream.leases, consumerId)
+	if err := b.storage.saveConsumers(pipelineId, stream.consumers); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *logBackend) SeekConsumer(pipelineId string, consumerId string, seek Seek) (*Consumer, error) {
+	if err := seek.Validate(); err != nil {
+		return nil, err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, err := b.pipelineStream(pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := stream.consumers[consumerId]; !ok {
+		return nil, ErrConsumerNotFound
+	}
+
+	var pointer int64
+	switch seek.Position {
+	case SeekBeginning:
+		pointer = stream.log.firstDatapoint()
+	case SeekEnd:
+		pointer = stream.log.currentDatapoint()
+	case SeekOffset:
+		if seek.Offset > stream.log.currentDatapoint()+1 {
+			return nil, ErrInvalidOffset
+		}
+		pointer = seek.Offset - 1
+	case SeekTimestamp:
+		next, err := stream.search(seek.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		pointer = next - 1
+	}
+
+	// outstanding leases don't survive moving the consumer
+	delete(stream.leases, consumerId)
+	if err := b.moveConsumer(pipelineId, stream, consumerId, pointer); err != nil {
+		return nil, err
+	}
+	consumer := stream.consumer(consumerId)
+	return &consumer, nil
+}
+
+// pipelineStream returns the stream of an existing pipeline
+func (b *logBackend) pipelineStream(pipelineId string) (*logStream, error) {
+	if _, ok := b.pipelines[pipelineId]; !ok {
+		return nil, ErrPipelineNotFound
+	}
+	return b.stream(pipelineId)
+}
+
+// search returns the index of the first datapoint stored at or after the
+// time, or the index following the last datapoint if there is none
+func (s *logStream) search(t time.Time) (int64, error) {
+	first := s.log.firstDatapoint()
+	current := s.log.currentDatapoint()
+
+	var searchErr error
+	// datapoints are appended in order, so their timestamps are sorted
+	index := first + 1 + int64(sort.Search(int(current-first), func(i int) bool {
+		timestamp, err := s.log.timestamp(first + 1 + int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return !timestamp.Before(t)
+	}))
+	return index, searchErr
+}
+
+func (b *logBackend) RetrievePipelineStatistic(id string) (*PipelineStatistic, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.pipelineStatistic(id), nil
+}
+
+// pipelineStatistic builds the statistic of the last ten days. Callers must hold
+// at least the read lock.
+func (b *logBackend) pipelineStatistic(id string) *PipelineStatistic {
+	intake := func(date time.Time) int64 {
+		if stream, ok := b.streams[id]; ok {
+			return stream.statistics[formatDate(date)]
+		}
+		return 0
+	}
+
+	currentTime := time.Now()
+	today := intake(currentTime)
+	yesterday := intake(currentTime.AddDate(0, 0, -1))
+
+	pipelineStatistic := &PipelineStatistic{}
+	pipelineStatistic.Today = today
+	if yesterday != 0 {
+		pipelineStatistic.ChangeRate = (((float64(today) - float64(yesterday)) / float64(yesterday)) * 100.0)
+	}
+
+	for i := 0; i < 10; i++ {
+		elementDate := currentTime.AddDate(0, 0, -1*i)
+		pipelineStatistic.Statistics = append(pipelineStatistic.Statistics, PipelineStatisticElement{
+			Date:   formatDate(elementDate),
+			Intake: intake(elementDate),
+		})
+	}
+	return pipelineStatistic
+}
+
+func (b *logBackend) UpdatePipeline(id string, pipeline *Pipeline) (*Pipeline, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stored, ok := b.pipelines[id]
+	if !ok {
+		return nil, ErrPipelineNotFound
+	}
+
+	updated := *stored
+	updated.Name = pipeline.Name
+	updated.Description = pipeline.Description
+	updated.Retention = pipeline.Retention
+	updated.DeadLetter = pipeline.DeadLetter
+	if err := b.storage.savePipeline(&updated); err != nil {
+		return nil, err
+	}
+	*stored = updated
+
+	return &updated, nil
+}
+
+func (b *logBackend) DeletePipeline(id string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if stream, ok := b.streams[id]; ok {
+		if err := stream.log.close(); err != nil {
+			return false, err
+		}
+		delete(b.streams, id)
+	}
+	if err := b.storage.deleteStream(id); err != nil {
+		return false, err
+	}
+	if err := b.storage.deletePipeline(id); err != nil {
+		return false, err
+	}
+	delete(b.pipelines, id)
+	return true, nil
+}
+
+func (b *logBackend) PopDatapoint(pipelineId string, consumerId string, limit PopLimit) ([]string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, err := b.stream(pipelineId)
+	if err != nil {
+		return nil, err
+	}
+
+	offsetDatapoints, err := stream.read(consumerId, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var datapoints []string
+	newPointer := stream.pointer(consumerId)
+	for _, datapoint := range offsetDatapoints {
+		datapoints = append(datapoints, datapoint.Value)
+		newPointer = datapoint.Offset
+	}
+	if err := b.moveConsumer(pipelineId, stream, consumerId, newPointer); err != nil {
+		return nil, err
+	}
+
+	return datapoints, nil
+}
+
+func (b *logBackend) PeekDatapoints(pipelineId string, consumerId string, limit PopLimit) ([]OffsetDatapoint, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, err := b.stream(pipelineId)
+	if err != nil {
+		return nil, err
+	}
+
+	datapoints, err := stream.read(consumerId, limit)
+	if err != nil {
+		return nil, err
+	}
+	// register the consumer without moving it
+	if err := b.moveConsumer(pipelineId, stream, consumerId, stream.consumers[consumerId]); err != nil {
+		return nil, err
+	}
+	return datapoints, nil
+}
+
+func (b *logBackend) CommitOffset(pipelineId string, consumerId string, offset int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, err := b.stream(pipelineId)
+	if err != nil {
+		return err
+	}
+
+	if offset > stream.log.currentDatapoint() {
+		return ErrInvalidOffset
+	}
+	pointer := stream.consumers[consumerId]
+	if offset > pointer {
+		pointer = offset
+	}
+	return b.moveConsumer(pipelineId, stream, consumerId, pointer)
+}
+
+func (b *logBackend) ReadDatapoints(pipelineId string, offset int64, limit PopLimit) ([]OffsetDatapoint, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, err := b.stream(pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	return stream.readAfter(offset, limit)
+}
+
+func (b *logBackend) DatapointOffsets(pipelineId string) (int64, int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, err := b.stream(pipelineId)
+	if err != nil {
+		return 0, 0, err
+	}
+	return stream.log.firstDatapoint(), stream.log.currentDatapoint(), nil
+}
+
+// pointer returns the consumer pointer, which is never before the first datapoint
+func (s *logStream) pointer(consumerId string) int64 {
+	consumerPointer := s.consumers[consumerId]
+	if first := s.log.firstDatapoint(); consumerPointer < first {
+		consumerPointer = first
+	}
+	return consumerPointer
+}
+
+// read returns the datapoints following the consumer pointer within the limit
+func (s *logStream) read(consumerId string, limit PopLimit) ([]OffsetDatapoint, error) {
+	return s.readAfter(s.pointer(consumerId), limit)
+}
+
+// readAfter returns the datapoints following the offset within the limit
+func (s *logStream) readAfter(offset int64, limit PopLimit) ([]OffsetDatapoint, error) {
+	if first := s.log.firstDatapoint(); offset < first {
+		offset = first
+	}
+
+	var datapoints []OffsetDatapoint
+	var bytes int64
+	for offset := offset + 1; offset <= s.log.currentDatapoint(); offset++ {
+		value, err := s.log.read(offset)
+		if err != nil {
+			return nil, err
+		}
+		if !limit.fits(int64(len(datapoints)), bytes, int64(len(value))) {
+			break
+		}
+		datapoints = append(datapoints, OffsetDatapoint{Offset: offset, Value: value})
+		bytes += int64(len(value))
+	}
+	return datapoints, nil
+}
+
+// moveConsumer sets the consumer pointer, saving the consumers if it changed
+func (b *logBackend) moveConsumer(pipelineId string, stream *logStream, consumerId string, pointer int64) error {
+	previousPointer, known := stream.consumers[consumerId]
+	stream.consumers[consumerId] = pointer
+	if !known || previousPointer != pointer {
+		return b.storage.saveConsumers(pipelineId, stream.consumers)
+	}
+	return nil
+}
+
+// PushDatapoint stores the datapoint before returning, so ack makes no difference
+func (b *logBackend) PushDatapoint(pipelineId string, value string, ack bool) (int64, error) {
+	_, last, err := b.PushDatapoints(pipelineId, []string{value}, ack)
+	return last, err
+}
+
+func (b *logBackend) PushDatapoints(pipelineId string, values []string, ack bool) (int64, int64, error) {
+	if len(values) == 0 {
+		return 0, 0, nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, err := b.stream(pipelineId)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now()
+	last, err := stream.log.append(values, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	first := last - int64(len(values)) + 1
+	b.broker.Publish(pipelineId)
+	stream.statistics[formatDate(now)] += int64(len(values))
+	if now.Sub(stream.statisticsSaved) >= statisticsInterval {
+		if err := b.storage.saveStatistics(pipelineId, stream.statistics); err != nil {
+			return first, last, err
+		}
+		stream.statisticsSaved = now
+	}
+
+	// removing consumed datapoints is left to the retention job
+	if pipeline, ok := b.pipelines[pipelineId]; ok && pipeline.Retention != nil {
+		policy := *pipeline.Retention
+		policy.DeleteConsumed = false
+		if _, err := b.applyRetention(stream, policy); err != nil {
+			return first, last, err
+		}
+	}
+
+	return first, last, nil
+}
+
+func (b *logBackend) Subscribe(pipelineId string) chan struct{} {
+	return b.broker.Subscribe(pipelineId)
+}
+
+func (b *logBackend) Unsubscribe(pipelineId string, notifications chan struct{}) {
+	b.broker.Unsubscribe(pipelineId, notifications)
+}
+
+// Status reports nothing beyond the pipelines, datapoints are stored right
+// away and there is no external storage to reach
+func (b *logBackend) Status() (*Status, error) {
+	return &Status{}, nil
+}
+
+func (b *logBackend) ApplyRetention(pipelineId string, policy RetentionPolicy) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, ok := b.streams[pipelineId]
+	if !ok {
+		return 0, nil
+	}
+	return b.applyRetention(stream, policy)
+}
+
+// applyRetention removes the datapoints the policy doesn't retain from the
+// stream. Callers must hold the write lock.
+func (b *logBackend) applyRetention(stream *logStream, policy RetentionPolicy) (int64, error) {
+	first := stream.log.firstDatapoint()
+	current := stream.log.currentDatapoint()
+	target := first
+
+	if policy.MaxDatapoints > 0 && current-target > policy.MaxDatapoints {
+		target = current - policy.MaxDatapoints
+	}
+
+	if policy.MaxAge > 0 {
+		cutoff := time.Now().Add(time.Duration(-policy.MaxAge) * time.Second)
+		// the first datapoint young enough marks the end of the expired ones
+		retained, err := stream.search(cutoff)
+		if err != nil {
+			return 0, err
+		}
+		if retained-1 > target {
+			target = retained - 1
+		}
+	}
+
+	if policy.DeleteConsumed && len(stream.consumers) > 0 {
+		consumed := current
+		for _, pointer := range stream.consumers {
+			if pointer < consumed {
+				consumed = pointer
+			}
+		}
+		if consumed > target {
+			target = consumed
+		}
+	}
+
+	if policy.MaxBytes > 0 {
+		size := stream.log.size()
+		for i := first + 1; i <= target; i++ {
+			datapointSize, err := stream.log.datapointSize(i)
+			if err != nil {
+				return 0, err
+			}
+			size -= datapointSize
+		}
+		for size > policy.MaxBytes && target < current {
+			target++
+			datapointSize, err := stream.log.datapointSize(target)
+			if err != nil {
+				return 0, err
+			}
+			size -= datapointSize
+		}
+	}
+
+	if target <= first {
+		return 0, nil
+	}
+	if err := stream.log.removeUntil(target); err != nil {
+		return 0, err
+	}
+	return target - first, nil
+}
+
+type pipelinesById []Pipeline
+
+func (p pipelinesById) Len() int           { return len(p) }
+func (p pipelinesById) Less(i, j int) bool { return p[i].Id < p[j].Id }
+func (p pipelinesById) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type consumersById []Consumer
+
+func (c consumersById) Len() int           { return len(c) }
+func (c consumersById) Less(i, j int) bool { return c[i].Id < c[j].Id }
+func (c consumersById) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
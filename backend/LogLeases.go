@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+)
+
+// leaseGroup tracks the leases of one consumer of a logBackend. Datapoints up
+// to the consumer pointer are acknowledged, the ones after it up to leased are
+// covered by outstanding leases.
+type leaseGroup struct {
+	leased int64
+	leases map[string]*lease
+}
+
+type lease struct {
+	first      int64
+	last       int64
+	member     string
+	expires    time.Time
+	deliveries int64
+}
+
+func leaseId(first int64, last int64) string {
+	return fmt.Sprintf("%d-%d", first, last)
+}
+
+func (s *logStream) leaseGroup(consumerId string) *leaseGroup {
+	group, ok := s.leases[consumerId]
+	if !ok {
+		group = &leaseGroup{leases: make(map[string]*lease)}
+		s.leases[consumerId] = group
+	}
+	return group
+}
+
+// expired returns the expired lease with the lowest offsets
+func (g *leaseGroup) expired(now time.Time) *lease {
+	var expired *lease
+	for _, l := range g.leases {
+		if !l.expires.After(now) && (expired == nil || l.first < expired.first) {
+			expired = l
+		}
+	}
+	return expired
+}
+
+func (b *logBackend) LeaseDatapoints(pipelineId string, consumerId string, memberId string, limit PopLimit, timeout time.Duration) (*Lease, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, err := b.stream(pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	// register the consumer without moving it
+	if err := b.moveConsumer(pipelineId, stream, consumerId, stream.consumers[consumerId]); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	group := stream.leaseGroup(consumerId)
+	leased := group.expired(now)
+	var datapoints []OffsetDatapoint
+	if leased != nil {
+		datapoints, err = stream.readAfter(leased.first-1, PopLimit{Max: leased.last - leased.first + 1})
+		if err != nil {
+			return nil, err
+		}
+		// the retention may have removed datapoints of the lease meanwhile
+		for len(datapoints) > 0 && datapoints[len(datapoints)-1].Offset > leased.last {
+			datapoints = datapoints[:len(datapoints)-1]
+		}
+	} else {
+		start := stream.pointer(consumerId)
+		if group.leased > start {
+			start = group.leased
+		}
+		datapoints, err = stream.readAfter(start, limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(datapoints) == 0 {
+			return nil, nil
+		}
+
+		leased = &lease{first: start + 1, last: datapoints[len(datapoints)-1].Offset}
+		group.leases[leaseId(leased.first, leased.last)] = leased
+		group.leased = leased.last
+	}
+
+	leased.member = memberId
+	leased.expires = now.Add(timeout)
+	leased.deliveries++
+	for i := range datapoints {
+		datapoints[i].Deliveries = leased.deliveries
+	}
+	return &Lease{Id: leaseId(leased.first, leased.last), Member: memberId, Expires: leased.expires, Deliveries: leased.deliveries, Datapoints: datapoints}, nil
+}
+
+// findLease returns the lease of the consumer
+func (b *logBackend) findLease(pipelineId string, consumerId string, leaseId string) (*logStream, *leaseGroup, *lease, error) {
+	stream, ok := b.streams[pipelineId]
+	if !ok {
+		return nil, nil, nil, ErrLeaseNotFound
+	}
+	group, ok := stream.leases[consumerId]
+	if !ok {
+		return nil, nil, nil, ErrLeaseNotFound
+	}
+	l, ok := group.leases[leaseId]
+	if !ok {
+		return nil, nil, nil, ErrLeaseNotFound
+	}
+	return stream, group, l, nil
+}
+
+func (b *logBackend) NackLease(pipelineId string, consumerId string, leaseId string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	_, _, l, err := b.findLease(pipelineId, consumerId, leaseId)
+	if err != nil {
+		return err
+	}
+	l.expires = time.Now().Add(redeliveryDelay(l.deliveries))
+	return nil
+}
+
+func (b *logBackend) AckLease(pipelineId string, consumerId string, leaseId string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, group, _, err := b.findLease(pipelineId, consumerId, leaseId)
+	if err != nil {
+		return err
+	}
+	delete(group.leases, leaseId)
+
+	// the pointer moves up to the first datapoint still leased
+	pointer := group.leased
+	for _, l := range group.leases {
+		if l.first-1 < pointer {
+			pointer = l.first - 1
+		}
+	}
+	if pointer <= stream.consumers[consumerId] {
+		return nil
+	}
+	return b.moveConsumer(pipelineId, stream, consumerId, pointer)
+}
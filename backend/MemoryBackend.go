@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"time"
+)
+
+// MemoryBackend keeps all pipelines and datapoints in process memory, which
+// makes it a good fit for tests and single node deployments. Everything is
+// lost once the process stops.
+type MemoryBackend struct {
+	*logBackend
+}
+
+func NewMemoryBackend() MemoryBackend {
+	return MemoryBackend{newLogBackend(memoryStorage{})}
+}
+
+type memoryStorage struct{}
+
+func (s memoryStorage) openLog(pipelineId string) (datapointLog, error) {
+	return &memoryLog{}, nil
+}
+
+func (s memoryStorage) savePipeline(pipeline *Pipeline) error { return nil }
+
+func (s memoryStorage) deletePipeline(id string) error { return nil }
+
+func (s memoryStorage) saveConsumers(pipelineId string, consumers map[string]int64) error {
+	return nil
+}
+
+func (s memoryStorage) saveStatistics(pipelineId string, statistics map[string]int64) error {
+	return nil
+}
+
+func (s memoryStorage) deleteStream(pipelineId string) error { return nil }
+
+type memoryLog struct {
+	first int64
+	// datapoints[i] holds the datapoint with index first+i+1
+	datapoints []memoryDatapoint
+	bytes      int64
+}
+
+type memoryDatapoint struct {
+	value     string
+	timestamp time.Time
+}
+
+func (l *memoryLog) firstDatapoint() int64 { return l.first }
+
+func (l *memoryLog) currentDatapoint() int64 { return l.first + int64(len(l.datapoints)) }
+
+func (l *memoryLog) append(values []string, timestamp time.Time) (int64, error) {
+	for _, value := range values {
+		l.datapoints = append(l.datapoints, memoryDatapoint{value, timestamp})
+		l.bytes += int64(len(value))
+	}
+	return l.currentDatapoint(), nil
+}
+
+func (l *memoryLog) read(index int64) (string, error) {
+	return l.datapoints[index-l.first-1].value, nil
+}
+
+func (l *memoryLog) timestamp(index int64) (time.Time, error) {
+	return l.datapoints[index-l.first-1].timestamp, nil
+}
+
+func (l *memoryLog) datapointSize(index int64) (int64, error) {
+	return int64(len(l.datapoints[index-l.first-1].value)), nil
+}
+
+func (l *memoryLog) size() int64 { return l.bytes }
+
+func (l *memoryLog) removeUntil(index int64) error {
+	removed := l.datapoints[:index-l.first]
+	for _, datapoint := range removed {
+		l.bytes -= int64(len(datapoint.value))
+	}
+	// copy the remaining datapoints so the removed ones can be collected
+	l.datapoints = append([]memoryDatapoint(nil), l.datapoints[index-l.first:]...)
+	l.first = index
+	return nil
+}
+
+func (l *memoryLog) close() error { return nil }
@@ -1,12 +1,16 @@
 package backend
 
 import (
+	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/rcrowley/go-metrics"
 	"github.com/satori/go.uuid"
 	"github.com/xuyu/goredis"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,6 +18,10 @@ import (
 type RedisBackend struct {
 	RedisUrl   string
 	Datapoints chan *Datapoint
+	// the writers publish stored datapoints to the subscribers of this server
+	Broker *Broker
+	// counts the running writers for the status, may be nil
+	Writers *WriterPool
 }
 
 func (b RedisBackend) openConnection() (*goredis.Redis, error) {
@@ -45,8 +53,8 @@ func (b RedisBackend) GetPipelines() ([]Pipeline, error) {
 		var pipeline Pipeline
 		decodingErr := json.Unmarshal(val, &pipeline)
 		if decodingErr != nil {
-			log.Fatal("Error decoding pipeline \"%s\"", string(val), decodingErr.Error())
-			return nil, err
+			log.Fatalf("Error decoding pipeline \"%s\": %s", string(val), decodingErr.Error())
+			return nil, decodingErr
 		}
 
 		// maybe better via expand
@@ -84,6 +92,12 @@ func (b RedisBackend) CreatePipeline(pipeline *Pipeline) (*Pipeline, error) {
 
 	redis.Set("pipelines:"+pipeline.Id, marshalledPipeline, 0, 0, false, false)
 
+	err = saveRetentionPolicy(redis, pipeline.Id, pipeline.Retention)
+	if err != nil {
+		log.Println("Error saving retention policy:", err.Error())
+		return nil, err
+	}
+
 	return pipeline, nil
 }
 
@@ -99,6 +113,9 @@ func (b RedisBackend) GetPipeline(id string) (*Pipeline, error) {
 		log.Fatal("Error retrieving pipeline from redis:", err.Error())
 		return nil, err
 	}
+	if readPipelineStr == nil {
+		return nil, ErrPipelineNotFound
+	}
 
 	readPipeline := &Pipeline{}
 	decodingErr := json.Unmarshal(readPipelineStr, &readPipeline)
@@ -114,21 +131,188 @@ func (b RedisBackend) GetPipeline(id string) (*Pipeline, error) {
 	}
 	readPipeline.PipelineStatistic = *pipelineStatistic
 
+	consumers, err := redisConsumers(redis, id)
+	if err != nil {
+		log.Println("Error retrieving consumers:", err.Error())
+		return nil, err
+	}
+	readPipeline.Consumers = consumers
+
+	return readPipeline, nil
+}
+
+// redisConsumers lists the consumers of the pipeline with their pointers
+func redisConsumers(redis *goredis.Redis, id string) ([]Consumer, error) {
 	currentElementPointer, _ := redis.IncrBy("pipeline:"+id+":datapoints", 0)
+	firstElementPointer, _ := redis.IncrBy("pipeline:"+id+":firstdatapoint", 0)
 
 	var consumers []Consumer
 	consumerKeys, err := redis.SMembers("pipeline:" + id + ":consumers")
+	if err != nil {
+		return nil, err
+	}
 	for _, consumerKey := range consumerKeys {
 		var consumer Consumer
 		consumer.Id = consumerKey[(strings.LastIndex(consumerKey, ":") + 1):]
-		len, _ := redis.IncrBy(consumerKey, 0)
-		consumer.UnreadElements = currentElementPointer - len
+		pointer, _ := redis.IncrBy(consumerKey, 0)
+		if pointer < firstElementPointer {
+			pointer = firstElementPointer
+		}
+		consumer.UnreadElements = currentElementPointer - pointer
+		consumer.Offset = pointer
 
 		consumers = append(consumers, consumer)
 	}
-	readPipeline.Consumers = consumers
+	sort.Sort(consumersById(consumers))
+	return consumers, nil
+}
 
-	return readPipeline, nil
+// checkPipeline returns ErrPipelineNotFound unless the pipeline exists
+func checkPipeline(redis *goredis.Redis, id string) error {
+	exists, err := redis.Exists("pipelines:" + id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrPipelineNotFound
+	}
+	return nil
+}
+
+func (b RedisBackend) GetConsumers(pipelineId string) ([]Consumer, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+	if err := checkPipeline(redis, pipelineId); err != nil {
+		return nil, err
+	}
+	return redisConsumers(redis, pipelineId)
+}
+
+func (b RedisBackend) CreateConsumer(pipelineId string, consumerId string) (*Consumer, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+	if err := checkPipeline(redis, pipelineId); err != nil {
+		return nil, err
+	}
+
+	consumerKey := "pipeline:" + pipelineId + ":consumers:" + consumerId
+	added, err := redis.SAdd("pipeline:"+pipelineId+":consumers", consumerKey)
+	if err != nil {
+		log.Println("Error adding consumer:", err.Error())
+		return nil, err
+	}
+	if added == 0 {
+		return nil, ErrConsumerExists
+	}
+
+	firstElementPointer, _ := redis.IncrBy("pipeline:"+pipelineId+":firstdatapoint", 0)
+	return b.moveConsumer(redis, pipelineId, consumerId, firstElementPointer)
+}
+
+func (b RedisBackend) DeleteConsumer(pipelineId string, consumerId string) (bool, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return false, err
+	}
+
+	consumerKey := "pipeline:" + pipelineId + ":consumers:" + consumerId
+	removed, err := redis.SRem("pipeline:"+pipelineId+":consumers", consumerKey)
+	if err != nil {
+		log.Println("Error removing consumer:", err.Error())
+		return false, err
+	}
+	if removed == 0 {
+		return false, ErrConsumerNotFound
+	}
+	if _, err := redis.Del(consumerKey, consumerKey+":leased", consumerKey+":leases"); err != nil {
+		log.Println("Error deleting consumer pointer:", err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
+func (b RedisBackend) SeekConsumer(pipelineId string, consumerId string, seek Seek) (*Consumer, error) {
+	if err := seek.Validate(); err != nil {
+		return nil, err
+	}
+
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+
+	consumerKey := "pipeline:" + pipelineId + ":consumers:" + consumerId
+	known, err := redis.SIsMember("pipeline:"+pipelineId+":consumers", consumerKey)
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		return nil, ErrConsumerNotFound
+	}
+
+	currentElementPointer, _ := redis.IncrBy("pipeline:"+pipelineId+":datapoints", 0)
+	var pointer int64
+	switch seek.Position {
+	case SeekBeginning:
+		pointer, _ = redis.IncrBy("pipeline:"+pipelineId+":firstdatapoint", 0)
+	case SeekEnd:
+		pointer = currentElementPointer
+	case SeekOffset:
+		if seek.Offset > currentElementPointer+1 {
+			return nil, ErrInvalidOffset
+		}
+		pointer = seek.Offset - 1
+	case SeekTimestamp:
+		next, err := searchTimeindex(redis, pipelineId, seek.Timestamp, currentElementPointer)
+		if err != nil {
+			log.Println("Error searching time index:", err.Error())
+			return nil, err
+		}
+		pointer = next - 1
+	}
+
+	return b.moveConsumer(redis, pipelineId, consumerId, pointer)
+}
+
+// moveConsumer sets the consumer pointer, dropping the outstanding leases
+func (b RedisBackend) moveConsumer(redis *goredis.Redis, pipelineId string, consumerId string, pointer int64) (*Consumer, error) {
+	consumerKey := "pipeline:" + pipelineId + ":consumers:" + consumerId
+	if _, err := redis.Del(consumerKey+":leased", consumerKey+":leases"); err != nil {
+		log.Println("Error dropping leases:", err.Error())
+		return nil, err
+	}
+	if err := redis.Set(consumerKey, fmt.Sprintf("%d", pointer), 0, 0, false, false); err != nil {
+		log.Println("Error moving consumer:", err.Error())
+		return nil, err
+	}
+
+	currentElementPointer, _ := redis.IncrBy("pipeline:"+pipelineId+":datapoints", 0)
+	return &Consumer{Id: consumerId, UnreadElements: currentElementPointer - pointer, Offset: pointer}, nil
+}
+
+// searchTimeindex returns the index of the first datapoint of the minute the
+// time falls into, or of the following minute holding datapoints. The time
+// index has a resolution of a minute, so up to a minute of datapoints before
+// the time may follow. Without any datapoint at or after the time the index
+// following current is returned.
+func searchTimeindex(redis *goredis.Redis, pipelineId string, t time.Time, current int64) (int64, error) {
+	minute := t.Unix() - t.Unix()%60
+	reply, err := executeCommand(redis, "ZRANGEBYSCORE", "pipeline:"+pipelineId+":timeindex", minute, "+inf", "LIMIT", 0, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply.Multi) == 0 {
+		return current + 1, nil
+	}
+	return strconv.ParseInt(string(reply.Multi[0].Bulk), 10, 64)
 }
 
 func (b RedisBackend) RetrievePipelineStatistic(id string) (*PipelineStatistic, error) {
@@ -190,6 +374,9 @@ func (b RedisBackend) UpdatePipeline(id string, pipeline *Pipeline) (*Pipeline,
 		log.Fatal("Error reading pipeline:", err.Error())
 		return nil, err
 	}
+	if readPipelineStr == nil {
+		return nil, ErrPipelineNotFound
+	}
 
 	readPipeline := &Pipeline{}
 	decodingErr2 := json.Unmarshal(readPipelineStr, &readPipeline)
@@ -200,6 +387,8 @@ func (b RedisBackend) UpdatePipeline(id string, pipeline *Pipeline) (*Pipeline,
 
 	readPipeline.Name = pipeline.Name
 	readPipeline.Description = pipeline.Description
+	readPipeline.Retention = pipeline.Retention
+	readPipeline.DeadLetter = pipeline.DeadLetter
 
 	pipelineStr, marshallingErr := json.Marshal(readPipeline)
 	if marshallingErr != nil {
@@ -209,9 +398,29 @@ func (b RedisBackend) UpdatePipeline(id string, pipeline *Pipeline) (*Pipeline,
 	marshalledPipeline := string(pipelineStr[:])
 	redis.Set("pipelines:"+id, marshalledPipeline, 0, 0, false, false)
 
+	err = saveRetentionPolicy(redis, id, readPipeline.Retention)
+	if err != nil {
+		log.Println("Error saving retention policy:", err.Error())
+		return nil, err
+	}
+
 	return readPipeline, nil
 }
 
+// saveRetentionPolicy stores the policy within a hash next to the pipeline, so
+// that the push script can enforce it
+func saveRetentionPolicy(redis *goredis.Redis, id string, policy *RetentionPolicy) error {
+	key := "pipeline:" + id + ":retention"
+	if _, err := redis.Del(key); err != nil {
+		return err
+	}
+	if policy == nil {
+		return nil
+	}
+	_, err := executeCommand(redis, retentionPolicyArgs(key, policy)...)
+	return err
+}
+
 func (b RedisBackend) DeletePipeline(id string) (bool, error) {
 	redis, err := b.openConnection()
 	if err != nil {
@@ -219,7 +428,7 @@ func (b RedisBackend) DeletePipeline(id string) (bool, error) {
 		return false, err
 	}
 
-	_, err = redis.Del("pipelines:" + id)
+	_, err = redis.Del("pipelines:"+id, "pipeline:"+id+":retention")
 	if err != nil {
 		log.Fatal("Failed deleting pipeline entry:", err.Error())
 		return false, err
@@ -227,56 +436,307 @@ func (b RedisBackend) DeletePipeline(id string) (bool, error) {
 	return true, nil
 }
 
-func (b RedisBackend) PopDatapoint(pipelineId string, consumerId string) ([]string, error) {
+// PopDatapoint reads the datapoints and advances the consumer pointer within a
+// single script, so concurrent pops of the same consumer never overlap
+func (b RedisBackend) PopDatapoint(pipelineId string, consumerId string, limit PopLimit) ([]string, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+
+	keys := []string{
+		"pipeline:" + pipelineId + ":datapoints",
+		"pipeline:" + pipelineId + ":firstdatapoint",
+		"pipeline:" + pipelineId + ":consumers:" + consumerId,
+		"pipeline:" + pipelineId + ":consumers",
+	}
+	args := []string{fmt.Sprintf("%d", limit.max()), fmt.Sprintf("%d", limit.MaxBytes)}
+	reply, err := evalScript(redis, redisPopScript, keys, args)
+	if err != nil {
+		log.Println("Error popping datapoints:", err.Error())
+		return nil, err
+	}
+
+	var datapoints []string
+	for i := 1; i < len(reply.Multi); i += 2 {
+		datapoints = append(datapoints, string(reply.Multi[i].Bulk))
+	}
+	return datapoints, nil
+}
+
+func (b RedisBackend) PeekDatapoints(pipelineId string, consumerId string, limit PopLimit) ([]OffsetDatapoint, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+
+	datapoints, _, err := readDatapoints(redis, pipelineId, "pipeline:"+pipelineId+":consumers:"+consumerId, limit)
+	return datapoints, err
+}
+
+func (b RedisBackend) ReadDatapoints(pipelineId string, offset int64, limit PopLimit) ([]OffsetDatapoint, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+
+	datapoints, _, err := readDatapointsAfter(redis, pipelineId, offset, limit)
+	return datapoints, err
+}
+
+func (b RedisBackend) DatapointOffsets(pipelineId string) (int64, int64, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return 0, 0, err
+	}
+
+	first, err := redis.IncrBy("pipeline:"+pipelineId+":firstdatapoint", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	current, err := redis.IncrBy("pipeline:"+pipelineId+":datapoints", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, current, nil
+}
+
+func (b RedisBackend) CommitOffset(pipelineId string, consumerId string, offset int64) error {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return err
+	}
+
+	consumerKey := "pipeline:" + pipelineId + ":consumers:" + consumerId
+	redis.SAdd("pipeline:"+pipelineId+":consumers", consumerKey)
+
+	keys := []string{consumerKey, "pipeline:" + pipelineId + ":datapoints"}
+	reply, err := evalScript(redis, redisCommitScript, keys, []string{fmt.Sprintf("%d", offset)})
+	if err != nil {
+		log.Println("Error committing offset:", err.Error())
+		return err
+	}
+	committed, err := reply.IntegerValue()
+	if err != nil {
+		return err
+	}
+	if committed == 0 {
+		return ErrInvalidOffset
+	}
+	return nil
+}
+
+func (b RedisBackend) LeaseDatapoints(pipelineId string, consumerId string, memberId string, limit PopLimit, timeout time.Duration) (*Lease, error) {
 	redis, err := b.openConnection()
 	if err != nil {
-		log.Fatal("error opening connection to redis:", err.Error())
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+
+	consumerKey := "pipeline:" + pipelineId + ":consumers:" + consumerId
+	keys := []string{
+		"pipeline:" + pipelineId + ":datapoints",
+		"pipeline:" + pipelineId + ":firstdatapoint",
+		consumerKey,
+		consumerKey + ":leased",
+		consumerKey + ":leases",
+		"pipeline:" + pipelineId + ":consumers",
+	}
+	args := []string{
+		memberId,
+		fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond)),
+		fmt.Sprintf("%d", timeout.Nanoseconds()/int64(time.Millisecond)),
+		fmt.Sprintf("%d", limit.max()),
+		fmt.Sprintf("%d", limit.MaxBytes),
+	}
+	reply, err := evalScript(redis, redisLeaseScript, keys, args)
+	if err != nil {
+		log.Println("Error leasing datapoints:", err.Error())
 		return nil, err
 	}
+	if len(reply.Multi) < 4 {
+		return nil, nil
+	}
+
+	first, last, expires, deliveries := reply.Multi[0].Integer, reply.Multi[1].Integer, reply.Multi[2].Integer, reply.Multi[3].Integer
+	lease := &Lease{
+		Id:         fmt.Sprintf("%d-%d", first, last),
+		Member:     memberId,
+		Expires:    time.Unix(0, expires*int64(time.Millisecond)),
+		Deliveries: deliveries,
+		Datapoints: []OffsetDatapoint{},
+	}
+	for i := 4; i+1 < len(reply.Multi); i += 2 {
+		lease.Datapoints = append(lease.Datapoints, OffsetDatapoint{Offset: reply.Multi[i].Integer, Value: string(reply.Multi[i+1].Bulk), Deliveries: deliveries})
+	}
+	return lease, nil
+}
+
+func (b RedisBackend) NackLease(pipelineId string, consumerId string, leaseId string) error {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return err
+	}
+
+	keys := []string{"pipeline:" + pipelineId + ":consumers:" + consumerId + ":leases"}
+	args := []string{
+		leaseId,
+		fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond)),
+		fmt.Sprintf("%d", redeliveryBackoff.Nanoseconds()/int64(time.Millisecond)),
+		fmt.Sprintf("%d", maxRedeliveryBackoff.Nanoseconds()/int64(time.Millisecond)),
+	}
+	reply, err := evalScript(redis, redisNackScript, keys, args)
+	if err != nil {
+		log.Println("Error nacking lease:", err.Error())
+		return err
+	}
+	nacked, err := reply.IntegerValue()
+	if err != nil {
+		return err
+	}
+	if nacked == 0 {
+		return ErrLeaseNotFound
+	}
+	return nil
+}
+
+func (b RedisBackend) AckLease(pipelineId string, consumerId string, leaseId string) error {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return err
+	}
+
 	consumerKey := "pipeline:" + pipelineId + ":consumers:" + consumerId
+	keys := []string{consumerKey, consumerKey + ":leased", consumerKey + ":leases"}
+	reply, err := evalScript(redis, redisAckScript, keys, []string{leaseId})
+	if err != nil {
+		log.Println("Error acknowledging lease:", err.Error())
+		return err
+	}
+	acked, err := reply.IntegerValue()
+	if err != nil {
+		return err
+	}
+	if acked == 0 {
+		return ErrLeaseNotFound
+	}
+	return nil
+}
+
+// readDatapoints returns the datapoints following the consumer pointer within
+// the limit and the pointer after reading them
+func readDatapoints(redis *goredis.Redis, pipelineId string, consumerKey string, limit PopLimit) ([]OffsetDatapoint, int64, error) {
 	// Add consumer to set of consumers for pipeline
 	redis.SAdd("pipeline:"+pipelineId+":consumers", consumerKey)
 
+	// last element read by the consumer
+	consumerPointer, _ := redis.IncrBy(consumerKey, 0)
+	return readDatapointsAfter(redis, pipelineId, consumerPointer, limit)
+}
+
+// readDatapointsAfter returns the datapoints following the offset within the
+// limit and the offset of the last datapoint read
+func readDatapointsAfter(redis *goredis.Redis, pipelineId string, offset int64, limit PopLimit) ([]OffsetDatapoint, int64, error) {
 	// current pointer
 	currentElementPointer, _ := redis.IncrBy("pipeline:"+pipelineId+":datapoints", 0)
-	// first readable element; the plan would be for a cleanup job to run, increasing this pointer ever forward
+	// last element removed from the pipeline; the retention cleanup job increases this pointer ever forward
 	firstElementPointer, _ := redis.IncrBy("pipeline:"+pipelineId+":firstdatapoint", 0)
-	// pointer for the consumer
-	consumerPointer, _ := redis.IncrBy(consumerKey, 0)
-	if consumerPointer == 0 {
-		consumerPointer = firstElementPointer
+	if offset < firstElementPointer {
+		offset = firstElementPointer
 	}
 
-	readableElements := currentElementPointer - consumerPointer
+	readableElements := currentElementPointer - offset
+	if readableElements > limit.max() {
+		readableElements = limit.max()
+	}
+	if readableElements <= 0 {
+		return nil, offset, nil
+	}
 
-	if readableElements > 0 {
-		var datapoints []string
+	elementKeys := make([]string, readableElements)
+	for i := range elementKeys {
+		elementKeys[i] = fmt.Sprintf("pipeline:%s:datapoints:%d", pipelineId, offset+int64(i)+1)
+	}
+	values, err := redis.MGet(elementKeys...)
+	if err != nil {
+		log.Println("Error reading datapoints:", err.Error())
+		return nil, 0, err
+	}
 
-		for i := int64(0); i < 10 && i < readableElements; i++ {
-			elementKey := fmt.Sprintf("pipeline:%s:datapoints:%d", pipelineId, consumerPointer+i)
-			value, _ := redis.Get(elementKey)
-			stringvalue := string(value)
-			if stringvalue != "" {
-				datapoints = append(datapoints, stringvalue)
-			}
+	datapoints := []OffsetDatapoint{}
+	var bytes, read int64
+	for _, value := range values {
+		if !limit.fits(int64(len(datapoints)), bytes, int64(len(value))) {
+			break
 		}
-		if readableElements < 10 {
-			redis.Set(consumerKey, fmt.Sprintf("%d", consumerPointer+readableElements), 0, 0, false, false)
-		} else {
-			redis.Set(consumerKey, fmt.Sprintf("%d", consumerPointer+10), 0, 0, false, false)
+		read++
+		// datapoints removed by the retention meanwhile are skipped
+		if value != nil {
+			datapoints = append(datapoints, OffsetDatapoint{Offset: offset + read, Value: string(value)})
+			bytes += int64(len(value))
 		}
-		return datapoints, nil
+	}
+	return datapoints, offset + read, nil
+}
+
+// PushDatapoint hands the datapoint to the writers. Unless ack is set it
+// returns without knowing the index, otherwise it waits until a writer stored
+// the datapoint.
+func (b RedisBackend) PushDatapoint(pipelineId string, value string, ack bool) (int64, error) {
+	return b.push(&Datapoint{PipelineId: pipelineId, Value: value}, ack)
+}
+
+// PushDatapoints hands the batch to the writers, which store it within one script call
+func (b RedisBackend) PushDatapoints(pipelineId string, values []string, ack bool) (int64, int64, error) {
+	if len(values) == 0 {
+		return 0, 0, nil
+	}
+	last, err := b.push(&Datapoint{PipelineId: pipelineId, Values: values}, ack)
+	if err != nil || last == 0 {
+		return 0, 0, err
+	}
+	return last - int64(len(values)) + 1, last, nil
+}
+
+func (b RedisBackend) push(datapoint *Datapoint, ack bool) (int64, error) {
+	if !ack {
+		b.Datapoints <- datapoint
+		return 0, nil
 	}
 
-	return nil, nil
+	datapoint.Result = make(chan PushResult, 1)
+	b.Datapoints <- datapoint
+	pushed := <-datapoint.Result
+	return pushed.Index, pushed.Err
 }
 
-/*
- *
- */
-func (b RedisBackend) PushDatapoint(pipelineId string, value string) (int64, error) {
-	b.Datapoints <- &Datapoint{pipelineId, value}
-	return 0, nil
+func (b RedisBackend) ApplyRetention(pipelineId string, policy RetentionPolicy) (int64, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return 0, err
+	}
+
+	keys := []string{
+		"pipeline:" + pipelineId + ":datapoints",
+		"pipeline:" + pipelineId + ":firstdatapoint",
+		"pipeline:" + pipelineId + ":bytes",
+		"pipeline:" + pipelineId + ":timeindex",
+		"pipeline:" + pipelineId + ":consumers",
+	}
+	reply, err := evalScript(redis, redisRetentionScript, keys, retentionArgs(policy))
+	if err != nil {
+		log.Println("Error applying retention policy:", err.Error())
+		return 0, err
+	}
+	return reply.IntegerValue()
 }
 
 func (b RedisBackend) StartScripting() (string, error) {
@@ -291,40 +751,134 @@ func (b RedisBackend) StartScripting() (string, error) {
 		return "", err
 	}
 
-	hash, err := redis.ScriptLoad(`
-			local link_id = redis.call("INCR", KEYS[1])
-			redis.call("SET", KEYS[1] .. ":" .. link_id, ARGV[1])
-			redis.call("INCR", KEYS[2])
-			return link_id`)
+	hash, err := redis.ScriptLoad(redisPushScript)
 	if err != nil {
 		log.Fatal("StartScripting, Failed loading script into redis:", err.Error())
 		return "", err
 	}
 
+	// the pop script is called by its hash, see evalScript
+	_, err = redis.ScriptLoad(redisPopScript)
+	if err != nil {
+		log.Println("StartScripting, Failed loading pop script into redis:", err.Error())
+		return "", err
+	}
+
 	return hash, nil
 }
 
-func (b RedisBackend) Start(t metrics.Timer, scriptHash string, datapoints chan *Datapoint) {
+// evalScript runs a script by its hash, sending the script itself only if
+// Redis doesn't know it, e.g. after a restart or SCRIPT FLUSH
+func evalScript(redis *goredis.Redis, script string, keys []string, args []string) (*goredis.Reply, error) {
+	reply, err := scriptReply(redis.EvalSha(fmt.Sprintf("%x", sha1.Sum([]byte(script))), keys, args))
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return scriptReply(redis.Eval(script, keys, args))
+	}
+	return reply, err
+}
+
+// scriptReply turns an error reply, e.g. NOSCRIPT or an error raised by the
+// script, into an error
+func scriptReply(reply *goredis.Reply, err error) (*goredis.Reply, error) {
+	if err == nil && reply.Type == goredis.ErrorReply {
+		return nil, errors.New(reply.Error)
+	}
+	return reply, err
+}
+
+func (b RedisBackend) Subscribe(pipelineId string) chan struct{} {
+	return b.Broker.Subscribe(pipelineId)
+}
+
+func (b RedisBackend) Unsubscribe(pipelineId string, notifications chan struct{}) {
+	b.Broker.Unsubscribe(pipelineId, notifications)
+}
+
+// Start runs a writer storing the datapoints received on the channel. The
+// index of every datapoint, or the error storing it, is reported to the
+// producer waiting for it.
+func (b RedisBackend) Start(t metrics.Timer, datapoints chan *Datapoint) {
+	b.Writers.started()
 	for {
 		redis, err := b.openConnection()
 		if err != nil {
-			log.Fatal("Error opening connection to redis:", err.Error())
+			log.Println("Error opening connection to redis:", err.Error())
+			time.Sleep(time.Second)
+			continue
 		}
 
 		for {
 			datapoint := <-datapoints
+			b.Writers.setBusy(true)
 
+			var index int64
 			t.Time(func() {
-				reply, err := redis.EvalSha(scriptHash, []string{"pipeline:" + datapoint.PipelineId + ":datapoints", fmt.Sprintf("pipeline:%s:statistics:%d-%02d-%02d", datapoint.PipelineId, time.Now().Year(), time.Now().Month(), time.Now().Day())}, []string{datapoint.Value})
-				if err != nil {
-					log.Fatal("Error executing script:", err.Error())
+				keys := []string{
+					"pipeline:" + datapoint.PipelineId + ":datapoints",
+					"pipeline:" + datapoint.PipelineId + ":statistics:" + formatDate(time.Now()),
+					"pipeline:" + datapoint.PipelineId + ":bytes",
+					"pipeline:" + datapoint.PipelineId + ":timeindex",
+					"pipeline:" + datapoint.PipelineId + ":firstdatapoint",
+					"pipeline:" + datapoint.PipelineId + ":consumers",
+					"pipeline:" + datapoint.PipelineId + ":retention",
 				}
-
-				_, err = reply.IntegerValue()
+				var reply *goredis.Reply
+				reply, err = evalScript(redis, redisPushScript, keys, pushArgs(datapoint.payloads()))
 				if err != nil {
-					log.Fatal("Error reading index:", err.Error())
+					return
 				}
+				index, err = reply.IntegerValue()
 			})
+
+			if err != nil {
+				log.Printf("Error storing datapoint of pipeline %s: %s", datapoint.PipelineId, err.Error())
+			} else {
+				b.Broker.Publish(datapoint.PipelineId)
+			}
+			if datapoint.Result != nil {
+				datapoint.Result <- PushResult{Index: index, Err: err}
+			}
+			b.Writers.setBusy(false)
+			if err != nil {
+				// the connection may be broken, so open a new one
+				break
+			}
+		}
+	}
+}
+
+// Status reports whether Redis can be reached, how much memory it uses and
+// how busy the writers are
+func (b RedisBackend) Status() (*Status, error) {
+	status := &Status{Writers: b.Writers.status(), Redis: &RedisStatus{}}
+	redis, err := b.openConnection()
+	if err == nil {
+		err = redis.Ping()
+	}
+	if err != nil {
+		status.Redis.Error = err.Error()
+		return status, nil
+	}
+	status.Redis.Connected = true
+
+	info, err := redis.Info("")
+	if err != nil {
+		return nil, err
+	}
+	// the info is made of lines like "used_memory:1024"
+	for _, line := range strings.Split(info, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "redis_version":
+			status.Redis.Version = fields[1]
+		case "used_memory":
+			status.Redis.UsedMemory, _ = strconv.ParseInt(fields[1], 10, 64)
+		case "maxmemory":
+			status.Redis.MaxMemory, _ = strconv.ParseInt(fields[1], 10, 64)
 		}
 	}
+	return status, nil
 }
@@ -0,0 +1,481 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+)
+
+// retentionBatchSize limits how many datapoints one run of a retention script
+// removes, so that Redis isn't blocked for too long. The rest is removed by
+// the following runs.
+const retentionBatchSize = 10000
+
+// recordMinuteFunction keeps a time index per pipeline, a sorted set holding
+// the index of the first datapoint of every minute scored by that minute
+const recordMinuteFunction = `
+	local function record_minute(timeindex, minute, index)
+		local last = redis.call("ZRANGE", timeindex, -1, -1, "WITHSCORES")
+		if #last == 0 or tonumber(last[2]) < tonumber(minute) then
+			redis.call("ZADD", timeindex, minute, index)
+		end
+	end`
+
+const retentionFunctions = `
+	-- retention_target returns the index of the last datapoint to remove
+	-- because of its age, the amount of datapoints or the consumers
+	local function retention_target(current, first, timeindex, cutoff, max_datapoints, consumed)
+		local target = first
+		if max_datapoints > 0 and current - target > max_datapoints then
+			target = current - max_datapoints
+		end
+		if cutoff > 0 and redis.call("ZCARD", timeindex) > 0 then
+			local retained = redis.call("ZRANGEBYSCORE", timeindex, cutoff, "+inf", "LIMIT", 0, 1)
+			local expired = current
+			if #retained > 0 then
+				expired = tonumber(retained[1]) - 1
+			end
+			if expired > target then
+				target = expired
+			end
+		end
+		if consumed > target then
+			target = consumed
+		end
+		if target > current then
+			target = current
+		end
+		return target
+	end
+
+	-- prune_timeindex drops the minutes whose datapoints were all removed
+	local function prune_timeindex(timeindex, removed)
+		while true do
+			local minutes = redis.call("ZRANGE", timeindex, 0, 1)
+			if #minutes < 2 or tonumber(minutes[2]) > removed + 1 then
+				return
+			end
+			redis.call("ZREM", timeindex, minutes[1])
+		end
+	end`
+
+// policyFunction reads the retention policy a pipeline enforces on write, the
+// amount of datapoints, their size and their age
+const policyFunction = `
+	local function write_policy(policy_key, now)
+		local policy = redis.call("HMGET", policy_key, "max_age", "max_datapoints", "max_bytes")
+		local max_age = tonumber(policy[1]) or 0
+		local cutoff = 0
+		if max_age > 0 then
+			cutoff = now - max_age
+		end
+		return cutoff, tonumber(policy[2]) or 0, tonumber(policy[3]) or 0
+	end`
+
+const redisRetentionFunction = `
+	local function apply_retention(datapoints, firstdatapoint, bytes_key, timeindex, consumers, cutoff, max_datapoints, max_bytes, delete_consumed, limit)
+		local current = tonumber(redis.call("GET", datapoints) or "0")
+		local first = tonumber(redis.call("GET", firstdatapoint) or "0")
+
+		local consumed = -1
+		if delete_consumed then
+			for _, consumerKey in ipairs(redis.call("SMEMBERS", consumers)) do
+				local pointer = tonumber(redis.call("GET", consumerKey) or "0")
+				if consumed < 0 or pointer < consumed then
+					consumed = pointer
+				end
+			end
+		end
+
+		local target = retention_target(current, first, timeindex, cutoff, max_datapoints, consumed)
+		local bytes = tonumber(redis.call("GET", bytes_key) or "0")
+
+		local removed = first
+		while removed < current and removed - first < limit and (removed < target or (max_bytes > 0 and bytes > max_bytes)) do
+			removed = removed + 1
+			local key = datapoints .. ":" .. removed
+			bytes = bytes - redis.call("STRLEN", key)
+			redis.call("DEL", key)
+		end
+		if removed == first then
+			return 0
+		end
+		if bytes < 0 then
+			bytes = 0
+		end
+
+		redis.call("SET", firstdatapoint, removed)
+		redis.call("SET", bytes_key, bytes)
+		prune_timeindex(timeindex, removed)
+		return removed - first
+	end`
+
+// KEYS: datapoints, statistics of today, bytes, time index, firstdatapoint, consumers, retention
+// ARGV: current minute, current time, batch size, values
+const redisPushScript = recordMinuteFunction + retentionFunctions + redisRetentionFunction + policyFunction + `
+	local first_id = tonumber(redis.call("GET", KEYS[1]) or "0") + 1
+	local link_id = redis.call("INCRBY", KEYS[1], #ARGV - 3)
+	local bytes = 0
+	for i = 4, #ARGV do
+		redis.call("SET", KEYS[1] .. ":" .. (first_id + i - 4), ARGV[i])
+		bytes = bytes + string.len(ARGV[i])
+	end
+	redis.call("INCRBY", KEYS[2], #ARGV - 3)
+	redis.call("INCRBY", KEYS[3], bytes)
+	record_minute(KEYS[4], ARGV[1], first_id)
+
+	local cutoff, max_datapoints, max_bytes = write_policy(KEYS[7], tonumber(ARGV[2]))
+	if cutoff > 0 or max_datapoints > 0 or max_bytes > 0 then
+		apply_retention(KEYS[1], KEYS[5], KEYS[3], KEYS[4], KEYS[6], cutoff, max_datapoints, max_bytes, false, tonumber(ARGV[3]))
+	end
+	return link_id`
+
+// KEYS: datapoints, firstdatapoint, bytes, time index, consumers
+// ARGV: cutoff, max datapoints, max bytes, delete consumed, batch size
+const redisRetentionScript = retentionFunctions + redisRetentionFunction + `
+	return apply_retention(KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5], tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), ARGV[4] == "1", tonumber(ARGV[5]))`
+
+const streamsRetentionFunction = `
+	local function stream_field(reply, name)
+		for i = 1, #reply, 2 do
+			if reply[i] == name then
+				return reply[i + 1]
+			end
+		end
+	end
+
+	local function stream_index(id)
+		return tonumber(string.match(id, "%d+$"))
+	end
+
+	local function apply_retention(stream, bytes_key, timeindex, cutoff, max_datapoints, max_bytes, delete_consumed, limit)
+		if redis.call("EXISTS", stream) == 0 then
+			return 0
+		end
+
+		local info = redis.call("XINFO", "STREAM", stream)
+		local current = stream_index(stream_field(info, "last-generated-id"))
+		local first = current
+		local first_entry = stream_field(info, "first-entry")
+		if first_entry then
+			first = stream_index(first_entry[1]) - 1
+		end
+
+		local consumed = -1
+		if delete_consumed then
+			for _, group in ipairs(redis.call("XINFO", "GROUPS", stream)) do
+				local pointer = stream_index(stream_field(group, "last-delivered-id"))
+				if tonumber(stream_field(group, "pending")) > 0 then
+					-- leased entries count as delivered, like the consumer
+					-- pointer stop before the first entry not acknowledged
+					local pending = redis.call("XPENDING", stream, stream_field(group, "name"))
+					pointer = stream_index(pending[2]) - 1
+				end
+				if consumed < 0 or pointer < consumed then
+					consumed = pointer
+				end
+			end
+		end
+
+		local target = retention_target(current, first, timeindex, cutoff, max_datapoints, consumed)
+		local bytes = tonumber(redis.call("GET", bytes_key) or "0")
+
+		local removed = first
+		local count = 0
+		local done = false
+		while not done do
+			local entries = redis.call("XRANGE", stream, "(0-" .. removed, "+", "COUNT", 100)
+			if #entries == 0 then
+				break
+			end
+			for _, entry in ipairs(entries) do
+				local index = stream_index(entry[1])
+				if count >= limit or not (index <= target or (max_bytes > 0 and bytes > max_bytes)) then
+					done = true
+					break
+				end
+				bytes = bytes - string.len(entry[2][2])
+				removed = index
+				count = count + 1
+			end
+		end
+		if count == 0 then
+			return 0
+		end
+		if bytes < 0 then
+			bytes = 0
+		end
+
+		redis.call("XTRIM", stream, "MINID", "0-" .. (removed + 1))
+		redis.call("SET", bytes_key, bytes)
+		prune_timeindex(timeindex, removed)
+		return count
+	end`
+
+// KEYS: stream, statistics of today, bytes, time index, retention
+// ARGV: current minute, current time, batch size, values
+const streamsPushScript = recordMinuteFunction + retentionFunctions + streamsRetentionFunction + policyFunction + `
+	local first_id
+	local id
+	local bytes = 0
+	for i = 4, #ARGV do
+		id = redis.call("XADD", KEYS[1], "0-*", "payload", ARGV[i])
+		first_id = first_id or string.match(id, "%d+$")
+		bytes = bytes + string.len(ARGV[i])
+	end
+	redis.call("INCRBY", KEYS[2], #ARGV - 3)
+	redis.call("INCRBY", KEYS[3], bytes)
+	record_minute(KEYS[4], ARGV[1], first_id)
+
+	local cutoff, max_datapoints, max_bytes = write_policy(KEYS[5], tonumber(ARGV[2]))
+	if cutoff > 0 or max_datapoints > 0 or max_bytes > 0 then
+		apply_retention(KEYS[1], KEYS[3], KEYS[4], cutoff, max_datapoints, max_bytes, false, tonumber(ARGV[3]))
+	end
+	return id`
+
+// KEYS: stream, bytes, time index
+// ARGV: cutoff, max datapoints, max bytes, delete consumed, batch size
+const streamsRetentionScript = retentionFunctions + streamsRetentionFunction + `
+	return apply_retention(KEYS[1], KEYS[2], KEYS[3], tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), ARGV[4] == "1", tonumber(ARGV[5]))`
+
+// KEYS: stream
+// ARGV: group, consumer, max, max bytes
+// returns the payloads read, the group is moved back over the entries
+// exceeding max bytes before any other pop of the group reads
+const streamsPopScript = `
+	-- NOACK keeps the entries out of the pending entries list, reading
+	-- advances the group just like the consumer pointer of the RedisBackend
+	local reply = redis.call("XREADGROUP", "GROUP", ARGV[1], ARGV[2], "COUNT", ARGV[3], "NOACK", "STREAMS", KEYS[1], ">")
+	if not reply or not reply[1] then
+		return {}
+	end
+	local max_bytes = tonumber(ARGV[4])
+
+	local payloads = {}
+	local bytes = 0
+	local last_id
+	for _, entry in ipairs(reply[1][2]) do
+		local payload = entry[2][2]
+		if #payloads > 0 and max_bytes > 0 and bytes + string.len(payload) > max_bytes then
+			redis.call("XGROUP", "SETID", KEYS[1], ARGV[1], last_id)
+			break
+		end
+		table.insert(payloads, payload)
+		bytes = bytes + string.len(payload)
+		last_id = entry[1]
+	end
+	return payloads`
+
+// KEYS: stream, delayed
+// ARGV: group, member, min idle, count, now
+// claims up to count entries pending for longer than min idle for the member,
+// skipping nacked entries whose redelivery isn't due yet, and returns them
+// like XCLAIM
+const streamsClaimScript = `
+	local count = tonumber(ARGV[4])
+	local now = tonumber(ARGV[5])
+	local ids = {}
+	local start = "-"
+	while #ids < count do
+		local pending = redis.call("XPENDING", KEYS[1], ARGV[1], "IDLE", ARGV[3], start, "+", count)
+		if #pending == 0 then
+			break
+		end
+		for _, entry in ipairs(pending) do
+			local due = redis.call("ZSCORE", KEYS[2], entry[1])
+			if not due or tonumber(due) <= now then
+				table.insert(ids, entry[1])
+				if #ids == count then
+					break
+				end
+			end
+		end
+		-- ids are 0-<index>, the next page starts after the last entry
+		start = "0-" .. (tonumber(string.match(pending[#pending][1], "%d+$")) + 1)
+	end
+	if #ids == 0 then
+		return {}
+	end
+	redis.call("ZREM", KEYS[2], unpack(ids))
+	return redis.call("XCLAIM", KEYS[1], ARGV[1], ARGV[2], ARGV[3], unpack(ids))`
+
+// KEYS: datapoints, firstdatapoint, consumer, consumers
+// ARGV: max, max bytes
+// returns {offset, value, offset, value...} of the datapoints read
+const redisPopScript = `
+	redis.call("SADD", KEYS[4], KEYS[3])
+
+	local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+	-- the retention cleanup job moves the first datapoint pointer ever forward
+	local pointer = math.max(tonumber(redis.call("GET", KEYS[3]) or "0"), tonumber(redis.call("GET", KEYS[2]) or "0"))
+	local max = tonumber(ARGV[1])
+	local max_bytes = tonumber(ARGV[2])
+
+	local reply = {}
+	local taken = 0
+	local bytes = 0
+	local index = pointer
+	while index < current and index - pointer < max do
+		local value = redis.call("GET", KEYS[1] .. ":" .. (index + 1))
+		if value then
+			if taken > 0 and max_bytes > 0 and bytes + string.len(value) > max_bytes then
+				break
+			end
+			table.insert(reply, index + 1)
+			table.insert(reply, value)
+			taken = taken + 1
+			bytes = bytes + string.len(value)
+		end
+		index = index + 1
+	end
+
+	if index > pointer then
+		redis.call("SET", KEYS[3], index)
+	end
+	return reply`
+
+// KEYS: consumer, datapoints
+// ARGV: offset
+// returns 0 if the offset is beyond the last datapoint
+const redisCommitScript = `
+	local offset = tonumber(ARGV[1])
+	if offset > tonumber(redis.call("GET", KEYS[2]) or "0") then
+		return 0
+	end
+	if offset > tonumber(redis.call("GET", KEYS[1]) or "0") then
+		redis.call("SET", KEYS[1], offset)
+	end
+	return 1`
+
+// leases are stored in a hash per consumer, the field being the lease id
+// first-last and the value first:last:expires:deliveries:member
+const leaseFunctions = `
+	local function parse_lease(record)
+		local first, last, expires, deliveries, member = string.match(record, "^(%d+):(%d+):(%d+):(%d+):(.*)$")
+		return tonumber(first), tonumber(last), tonumber(expires), tonumber(deliveries), member
+	end
+
+	local function lease_record(first, last, expires, deliveries, member)
+		return first .. ":" .. last .. ":" .. expires .. ":" .. deliveries .. ":" .. member
+	end`
+
+// KEYS: datapoints, firstdatapoint, consumer, leased, leases, consumers
+// ARGV: member, now in milliseconds, timeout in milliseconds, max, max bytes
+// returns {first, last, expires, deliveries, offset, value, offset, value...} or nothing
+const redisLeaseScript = leaseFunctions + `
+	local now = tonumber(ARGV[2])
+	redis.call("SADD", KEYS[6], KEYS[3])
+
+	-- hand out the expired lease with the lowest offsets again
+	local lease_first, lease_last
+	local deliveries = 0
+	for _, record in ipairs(redis.call("HVALS", KEYS[5])) do
+		local first, last, expires, count = parse_lease(record)
+		if expires <= now and (lease_first == nil or first < lease_first) then
+			lease_first, lease_last, deliveries = first, last, count
+		end
+	end
+
+	local removed = tonumber(redis.call("GET", KEYS[2]) or "0")
+	if lease_first == nil then
+		local start = math.max(tonumber(redis.call("GET", KEYS[4]) or "0"), tonumber(redis.call("GET", KEYS[3]) or "0"), removed)
+		local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+		local max = tonumber(ARGV[4])
+		local max_bytes = tonumber(ARGV[5])
+		local bytes = 0
+		local index = start
+		while index < current and index - start < max do
+			local size = redis.call("STRLEN", KEYS[1] .. ":" .. (index + 1))
+			if index > start and max_bytes > 0 and bytes + size > max_bytes then
+				break
+			end
+			index = index + 1
+			bytes = bytes + size
+		end
+		if index == start then
+			return {}
+		end
+		lease_first, lease_last = start + 1, index
+		redis.call("SET", KEYS[4], lease_last)
+	end
+
+	local expires = now + tonumber(ARGV[3])
+	deliveries = deliveries + 1
+	redis.call("HSET", KEYS[5], lease_first .. "-" .. lease_last, lease_record(lease_first, lease_last, expires, deliveries, ARGV[1]))
+
+	local reply = {lease_first, lease_last, expires, deliveries}
+	for index = math.max(lease_first, removed + 1), lease_last do
+		local value = redis.call("GET", KEYS[1] .. ":" .. index)
+		if value then
+			table.insert(reply, index)
+			table.insert(reply, value)
+		end
+	end
+	return reply`
+
+// KEYS: consumer, leased, leases
+// ARGV: lease id
+// returns 0 if the lease doesn't exist
+const redisAckScript = leaseFunctions + `
+	if redis.call("HDEL", KEYS[3], ARGV[1]) == 0 then
+		return 0
+	end
+
+	-- the pointer moves up to the first datapoint still leased
+	local pointer = tonumber(redis.call("GET", KEYS[2]) or "0")
+	for _, record in ipairs(redis.call("HVALS", KEYS[3])) do
+		local first = parse_lease(record)
+		if first - 1 < pointer then
+			pointer = first - 1
+		end
+	end
+	if pointer > tonumber(redis.call("GET", KEYS[1]) or "0") then
+		redis.call("SET", KEYS[1], pointer)
+	end
+	return 1`
+
+// KEYS: leases
+// ARGV: lease id, now in milliseconds, first delay in milliseconds, maximum delay in milliseconds
+// returns 0 if the lease doesn't exist
+const redisNackScript = leaseFunctions + `
+	local record = redis.call("HGET", KEYS[1], ARGV[1])
+	if not record then
+		return 0
+	end
+
+	local first, last, expires, deliveries, member = parse_lease(record)
+	local delay = math.min(tonumber(ARGV[3]) * 2 ^ (deliveries - 1), tonumber(ARGV[4]))
+	redis.call("HSET", KEYS[1], ARGV[1], lease_record(first, last, tonumber(ARGV[2]) + delay, deliveries, member))
+	return 1`
+
+// pushArgs returns the arguments of the push scripts: the start of the current
+// minute, which is the resolution of the time index, the current time, the
+// retention batch size and the values, which are stored in order
+func pushArgs(values []string) []string {
+	now := time.Now().Unix()
+	return append([]string{fmt.Sprintf("%d", now-now%60), fmt.Sprintf("%d", now), fmt.Sprintf("%d", retentionBatchSize)}, values...)
+}
+
+// retentionPolicyArgs returns the arguments of HSET storing the part of the
+// policy the push scripts enforce on write
+func retentionPolicyArgs(key string, policy *RetentionPolicy) []interface{} {
+	return []interface{}{"HSET", key, "max_age", policy.MaxAge, "max_datapoints", policy.MaxDatapoints, "max_bytes", policy.MaxBytes}
+}
+
+// retentionArgs returns the arguments of the retention scripts for the policy
+func retentionArgs(policy RetentionPolicy) []string {
+	cutoff := int64(0)
+	if policy.MaxAge > 0 {
+		cutoff = time.Now().Unix() - policy.MaxAge
+	}
+	deleteConsumed := "0"
+	if policy.DeleteConsumed {
+		deleteConsumed = "1"
+	}
+	return []string{
+		fmt.Sprintf("%d", cutoff),
+		fmt.Sprintf("%d", policy.MaxDatapoints),
+		fmt.Sprintf("%d", policy.MaxBytes),
+		deleteConsumed,
+		fmt.Sprintf("%d", retentionBatchSize),
+	}
+}
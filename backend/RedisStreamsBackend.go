@@ -0,0 +1,819 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xuyu/goredis"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// name of the single stream consumer within each consumer group
+const streamConsumerName = "turbine"
+
+// RedisStreamsBackend keeps the datapoints of a pipeline in a Redis stream
+// (Redis 7 or newer) instead of one key per datapoint. Entries are added with
+// the id 0-<index>, so the sequence number of an entry is the datapoint index.
+// Each Turbine consumer is a consumer group on the stream; the last delivered
+// id of the group is the consumer pointer. Pipeline definitions and
+// statistics use the same keys as the RedisBackend.
+type RedisStreamsBackend struct {
+	RedisBackend
+}
+
+func NewRedisStreamsBackend(redisUrl string) (RedisStreamsBackend, error) {
+	b := RedisStreamsBackend{RedisBackend: RedisBackend{RedisUrl: redisUrl, Broker: NewBroker()}}
+
+	redis, err := b.openConnection()
+	if err != nil {
+		return b, err
+	}
+
+	// scripts run by their hash, loading one fails early if Redis is unreachable
+	_, err = redis.ScriptLoad(streamsPushScript)
+	return b, err
+}
+
+// idle time in milliseconds of entries released from a lease, which is longer
+// than any visibility timeout
+const releasedIdle = 365 * 24 * 60 * 60 * 1000
+
+func streamKey(pipelineId string) string {
+	return "pipeline:" + pipelineId + ":stream"
+}
+
+// delayedKey is the sorted set of the nacked entries of the consumer group,
+// scored by the time in milliseconds their redelivery is due
+func delayedKey(pipelineId string, consumerId string) string {
+	return "pipeline:" + pipelineId + ":stream:" + consumerId + ":delayed"
+}
+
+func (b RedisStreamsBackend) GetPipeline(id string) (*Pipeline, error) {
+	readPipeline, err := b.RedisBackend.GetPipeline(id)
+	if err != nil {
+		return nil, err
+	}
+
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+
+	consumers, err := streamConsumers(redis, id)
+	if err != nil {
+		return nil, err
+	}
+	readPipeline.Consumers = consumers
+
+	return readPipeline, nil
+}
+
+// streamConsumers lists the consumer groups of the stream as consumers
+func streamConsumers(redis *goredis.Redis, id string) ([]Consumer, error) {
+	currentElementPointer, err := currentStreamIndex(redis, id)
+	if err != nil {
+		log.Println("Error retrieving stream information:", err.Error())
+		return nil, err
+	}
+
+	groups, err := streamGroups(redis, id)
+	if err != nil {
+		log.Println("Error retrieving consumer groups:", err.Error())
+		return nil, err
+	}
+
+	var consumers []Consumer
+	for _, group := range groups {
+		pointer := group.lastDelivered
+		if group.pending > 0 {
+			// like the consumer pointer, stop before the first entry not acknowledged
+			pointer, err = firstPendingIndex(redis, id, group.name)
+			if err != nil {
+				log.Println("Error retrieving pending entries:", err.Error())
+				return nil, err
+			}
+			pointer--
+		}
+		consumers = append(consumers, streamConsumer(group.name, currentElementPointer, pointer))
+	}
+	sort.Sort(consumersById(consumers))
+	return consumers, nil
+}
+
+func streamConsumer(consumerId string, current int64, lastDelivered int64) Consumer {
+	return Consumer{Id: consumerId, UnreadElements: current - lastDelivered, Offset: lastDelivered}
+}
+
+func (b RedisStreamsBackend) GetConsumers(pipelineId string) ([]Consumer, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+	if err := checkPipeline(redis, pipelineId); err != nil {
+		return nil, err
+	}
+	return streamConsumers(redis, pipelineId)
+}
+
+// CreateConsumer creates the consumer group of the consumer
+func (b RedisStreamsBackend) CreateConsumer(pipelineId string, consumerId string) (*Consumer, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+	if err := checkPipeline(redis, pipelineId); err != nil {
+		return nil, err
+	}
+
+	_, err = executeCommand(redis, "XGROUP", "CREATE", streamKey(pipelineId), consumerId, "0", "MKSTREAM")
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, ErrConsumerExists
+		}
+		log.Println("Error creating consumer group:", err.Error())
+		return nil, err
+	}
+
+	current, err := currentStreamIndex(redis, pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	consumer := streamConsumer(consumerId, current, 0)
+	return &consumer, nil
+}
+
+// DeleteConsumer destroys the consumer group of the consumer
+func (b RedisStreamsBackend) DeleteConsumer(pipelineId string, consumerId string) (bool, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return false, err
+	}
+
+	reply, err := executeCommand(redis, "XGROUP", "DESTROY", streamKey(pipelineId), consumerId)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return false, ErrConsumerNotFound
+		}
+		log.Println("Error destroying consumer group:", err.Error())
+		return false, err
+	}
+	if reply.Integer == 0 {
+		return false, ErrConsumerNotFound
+	}
+	if _, err := redis.Del(delayedKey(pipelineId, consumerId)); err != nil {
+		log.Println("Error deleting nacked entries:", err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
+// SeekConsumer sets the last delivered id of the consumer group
+func (b RedisStreamsBackend) SeekConsumer(pipelineId string, consumerId string, seek Seek) (*Consumer, error) {
+	if err := seek.Validate(); err != nil {
+		return nil, err
+	}
+
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+
+	if _, err := findStreamGroup(redis, pipelineId, consumerId); err != nil {
+		return nil, err
+	}
+	current, err := currentStreamIndex(redis, pipelineId)
+	if err != nil {
+		log.Println("Error retrieving stream information:", err.Error())
+		return nil, err
+	}
+
+	var pointer int64
+	switch seek.Position {
+	case SeekBeginning:
+		pointer = 0
+	case SeekEnd:
+		pointer = current
+	case SeekOffset:
+		if seek.Offset > current+1 {
+			return nil, ErrInvalidOffset
+		}
+		pointer = seek.Offset - 1
+	case SeekTimestamp:
+		next, err := searchTimeindex(redis, pipelineId, seek.Timestamp, current)
+		if err != nil {
+			log.Println("Error searching time index:", err.Error())
+			return nil, err
+		}
+		pointer = next - 1
+	}
+
+	_, err = executeCommand(redis, "XGROUP", "SETID", streamKey(pipelineId), consumerId, fmt.Sprintf("0-%d", pointer))
+	if err != nil {
+		log.Println("Error moving consumer group:", err.Error())
+		return nil, err
+	}
+	consumer := streamConsumer(consumerId, current, pointer)
+	return &consumer, nil
+}
+
+func (b RedisStreamsBackend) PopDatapoint(pipelineId string, consumerId string, limit PopLimit) ([]string, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+
+	if err := createStreamGroup(redis, pipelineId, consumerId); err != nil {
+		log.Println("Error creating consumer group:", err.Error())
+		return nil, err
+	}
+
+	// reading and moving the group back over the datapoints exceeding the
+	// limit happen within one script, so concurrent pops never overlap
+	args := []string{consumerId, streamConsumerName, fmt.Sprintf("%d", limit.max()), fmt.Sprintf("%d", limit.MaxBytes)}
+	reply, err := evalScript(redis, streamsPopScript, []string{streamKey(pipelineId)}, args)
+	if err != nil {
+		log.Println("Error reading from stream:", err.Error())
+		return nil, err
+	}
+
+	var datapoints []string
+	for _, value := range reply.Multi {
+		datapoints = append(datapoints, string(value.Bulk))
+	}
+	return datapoints, nil
+}
+
+// PeekDatapoints reads the entries following the last one delivered to the
+// consumer group with XRANGE, which leaves the group untouched
+func (b RedisStreamsBackend) PeekDatapoints(pipelineId string, consumerId string, limit PopLimit) ([]OffsetDatapoint, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+
+	if err := createStreamGroup(redis, pipelineId, consumerId); err != nil {
+		log.Println("Error creating consumer group:", err.Error())
+		return nil, err
+	}
+	group, err := findStreamGroup(redis, pipelineId, consumerId)
+	if err != nil {
+		log.Println("Error retrieving consumer group:", err.Error())
+		return nil, err
+	}
+
+	return rangeDatapoints(redis, pipelineId, group.lastDelivered, limit)
+}
+
+// ReadDatapoints reads the entries following the offset with XRANGE
+func (b RedisStreamsBackend) ReadDatapoints(pipelineId string, offset int64, limit PopLimit) ([]OffsetDatapoint, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+	return rangeDatapoints(redis, pipelineId, offset, limit)
+}
+
+// DatapointOffsets derives the offsets from the first and the last entry id of
+// the stream, as the retention trims the stream from its head
+func (b RedisStreamsBackend) DatapointOffsets(pipelineId string) (int64, int64, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return 0, 0, err
+	}
+
+	reply, err := executeCommand(redis, "XINFO", "STREAM", streamKey(pipelineId))
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return 0, 0, nil
+		}
+		log.Println("Error retrieving stream information:", err.Error())
+		return 0, 0, err
+	}
+
+	fields := replyFields(reply)
+	lastGenerated, ok := fields["last-generated-id"]
+	if !ok {
+		return 0, 0, errors.New("missing last-generated-id in stream information")
+	}
+	current, err := streamIndex(string(lastGenerated.Bulk))
+	if err != nil {
+		return 0, 0, err
+	}
+	firstEntry, ok := fields["first-entry"]
+	if !ok || len(firstEntry.Multi) == 0 {
+		return current, current, nil
+	}
+	first, err := streamIndex(string(firstEntry.Multi[0].Bulk))
+	if err != nil {
+		return 0, 0, err
+	}
+	return first - 1, current, nil
+}
+
+// rangeDatapoints returns the entries following the offset within the limit
+func rangeDatapoints(redis *goredis.Redis, pipelineId string, offset int64, limit PopLimit) ([]OffsetDatapoint, error) {
+	reply, err := executeCommand(redis, "XRANGE", streamKey(pipelineId), fmt.Sprintf("(0-%d", offset), "+", "COUNT", limit.max())
+	if err != nil {
+		log.Println("Error reading from stream:", err.Error())
+		return nil, err
+	}
+	entries, err := streamEntries(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	datapoints := []OffsetDatapoint{}
+	var bytes int64
+	for _, entry := range entries {
+		if !limit.fits(int64(len(datapoints)), bytes, int64(len(entry.payload))) {
+			break
+		}
+		datapoints = append(datapoints, OffsetDatapoint{Offset: entry.index, Value: entry.payload})
+		bytes += int64(len(entry.payload))
+	}
+	return datapoints, nil
+}
+
+// CommitOffset moves the consumer group forward with XGROUP SETID
+func (b RedisStreamsBackend) CommitOffset(pipelineId string, consumerId string, offset int64) error {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return err
+	}
+
+	current, err := currentStreamIndex(redis, pipelineId)
+	if err != nil {
+		log.Println("Error retrieving stream information:", err.Error())
+		return err
+	}
+	if offset > current {
+		return ErrInvalidOffset
+	}
+
+	if err := createStreamGroup(redis, pipelineId, consumerId); err != nil {
+		log.Println("Error creating consumer group:", err.Error())
+		return err
+	}
+	group, err := findStreamGroup(redis, pipelineId, consumerId)
+	if err != nil {
+		log.Println("Error retrieving consumer group:", err.Error())
+		return err
+	}
+	if offset <= group.lastDelivered {
+		return nil
+	}
+
+	_, err = executeCommand(redis, "XGROUP", "SETID", streamKey(pipelineId), consumerId, fmt.Sprintf("0-%d", offset))
+	if err != nil {
+		log.Println("Error committing offset:", err.Error())
+	}
+	return err
+}
+
+// LeaseDatapoints reads the entries with the member as consumer of the group
+// without NOACK, so they stay in the pending entries list until acknowledged.
+// Entries pending for longer than the timeout are claimed first, so for this
+// backend the timeout of the member asking decides when a lease expired.
+// Nacked entries are claimed once their redelivery is due.
+func (b RedisStreamsBackend) LeaseDatapoints(pipelineId string, consumerId string, memberId string, limit PopLimit, timeout time.Duration) (*Lease, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return nil, err
+	}
+
+	if err := createStreamGroup(redis, pipelineId, consumerId); err != nil {
+		log.Println("Error creating consumer group:", err.Error())
+		return nil, err
+	}
+
+	key := streamKey(pipelineId)
+	args := []string{
+		consumerId,
+		memberId,
+		fmt.Sprintf("%d", timeout.Nanoseconds()/int64(time.Millisecond)),
+		fmt.Sprintf("%d", limit.max()),
+		fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond)),
+	}
+	reply, err := evalScript(redis, streamsClaimScript, []string{key, delayedKey(pipelineId, consumerId)}, args)
+	if err != nil {
+		log.Println("Error claiming expired entries:", err.Error())
+		return nil, err
+	}
+	entries, err := streamEntries(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		reply, err = executeCommand(redis, "XREADGROUP", "GROUP", consumerId, memberId, "COUNT", limit.max(), "STREAMS", key, ">")
+		if err != nil {
+			log.Println("Error reading from stream:", err.Error())
+			return nil, err
+		}
+		entries, err = readGroupEntries(reply)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	datapoints := []OffsetDatapoint{}
+	var bytes int64
+	var released []interface{}
+	for _, entry := range entries {
+		if len(released) > 0 || !limit.fits(int64(len(datapoints)), bytes, int64(len(entry.payload))) {
+			released = append(released, fmt.Sprintf("0-%d", entry.index))
+			continue
+		}
+		datapoints = append(datapoints, OffsetDatapoint{Offset: entry.index, Value: entry.payload})
+		bytes += int64(len(entry.payload))
+	}
+	if len(released) > 0 {
+		// entries exceeding the limit are marked as expired right away, so
+		// that the next member asking claims them
+		args := append([]interface{}{"XCLAIM", key, consumerId, memberId, 0}, released...)
+		args = append(args, "IDLE", releasedIdle, "JUSTID")
+		if _, err := executeCommand(redis, args...); err != nil {
+			log.Println("Error releasing entries:", err.Error())
+			return nil, err
+		}
+	}
+	if len(datapoints) == 0 {
+		return nil, nil
+	}
+
+	first, last := datapoints[0].Offset, datapoints[len(datapoints)-1].Offset
+	lease := &Lease{
+		Id:         fmt.Sprintf("%d-%d-%s", first, last, memberId),
+		Member:     memberId,
+		Expires:    time.Now().Add(timeout),
+		Datapoints: datapoints,
+	}
+
+	// the pending entries list counts the deliveries of every entry
+	pending, err := pendingEntries(redis, pipelineId, consumerId, first, last, memberId)
+	if err != nil {
+		log.Println("Error retrieving pending entries:", err.Error())
+		return nil, err
+	}
+	for i := range lease.Datapoints {
+		lease.Datapoints[i].Deliveries = pending[lease.Datapoints[i].Offset]
+		if lease.Datapoints[i].Deliveries > lease.Deliveries {
+			lease.Deliveries = lease.Datapoints[i].Deliveries
+		}
+	}
+	return lease, nil
+}
+
+// NackLease records when the redelivery of every entry is due and marks the
+// entries as expired, so that the first lease after that claims them. Redis
+// moves delivery times in the future back to now, so the delay is kept aside
+// the pending entries list.
+func (b RedisStreamsBackend) NackLease(pipelineId string, consumerId string, leaseId string) error {
+	first, last, memberId, err := parseStreamLeaseId(leaseId)
+	if err != nil {
+		return err
+	}
+
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return err
+	}
+
+	pending, err := pendingEntries(redis, pipelineId, consumerId, first, last, memberId)
+	if err != nil {
+		log.Println("Error retrieving pending entries:", err.Error())
+		return err
+	}
+	if len(pending) == 0 {
+		return ErrLeaseNotFound
+	}
+
+	now := time.Now()
+	delays := []interface{}{"ZADD", delayedKey(pipelineId, consumerId)}
+	args := []interface{}{"XCLAIM", streamKey(pipelineId), consumerId, memberId, 0}
+	for index, deliveries := range pending {
+		due := now.Add(redeliveryDelay(deliveries)).UnixNano() / int64(time.Millisecond)
+		delays = append(delays, due, fmt.Sprintf("0-%d", index))
+		args = append(args, fmt.Sprintf("0-%d", index))
+	}
+	// the delay is recorded first, so no lease claims the entries before
+	if _, err := executeCommand(redis, delays...); err != nil {
+		log.Println("Error delaying entries:", err.Error())
+		return err
+	}
+	args = append(args, "IDLE", releasedIdle, "JUSTID")
+	if _, err := executeCommand(redis, args...); err != nil {
+		log.Println("Error nacking entries:", err.Error())
+		return err
+	}
+	return nil
+}
+
+func parseStreamLeaseId(leaseId string) (int64, int64, string, error) {
+	parts := strings.SplitN(leaseId, "-", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", ErrLeaseNotFound
+	}
+	first, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, "", ErrLeaseNotFound
+	}
+	last, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, "", ErrLeaseNotFound
+	}
+	return first, last, parts[2], nil
+}
+
+// pendingEntries returns the delivery counts of the entries between first and
+// last pending for the member
+func pendingEntries(redis *goredis.Redis, pipelineId string, consumerId string, first int64, last int64, memberId string) (map[int64]int64, error) {
+	reply, err := executeCommand(redis, "XPENDING", streamKey(pipelineId), consumerId, fmt.Sprintf("0-%d", first), fmt.Sprintf("0-%d", last), last-first+1, memberId)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	pending := make(map[int64]int64)
+	for _, entry := range reply.Multi {
+		if len(entry.Multi) < 4 {
+			continue
+		}
+		index, err := streamIndex(string(entry.Multi[0].Bulk))
+		if err != nil {
+			return nil, err
+		}
+		pending[index] = entry.Multi[3].Integer
+	}
+	return pending, nil
+}
+
+// AckLease acknowledges the entries of the lease still pending for the member
+func (b RedisStreamsBackend) AckLease(pipelineId string, consumerId string, leaseId string) error {
+	first, last, memberId, err := parseStreamLeaseId(leaseId)
+	if err != nil {
+		return err
+	}
+
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return err
+	}
+
+	pending, err := pendingEntries(redis, pipelineId, consumerId, first, last, memberId)
+	if err != nil {
+		log.Println("Error retrieving pending entries:", err.Error())
+		return err
+	}
+	if len(pending) == 0 {
+		return ErrLeaseNotFound
+	}
+
+	var ids []interface{}
+	for index := range pending {
+		ids = append(ids, fmt.Sprintf("0-%d", index))
+	}
+	if _, err := executeCommand(redis, append([]interface{}{"XACK", streamKey(pipelineId), consumerId}, ids...)...); err != nil {
+		log.Println("Error acknowledging entries:", err.Error())
+		return err
+	}
+	// entries acknowledged after a nack no longer wait for their redelivery
+	if _, err := executeCommand(redis, append([]interface{}{"ZREM", delayedKey(pipelineId, consumerId)}, ids...)...); err != nil {
+		log.Println("Error removing nacked entries:", err.Error())
+		return err
+	}
+	return nil
+}
+
+// PushDatapoint adds the datapoint to the stream right away, so ack makes no difference
+func (b RedisStreamsBackend) PushDatapoint(pipelineId string, value string, ack bool) (int64, error) {
+	_, last, err := b.PushDatapoints(pipelineId, []string{value}, ack)
+	return last, err
+}
+
+func (b RedisStreamsBackend) PushDatapoints(pipelineId string, values []string, ack bool) (int64, int64, error) {
+	if len(values) == 0 {
+		return 0, 0, nil
+	}
+
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return 0, 0, err
+	}
+
+	keys := []string{
+		streamKey(pipelineId),
+		"pipeline:" + pipelineId + ":statistics:" + formatDate(time.Now()),
+		"pipeline:" + pipelineId + ":bytes",
+		"pipeline:" + pipelineId + ":timeindex",
+		"pipeline:" + pipelineId + ":retention",
+	}
+	reply, err := evalScript(redis, streamsPushScript, keys, pushArgs(values))
+	if err != nil {
+		log.Println("Error adding datapoints to stream:", err.Error())
+		return 0, 0, err
+	}
+
+	id, err := reply.StringValue()
+	if err != nil {
+		return 0, 0, err
+	}
+	last, err := streamIndex(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	b.Broker.Publish(pipelineId)
+	return last - int64(len(values)) + 1, last, nil
+}
+
+func (b RedisStreamsBackend) ApplyRetention(pipelineId string, policy RetentionPolicy) (int64, error) {
+	redis, err := b.openConnection()
+	if err != nil {
+		log.Println("Error opening connection to redis:", err.Error())
+		return 0, err
+	}
+
+	keys := []string{streamKey(pipelineId), "pipeline:" + pipelineId + ":bytes", "pipeline:" + pipelineId + ":timeindex"}
+	reply, err := evalScript(redis, streamsRetentionScript, keys, retentionArgs(policy))
+	if err != nil {
+		log.Println("Error applying retention policy:", err.Error())
+		return 0, err
+	}
+	return reply.IntegerValue()
+}
+
+// executeCommand sends a raw command, turning error replies into errors
+func executeCommand(redis *goredis.Redis, args ...interface{}) (*goredis.Reply, error) {
+	reply, err := redis.ExecuteCommand(args...)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type == goredis.ErrorReply {
+		return nil, errors.New(reply.Error)
+	}
+	return reply, nil
+}
+
+// createStreamGroup creates the consumer group, starting at the beginning of
+// the stream, unless it already exists
+func createStreamGroup(redis *goredis.Redis, pipelineId string, consumerId string) error {
+	_, err := executeCommand(redis, "XGROUP", "CREATE", streamKey(pipelineId), consumerId, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// streamIndex returns the datapoint index of a stream entry id 0-<index>
+func streamIndex(id string) (int64, error) {
+	separator := strings.Index(id, "-")
+	if separator < 0 {
+		return 0, fmt.Errorf("invalid stream id \"%s\"", id)
+	}
+	return strconv.ParseInt(id[separator+1:], 10, 64)
+}
+
+type streamEntry struct {
+	index   int64
+	payload string
+}
+
+// readGroupEntries decodes the entries of an XREADGROUP reply, which nests them
+// within a [key, entries] pair per stream
+func readGroupEntries(reply *goredis.Reply) ([]streamEntry, error) {
+	if reply == nil || len(reply.Multi) == 0 || len(reply.Multi[0].Multi) != 2 {
+		return nil, nil
+	}
+	return streamEntries(reply.Multi[0].Multi[1])
+}
+
+// streamEntries decodes a list of [id, [field, value...]] entries as replied by XRANGE
+func streamEntries(reply *goredis.Reply) ([]streamEntry, error) {
+	var entries []streamEntry
+	for _, entryReply := range reply.Multi {
+		if len(entryReply.Multi) != 2 {
+			continue
+		}
+		index, err := streamIndex(string(entryReply.Multi[0].Bulk))
+		if err != nil {
+			return nil, err
+		}
+		entry := streamEntry{index: index}
+		fields := entryReply.Multi[1].Multi
+		for i := 0; i+1 < len(fields); i += 2 {
+			if string(fields[i].Bulk) == "payload" {
+				entry.payload = string(fields[i+1].Bulk)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// replyFields turns a flat [name, value, name, value...] reply into a map
+func replyFields(reply *goredis.Reply) map[string]*goredis.Reply {
+	fields := make(map[string]*goredis.Reply)
+	for i := 0; i+1 < len(reply.Multi); i += 2 {
+		fields[string(reply.Multi[i].Bulk)] = reply.Multi[i+1]
+	}
+	return fields
+}
+
+// currentStreamIndex returns the index of the last datapoint added to the stream
+func currentStreamIndex(redis *goredis.Redis, pipelineId string) (int64, error) {
+	reply, err := executeCommand(redis, "XINFO", "STREAM", streamKey(pipelineId))
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	lastGenerated, ok := replyFields(reply)["last-generated-id"]
+	if !ok {
+		return 0, errors.New("missing last-generated-id in stream information")
+	}
+	return streamIndex(string(lastGenerated.Bulk))
+}
+
+// firstPendingIndex returns the index of the first entry delivered to the group
+// but not acknowledged yet
+func firstPendingIndex(redis *goredis.Redis, pipelineId string, group string) (int64, error) {
+	reply, err := executeCommand(redis, "XPENDING", streamKey(pipelineId), group)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply.Multi) < 2 || reply.Multi[1].Bulk == nil {
+		return 0, errors.New("missing pending entries")
+	}
+	return streamIndex(string(reply.Multi[1].Bulk))
+}
+
+// findStreamGroup returns the consumer group of the consumer
+func findStreamGroup(redis *goredis.Redis, pipelineId string, consumerId string) (streamGroup, error) {
+	groups, err := streamGroups(redis, pipelineId)
+	if err != nil {
+		return streamGroup{}, err
+	}
+	for _, group := range groups {
+		if group.name == consumerId {
+			return group, nil
+		}
+	}
+	return streamGroup{}, ErrConsumerNotFound
+}
+
+type streamGroup struct {
+	name          string
+	lastDelivered int64
+	pending       int64
+}
+
+func streamGroups(redis *goredis.Redis, pipelineId string) ([]streamGroup, error) {
+	reply, err := executeCommand(redis, "XINFO", "GROUPS", streamKey(pipelineId))
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var groups []streamGroup
+	for _, groupReply := range reply.Multi {
+		fields := replyFields(groupReply)
+		group := streamGroup{}
+		if name, ok := fields["name"]; ok {
+			group.name = string(name.Bulk)
+		}
+		if pending, ok := fields["pending"]; ok {
+			group.pending = pending.Integer
+		}
+		if lastDelivered, ok := fields["last-delivered-id"]; ok {
+			group.lastDelivered, err = streamIndex(string(lastDelivered.Bulk))
+			if err != nil {
+				return nil, err
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"encoding/json"
+	"github.com/rcrowley/go-metrics"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// RetentionPolicies assigns retention policies to pipelines that don't define
+// a policy of their own, pipelines not listed get the default one
+type RetentionPolicies struct {
+	Default   RetentionPolicy            `json:"default"`
+	Pipelines map[string]RetentionPolicy `json:"pipelines"`
+}
+
+// ReadRetentionPolicies reads the policies from a json file like
+//
+//	{
+//	  "default": {"max_age": 604800},
+//	  "pipelines": {
+//	    "9d436fd2-fdeb-41e0-b110-09d31ddc2a50": {"max_datapoints": 100000, "delete_consumed": true}
+//	  }
+//	}
+func ReadRetentionPolicies(path string) (RetentionPolicies, error) {
+	policies := RetentionPolicies{}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return policies, err
+	}
+	err = json.Unmarshal(content, &policies)
+	return policies, err
+}
+
+func (p RetentionPolicies) Policy(pipelineId string) RetentionPolicy {
+	if policy, ok := p.Pipelines[pipelineId]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+// Retention is the cleanup job removing expired datapoints. Every interval it
+// applies the retention policy of each pipeline, which increases the first
+// datapoint pointer of the pipeline ever forward.
+type Retention struct {
+	Backend  Backend
+	Interval time.Duration
+	Policies RetentionPolicies
+}
+
+func (r Retention) Run() {
+	removed := metrics.NewCounter()
+	metrics.Register("retention", removed)
+
+	for {
+		time.Sleep(r.Interval)
+		r.Apply(removed)
+	}
+}
+
+// Apply runs the cleanup once for all pipelines, counting removed datapoints
+func (r Retention) Apply(removed metrics.Counter) {
+	pipelines, err := r.Backend.GetPipelines()
+	if err != nil {
+		log.Println("Error retrieving pipelines for retention:", err.Error())
+		return
+	}
+
+	for _, pipeline := range pipelines {
+		policy := r.Policies.Policy(pipeline.Id)
+		if pipeline.Retention != nil {
+			policy = *pipeline.Retention
+		}
+		if policy.IsEmpty() {
+			continue
+		}
+
+		count, err := r.Backend.ApplyRetention(pipeline.Id, policy)
+		if err != nil {
+			log.Printf("Error applying retention to pipeline %s: %s", pipeline.Id, err.Error())
+			continue
+		}
+		if count > 0 {
+			log.Printf("Removed %d datapoints from pipeline %s", count, pipeline.Id)
+			removed.Inc(count)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"sync/atomic"
+)
+
+// Status is the state of a backend as shown by turbined status
+type Status struct {
+	// name of the backend as configured, e.g. "redis"
+	Backend   string           `json:"backend"`
+	Pipelines []PipelineStatus `json:"pipelines"`
+	// writers of backends storing datapoints asynchronously
+	Writers *WriterStatus `json:"writers,omitempty"`
+	Redis   *RedisStatus  `json:"redis,omitempty"`
+}
+
+type PipelineStatus struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// datapoints retained in the pipeline
+	Datapoints int64 `json:"datapoints"`
+	// offset of the last datapoint stored
+	LastOffset int64      `json:"last_offset"`
+	Today      int64      `json:"today"`
+	Consumers  []Consumer `json:"consumers"`
+}
+
+type WriterStatus struct {
+	Size int64 `json:"size"`
+	// writers storing datapoints right now
+	Busy int64 `json:"busy"`
+}
+
+type RedisStatus struct {
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+	Version   string `json:"version,omitempty"`
+	// bytes used by Redis and the configured limit, 0 if unlimited
+	UsedMemory int64 `json:"used_memory"`
+	MaxMemory  int64 `json:"max_memory"`
+}
+
+// ReadStatus returns the status of the backend along with the datapoints and
+// consumers of every pipeline. The pipelines are left out if Redis can't be
+// reached.
+func ReadStatus(b Backend) (*Status, error) {
+	status, err := b.Status()
+	if err != nil {
+		return nil, err
+	}
+	if status.Redis != nil && !status.Redis.Connected {
+		return status, nil
+	}
+
+	pipelines, err := b.GetPipelines()
+	if err != nil {
+		return nil, err
+	}
+	status.Pipelines = []PipelineStatus{}
+	for _, pipeline := range pipelines {
+		first, last, err := b.DatapointOffsets(pipeline.Id)
+		if err == ErrPipelineNotFound {
+			// deleted in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		consumers, err := b.GetConsumers(pipeline.Id)
+		if err == ErrPipelineNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		status.Pipelines = append(status.Pipelines, PipelineStatus{
+			Id:         pipeline.Id,
+			Name:       pipeline.Name,
+			Datapoints: last - first,
+			LastOffset: last,
+			Today:      pipeline.PipelineStatistic.Today,
+			Consumers:  consumers,
+		})
+	}
+	return status, nil
+}
+
+// WriterPool counts the writers of a RedisBackend and how many of them are
+// storing datapoints
+type WriterPool struct {
+	size int64
+	busy int64
+}
+
+func (p *WriterPool) started() {
+	if p != nil {
+		atomic.AddInt64(&p.size, 1)
+	}
+}
+
+func (p *WriterPool) setBusy(busy bool) {
+	if p == nil {
+		return
+	}
+	if busy {
+		atomic.AddInt64(&p.busy, 1)
+	} else {
+		atomic.AddInt64(&p.busy, -1)
+	}
+}
+
+// status returns nil for a backend without writers
+func (p *WriterPool) status() *WriterStatus {
+	if p == nil {
+		return nil
+	}
+	return &WriterStatus{Size: atomic.LoadInt64(&p.size), Busy: atomic.LoadInt64(&p.busy)}
+}
@@ -0,0 +1,1058 @@
+// Package backendtest provides a conformance suite every backend.Backend
+// implementation is expected to pass. A backend is verified by running the
+// suite from a regular test with a factory returning a fresh, empty backend:
+//
+//	func TestMemoryBackend(t *testing.T) {
+//		backendtest.Run(t, func(t *testing.T) backend.Backend {
+//			return backend.NewMemoryBackend()
+//		})
+//	}
+//
+// The RedisBackend can be verified without a Redis server by pointing it at an
+// embedded stand-in such as github.com/alicebob/miniredis, loading the scripts
+// and starting a writer within the factory, the RedisStreamsBackend needs a
+// Redis 7 server instead. Datapoints pushed one after another are expected to
+// be read in the same order, so asynchronous backends have to keep that
+// order, e.g. by using a single writer.
+package backendtest
+
+import (
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory returns a new backend without any pipelines or datapoints
+type Factory func(t *testing.T) backend.Backend
+
+// how long to wait for datapoints written asynchronously to become visible
+const writeTimeout = 5 * time.Second
+
+// Run executes the whole conformance suite, each test against a new backend
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, b backend.Backend)
+	}{
+		{"CreatePipeline", testCreatePipeline},
+		{"CreatePipelineWithId", testCreatePipelineWithId},
+		{"GetPipelines", testGetPipelines},
+		{"UpdatePipeline", testUpdatePipeline},
+		{"DeletePipeline", testDeletePipeline},
+		{"UnknownPipeline", testUnknownPipeline},
+		{"Statistics", testStatistics},
+		{"EmptyPipeline", testEmptyPipeline},
+		{"ConsumerPointer", testConsumerPointer},
+		{"IndependentConsumers", testIndependentConsumers},
+		{"BatchLimit", testBatchLimit},
+		{"PopMax", testPopMax},
+		{"PopMaxBytes", testPopMaxBytes},
+		{"UnreadElements", testUnreadElements},
+		{"ConcurrentPushPop", testConcurrentPushPop},
+		{"ConcurrentSharedConsumer", testConcurrentSharedConsumer},
+		{"RetentionMaxDatapoints", testRetentionMaxDatapoints},
+		{"RetentionMaxAge", testRetentionMaxAge},
+		{"RetentionMaxBytes", testRetentionMaxBytes},
+		{"RetentionDeleteConsumed", testRetentionDeleteConsumed},
+		{"PipelineRetention", testPipelineRetention},
+		{"PushAcknowledged", testPushAcknowledged},
+		{"PushBatch", testPushBatch},
+		{"ManualCommit", testManualCommit},
+		{"ReadDatapoints", testReadDatapoints},
+		{"ConsumerLifecycle", testConsumerLifecycle},
+		{"SeekConsumer", testSeekConsumer},
+		{"Leases", testLeases},
+		{"LeaseExpiry", testLeaseExpiry},
+		{"NackLease", testNackLease},
+		{"DeadLetter", testDeadLetter},
+		{"Notifications", testNotifications},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, factory(t))
+		})
+	}
+}
+
+func createPipeline(t *testing.T, b backend.Backend) *backend.Pipeline {
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "Awesome Pipeline 1", Description: "Data of awesome sensors"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	return pipeline
+}
+
+// push writes the values in order, verifying the returned indexes when the
+// backend reports them, and waits until all of them are stored
+func push(t *testing.T, b backend.Backend, pipelineId string, values ...string) {
+	before := intake(t, b, pipelineId)
+
+	var lastIndex int64
+	for _, value := range values {
+		index, err := b.PushDatapoint(pipelineId, value, false)
+		if err != nil {
+			t.Fatalf("PushDatapoint failed: %s", err.Error())
+		}
+		// asynchronous backends report 0 instead of the index
+		if index != 0 {
+			if lastIndex != 0 && index != lastIndex+1 {
+				t.Fatalf("PushDatapoint returned index %d after %d", index, lastIndex)
+			}
+			lastIndex = index
+		}
+	}
+
+	awaitIntake(t, b, pipelineId, before+int64(len(values)))
+}
+
+func intake(t *testing.T, b backend.Backend, pipelineId string) int64 {
+	statistic, err := b.RetrievePipelineStatistic(pipelineId)
+	if err != nil {
+		t.Fatalf("RetrievePipelineStatistic failed: %s", err.Error())
+	}
+	return statistic.Today
+}
+
+// awaitIntake waits until the statistic of today shows the expected intake
+func awaitIntake(t *testing.T, b backend.Backend, pipelineId string, expected int64) {
+	deadline := time.Now().Add(writeTimeout)
+	for {
+		current := intake(t, b, pipelineId)
+		if current == expected {
+			return
+		}
+		if current > expected || time.Now().After(deadline) {
+			t.Fatalf("expected an intake of %d datapoints but got %d", expected, current)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func pop(t *testing.T, b backend.Backend, pipelineId string, consumerId string) []string {
+	return popLimited(t, b, pipelineId, consumerId, backend.PopLimit{})
+}
+
+func popLimited(t *testing.T, b backend.Backend, pipelineId string, consumerId string, limit backend.PopLimit) []string {
+	datapoints, err := b.PopDatapoint(pipelineId, consumerId, limit)
+	if err != nil {
+		t.Fatalf("PopDatapoint failed: %s", err.Error())
+	}
+	return datapoints
+}
+
+func values(prefix string, count int) []string {
+	var values []string
+	for i := 0; i < count; i++ {
+		values = append(values, fmt.Sprintf("%s %d", prefix, i))
+	}
+	return values
+}
+
+func expectDatapoints(t *testing.T, actual []string, expected []string) {
+	if len(actual) != len(expected) {
+		t.Fatalf("expected datapoints %v but got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("expected datapoints %v but got %v", expected, actual)
+		}
+	}
+}
+
+func consumer(t *testing.T, b backend.Backend, pipelineId string, consumerId string) backend.Consumer {
+	pipeline, err := b.GetPipeline(pipelineId)
+	if err != nil {
+		t.Fatalf("GetPipeline failed: %s", err.Error())
+	}
+	for _, consumer := range pipeline.Consumers {
+		if consumer.Id == consumerId {
+			return consumer
+		}
+	}
+	t.Fatalf("consumer %s not found in %v", consumerId, pipeline.Consumers)
+	return backend.Consumer{}
+}
+
+func testCreatePipeline(t *testing.T, b backend.Backend) {
+	created := createPipeline(t, b)
+	if created.Id == "" {
+		t.Fatal("CreatePipeline didn't assign an id")
+	}
+
+	pipeline, err := b.GetPipeline(created.Id)
+	if err != nil {
+		t.Fatalf("GetPipeline failed: %s", err.Error())
+	}
+	if pipeline.Id != created.Id || pipeline.Name != "Awesome Pipeline 1" || pipeline.Description != "Data of awesome sensors" {
+		t.Fatalf("GetPipeline returned %+v for %+v", pipeline, created)
+	}
+	if len(pipeline.Consumers) != 0 {
+		t.Fatalf("new pipeline has consumers %v", pipeline.Consumers)
+	}
+}
+
+func testCreatePipelineWithId(t *testing.T, b backend.Backend) {
+	created, err := b.CreatePipeline(&backend.Pipeline{Id: "sensors", Name: "Sensors"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	if created.Id != "sensors" {
+		t.Fatalf("CreatePipeline replaced id with %s", created.Id)
+	}
+
+	pipeline, err := b.GetPipeline("sensors")
+	if err != nil {
+		t.Fatalf("GetPipeline failed: %s", err.Error())
+	}
+	if pipeline.Name != "Sensors" {
+		t.Fatalf("GetPipeline returned %+v", pipeline)
+	}
+}
+
+func testGetPipelines(t *testing.T, b backend.Backend) {
+	pipelines, err := b.GetPipelines()
+	if err != nil {
+		t.Fatalf("GetPipelines failed: %s", err.Error())
+	}
+	if len(pipelines) != 0 {
+		t.Fatalf("new backend has pipelines %v", pipelines)
+	}
+
+	first := createPipeline(t, b)
+	second := createPipeline(t, b)
+
+	pipelines, err = b.GetPipelines()
+	if err != nil {
+		t.Fatalf("GetPipelines failed: %s", err.Error())
+	}
+	found := make(map[string]bool)
+	for _, pipeline := range pipelines {
+		found[pipeline.Id] = true
+		if len(pipeline.PipelineStatistic.Statistics) != 10 {
+			t.Fatalf("pipeline %s lacks statistics: %+v", pipeline.Id, pipeline.PipelineStatistic)
+		}
+	}
+	if len(pipelines) != 2 || !found[first.Id] || !found[second.Id] {
+		t.Fatalf("expected pipelines %s and %s but got %v", first.Id, second.Id, pipelines)
+	}
+}
+
+func testUpdatePipeline(t *testing.T, b backend.Backend) {
+	created := createPipeline(t, b)
+
+	updated, err := b.UpdatePipeline(created.Id, &backend.Pipeline{Name: "Renamed", Description: "Changed"})
+	if err != nil {
+		t.Fatalf("UpdatePipeline failed: %s", err.Error())
+	}
+	if updated.Id != created.Id || updated.Name != "Renamed" || updated.Description != "Changed" {
+		t.Fatalf("UpdatePipeline returned %+v", updated)
+	}
+
+	pipeline, err := b.GetPipeline(created.Id)
+	if err != nil {
+		t.Fatalf("GetPipeline failed: %s", err.Error())
+	}
+	if pipeline.Name != "Renamed" || pipeline.Description != "Changed" {
+		t.Fatalf("GetPipeline returned %+v after update", pipeline)
+	}
+}
+
+func testDeletePipeline(t *testing.T, b backend.Backend) {
+	created := createPipeline(t, b)
+
+	deleted, err := b.DeletePipeline(created.Id)
+	if err != nil || !deleted {
+		t.Fatalf("DeletePipeline returned %v, %v", deleted, err)
+	}
+
+	if _, err := b.GetPipeline(created.Id); err == nil {
+		t.Fatal("GetPipeline succeeded for a deleted pipeline")
+	}
+	pipelines, err := b.GetPipelines()
+	if err != nil {
+		t.Fatalf("GetPipelines failed: %s", err.Error())
+	}
+	if len(pipelines) != 0 {
+		t.Fatalf("deleted pipeline is still listed: %v", pipelines)
+	}
+}
+
+func testUnknownPipeline(t *testing.T, b backend.Backend) {
+	if _, err := b.GetPipeline("unknown"); err != backend.ErrPipelineNotFound {
+		t.Fatalf("GetPipeline returned %v instead of ErrPipelineNotFound", err)
+	}
+	if _, err := b.UpdatePipeline("unknown", &backend.Pipeline{Name: "Unknown"}); err != backend.ErrPipelineNotFound {
+		t.Fatalf("UpdatePipeline returned %v instead of ErrPipelineNotFound", err)
+	}
+}
+
+func testStatistics(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	push(t, b, pipeline.Id, values("Event", 3)...)
+
+	statistic, err := b.RetrievePipelineStatistic(pipeline.Id)
+	if err != nil {
+		t.Fatalf("RetrievePipelineStatistic failed: %s", err.Error())
+	}
+	if statistic.Today != 3 {
+		t.Fatalf("expected an intake of 3 today but got %d", statistic.Today)
+	}
+	if len(statistic.Statistics) != 10 {
+		t.Fatalf("expected statistics for 10 days but got %d", len(statistic.Statistics))
+	}
+	now := time.Now()
+	today := fmt.Sprintf("%d-%02d-%02d", now.Year(), now.Month(), now.Day())
+	if statistic.Statistics[0].Date != today || statistic.Statistics[0].Intake != 3 {
+		t.Fatalf("expected today's intake first but got %+v", statistic.Statistics[0])
+	}
+	if statistic.ChangeRate != 0 {
+		t.Fatalf("expected no change rate without intake yesterday but got %f", statistic.ChangeRate)
+	}
+
+	retrieved, err := b.GetPipeline(pipeline.Id)
+	if err != nil {
+		t.Fatalf("GetPipeline failed: %s", err.Error())
+	}
+	if retrieved.PipelineStatistic.Today != 3 {
+		t.Fatalf("GetPipeline reports an intake of %d", retrieved.PipelineStatistic.Today)
+	}
+}
+
+func testEmptyPipeline(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+
+	if datapoints := pop(t, b, pipeline.Id, "consumer1"); len(datapoints) != 0 {
+		t.Fatalf("empty pipeline returned %v", datapoints)
+	}
+	if unread := consumer(t, b, pipeline.Id, "consumer1").UnreadElements; unread != 0 {
+		t.Fatalf("consumer of an empty pipeline has %d unread elements", unread)
+	}
+
+	// the consumer must still see datapoints pushed after the first pop
+	push(t, b, pipeline.Id, "Event 1")
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), []string{"Event 1"})
+}
+
+func testConsumerPointer(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	push(t, b, pipeline.Id, values("Event", 5)...)
+
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), values("Event", 5))
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), nil)
+
+	push(t, b, pipeline.Id, "Event 5", "Event 6")
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), []string{"Event 5", "Event 6"})
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), nil)
+}
+
+func testIndependentConsumers(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	push(t, b, pipeline.Id, values("Event", 3)...)
+
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), values("Event", 3))
+	push(t, b, pipeline.Id, "Event 3")
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer2"), values("Event", 4))
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), []string{"Event 3"})
+}
+
+func testBatchLimit(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	events := values("Event", 25)
+	push(t, b, pipeline.Id, events...)
+
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events[0:10])
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events[10:20])
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events[20:25])
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), nil)
+}
+
+func testPopMax(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	events := values("Event", 30)
+	push(t, b, pipeline.Id, events...)
+
+	expectDatapoints(t, popLimited(t, b, pipeline.Id, "consumer1", backend.PopLimit{Max: 25}), events[0:25])
+	expectDatapoints(t, popLimited(t, b, pipeline.Id, "consumer1", backend.PopLimit{Max: 2}), events[25:27])
+	expectDatapoints(t, popLimited(t, b, pipeline.Id, "consumer1", backend.PopLimit{Max: 25}), events[27:30])
+}
+
+// testPopMaxBytes verifies that a pop stops before exceeding the size limit,
+// but always returns at least one datapoint
+func testPopMaxBytes(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	// every value has 7 bytes
+	events := values("Event", 6)
+	push(t, b, pipeline.Id, events...)
+
+	expectDatapoints(t, popLimited(t, b, pipeline.Id, "consumer1", backend.PopLimit{MaxBytes: 20}), events[0:2])
+	expectDatapoints(t, popLimited(t, b, pipeline.Id, "consumer1", backend.PopLimit{MaxBytes: 3}), events[2:3])
+	expectDatapoints(t, popLimited(t, b, pipeline.Id, "consumer1", backend.PopLimit{Max: 2, MaxBytes: 100}), events[3:5])
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events[5:6])
+}
+
+func testUnreadElements(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	push(t, b, pipeline.Id, values("Event", 15)...)
+
+	pop(t, b, pipeline.Id, "consumer1")
+	if unread := consumer(t, b, pipeline.Id, "consumer1").UnreadElements; unread != 5 {
+		t.Fatalf("expected 5 unread elements but got %d", unread)
+	}
+
+	pop(t, b, pipeline.Id, "consumer1")
+	if unread := consumer(t, b, pipeline.Id, "consumer1").UnreadElements; unread != 0 {
+		t.Fatalf("expected no unread elements but got %d", unread)
+	}
+}
+
+// testConcurrentPushPop pushes from several producers while consumers with
+// distinct ids read. Every consumer has to see every datapoint exactly once.
+func testConcurrentPushPop(t *testing.T, b backend.Backend) {
+	const producers = 4
+	const datapointsPerProducer = 50
+	const consumers = 3
+
+	pipeline := createPipeline(t, b)
+	before := intake(t, b, pipeline.Id)
+
+	var producing sync.WaitGroup
+	errs := make(chan error, producers+consumers)
+	for p := 0; p < producers; p++ {
+		producing.Add(1)
+		go func(p int) {
+			defer producing.Done()
+			for i := 0; i < datapointsPerProducer; i++ {
+				if _, err := b.PushDatapoint(pipeline.Id, fmt.Sprintf("%d %d", p, i), false); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p)
+	}
+
+	var consuming sync.WaitGroup
+	received := make([][]string, consumers)
+	for c := 0; c < consumers; c++ {
+		consuming.Add(1)
+		go func(c int) {
+			defer consuming.Done()
+			deadline := time.Now().Add(writeTimeout)
+			for len(received[c]) < producers*datapointsPerProducer && time.Now().Before(deadline) {
+				datapoints, err := b.PopDatapoint(pipeline.Id, fmt.Sprintf("consumer%d", c), backend.PopLimit{})
+				if err != nil {
+					errs <- err
+					return
+				}
+				received[c] = append(received[c], datapoints...)
+				if len(datapoints) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}(c)
+	}
+
+	producing.Wait()
+	consuming.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent push or pop failed: %s", err.Error())
+	}
+	awaitIntake(t, b, pipeline.Id, before+producers*datapointsPerProducer)
+
+	for c, datapoints := range received {
+		if len(datapoints) != producers*datapointsPerProducer {
+			t.Fatalf("consumer%d received %d datapoints instead of %d", c, len(datapoints), producers*datapointsPerProducer)
+		}
+		seen := make(map[string]bool)
+		for _, datapoint := range datapoints {
+			if seen[datapoint] {
+				t.Fatalf("consumer%d received datapoint %s twice", c, datapoint)
+			}
+			seen[datapoint] = true
+		}
+	}
+}
+
+// testConcurrentSharedConsumer pops with several goroutines using the same
+// consumer id. Together they have to see every datapoint exactly once.
+func testConcurrentSharedConsumer(t *testing.T, b backend.Backend) {
+	const datapoints = 200
+	const poppers = 4
+
+	pipeline := createPipeline(t, b)
+	push(t, b, pipeline.Id, values("datapoint", datapoints)...)
+
+	var popping sync.WaitGroup
+	var mutex sync.Mutex
+	seen := make(map[string]int)
+	errs := make(chan error, poppers)
+	for p := 0; p < poppers; p++ {
+		popping.Add(1)
+		go func() {
+			defer popping.Done()
+			deadline := time.Now().Add(writeTimeout)
+			for time.Now().Before(deadline) {
+				popped, err := b.PopDatapoint(pipeline.Id, "shared", backend.PopLimit{Max: 3})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(popped) == 0 {
+					return
+				}
+				mutex.Lock()
+				for _, datapoint := range popped {
+					seen[datapoint]++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	popping.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent pop failed: %s", err.Error())
+	}
+
+	for _, datapoint := range values("datapoint", datapoints) {
+		if seen[datapoint] != 1 {
+			t.Fatalf("datapoint %s was received %d times", datapoint, seen[datapoint])
+		}
+	}
+}
+
+func applyRetention(t *testing.T, b backend.Backend, pipelineId string, policy backend.RetentionPolicy) int64 {
+	removed, err := b.ApplyRetention(pipelineId, policy)
+	if err != nil {
+		t.Fatalf("ApplyRetention failed: %s", err.Error())
+	}
+	return removed
+}
+
+func testRetentionMaxDatapoints(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	events := values("Event", 15)
+	push(t, b, pipeline.Id, events...)
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1")[:3], events[:3])
+
+	if removed := applyRetention(t, b, pipeline.Id, backend.RetentionPolicy{MaxDatapoints: 5}); removed != 10 {
+		t.Fatalf("expected 10 removed datapoints but got %d", removed)
+	}
+	if removed := applyRetention(t, b, pipeline.Id, backend.RetentionPolicy{MaxDatapoints: 5}); removed != 0 {
+		t.Fatalf("second run removed %d datapoints", removed)
+	}
+
+	// consumers behind the first datapoint continue with the oldest one left
+	if unread := consumer(t, b, pipeline.Id, "consumer1").UnreadElements; unread != 5 {
+		t.Fatalf("expected 5 unread elements but got %d", unread)
+	}
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events[10:])
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer2"), events[10:])
+
+	push(t, b, pipeline.Id, "Event 15")
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), []string{"Event 15"})
+}
+
+func testRetentionMaxAge(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	events := values("Event", 5)
+	push(t, b, pipeline.Id, events...)
+
+	if removed := applyRetention(t, b, pipeline.Id, backend.RetentionPolicy{MaxAge: 3600}); removed != 0 {
+		t.Fatalf("removed %d datapoints younger than the maximum age", removed)
+	}
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events)
+}
+
+func testRetentionMaxBytes(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	var events []string
+	for i := 0; i < 10; i++ {
+		events = append(events, fmt.Sprintf("%0100d", i))
+	}
+	push(t, b, pipeline.Id, events...)
+
+	removed := applyRetention(t, b, pipeline.Id, backend.RetentionPolicy{MaxBytes: 500})
+	// backends may count some overhead per datapoint
+	if removed < 5 || removed > 9 {
+		t.Fatalf("expected 5 to 9 removed datapoints but got %d", removed)
+	}
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events[removed:])
+}
+
+func testRetentionDeleteConsumed(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	events := values("Event", 15)
+	push(t, b, pipeline.Id, events...)
+
+	if removed := applyRetention(t, b, pipeline.Id, backend.RetentionPolicy{DeleteConsumed: true}); removed != 0 {
+		t.Fatalf("removed %d datapoints without any consumer", removed)
+	}
+
+	pop(t, b, pipeline.Id, "consumer1")
+	pop(t, b, pipeline.Id, "consumer1")
+	pop(t, b, pipeline.Id, "consumer2")
+
+	if removed := applyRetention(t, b, pipeline.Id, backend.RetentionPolicy{DeleteConsumed: true}); removed != 10 {
+		t.Fatalf("expected 10 removed datapoints but got %d", removed)
+	}
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer2"), events[10:])
+}
+
+func testPipelineRetention(t *testing.T, b backend.Backend) {
+	created, err := b.CreatePipeline(&backend.Pipeline{Name: "Limited", Retention: &backend.RetentionPolicy{MaxDatapoints: 5, MaxAge: 3600}})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+
+	pipeline, err := b.GetPipeline(created.Id)
+	if err != nil {
+		t.Fatalf("GetPipeline failed: %s", err.Error())
+	}
+	if pipeline.Retention == nil || pipeline.Retention.MaxDatapoints != 5 || pipeline.Retention.MaxAge != 3600 {
+		t.Fatalf("GetPipeline returned retention %+v", pipeline.Retention)
+	}
+
+	// the policy is enforced when writing
+	events := values("Event", 8)
+	push(t, b, created.Id, events...)
+	expectDatapoints(t, pop(t, b, created.Id, "consumer1"), events[3:])
+
+	updated, err := b.UpdatePipeline(created.Id, &backend.Pipeline{Name: "Unlimited"})
+	if err != nil {
+		t.Fatalf("UpdatePipeline failed: %s", err.Error())
+	}
+	if updated.Retention != nil {
+		t.Fatalf("UpdatePipeline kept retention %+v", updated.Retention)
+	}
+
+	more := values("More", 4)
+	push(t, b, created.Id, more...)
+	expectDatapoints(t, pop(t, b, created.Id, "consumer2"), append(events[3:], more...))
+}
+
+// testPushAcknowledged verifies that an acknowledged push reports the index of
+// the datapoint, which is readable as soon as the push returns
+func testPushAcknowledged(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+
+	events := values("Event", 3)
+	for i, value := range events {
+		index, err := b.PushDatapoint(pipeline.Id, value, true)
+		if err != nil {
+			t.Fatalf("PushDatapoint failed: %s", err.Error())
+		}
+		if index != int64(i+1) {
+			t.Fatalf("PushDatapoint returned index %d instead of %d", index, i+1)
+		}
+	}
+
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events)
+}
+
+// testPushBatch verifies that a batch gets consecutive indexes and is read in
+// order, just like datapoints pushed one by one
+func testPushBatch(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+
+	push(t, b, pipeline.Id, "Single")
+	batch := values("Event", 5)
+	first, last, err := b.PushDatapoints(pipeline.Id, batch, true)
+	if err != nil {
+		t.Fatalf("PushDatapoints failed: %s", err.Error())
+	}
+	if first != 2 || last != 6 {
+		t.Fatalf("PushDatapoints returned range %d-%d instead of 2-6", first, last)
+	}
+
+	first, last, err = b.PushDatapoints(pipeline.Id, nil, true)
+	if err != nil {
+		t.Fatalf("PushDatapoints of an empty batch failed: %s", err.Error())
+	}
+	if first != 0 || last != 0 {
+		t.Fatalf("PushDatapoints of an empty batch returned range %d-%d", first, last)
+	}
+
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), append([]string{"Single"}, batch...))
+	if statistic := intake(t, b, pipeline.Id); statistic != 6 {
+		t.Fatalf("expected an intake of 6 but got %d", statistic)
+	}
+}
+
+func peek(t *testing.T, b backend.Backend, pipelineId string, consumerId string, limit backend.PopLimit) []backend.OffsetDatapoint {
+	datapoints, err := b.PeekDatapoints(pipelineId, consumerId, limit)
+	if err != nil {
+		t.Fatalf("PeekDatapoints failed: %s", err.Error())
+	}
+	return datapoints
+}
+
+func expectOffsets(t *testing.T, actual []backend.OffsetDatapoint, first int64, expected []string) {
+	if len(actual) != len(expected) {
+		t.Fatalf("expected datapoints %v but got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i].Offset != first+int64(i) || actual[i].Value != expected[i] {
+			t.Fatalf("expected datapoint %d at offset %d but got %v", i, first+int64(i), actual)
+		}
+	}
+}
+
+func commit(t *testing.T, b backend.Backend, pipelineId string, consumerId string, offset int64) {
+	if err := b.CommitOffset(pipelineId, consumerId, offset); err != nil {
+		t.Fatalf("CommitOffset failed: %s", err.Error())
+	}
+}
+
+// testManualCommit verifies that peeking leaves the consumer pointer in place
+// until the consumer commits the offset of the last datapoint processed
+func testManualCommit(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	events := values("Event", 5)
+	push(t, b, pipeline.Id, events...)
+
+	expectOffsets(t, peek(t, b, pipeline.Id, "consumer1", backend.PopLimit{Max: 3}), 1, events[0:3])
+	expectOffsets(t, peek(t, b, pipeline.Id, "consumer1", backend.PopLimit{Max: 3}), 1, events[0:3])
+	if unread := consumer(t, b, pipeline.Id, "consumer1").UnreadElements; unread != 5 {
+		t.Fatalf("expected 5 unread elements after peeking but got %d", unread)
+	}
+
+	commit(t, b, pipeline.Id, "consumer1", 2)
+	expectOffsets(t, peek(t, b, pipeline.Id, "consumer1", backend.PopLimit{}), 3, events[2:5])
+
+	// committing an older offset doesn't move the consumer back
+	commit(t, b, pipeline.Id, "consumer1", 1)
+	expectOffsets(t, peek(t, b, pipeline.Id, "consumer1", backend.PopLimit{Max: 1}), 3, events[2:3])
+
+	if err := b.CommitOffset(pipeline.Id, "consumer1", 6); err != backend.ErrInvalidOffset {
+		t.Fatalf("CommitOffset beyond the last datapoint returned %v", err)
+	}
+
+	commit(t, b, pipeline.Id, "consumer1", 5)
+	expectOffsets(t, peek(t, b, pipeline.Id, "consumer1", backend.PopLimit{}), 0, nil)
+	if unread := consumer(t, b, pipeline.Id, "consumer1").UnreadElements; unread != 0 {
+		t.Fatalf("expected no unread elements after committing but got %d", unread)
+	}
+}
+
+func read(t *testing.T, b backend.Backend, pipelineId string, offset int64, limit backend.PopLimit) []backend.OffsetDatapoint {
+	datapoints, err := b.ReadDatapoints(pipelineId, offset, limit)
+	if err != nil {
+		t.Fatalf("ReadDatapoints failed: %s", err.Error())
+	}
+	return datapoints
+}
+
+func expectDatapointOffsets(t *testing.T, b backend.Backend, pipelineId string, first int64, last int64) {
+	actualFirst, actualLast, err := b.DatapointOffsets(pipelineId)
+	if err != nil {
+		t.Fatalf("DatapointOffsets failed: %s", err.Error())
+	}
+	if actualFirst != first || actualLast != last {
+		t.Fatalf("expected datapoint offsets %d to %d but got %d to %d", first, last, actualFirst, actualLast)
+	}
+}
+
+// testReadDatapoints verifies reading by offset, which neither needs nor
+// moves a consumer
+func testReadDatapoints(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	expectDatapointOffsets(t, b, pipeline.Id, 0, 0)
+
+	events := values("Event", 10)
+	push(t, b, pipeline.Id, events...)
+	expectDatapointOffsets(t, b, pipeline.Id, 0, 10)
+
+	expectOffsets(t, read(t, b, pipeline.Id, 0, backend.PopLimit{Max: 3}), 1, events[0:3])
+	expectOffsets(t, read(t, b, pipeline.Id, 7, backend.PopLimit{}), 8, events[7:])
+	expectOffsets(t, read(t, b, pipeline.Id, 10, backend.PopLimit{}), 0, nil)
+	if consumers, err := b.GetConsumers(pipeline.Id); err != nil || len(consumers) != 0 {
+		t.Fatalf("expected no consumers after reading but got %v (%v)", consumers, err)
+	}
+
+	if removed := applyRetention(t, b, pipeline.Id, backend.RetentionPolicy{MaxDatapoints: 4}); removed != 6 {
+		t.Fatalf("expected 6 removed datapoints but got %d", removed)
+	}
+	expectDatapointOffsets(t, b, pipeline.Id, 6, 10)
+	// reads before the first datapoint continue with the oldest one left
+	expectOffsets(t, read(t, b, pipeline.Id, 2, backend.PopLimit{}), 7, events[6:])
+}
+
+func testConsumerLifecycle(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	push(t, b, pipeline.Id, values("Event", 3)...)
+
+	created, err := b.CreateConsumer(pipeline.Id, "consumer1")
+	if err != nil {
+		t.Fatalf("CreateConsumer failed: %s", err.Error())
+	}
+	if created.Id != "consumer1" || created.UnreadElements != 3 || created.Offset != 0 {
+		t.Fatalf("CreateConsumer returned %+v", created)
+	}
+	if _, err := b.CreateConsumer(pipeline.Id, "consumer1"); err != backend.ErrConsumerExists {
+		t.Fatalf("CreateConsumer of an existing consumer returned %v", err)
+	}
+	if _, err := b.CreateConsumer("unknown", "consumer1"); err != backend.ErrPipelineNotFound {
+		t.Fatalf("CreateConsumer of an unknown pipeline returned %v", err)
+	}
+
+	// consumers are also created by reading
+	pop(t, b, pipeline.Id, "consumer2")
+
+	consumers, err := b.GetConsumers(pipeline.Id)
+	if err != nil {
+		t.Fatalf("GetConsumers failed: %s", err.Error())
+	}
+	if len(consumers) != 2 || consumers[0].Id != "consumer1" || consumers[1].Id != "consumer2" {
+		t.Fatalf("GetConsumers returned %+v", consumers)
+	}
+	if consumers[1].Offset != 3 || consumers[1].UnreadElements != 0 {
+		t.Fatalf("GetConsumers returned consumer %+v after reading everything", consumers[1])
+	}
+
+	if _, err := b.DeleteConsumer(pipeline.Id, "consumer1"); err != nil {
+		t.Fatalf("DeleteConsumer failed: %s", err.Error())
+	}
+	if _, err := b.DeleteConsumer(pipeline.Id, "consumer1"); err != backend.ErrConsumerNotFound {
+		t.Fatalf("DeleteConsumer of a deleted consumer returned %v", err)
+	}
+	consumers, err = b.GetConsumers(pipeline.Id)
+	if err != nil {
+		t.Fatalf("GetConsumers failed: %s", err.Error())
+	}
+	if len(consumers) != 1 || consumers[0].Id != "consumer2" {
+		t.Fatalf("GetConsumers returned %+v after deleting a consumer", consumers)
+	}
+	if _, err := b.GetConsumers("unknown"); err != backend.ErrPipelineNotFound {
+		t.Fatalf("GetConsumers of an unknown pipeline returned %v", err)
+	}
+}
+
+func seek(t *testing.T, b backend.Backend, pipelineId string, consumerId string, seek backend.Seek) *backend.Consumer {
+	consumer, err := b.SeekConsumer(pipelineId, consumerId, seek)
+	if err != nil {
+		t.Fatalf("SeekConsumer failed: %s", err.Error())
+	}
+	return consumer
+}
+
+func testSeekConsumer(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	events := values("Event", 5)
+	push(t, b, pipeline.Id, events...)
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events)
+
+	if consumer := seek(t, b, pipeline.Id, "consumer1", backend.Seek{Position: backend.SeekBeginning}); consumer.UnreadElements != 5 {
+		t.Fatalf("SeekConsumer to the beginning returned %+v", consumer)
+	}
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events)
+
+	seek(t, b, pipeline.Id, "consumer1", backend.Seek{Position: backend.SeekOffset, Offset: 4})
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events[3:])
+
+	// seeking right after the last datapoint waits for the next one
+	seek(t, b, pipeline.Id, "consumer1", backend.Seek{Position: backend.SeekOffset, Offset: 6})
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), nil)
+	if _, err := b.SeekConsumer(pipeline.Id, "consumer1", backend.Seek{Position: backend.SeekOffset, Offset: 7}); err != backend.ErrInvalidOffset {
+		t.Fatalf("SeekConsumer beyond the last datapoint returned %v", err)
+	}
+
+	seek(t, b, pipeline.Id, "consumer1", backend.Seek{Position: backend.SeekTimestamp, Timestamp: time.Now().Add(-time.Hour)})
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), events)
+
+	seek(t, b, pipeline.Id, "consumer1", backend.Seek{Position: backend.SeekTimestamp, Timestamp: time.Now().Add(time.Hour)})
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), nil)
+
+	seek(t, b, pipeline.Id, "consumer1", backend.Seek{Position: backend.SeekBeginning})
+	if consumer := seek(t, b, pipeline.Id, "consumer1", backend.Seek{Position: backend.SeekEnd}); consumer.UnreadElements != 0 || consumer.Offset != 5 {
+		t.Fatalf("SeekConsumer to the end returned %+v", consumer)
+	}
+
+	if _, err := b.SeekConsumer(pipeline.Id, "consumer2", backend.Seek{Position: backend.SeekEnd}); err != backend.ErrConsumerNotFound {
+		t.Fatalf("SeekConsumer of an unknown consumer returned %v", err)
+	}
+	if _, err := b.SeekConsumer(pipeline.Id, "consumer1", backend.Seek{Position: "middle"}); err != backend.ErrInvalidSeek {
+		t.Fatalf("SeekConsumer to an unknown position returned %v", err)
+	}
+}
+
+func lease(t *testing.T, b backend.Backend, pipelineId string, memberId string, limit backend.PopLimit, timeout time.Duration) *backend.Lease {
+	lease, err := b.LeaseDatapoints(pipelineId, "group1", memberId, limit, timeout)
+	if err != nil {
+		t.Fatalf("LeaseDatapoints failed: %s", err.Error())
+	}
+	return lease
+}
+
+func ack(t *testing.T, b backend.Backend, pipelineId string, lease *backend.Lease) {
+	if err := b.AckLease(pipelineId, "group1", lease.Id); err != nil {
+		t.Fatalf("AckLease failed: %s", err.Error())
+	}
+}
+
+// testLeases verifies that members of a consumer get distinct datapoints and
+// that the consumer pointer only moves over acknowledged leases
+func testLeases(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	events := values("Event", 6)
+	push(t, b, pipeline.Id, events...)
+
+	first := lease(t, b, pipeline.Id, "member1", backend.PopLimit{Max: 3}, time.Minute)
+	if first == nil || first.Member != "member1" {
+		t.Fatalf("LeaseDatapoints returned %+v", first)
+	}
+	expectOffsets(t, first.Datapoints, 1, events[0:3])
+	second := lease(t, b, pipeline.Id, "member2", backend.PopLimit{Max: 3}, time.Minute)
+	if second == nil {
+		t.Fatal("LeaseDatapoints returned no lease for the remaining datapoints")
+	}
+	expectOffsets(t, second.Datapoints, 4, events[3:6])
+	if third := lease(t, b, pipeline.Id, "member3", backend.PopLimit{}, time.Minute); third != nil {
+		t.Fatalf("LeaseDatapoints returned %+v although everything is leased", third)
+	}
+
+	ack(t, b, pipeline.Id, second)
+	if unread := consumer(t, b, pipeline.Id, "group1").UnreadElements; unread != 6 {
+		t.Fatalf("expected 6 unread elements while the first lease is outstanding but got %d", unread)
+	}
+	ack(t, b, pipeline.Id, first)
+	if unread := consumer(t, b, pipeline.Id, "group1").UnreadElements; unread != 0 {
+		t.Fatalf("expected no unread elements after acknowledging all leases but got %d", unread)
+	}
+
+	if err := b.AckLease(pipeline.Id, "group1", first.Id); err != backend.ErrLeaseNotFound {
+		t.Fatalf("AckLease of an acknowledged lease returned %v", err)
+	}
+}
+
+// testLeaseExpiry verifies that an expired lease is handed to the next member
+func testLeaseExpiry(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	events := values("Event", 3)
+	push(t, b, pipeline.Id, events...)
+
+	const timeout = 50 * time.Millisecond
+	expired := lease(t, b, pipeline.Id, "member1", backend.PopLimit{}, timeout)
+	if expired == nil {
+		t.Fatal("LeaseDatapoints returned no lease")
+	}
+	expectOffsets(t, expired.Datapoints, 1, events)
+
+	time.Sleep(2 * timeout)
+	redelivered := lease(t, b, pipeline.Id, "member2", backend.PopLimit{}, timeout)
+	if redelivered == nil || redelivered.Member != "member2" {
+		t.Fatalf("LeaseDatapoints returned %+v instead of the expired lease", redelivered)
+	}
+	expectOffsets(t, redelivered.Datapoints, 1, events)
+
+	ack(t, b, pipeline.Id, redelivered)
+	if unread := consumer(t, b, pipeline.Id, "group1").UnreadElements; unread != 0 {
+		t.Fatalf("expected no unread elements after acknowledging the lease but got %d", unread)
+	}
+}
+
+// testNackLease verifies that a nacked lease is delivered again after a
+// backoff, counting its deliveries
+func testNackLease(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	events := values("Event", 2)
+	push(t, b, pipeline.Id, events...)
+
+	const timeout = 100 * time.Millisecond
+	nacked := lease(t, b, pipeline.Id, "member1", backend.PopLimit{}, timeout)
+	if nacked == nil || nacked.Deliveries != 1 {
+		t.Fatalf("LeaseDatapoints returned %+v", nacked)
+	}
+	if err := b.NackLease(pipeline.Id, "group1", nacked.Id); err != nil {
+		t.Fatalf("NackLease failed: %s", err.Error())
+	}
+	if redelivered := lease(t, b, pipeline.Id, "member2", backend.PopLimit{}, timeout); redelivered != nil {
+		t.Fatalf("LeaseDatapoints returned %+v right after the nack", redelivered)
+	}
+
+	deadline := time.Now().Add(writeTimeout)
+	for {
+		redelivered := lease(t, b, pipeline.Id, "member2", backend.PopLimit{}, timeout)
+		if redelivered != nil {
+			expectOffsets(t, redelivered.Datapoints, 1, events)
+			if redelivered.Deliveries != 2 || redelivered.Datapoints[0].Deliveries != 2 {
+				t.Fatalf("expected the second delivery but got %+v", redelivered)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("nacked lease wasn't delivered again")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := b.NackLease(pipeline.Id, "group1", "1-1000"); err != backend.ErrLeaseNotFound {
+		t.Fatalf("NackLease of an unknown lease returned %v", err)
+	}
+}
+
+// testDeadLetter verifies that datapoints delivered more often than allowed end
+// up in the dead letter pipeline
+func testDeadLetter(t *testing.T, b backend.Backend) {
+	deadLetter := createPipeline(t, b)
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "Source", DeadLetter: &backend.DeadLetterPolicy{Pipeline: deadLetter.Id, MaxDeliveries: 1}})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	if read, err := b.GetPipeline(pipeline.Id); err != nil || read.DeadLetter == nil || read.DeadLetter.Pipeline != deadLetter.Id {
+		t.Fatalf("GetPipeline returned %+v, %v", read, err)
+	}
+
+	events := values("Event", 2)
+	push(t, b, pipeline.Id, events...)
+
+	const timeout = 50 * time.Millisecond
+	first, err := backend.LeaseWithDeadLetter(b, pipeline.Id, "group1", "member1", backend.PopLimit{}, timeout)
+	if err != nil || first == nil {
+		t.Fatalf("LeaseWithDeadLetter returned %+v, %v", first, err)
+	}
+	expectOffsets(t, first.Datapoints, 1, events)
+
+	time.Sleep(2 * timeout)
+	if second, err := backend.LeaseWithDeadLetter(b, pipeline.Id, "group1", "member2", backend.PopLimit{}, timeout); err != nil || second != nil {
+		t.Fatalf("LeaseWithDeadLetter returned %+v, %v instead of moving the lease", second, err)
+	}
+
+	expectDatapoints(t, pop(t, b, deadLetter.Id, "consumer1"), events)
+	if unread := consumer(t, b, pipeline.Id, "group1").UnreadElements; unread != 0 {
+		t.Fatalf("expected no unread elements after moving the datapoints but got %d", unread)
+	}
+}
+
+// testNotifications checks that subscribers of a pipeline are signalled about
+// pushed datapoints, and only subscribers of that pipeline
+func testNotifications(t *testing.T, b backend.Backend) {
+	pipeline := createPipeline(t, b)
+	other := createPipeline(t, b)
+
+	notifications := b.Subscribe(pipeline.Id)
+	defer b.Unsubscribe(pipeline.Id, notifications)
+	otherNotifications := b.Subscribe(other.Id)
+	defer b.Unsubscribe(other.Id, otherNotifications)
+
+	push(t, b, pipeline.Id, values("datapoint", 3)...)
+
+	select {
+	case <-notifications:
+	case <-time.After(writeTimeout):
+		t.Fatalf("no notification about pushed datapoints within %s", writeTimeout)
+	}
+	select {
+	case <-otherNotifications:
+		t.Fatalf("subscriber of another pipeline was notified")
+	default:
+	}
+
+	// the pointer model decides what is read, a notification only wakes up
+	expectDatapoints(t, pop(t, b, pipeline.Id, "consumer1"), values("datapoint", 3))
+}
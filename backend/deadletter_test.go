@@ -0,0 +1,63 @@
+package backend_test
+
+import (
+	"github.com/cgrotz/turbine.go/backend"
+	"testing"
+	"time"
+)
+
+// redeliveredBackend hands out the first datapoint of every lease as if it
+// had been delivered before, like the redis-streams backend leasing
+// redelivered entries together with new ones
+type redeliveredBackend struct {
+	backend.Backend
+	deliveries int64
+}
+
+func (b redeliveredBackend) LeaseDatapoints(pipelineId string, consumerId string, memberId string, limit backend.PopLimit, timeout time.Duration) (*backend.Lease, error) {
+	lease, err := b.Backend.LeaseDatapoints(pipelineId, consumerId, memberId, limit, timeout)
+	if err != nil || lease == nil {
+		return lease, err
+	}
+	lease.Datapoints[0].Deliveries = b.deliveries
+	lease.Deliveries = b.deliveries
+	return lease, nil
+}
+
+// TestLeaseWithDeadLetterMixed verifies that only the datapoints of a lease
+// exceeding the policy are moved, the others are still handed out
+func TestLeaseWithDeadLetterMixed(t *testing.T) {
+	b := redeliveredBackend{Backend: backend.NewMemoryBackend(), deliveries: 3}
+	deadLetter, err := b.CreatePipeline(&backend.Pipeline{Name: "Dead Letters"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "Source", DeadLetter: &backend.DeadLetterPolicy{Pipeline: deadLetter.Id, MaxDeliveries: 2}})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	if _, _, err := b.PushDatapoints(pipeline.Id, []string{"poison", "fresh 1", "fresh 2"}, true); err != nil {
+		t.Fatalf("PushDatapoints failed: %s", err.Error())
+	}
+
+	lease, err := backend.LeaseWithDeadLetter(b, pipeline.Id, "group1", "member1", backend.PopLimit{}, time.Minute)
+	if err != nil || lease == nil {
+		t.Fatalf("LeaseWithDeadLetter returned %+v, %v", lease, err)
+	}
+	if len(lease.Datapoints) != 2 || lease.Datapoints[0].Value != "fresh 1" || lease.Datapoints[1].Value != "fresh 2" || lease.Deliveries != 1 {
+		t.Fatalf("expected the fresh datapoints but got %+v", lease)
+	}
+	moved, err := b.PopDatapoint(deadLetter.Id, "consumer1", backend.PopLimit{})
+	if err != nil || len(moved) != 1 || moved[0] != "poison" {
+		t.Fatalf("expected the poison datapoint in the dead letter pipeline but got %q, %v", moved, err)
+	}
+
+	// the moved datapoint is acknowledged together with the lease
+	if err := b.AckLease(pipeline.Id, "group1", lease.Id); err != nil {
+		t.Fatalf("AckLease failed: %s", err.Error())
+	}
+	consumers, err := b.GetConsumers(pipeline.Id)
+	if err != nil || len(consumers) != 1 || consumers[0].UnreadElements != 0 {
+		t.Fatalf("expected no unread elements but got %+v, %v", consumers, err)
+	}
+}
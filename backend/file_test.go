@@ -0,0 +1,106 @@
+package backend_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"github.com/cgrotz/turbine.go/backend/backendtest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// small segments, so the suite spans several segments per pipeline
+const testSegmentSize = 256
+
+func TestFileBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		b, err := backend.NewFileBackend(t.TempDir(), testSegmentSize)
+		if err != nil {
+			t.Fatalf("NewFileBackend failed: %s", err.Error())
+		}
+		return b
+	})
+}
+
+// TestFileBackendCorruptLength verifies that records whose length exceeds the
+// segment are cut off on startup instead of being allocated
+func TestFileBackendCorruptLength(t *testing.T) {
+	for _, length := range []uint32{0xffffffff, 1000} {
+		directory := t.TempDir()
+		b, err := backend.NewFileBackend(directory, backend.DefaultSegmentSize)
+		if err != nil {
+			t.Fatalf("NewFileBackend failed: %s", err.Error())
+		}
+		pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "Pipeline"})
+		if err != nil {
+			t.Fatalf("CreatePipeline failed: %s", err.Error())
+		}
+		if _, _, err := b.PushDatapoints(pipeline.Id, []string{"Event 1", "Event 2"}, true); err != nil {
+			t.Fatalf("PushDatapoints failed: %s", err.Error())
+		}
+
+		// the second record follows the 16 byte header and payload of the first
+		segment, err := os.OpenFile(filepath.Join(directory, url.PathEscape(pipeline.Id), fmt.Sprintf("%020d.log", 1)), os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatalf("Opening the segment failed: %s", err.Error())
+		}
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, length)
+		_, err = segment.WriteAt(header, 16+int64(len("Event 1")))
+		segment.Close()
+		if err != nil {
+			t.Fatalf("Corrupting the segment failed: %s", err.Error())
+		}
+
+		b, err = backend.NewFileBackend(directory, backend.DefaultSegmentSize)
+		if err != nil {
+			t.Fatalf("NewFileBackend failed: %s", err.Error())
+		}
+		datapoints, err := b.ReadDatapoints(pipeline.Id, 0, backend.PopLimit{})
+		if err != nil || len(datapoints) != 1 || datapoints[0].Value != "Event 1" {
+			t.Fatalf("expected the record with length %d to be cut off but read %+v, %v", length, datapoints, err)
+		}
+	}
+}
+
+// TestFileBackendStatistics verifies that datapoints pushed after the
+// statistics were saved are counted again on startup
+func TestFileBackendStatistics(t *testing.T) {
+	directory := t.TempDir()
+	b, err := backend.NewFileBackend(directory, testSegmentSize)
+	if err != nil {
+		t.Fatalf("NewFileBackend failed: %s", err.Error())
+	}
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "Pipeline"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := b.PushDatapoint(pipeline.Id, fmt.Sprintf("Event %d", i), true); err != nil {
+			t.Fatalf("PushDatapoint failed: %s", err.Error())
+		}
+	}
+	// retention removes some of the datapoints not counted yet
+	if _, err := b.ApplyRetention(pipeline.Id, backend.RetentionPolicy{MaxDatapoints: 5}); err != nil {
+		t.Fatalf("ApplyRetention failed: %s", err.Error())
+	}
+
+	b, err = backend.NewFileBackend(directory, testSegmentSize)
+	if err != nil {
+		t.Fatalf("NewFileBackend failed: %s", err.Error())
+	}
+	reopened, err := b.GetPipeline(pipeline.Id)
+	if err != nil || reopened.PipelineStatistic.Today != 20 {
+		t.Fatalf("expected 20 datapoints pushed today but got %+v, %v", reopened, err)
+	}
+	// counting again on the next startup doesn't count twice
+	b, err = backend.NewFileBackend(directory, testSegmentSize)
+	if err != nil {
+		t.Fatalf("NewFileBackend failed: %s", err.Error())
+	}
+	if reopened, err := b.GetPipeline(pipeline.Id); err != nil || reopened.PipelineStatistic.Today != 20 {
+		t.Fatalf("expected 20 datapoints pushed today but got %+v, %v", reopened, err)
+	}
+}
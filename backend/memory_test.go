@@ -0,0 +1,13 @@
+package backend_test
+
+import (
+	"github.com/cgrotz/turbine.go/backend"
+	"github.com/cgrotz/turbine.go/backend/backendtest"
+	"testing"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		return backend.NewMemoryBackend()
+	})
+}
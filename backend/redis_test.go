@@ -0,0 +1,123 @@
+package backend_test
+
+import (
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cgrotz/turbine.go/backend"
+	"github.com/cgrotz/turbine.go/backend/backendtest"
+	"github.com/rcrowley/go-metrics"
+	"github.com/xuyu/goredis"
+	"sync"
+	"testing"
+)
+
+func TestRedisBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		return startRedisBackend(t, miniredis.RunT(t))
+	})
+}
+
+// TestRedisBackendConcurrentPop pops for one consumer from many connections at
+// once, the pop script has to hand out every datapoint exactly once and in order
+func TestRedisBackendConcurrentPop(t *testing.T) {
+	const datapoints = 500
+	const poppers = 8
+
+	b := startRedisBackend(t, miniredis.RunT(t))
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "concurrent"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	var values []string
+	for i := 0; i < datapoints; i++ {
+		values = append(values, fmt.Sprintf("%05d", i))
+	}
+	if _, _, err := b.PushDatapoints(pipeline.Id, values, true); err != nil {
+		t.Fatalf("PushDatapoints failed: %s", err.Error())
+	}
+
+	var popping sync.WaitGroup
+	var mutex sync.Mutex
+	seen := make(map[string]int)
+	errs := make(chan error, poppers)
+	for p := 0; p < poppers; p++ {
+		popping.Add(1)
+		go func() {
+			defer popping.Done()
+			last := ""
+			for {
+				popped, err := b.PopDatapoint(pipeline.Id, "shared", backend.PopLimit{Max: 3})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(popped) == 0 {
+					return
+				}
+				mutex.Lock()
+				for _, datapoint := range popped {
+					seen[datapoint]++
+				}
+				mutex.Unlock()
+				if popped[0] <= last {
+					errs <- fmt.Errorf("popped %s after %s", popped[0], last)
+					return
+				}
+				last = popped[len(popped)-1]
+			}
+		}()
+	}
+
+	popping.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent pop failed: %s", err.Error())
+	}
+	for _, value := range values {
+		if seen[value] != 1 {
+			t.Fatalf("datapoint %s was popped %d times", value, seen[value])
+		}
+	}
+}
+
+// TestRedisBackendScriptFlush pushes and pops after Redis lost the scripts, as
+// it does on a restart, which sends the scripts again
+func TestRedisBackendScriptFlush(t *testing.T) {
+	server := miniredis.RunT(t)
+	b := startRedisBackend(t, server)
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "flushed"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+
+	redis, err := goredis.DialURL("tcp://" + server.Addr())
+	if err != nil {
+		t.Fatalf("DialURL failed: %s", err.Error())
+	}
+	if err := redis.ScriptFlush(); err != nil {
+		t.Fatalf("ScriptFlush failed: %s", err.Error())
+	}
+
+	if index, err := b.PushDatapoint(pipeline.Id, "Event 1", true); err != nil || index != 1 {
+		t.Fatalf("PushDatapoint returned %d, %v after the scripts were flushed", index, err)
+	}
+	popped, err := b.PopDatapoint(pipeline.Id, "consumer", backend.PopLimit{})
+	if err != nil || len(popped) != 1 || popped[0] != "Event 1" {
+		t.Fatalf("PopDatapoint returned %q, %v after the scripts were flushed", popped, err)
+	}
+}
+
+// startRedisBackend loads the scripts and starts a single writer, which keeps
+// datapoints pushed one after another in order
+func startRedisBackend(t *testing.T, server *miniredis.Miniredis) backend.RedisBackend {
+	b := backend.RedisBackend{
+		RedisUrl:   "tcp://" + server.Addr(),
+		Datapoints: make(chan *backend.Datapoint),
+		Broker:     backend.NewBroker(),
+	}
+	if _, err := b.StartScripting(); err != nil {
+		t.Fatalf("StartScripting failed: %s", err.Error())
+	}
+	go b.Start(metrics.NewTimer(), b.Datapoints)
+	return b
+}
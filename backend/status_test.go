@@ -0,0 +1,48 @@
+package backend_test
+
+import (
+	"github.com/cgrotz/turbine.go/backend"
+	"testing"
+)
+
+func TestReadStatus(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "Pipeline"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	if _, _, err := b.PushDatapoints(pipeline.Id, []string{"Event 1", "Event 2", "Event 3"}, true); err != nil {
+		t.Fatalf("PushDatapoints failed: %s", err.Error())
+	}
+	if _, err := b.PopDatapoint(pipeline.Id, "consumer1", backend.PopLimit{Max: 1}); err != nil {
+		t.Fatalf("PopDatapoint failed: %s", err.Error())
+	}
+
+	status, err := backend.ReadStatus(b)
+	if err != nil {
+		t.Fatalf("ReadStatus failed: %s", err.Error())
+	}
+	if status.Redis != nil || len(status.Pipelines) != 1 {
+		t.Fatalf("expected the status of one pipeline without Redis but got %+v", status)
+	}
+	p := status.Pipelines[0]
+	if p.Id != pipeline.Id || p.Name != "Pipeline" || p.Datapoints != 3 || p.LastOffset != 3 || p.Today != 3 {
+		t.Fatalf("expected 3 datapoints pushed today but got %+v", p)
+	}
+	if len(p.Consumers) != 1 || p.Consumers[0].Id != "consumer1" || p.Consumers[0].Offset != 1 || p.Consumers[0].UnreadElements != 2 {
+		t.Fatalf("expected consumer1 at offset 1 but got %+v", p.Consumers)
+	}
+}
+
+// TestReadStatusUnreachable verifies that an unreachable Redis is reported
+// instead of failing
+func TestReadStatusUnreachable(t *testing.T) {
+	b := backend.RedisBackend{RedisUrl: "tcp://127.0.0.1:1", Broker: backend.NewBroker()}
+	status, err := backend.ReadStatus(b)
+	if err != nil {
+		t.Fatalf("ReadStatus failed: %s", err.Error())
+	}
+	if status.Redis == nil || status.Redis.Connected || status.Redis.Error == "" || status.Pipelines != nil {
+		t.Fatalf("expected a disconnected status without pipelines but got %+v with %+v", status, status.Redis)
+	}
+}
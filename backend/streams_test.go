@@ -0,0 +1,36 @@
+package backend_test
+
+import (
+	"github.com/cgrotz/turbine.go/backend"
+	"github.com/cgrotz/turbine.go/backend/backendtest"
+	"github.com/xuyu/goredis"
+	"os"
+	"testing"
+)
+
+// TestRedisStreamsBackend needs Redis 7, the stand-in used for the
+// RedisBackend lacks stream commands like XAUTOCLAIM and XGROUP SETID. It runs
+// against the server of TURBINE_TEST_REDIS_URL, e.g. tcp://localhost:6379.
+// The backend uses database 0, which is flushed before every test.
+func TestRedisStreamsBackend(t *testing.T) {
+	redisUrl := os.Getenv("TURBINE_TEST_REDIS_URL")
+	if redisUrl == "" {
+		t.Skip("TURBINE_TEST_REDIS_URL isn't set")
+	}
+
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		redis, err := goredis.DialURL(redisUrl + "/0")
+		if err != nil {
+			t.Fatalf("Connecting to %s failed: %s", redisUrl, err.Error())
+		}
+		if _, err := redis.ExecuteCommand("FLUSHDB"); err != nil {
+			t.Fatalf("FLUSHDB failed: %s", err.Error())
+		}
+
+		b, err := backend.NewRedisStreamsBackend(redisUrl)
+		if err != nil {
+			t.Fatalf("NewRedisStreamsBackend failed: %s", err.Error())
+		}
+		return b
+	})
+}
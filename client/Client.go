@@ -0,0 +1,299 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides how often requests failing with a network error or a
+// 5xx answer are sent again. Only idempotent calls are retried unless
+// NonIdempotent is set: if only the answer got lost, a datapoint pushed again
+// is stored twice and the datapoints of a pop sent again are skipped.
+type RetryPolicy struct {
+	// attempts including the first one, 1 disables retries
+	MaxAttempts int
+	// delay before the first retry, doubled for every further retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// retries CreatePipeline, Push, PushBatch and Pop as well
+	NonIdempotent bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 4, Backoff: 100 * time.Millisecond, MaxBackoff: 5 * time.Second}
+
+// Client calls the REST interface of a Turbine server, e.g.
+//
+//	c := client.NewClient("http://localhost:3000")
+//	pipeline, err := c.CreatePipeline(ctx, &backend.Pipeline{Name: "sensors"})
+type Client struct {
+	baseUrl string
+	// sends the requests, its timeout has to exceed the wait of pops
+	HTTPClient *http.Client
+	Retry      RetryPolicy
+}
+
+func NewClient(baseUrl string) *Client {
+	return &Client{
+		baseUrl:    strings.TrimRight(baseUrl, "/"),
+		HTTPClient: http.DefaultClient,
+		Retry:      DefaultRetryPolicy,
+	}
+}
+
+// Error is an answer of the server with an error status. Errors of the
+// backend are returned as such instead, e.g. backend.ErrConsumerExists.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("turbine answered %d: %s", e.StatusCode, e.Message)
+}
+
+var backendErrors = []error{
+	backend.ErrPipelineNotFound,
+	backend.ErrInvalidOffset,
+	backend.ErrConsumerNotFound,
+	backend.ErrConsumerExists,
+	backend.ErrInvalidSeek,
+	backend.ErrLeaseNotFound,
+}
+
+// responseError turns an error answer into the backend error of the same message
+func responseError(statusCode int, body []byte) error {
+	message := strings.TrimSpace(string(body))
+	for _, err := range backendErrors {
+		if message == err.Error() {
+			return err
+		}
+	}
+	return &Error{StatusCode: statusCode, Message: message}
+}
+
+func (c *Client) GetPipelines(ctx context.Context) ([]backend.Pipeline, error) {
+	var pipelines []backend.Pipeline
+	_, err := c.do(ctx, "GET", true, pipelinePath(), nil, nil, &pipelines)
+	return pipelines, err
+}
+
+func (c *Client) GetPipeline(ctx context.Context, id string) (*backend.Pipeline, error) {
+	pipeline := &backend.Pipeline{}
+	if _, err := c.do(ctx, "GET", true, pipelinePath(id), nil, nil, pipeline); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (c *Client) CreatePipeline(ctx context.Context, pipeline *backend.Pipeline) (*backend.Pipeline, error) {
+	created := &backend.Pipeline{}
+	if _, err := c.do(ctx, "POST", false, pipelinePath(), nil, pipeline, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *Client) UpdatePipeline(ctx context.Context, id string, pipeline *backend.Pipeline) error {
+	_, err := c.do(ctx, "PUT", true, pipelinePath(id), nil, pipeline, nil)
+	return err
+}
+
+func (c *Client) DeletePipeline(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "DELETE", true, pipelinePath(id), nil, nil, nil)
+	return err
+}
+
+func (c *Client) GetStatistic(ctx context.Context, id string) (*backend.PipelineStatistic, error) {
+	statistic := &backend.PipelineStatistic{}
+	if _, err := c.do(ctx, "GET", true, pipelinePath(id, "statistics"), nil, nil, statistic); err != nil {
+		return nil, err
+	}
+	return statistic, nil
+}
+
+// GetStatus returns the status of the backend of the server and its pipelines
+func (c *Client) GetStatus(ctx context.Context) (*backend.Status, error) {
+	status := &backend.Status{}
+	if _, err := c.do(ctx, "GET", true, "/api/v1/status", nil, nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Push pushes a datapoint and returns its offset, which is 0 if the server
+// answered before storing it, see backend.Backend.PushDatapoint
+func (c *Client) Push(ctx context.Context, pipelineId string, payload string, ack bool) (int64, error) {
+	response, err := c.send(ctx, "POST", false, pipelinePath(pipelineId, "datapoints"), ackQuery(ack), "text/plain", []byte(payload), nil)
+	if err != nil || response.StatusCode == http.StatusAccepted {
+		return 0, err
+	}
+	// the location ends with the offset of the datapoint
+	location := response.Header.Get("Location")
+	return strconv.ParseInt(path.Base(location), 10, 64)
+}
+
+// PushBatch pushes the datapoints at once and returns the offsets of the
+// first and the last one, zeros just like Push
+func (c *Client) PushBatch(ctx context.Context, pipelineId string, payloads []string, ack bool) (int64, int64, error) {
+	body, err := json.Marshal(payloads)
+	if err != nil {
+		return 0, 0, err
+	}
+	datapointRange := backend.DatapointRange{}
+	response, err := c.send(ctx, "POST", false, pipelinePath(pipelineId, "datapoints", "batch"), ackQuery(ack), "application/json", body, &datapointRange)
+	if err != nil || response.StatusCode == http.StatusAccepted {
+		return 0, 0, err
+	}
+	return datapointRange.First, datapointRange.Last, nil
+}
+
+// Pop returns the next datapoints of the consumer and moves its pointer over
+// them. If there are none, the server waits up to wait for new datapoints.
+func (c *Client) Pop(ctx context.Context, pipelineId string, consumerId string, limit backend.PopLimit, wait time.Duration) ([]string, error) {
+	var datapoints []string
+	_, err := c.do(ctx, "GET", false, pipelinePath(pipelineId, "datapoints"), popQuery(consumerId, limit, wait), nil, &datapoints)
+	return datapoints, err
+}
+
+// Peek returns the next datapoints of the consumer with their offsets,
+// leaving the pointer in place until the consumer commits
+func (c *Client) Peek(ctx context.Context, pipelineId string, consumerId string, limit backend.PopLimit, wait time.Duration) ([]backend.OffsetDatapoint, error) {
+	query := popQuery(consumerId, limit, wait)
+	query.Set("commit", "manual")
+	var datapoints []backend.OffsetDatapoint
+	_, err := c.do(ctx, "GET", true, pipelinePath(pipelineId, "datapoints"), query, nil, &datapoints)
+	return datapoints, err
+}
+
+// Commit moves the pointer of the consumer forward to the offset of the last
+// datapoint it processed
+func (c *Client) Commit(ctx context.Context, pipelineId string, consumerId string, offset int64) error {
+	body := struct {
+		Offset int64 `json:"offset"`
+	}{offset}
+	_, err := c.do(ctx, "POST", true, pipelinePath(pipelineId, "consumers", consumerId, "commit"), nil, body, nil)
+	return err
+}
+
+// do sends the object as JSON, unless it is nil, and decodes the JSON answer
+// into the result, unless it is nil
+func (c *Client) do(ctx context.Context, method string, idempotent bool, urlPath string, query url.Values, object interface{}, result interface{}) (*http.Response, error) {
+	var body []byte
+	if object != nil {
+		var err error
+		if body, err = json.Marshal(object); err != nil {
+			return nil, err
+		}
+	}
+	return c.send(ctx, method, idempotent, urlPath, query, "application/json", body, result)
+}
+
+// send sends the request until it succeeds or the attempts of the retry
+// policy are used up, requests that aren't idempotent only once unless the
+// policy allows retrying them
+func (c *Client) send(ctx context.Context, method string, idempotent bool, urlPath string, query url.Values, contentType string, body []byte, result interface{}) (*http.Response, error) {
+	backoff := c.Retry.Backoff
+	for attempt := 1; ; attempt++ {
+		response, data, err := c.roundTrip(ctx, method, urlPath, query, contentType, body)
+		if err == nil && response.StatusCode < 500 {
+			if response.StatusCode >= 400 {
+				return nil, responseError(response.StatusCode, data)
+			}
+			if result != nil && len(data) > 0 {
+				if err := json.Unmarshal(data, result); err != nil {
+					return nil, err
+				}
+			}
+			return response, nil
+		}
+		if err == nil {
+			err = responseError(response.StatusCode, data)
+		}
+
+		if attempt >= c.Retry.MaxAttempts || !idempotent && !c.Retry.NonIdempotent {
+			return nil, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if backoff *= 2; backoff > c.Retry.MaxBackoff {
+			backoff = c.Retry.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) roundTrip(ctx context.Context, method string, urlPath string, query url.Values, contentType string, body []byte) (*http.Response, []byte, error) {
+	request, err := c.newRequest(ctx, method, urlPath, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		request.ContentLength = int64(len(body))
+		request.Header.Set("Content-Type", contentType)
+	}
+	request.Header.Set("Accept", "application/json")
+
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	return response, data, err
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, urlPath string, query url.Values) (*http.Request, error) {
+	requestUrl := c.baseUrl + urlPath
+	if len(query) > 0 {
+		requestUrl += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, requestUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	return request.WithContext(ctx), nil
+}
+
+// pipelinePath returns the path of the pipelines resource followed by the
+// escaped segments
+func pipelinePath(segments ...string) string {
+	urlPath := "/api/v1/pipelines"
+	for _, segment := range segments {
+		urlPath += "/" + url.PathEscape(segment)
+	}
+	return urlPath
+}
+
+func ackQuery(ack bool) url.Values {
+	if !ack {
+		return nil
+	}
+	return url.Values{"ack": {"true"}}
+}
+
+func popQuery(consumerId string, limit backend.PopLimit, wait time.Duration) url.Values {
+	query := url.Values{"consumer": {consumerId}}
+	if limit.Max > 0 {
+		query.Set("max", strconv.FormatInt(limit.Max, 10))
+	}
+	if limit.MaxBytes > 0 {
+		query.Set("max_bytes", strconv.FormatInt(limit.MaxBytes, 10))
+	}
+	if wait > 0 {
+		query.Set("wait", wait.String())
+	}
+	return query
+}
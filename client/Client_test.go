@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"github.com/cgrotz/turbine.go/backend"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer answers every request with the handler and counts them
+func countingServer(handler http.HandlerFunc) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler(w, r)
+	}))
+	return server, &requests
+}
+
+func testClient(url string) *Client {
+	c := NewClient(url)
+	c.Retry.Backoff = time.Millisecond
+	c.Retry.MaxBackoff = time.Millisecond
+	return c
+}
+
+// TestRetry verifies that only idempotent calls are sent again, unless the
+// policy allows retrying all of them
+func TestRetry(t *testing.T) {
+	server, requests := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+	c := testClient(server.URL)
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		idempotent bool
+		call       func() error
+	}{
+		{"GetPipelines", true, func() error { _, err := c.GetPipelines(ctx); return err }},
+		{"GetPipeline", true, func() error { _, err := c.GetPipeline(ctx, "p"); return err }},
+		{"UpdatePipeline", true, func() error { return c.UpdatePipeline(ctx, "p", &backend.Pipeline{}) }},
+		{"DeletePipeline", true, func() error { return c.DeletePipeline(ctx, "p") }},
+		{"GetStatus", true, func() error { _, err := c.GetStatus(ctx); return err }},
+		{"Peek", true, func() error { _, err := c.Peek(ctx, "p", "c", backend.PopLimit{}, 0); return err }},
+		{"Commit", true, func() error { return c.Commit(ctx, "p", "c", 1) }},
+		{"CreatePipeline", false, func() error { _, err := c.CreatePipeline(ctx, &backend.Pipeline{}); return err }},
+		{"Push", false, func() error { _, err := c.Push(ctx, "p", "Event", true); return err }},
+		{"PushBatch", false, func() error { _, _, err := c.PushBatch(ctx, "p", []string{"Event"}, true); return err }},
+		{"Pop", false, func() error { _, err := c.Pop(ctx, "p", "c", backend.PopLimit{}, 0); return err }},
+	}
+
+	for _, nonIdempotent := range []bool{false, true} {
+		c.Retry.NonIdempotent = nonIdempotent
+		for _, test := range tests {
+			atomic.StoreInt32(requests, 0)
+			err := test.call()
+			if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusServiceUnavailable || e.Message != "unavailable" {
+				t.Errorf("%s returned %v", test.name, err)
+			}
+			expected := int32(1)
+			if test.idempotent || nonIdempotent {
+				expected = int32(c.Retry.MaxAttempts)
+			}
+			if sent := atomic.LoadInt32(requests); sent != expected {
+				t.Errorf("%s was sent %d times instead of %d with NonIdempotent %t", test.name, sent, expected, nonIdempotent)
+			}
+		}
+	}
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	var failures int32 = 2
+	server, requests := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			// the connection breaks without an answer
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"id":"p","name":"Pipeline"}`))
+	})
+	defer server.Close()
+
+	pipeline, err := testClient(server.URL).GetPipeline(context.Background(), "p")
+	if err != nil || pipeline.Name != "Pipeline" {
+		t.Fatalf("GetPipeline returned %+v, %v", pipeline, err)
+	}
+	if sent := atomic.LoadInt32(requests); sent != 3 {
+		t.Fatalf("GetPipeline was sent %d times instead of 3", sent)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	server, _ := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+	c := testClient(server.URL)
+	c.Retry.Backoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetPipeline(ctx, "p"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the retry to end with the context but got %v", err)
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		message    string
+		err        error
+	}{
+		{http.StatusNotFound, backend.ErrPipelineNotFound.Error(), backend.ErrPipelineNotFound},
+		{http.StatusNotFound, backend.ErrConsumerNotFound.Error(), backend.ErrConsumerNotFound},
+		{http.StatusNotFound, backend.ErrLeaseNotFound.Error(), backend.ErrLeaseNotFound},
+		{http.StatusConflict, backend.ErrConsumerExists.Error(), backend.ErrConsumerExists},
+		{http.StatusBadRequest, backend.ErrInvalidOffset.Error(), backend.ErrInvalidOffset},
+		{http.StatusBadRequest, backend.ErrInvalidSeek.Error(), backend.ErrInvalidSeek},
+		{http.StatusBadRequest, "invalid max", &Error{StatusCode: http.StatusBadRequest, Message: "invalid max"}},
+		{http.StatusInternalServerError, "disk full", &Error{StatusCode: http.StatusInternalServerError, Message: "disk full"}},
+	}
+
+	for _, test := range tests {
+		server, requests := countingServer(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, test.message, test.statusCode)
+		})
+		c := testClient(server.URL)
+		c.Retry.MaxAttempts = 1
+		err := c.Commit(context.Background(), "p", "c", 1)
+		server.Close()
+
+		if e, ok := test.err.(*Error); ok {
+			if actual, ok := err.(*Error); !ok || *actual != *e {
+				t.Errorf("%d %s was returned as %v instead of %v", test.statusCode, test.message, err, test.err)
+			}
+		} else if err != test.err {
+			t.Errorf("%d %s was returned as %v instead of %v", test.statusCode, test.message, err, test.err)
+		}
+		if sent := atomic.LoadInt32(requests); sent != 1 {
+			t.Errorf("%d %s was sent %d times", test.statusCode, test.message, sent)
+		}
+	}
+}
+
+func TestPush(t *testing.T) {
+	server, _ := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("ack") != "true" {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Location", r.URL.Path+"/7")
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer server.Close()
+	c := testClient(server.URL)
+
+	if offset, err := c.Push(context.Background(), "p", "Event", true); err != nil || offset != 7 {
+		t.Fatalf("Push returned %d, %v", offset, err)
+	}
+	// the server answers before storing the datapoint without ack
+	if offset, err := c.Push(context.Background(), "p", "Event", false); err != nil || offset != 0 {
+		t.Fatalf("Push returned %d, %v", offset, err)
+	}
+}
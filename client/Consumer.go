@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"github.com/cgrotz/turbine.go/backend"
+	"time"
+)
+
+// how long a consumer waits for new datapoints with a single request
+const defaultWait = 30 * time.Second
+
+// Handler processes a batch of datapoints, an error stops the consumer
+// without committing the batch
+type Handler func(ctx context.Context, datapoints []backend.OffsetDatapoint) error
+
+// Consumer hands the datapoints of a consumer to a handler batch by batch.
+// The pointer moves over a batch once the handler returns, so every
+// datapoint is processed at least once.
+type Consumer struct {
+	Client     *Client
+	PipelineId string
+	ConsumerId string
+	Limit      backend.PopLimit
+	Wait       time.Duration
+	Handler    Handler
+}
+
+func NewConsumer(c *Client, pipelineId string, consumerId string, handler Handler) *Consumer {
+	return &Consumer{
+		Client:     c,
+		PipelineId: pipelineId,
+		ConsumerId: consumerId,
+		Wait:       defaultWait,
+		Handler:    handler,
+	}
+}
+
+// Run processes datapoints until the context is done or a request or the
+// handler fails
+func (c *Consumer) Run(ctx context.Context) error {
+	for {
+		datapoints, err := c.Client.Peek(ctx, c.PipelineId, c.ConsumerId, c.Limit, c.Wait)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		if len(datapoints) == 0 {
+			continue
+		}
+
+		if err := c.Handler(ctx, datapoints); err != nil {
+			return err
+		}
+		if err := c.Client.Commit(ctx, c.PipelineId, c.ConsumerId, datapoints[len(datapoints)-1].Offset); err != nil {
+			return err
+		}
+	}
+}
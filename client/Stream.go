@@ -0,0 +1,158 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"github.com/cgrotz/turbine.go/backend"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stream receives the datapoints of a consumer as server-sent events. A
+// broken connection is opened again with the offset of the last datapoint
+// received as Last-Event-ID, so no datapoint is skipped or received twice.
+type Stream struct {
+	client     *Client
+	ctx        context.Context
+	pipelineId string
+	consumerId string
+	limit      backend.PopLimit
+	// offset of the last datapoint received
+	lastEventId int64
+	response    *http.Response
+	reader      *bufio.Reader
+}
+
+// Stream opens a stream of the datapoints following the pointer of the
+// consumer. The limit bounds the datapoints the server reads at once.
+func (c *Client) Stream(ctx context.Context, pipelineId string, consumerId string, limit backend.PopLimit) (*Stream, error) {
+	s := &Stream{client: c, ctx: ctx, pipelineId: pipelineId, consumerId: consumerId, limit: limit}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Next blocks until the next datapoint arrives
+func (s *Stream) Next() (backend.OffsetDatapoint, error) {
+	for {
+		if s.reader != nil {
+			datapoint, err := s.readEvent()
+			if err == nil {
+				s.lastEventId = datapoint.Offset
+				return datapoint, nil
+			}
+			s.Close()
+		}
+		if err := s.ctx.Err(); err != nil {
+			return backend.OffsetDatapoint{}, err
+		}
+		if err := s.connect(); err != nil {
+			return backend.OffsetDatapoint{}, err
+		}
+	}
+}
+
+func (s *Stream) Close() error {
+	if s.response == nil {
+		return nil
+	}
+	err := s.response.Body.Close()
+	s.response = nil
+	s.reader = nil
+	return err
+}
+
+// connect opens the connection, retrying like any other request
+func (s *Stream) connect() error {
+	policy := s.client.Retry
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := s.open()
+		if err == nil {
+			return nil
+		}
+		// errors of the backend answered with 4xx aren't retried
+		_, broken := err.(*url.Error)
+		if e, ok := err.(*Error); (broken && s.ctx.Err() == nil) || (ok && e.StatusCode >= 500) {
+			if attempt < policy.MaxAttempts {
+				select {
+				case <-time.After(backoff):
+				case <-s.ctx.Done():
+					return s.ctx.Err()
+				}
+				if backoff *= 2; backoff > policy.MaxBackoff {
+					backoff = policy.MaxBackoff
+				}
+				continue
+			}
+		}
+		return err
+	}
+}
+
+func (s *Stream) open() error {
+	request, err := s.client.newRequest(s.ctx, "GET", pipelinePath(s.pipelineId, "datapoints"), popQuery(s.consumerId, s.limit, 0))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	if s.lastEventId > 0 {
+		request.Header.Set("Last-Event-ID", strconv.FormatInt(s.lastEventId, 10))
+	}
+
+	response, err := s.client.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		data, _ := ioutil.ReadAll(response.Body)
+		return responseError(response.StatusCode, data)
+	}
+	s.response = response
+	s.reader = bufio.NewReader(response.Body)
+	return nil
+}
+
+// readEvent reads lines up to the blank line ending an event with data.
+// Comments, as sent to keep the connection alive, and unknown fields are
+// skipped.
+func (s *Stream) readEvent() (backend.OffsetDatapoint, error) {
+	datapoint := backend.OffsetDatapoint{}
+	var data []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return datapoint, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		if line == "" {
+			if data != nil {
+				datapoint.Value = strings.Join(data, "\n")
+				return datapoint, nil
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			if datapoint.Offset, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return datapoint, err
+			}
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
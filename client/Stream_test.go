@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// TestStream verifies the parsing of events and that a broken stream is
+// resumed after the last datapoint received
+func TestStream(t *testing.T) {
+	lastEventIds := make(chan string, 2)
+	server, _ := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" || r.URL.Query().Get("consumer") != "c" {
+			http.Error(w, "not a stream", http.StatusBadRequest)
+			return
+		}
+		lastEventIds <- r.Header.Get("Last-Event-ID")
+		w.Header().Set("Content-Type", "text/event-stream")
+		switch r.Header.Get("Last-Event-ID") {
+		case "":
+			fmt.Fprint(w, ": keep-alive\n\n")
+			fmt.Fprint(w, "id: 1\ndata: line 1\ndata: line 2\n\n")
+			// lines may end with CRLF, unknown fields are ignored
+			fmt.Fprint(w, "event: datapoint\r\nid: 2\r\ndata:no space\r\n\r\n")
+			fmt.Fprint(w, "id: 3\ndata\n\n")
+			// the connection breaks within an event
+			fmt.Fprint(w, "id: 4\ndata: lost")
+		case "3":
+			fmt.Fprint(w, "id: 4\ndata: Event 4\n\n")
+		}
+	})
+	defer server.Close()
+
+	stream, err := testClient(server.URL).Stream(context.Background(), "p", "c", backend.PopLimit{})
+	if err != nil {
+		t.Fatalf("Stream failed: %s", err.Error())
+	}
+	defer stream.Close()
+
+	expected := []backend.OffsetDatapoint{
+		{Offset: 1, Value: "line 1\nline 2"},
+		{Offset: 2, Value: "no space"},
+		// a field without colon has an empty value
+		{Offset: 3, Value: ""},
+	}
+	for _, datapoint := range expected {
+		if received, err := stream.Next(); err != nil || received != datapoint {
+			t.Fatalf("expected %+v but received %+v, %v", datapoint, received, err)
+		}
+	}
+	if lastEventId := <-lastEventIds; lastEventId != "" {
+		t.Fatalf("the stream was opened with Last-Event-ID %s", lastEventId)
+	}
+
+	if received, err := stream.Next(); err != nil || received.Offset != 4 || received.Value != "Event 4" {
+		t.Fatalf("expected datapoint 4 but received %+v, %v", received, err)
+	}
+	if lastEventId := <-lastEventIds; lastEventId != "3" {
+		t.Fatalf("the stream was resumed with Last-Event-ID %q", lastEventId)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	server, requests := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, backend.ErrConsumerNotFound.Error(), http.StatusNotFound)
+	})
+	defer server.Close()
+	c := testClient(server.URL)
+	if _, err := c.Stream(context.Background(), "p", "c", backend.PopLimit{}); err != backend.ErrConsumerNotFound {
+		t.Fatalf("expected ErrConsumerNotFound but got %v", err)
+	}
+	if sent := atomic.LoadInt32(requests); sent != 1 {
+		t.Fatalf("the stream was opened %d times", sent)
+	}
+
+	server, requests = countingServer(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+	c = testClient(server.URL)
+	if _, err := c.Stream(context.Background(), "p", "c", backend.PopLimit{}); err == nil {
+		t.Fatal("expected the stream to fail")
+	}
+	if sent := atomic.LoadInt32(requests); sent != int32(c.Retry.MaxAttempts) {
+		t.Fatalf("the stream was opened %d times instead of %d", sent, c.Retry.MaxAttempts)
+	}
+}
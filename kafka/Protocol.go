@@ -0,0 +1,190 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maximum size of a request, which covers the largest batch a producer may send
+const maxRequestSize = 64 * 1024 * 1024
+
+var errMalformedRequest = errors.New("malformed request")
+
+type request struct {
+	apiKey        int16
+	apiVersion    int16
+	correlationId int32
+	clientId      string
+	body          *decoder
+}
+
+// readRequest reads a size delimited request and its header. Only versions
+// without tagged fields are supported, so the header never carries any.
+func readRequest(r io.Reader) (*request, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(header))
+	if size < 8 || size > maxRequestSize {
+		return nil, fmt.Errorf("request of %d bytes is out of bounds", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	d := &decoder{data: payload}
+	req := &request{apiKey: d.int16(), apiVersion: d.int16(), correlationId: d.int32()}
+	req.clientId, _ = d.nullableString()
+	if d.err != nil {
+		return nil, d.err
+	}
+	req.body = d
+	return req, nil
+}
+
+// writeResponse writes the response to the request with the given correlation id
+func writeResponse(w io.Writer, correlationId int32, body []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(body)+4))
+	binary.BigEndian.PutUint32(header[4:], uint32(correlationId))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// decoder reads the fields of a request, the first error sticks
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || n < 0 || len(d.data) < n {
+		d.err = errMalformedRequest
+		return make([]byte, 8)
+	}
+	value := d.data[:n]
+	d.data = d.data[n:]
+	return value
+}
+
+func (d *decoder) int8() int8 {
+	return int8(d.take(1)[0])
+}
+
+func (d *decoder) int16() int16 {
+	return int16(binary.BigEndian.Uint16(d.take(2)))
+}
+
+func (d *decoder) int32() int32 {
+	return int32(binary.BigEndian.Uint32(d.take(4)))
+}
+
+func (d *decoder) int64() int64 {
+	return int64(binary.BigEndian.Uint64(d.take(8)))
+}
+
+func (d *decoder) boolean() bool {
+	return d.take(1)[0] != 0
+}
+
+func (d *decoder) string() string {
+	return string(d.take(int(d.int16())))
+}
+
+// nullableString returns false for a null string
+func (d *decoder) nullableString() (string, bool) {
+	size := d.int16()
+	if size < 0 {
+		return "", false
+	}
+	return string(d.take(int(size))), true
+}
+
+// bytes returns nil for null bytes
+func (d *decoder) bytes() []byte {
+	size := d.int32()
+	if size < 0 {
+		return nil
+	}
+	return d.take(int(size))
+}
+
+// arrayLength returns the number of elements of an array, -1 for a null
+// array. Every element takes at least one byte, which bounds the length.
+func (d *decoder) arrayLength() int {
+	length := int(d.int32())
+	if length > len(d.data) {
+		d.err = errMalformedRequest
+	}
+	if d.err != nil {
+		return 0
+	}
+	return length
+}
+
+// encoder writes the fields of a response
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) int8(value int8) {
+	e.data = append(e.data, byte(value))
+}
+
+func (e *encoder) int16(value int16) {
+	e.data = append(e.data, byte(value>>8), byte(value))
+}
+
+func (e *encoder) int32(value int32) {
+	e.data = append(e.data, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func (e *encoder) int64(value int64) {
+	e.int32(int32(value >> 32))
+	e.int32(int32(value))
+}
+
+func (e *encoder) boolean(value bool) {
+	if value {
+		e.int8(1)
+	} else {
+		e.int8(0)
+	}
+}
+
+func (e *encoder) string(value string) {
+	e.int16(int16(len(value)))
+	e.data = append(e.data, value...)
+}
+
+func (e *encoder) nullString() {
+	e.int16(-1)
+}
+
+// bytes writes null bytes for nil
+func (e *encoder) bytes(value []byte) {
+	if value == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(value)))
+	e.data = append(e.data, value...)
+}
+
+func (e *encoder) arrayLength(length int) {
+	e.int32(int32(length))
+}
+
+func (e *encoder) int32Array(values ...int32) {
+	e.arrayLength(len(values))
+	for _, value := range values {
+		e.int32(value)
+	}
+}
@@ -0,0 +1,111 @@
+package kafka
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		input    string
+		apiKey   int16
+		version  int16
+		clientId string
+		body     string
+		err      error
+	}{
+		{"\x00\x00\x00\x11\x00\x03\x00\x01\x00\x00\x00\x07\x00\x03abcbody", apiMetadata, 1, "abc", "body", nil},
+		// a null client id
+		{"\x00\x00\x00\x0a\x00\x12\x00\x00\x00\x00\x00\x07\xff\xff", apiApiVersions, 0, "", "", nil},
+		// the size is checked before the request is allocated
+		{"\xff\xff\xff\xff", 0, 0, "", "", fmt.Errorf("request of -1 bytes is out of bounds")},
+		{"\x00\x00\x00\x07\x00\x03\x00\x01\x00\x00\x00", 0, 0, "", "", fmt.Errorf("request of 7 bytes is out of bounds")},
+		{"\x7f\xff\xff\xff", 0, 0, "", "", fmt.Errorf("request of 2147483647 bytes is out of bounds")},
+		// a client id longer than the request
+		{"\x00\x00\x00\x0a\x00\x03\x00\x01\x00\x00\x00\x07\x00\x03", 0, 0, "", "", errMalformedRequest},
+		{"\x00\x00\x00\x0f\x00\x03\x00\x01", 0, 0, "", "", io.ErrUnexpectedEOF},
+		{"\x00\x00", 0, 0, "", "", io.ErrUnexpectedEOF},
+		{"", 0, 0, "", "", io.EOF},
+	}
+
+	for _, test := range tests {
+		req, err := readRequest(strings.NewReader(test.input))
+		if fmt.Sprint(err) != fmt.Sprint(test.err) {
+			t.Errorf("readRequest(%q) returned %v instead of %v", test.input, err, test.err)
+			continue
+		}
+		if err == nil && (req.apiKey != test.apiKey || req.apiVersion != test.version || req.correlationId != 7 || req.clientId != test.clientId || string(req.body.data) != test.body) {
+			t.Errorf("readRequest(%q) returned %+v with body %q", test.input, req, req.body.data)
+		}
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeResponse(&buffer, 7, []byte("body")); err != nil {
+		t.Fatalf("writeResponse failed: %s", err.Error())
+	}
+	if buffer.String() != "\x00\x00\x00\x08\x00\x00\x00\x07body" {
+		t.Fatalf("writeResponse wrote %q", buffer.String())
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	e := &encoder{}
+	e.int8(-1)
+	e.int16(-2)
+	e.int32(-3)
+	e.int64(-4)
+	e.boolean(true)
+	e.string("topic")
+	e.nullString()
+	e.bytes([]byte("value"))
+	e.bytes(nil)
+	e.int32Array(1, 2)
+
+	d := &decoder{data: e.data}
+	i8, i16, i32, i64, boolean, topic := d.int8(), d.int16(), d.int32(), d.int64(), d.boolean(), d.string()
+	_, notNull := d.nullableString()
+	value, null := d.bytes(), d.bytes()
+	length := d.arrayLength()
+	first, second := d.int32(), d.int32()
+	if d.err != nil || i8 != -1 || i16 != -2 || i32 != -3 || i64 != -4 || !boolean || topic != "topic" || notNull || string(value) != "value" || null != nil || length != 2 || first != 1 || second != 2 {
+		t.Fatalf("decoded %d %d %d %d %t %q %t %q %q %d %d %d, %v", i8, i16, i32, i64, boolean, topic, notNull, value, null, length, first, second, d.err)
+	}
+	if len(d.data) != 0 {
+		t.Fatalf("%d bytes left after decoding", len(d.data))
+	}
+
+	malformed := []struct {
+		data   string
+		decode func(d *decoder)
+	}{
+		{"", func(d *decoder) { d.int32() }},
+		{"\x00\x05abc", func(d *decoder) { d.string() }},
+		// only nullable strings may have a negative length
+		{"\xff\xffabc", func(d *decoder) { d.string() }},
+		{"\xff\xfeabc", func(d *decoder) { d.string() }},
+		{"\x00\x00\x00\x05abc", func(d *decoder) { d.bytes() }},
+		// an array can't have more elements than bytes left
+		{"\x00\x00\x00\x04abc", func(d *decoder) { d.arrayLength() }},
+		{"\x7f\xff\xff\xff", func(d *decoder) { d.arrayLength() }},
+	}
+	for _, test := range malformed {
+		d := &decoder{data: []byte(test.data)}
+		test.decode(d)
+		// the first error sticks, even if there were enough bytes for a byte
+		d.int8()
+		if d.err != errMalformedRequest {
+			t.Errorf("decoding %q returned %v", test.data, d.err)
+		}
+	}
+
+	// a null array has a length of -1
+	d = &decoder{data: []byte("\xff\xff\xff\xff")}
+	if length := d.arrayLength(); d.err != nil || length != -1 {
+		t.Fatalf("decoded a null array as %d, %v", length, d.err)
+	}
+}
@@ -0,0 +1,191 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"github.com/cgrotz/turbine.go/backend"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// record batches are the message format of Kafka 0.11 and newer, the older
+// message sets aren't supported
+const recordBatchMagic = 2
+
+// compression codecs in the lowest bits of the batch attributes
+const (
+	compressionNone = 0
+	compressionGzip = 1
+	compressionMask = 7
+)
+
+// size of the batch header up to and including the length field
+const batchOverhead = 12
+
+// size of the batch header following the length field up to the records
+const batchHeaderSize = 49
+
+var errCorruptMessage = errors.New("corrupt record batch")
+var errUnsupportedCompression = errors.New("unsupported compression")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// decodeRecords returns the values of all records in the record batches.
+// Keys, headers and timestamps of the records are dropped, Turbine only keeps
+// payloads.
+func decodeRecords(data []byte) ([]string, error) {
+	var values []string
+	for len(data) > 0 {
+		if len(data) < batchOverhead {
+			return nil, errCorruptMessage
+		}
+		length := int(int32(binary.BigEndian.Uint32(data[8:])))
+		if length < batchHeaderSize || len(data) < batchOverhead+length {
+			return nil, errCorruptMessage
+		}
+		batch := data[batchOverhead : batchOverhead+length]
+		data = data[batchOverhead+length:]
+
+		// partition leader epoch, magic, crc and the checksummed remainder
+		if batch[4] != recordBatchMagic {
+			return nil, errCorruptMessage
+		}
+		if crc32.Checksum(batch[9:], crcTable) != binary.BigEndian.Uint32(batch[5:]) {
+			return nil, errCorruptMessage
+		}
+		attributes := binary.BigEndian.Uint16(batch[9:])
+		count := int(int32(binary.BigEndian.Uint32(batch[batchHeaderSize-4:])))
+		records := batch[batchHeaderSize:]
+
+		switch attributes & compressionMask {
+		case compressionNone:
+		case compressionGzip:
+			reader, err := gzip.NewReader(bytes.NewReader(records))
+			if err != nil {
+				return nil, errCorruptMessage
+			}
+			if records, err = ioutil.ReadAll(io.LimitReader(reader, maxRequestSize+1)); err != nil || len(records) > maxRequestSize {
+				return nil, errCorruptMessage
+			}
+		default:
+			return nil, errUnsupportedCompression
+		}
+
+		for i := 0; i < count; i++ {
+			value, rest, err := decodeRecord(records)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			records = rest
+		}
+	}
+	return values, nil
+}
+
+// decodeRecord returns the value of the record at the start of the data and
+// the data following the record
+func decodeRecord(data []byte) (string, []byte, error) {
+	length, n := binary.Varint(data)
+	if n <= 0 || length < 0 || int64(len(data)-n) < length {
+		return "", nil, errCorruptMessage
+	}
+	record := data[n : n+int(length)]
+	rest := data[n+int(length):]
+
+	// attributes
+	if len(record) < 1 {
+		return "", nil, errCorruptMessage
+	}
+	record = record[1:]
+	// timestamp and offset delta
+	for i := 0; i < 2; i++ {
+		if _, n = binary.Varint(record); n <= 0 {
+			return "", nil, errCorruptMessage
+		}
+		record = record[n:]
+	}
+	// key
+	if _, record = varintBytes(record); record == nil {
+		return "", nil, errCorruptMessage
+	}
+	value, record := varintBytes(record)
+	if record == nil {
+		return "", nil, errCorruptMessage
+	}
+	return string(value), rest, nil
+}
+
+// varintBytes returns the bytes prefixed with their varint length, null bytes
+// are returned as nil, and the data following them. The remainder is nil if
+// the data is too short.
+func varintBytes(data []byte) ([]byte, []byte) {
+	length, n := binary.Varint(data)
+	if n <= 0 || int64(len(data)-n) < length {
+		return nil, nil
+	}
+	if length < 0 {
+		return nil, data[n:]
+	}
+	return data[n : n+int(length)], data[n+int(length):]
+}
+
+// encodeRecords writes the datapoints as a single uncompressed record batch.
+// Turbine doesn't expose when a datapoint was stored, so the records come
+// without timestamps.
+func encodeRecords(datapoints []backend.OffsetDatapoint) []byte {
+	if len(datapoints) == 0 {
+		return []byte{}
+	}
+	baseOffset := kafkaOffset(datapoints[0].Offset)
+
+	var records []byte
+	for _, datapoint := range datapoints {
+		var record []byte
+		// attributes and timestamp delta
+		record = append(record, 0)
+		record = appendVarint(record, 0)
+		record = appendVarint(record, kafkaOffset(datapoint.Offset)-baseOffset)
+		// null key
+		record = appendVarint(record, -1)
+		record = appendVarint(record, int64(len(datapoint.Value)))
+		record = append(record, datapoint.Value...)
+		// no headers
+		record = appendVarint(record, 0)
+
+		records = appendVarint(records, int64(len(record)))
+		records = append(records, record...)
+	}
+
+	e := &encoder{}
+	e.int64(baseOffset)
+	e.int32(int32(batchHeaderSize + len(records)))
+	// partition leader epoch
+	e.int32(0)
+	e.int8(recordBatchMagic)
+	// crc, filled in below
+	e.int32(0)
+	crcStart := len(e.data)
+	e.int16(compressionNone)
+	e.int32(int32(kafkaOffset(datapoints[len(datapoints)-1].Offset) - baseOffset))
+	// first and max timestamp
+	e.int64(-1)
+	e.int64(-1)
+	// producer id, epoch and base sequence
+	e.int64(-1)
+	e.int16(-1)
+	e.int32(-1)
+	e.int32(int32(len(datapoints)))
+	e.data = append(e.data, records...)
+
+	binary.BigEndian.PutUint32(e.data[crcStart-4:], crc32.Checksum(e.data[crcStart:], crcTable))
+	return e.data
+}
+
+func appendVarint(data []byte, value int64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return append(data, buffer[:binary.PutVarint(buffer, value)]...)
+}
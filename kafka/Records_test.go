@@ -0,0 +1,95 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"hash/crc32"
+	"testing"
+)
+
+func TestRecordsRoundTrip(t *testing.T) {
+	datapoints := []backend.OffsetDatapoint{{Offset: 5, Value: "Event 1"}, {Offset: 6, Value: ""}, {Offset: 7, Value: "Event 3"}}
+	batch := encodeRecords(datapoints)
+	// the records of two batches are concatenated
+	values, err := decodeRecords(append(batch, batch...))
+	if err != nil || fmt.Sprintf("%q", values) != `["Event 1" "" "Event 3" "Event 1" "" "Event 3"]` {
+		t.Fatalf("decodeRecords returned %q, %v", values, err)
+	}
+	if baseOffset := int64(binary.BigEndian.Uint64(batch)); baseOffset != 4 {
+		t.Fatalf("expected the base offset 4 but got %d", baseOffset)
+	}
+
+	if values, err := decodeRecords(nil); err != nil || len(values) != 0 {
+		t.Fatalf("decodeRecords of no batch returned %q, %v", values, err)
+	}
+}
+
+func TestDecodeGzipRecords(t *testing.T) {
+	batch := encodeRecords([]backend.OffsetDatapoint{{Offset: 1, Value: "compressed"}})
+	var records bytes.Buffer
+	writer := gzip.NewWriter(&records)
+	writer.Write(batch[batchOverhead+batchHeaderSize:])
+	writer.Close()
+
+	batch = append(batch[:batchOverhead+batchHeaderSize], records.Bytes()...)
+	binary.BigEndian.PutUint32(batch[8:], uint32(len(batch)-batchOverhead))
+	binary.BigEndian.PutUint16(batch[21:], compressionGzip)
+	checksum(batch)
+	if values, err := decodeRecords(batch); err != nil || len(values) != 1 || values[0] != "compressed" {
+		t.Fatalf("decodeRecords returned %q, %v", values, err)
+	}
+}
+
+// checksum updates the crc of the batch after it was modified
+func checksum(batch []byte) {
+	binary.BigEndian.PutUint32(batch[17:], crc32.Checksum(batch[21:], crcTable))
+}
+
+func TestDecodeCorruptRecords(t *testing.T) {
+	valid := encodeRecords([]backend.OffsetDatapoint{{Offset: 1, Value: "Event 1"}})
+	tests := []struct {
+		name   string
+		modify func(batch []byte) []byte
+		err    error
+	}{
+		{"truncated header", func(batch []byte) []byte { return batch[:batchOverhead-1] }, errCorruptMessage},
+		{"truncated batch", func(batch []byte) []byte { return batch[:len(batch)-1] }, errCorruptMessage},
+		{"negative length", func(batch []byte) []byte {
+			binary.BigEndian.PutUint32(batch[8:], 0xffffffff)
+			return batch
+		}, errCorruptMessage},
+		{"old magic", func(batch []byte) []byte {
+			batch[16] = 1
+			return batch
+		}, errCorruptMessage},
+		{"checksum mismatch", func(batch []byte) []byte {
+			batch[len(batch)-2]++
+			return batch
+		}, errCorruptMessage},
+		{"more records than sent", func(batch []byte) []byte {
+			binary.BigEndian.PutUint32(batch[batchOverhead+batchHeaderSize-4:], 2)
+			checksum(batch)
+			return batch
+		}, errCorruptMessage},
+		{"negative record length", func(batch []byte) []byte {
+			batch[batchOverhead+batchHeaderSize] = 1
+			checksum(batch)
+			return batch
+		}, errCorruptMessage},
+		{"snappy", func(batch []byte) []byte {
+			binary.BigEndian.PutUint16(batch[21:], 2)
+			checksum(batch)
+			return batch
+		}, errUnsupportedCompression},
+	}
+
+	for _, test := range tests {
+		batch := test.modify(append([]byte(nil), valid...))
+		if values, err := decodeRecords(batch); err != test.err {
+			t.Errorf("decodeRecords of a batch with %s returned %q, %v instead of %v", test.name, values, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,829 @@
+package kafka
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// api keys of the supported requests
+const (
+	apiProduce         = 0
+	apiFetch           = 1
+	apiListOffsets     = 2
+	apiMetadata        = 3
+	apiOffsetCommit    = 8
+	apiOffsetFetch     = 9
+	apiFindCoordinator = 10
+	apiApiVersions     = 18
+)
+
+type apiVersion struct {
+	apiKey     int16
+	minVersion int16
+	maxVersion int16
+}
+
+// the supported versions end before the first one with tagged fields
+var apiVersions = []apiVersion{
+	{apiProduce, 3, 8},
+	{apiFetch, 4, 11},
+	{apiListOffsets, 0, 5},
+	{apiMetadata, 0, 8},
+	{apiOffsetCommit, 0, 7},
+	{apiOffsetFetch, 0, 5},
+	{apiFindCoordinator, 0, 2},
+	{apiApiVersions, 0, 2},
+}
+
+// error codes
+const (
+	errorNone                        = 0
+	errorUnknownServerError          = -1
+	errorOffsetOutOfRange            = 1
+	errorCorruptMessage              = 2
+	errorUnknownTopicOrPartition     = 3
+	errorUnsupportedVersion          = 35
+	errorUnsupportedForMessageFormat = 43
+	errorUnsupportedCompressionType  = 76
+)
+
+// special timestamps of a ListOffsets request
+const (
+	latestTimestamp   = -1
+	earliestTimestamp = -2
+)
+
+// Turbine is the only broker of its cluster
+const nodeId = 0
+
+const clusterId = "turbine"
+
+// authorized operations aren't reported
+const authorizedOperationsOmitted = -2147483648
+
+// upper bound of the time a fetch waits for datapoints
+const maxFetchWait = 30 * time.Second
+
+// how long a pipeline is known to exist without asking the backend again
+const pipelineCacheTimeout = time.Minute
+
+// Server speaks the subset of the Kafka protocol producers and consumers need.
+// Every pipeline is a topic with a single partition, whose records are the
+// datapoints. Kafka offsets start with 0, so the Kafka offset of a datapoint
+// is its Turbine offset minus one. This way the offset a consumer group
+// commits, the offset of the next record to read, equals the pointer of the
+// Turbine consumer named like the group. Group membership isn't supported,
+// consumers assign the partition themselves.
+type Server struct {
+	Backend backend.Backend
+	// upper bound of the records of a partition returned by a fetch
+	MaxPop int64
+}
+
+func (s *Server) ListenAndServe(bind string) error {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+type connection struct {
+	server *Server
+	conn   net.Conn
+	// pipelines known to exist and when that was checked
+	pipelines map[string]time.Time
+}
+
+// serve answers the requests of the connection in order, just like a Kafka
+// broker does
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &connection{server: s, conn: conn, pipelines: make(map[string]time.Time)}
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		req, err := readRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Error reading kafka request:", err.Error())
+			}
+			return
+		}
+
+		body, err := c.handle(req)
+		if err != nil {
+			log.Printf("Error handling kafka request %d v%d of client %s: %s", req.apiKey, req.apiVersion, req.clientId, err.Error())
+			return
+		}
+		// producers with acks=0 don't expect a response
+		if body != nil {
+			if err := writeResponse(writer, req.correlationId, body); err != nil {
+				return
+			}
+		}
+		// pipelined requests are answered at once
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *connection) handle(req *request) ([]byte, error) {
+	if !supports(req.apiKey, req.apiVersion) {
+		if req.apiKey == apiApiVersions {
+			// clients try their latest version first and fall back to a
+			// supported one, which is announced in a version 0 response
+			return c.apiVersions(0, errorUnsupportedVersion), nil
+		}
+		return nil, fmt.Errorf("unsupported api key %d with version %d", req.apiKey, req.apiVersion)
+	}
+
+	var body []byte
+	switch req.apiKey {
+	case apiProduce:
+		body = c.produce(req.apiVersion, req.body)
+	case apiFetch:
+		body = c.fetch(req.apiVersion, req.body)
+	case apiListOffsets:
+		body = c.listOffsets(req.apiVersion, req.body)
+	case apiMetadata:
+		body = c.metadata(req.apiVersion, req.body)
+	case apiOffsetCommit:
+		body = c.offsetCommit(req.apiVersion, req.body)
+	case apiOffsetFetch:
+		body = c.offsetFetch(req.apiVersion, req.body)
+	case apiFindCoordinator:
+		body = c.findCoordinator(req.apiVersion, req.body)
+	case apiApiVersions:
+		body = c.apiVersions(req.apiVersion, errorNone)
+	}
+	if req.body.err != nil {
+		return nil, req.body.err
+	}
+	return body, nil
+}
+
+func supports(apiKey int16, version int16) bool {
+	for _, api := range apiVersions {
+		if api.apiKey == apiKey {
+			return version >= api.minVersion && version <= api.maxVersion
+		}
+	}
+	return false
+}
+
+func (c *connection) apiVersions(version int16, errorCode int16) []byte {
+	e := &encoder{}
+	e.int16(errorCode)
+	e.arrayLength(len(apiVersions))
+	for _, api := range apiVersions {
+		e.int16(api.apiKey)
+		e.int16(api.minVersion)
+		e.int16(api.maxVersion)
+	}
+	if version >= 1 {
+		// throttle time
+		e.int32(0)
+	}
+	return e.data
+}
+
+// produce pushes the records of each partition as one batch. With acks=0 the
+// producer doesn't wait for a response, otherwise the response is sent once
+// the datapoints are stored.
+func (c *connection) produce(version int16, d *decoder) []byte {
+	// transactional id
+	d.nullableString()
+	acks := d.int16()
+	// timeout
+	d.int32()
+
+	e := &encoder{}
+	topics := d.arrayLength()
+	e.arrayLength(topics)
+	for i := 0; i < topics; i++ {
+		topic := d.string()
+		e.string(topic)
+		partitions := d.arrayLength()
+		e.arrayLength(partitions)
+		for j := 0; j < partitions; j++ {
+			partition := d.int32()
+			records := d.bytes()
+			if d.err != nil {
+				return nil
+			}
+
+			errorCode, baseOffset := c.push(topic, partition, records, acks != 0)
+			e.int32(partition)
+			e.int16(errorCode)
+			e.int64(baseOffset)
+			// log append time
+			e.int64(-1)
+			if version >= 5 {
+				// log start offset
+				e.int64(-1)
+			}
+			if version >= 8 {
+				// record errors and error message
+				e.arrayLength(0)
+				e.nullString()
+			}
+		}
+	}
+	// throttle time
+	e.int32(0)
+
+	if acks == 0 {
+		return nil
+	}
+	return e.data
+}
+
+// push stores the records and returns the error code and the Kafka offset of
+// the first record
+func (c *connection) push(topic string, partition int32, records []byte, ack bool) (int16, int64) {
+	if partition != 0 || !c.pipelineExists(topic) {
+		return errorUnknownTopicOrPartition, -1
+	}
+	values, err := decodeRecords(records)
+	if err == errUnsupportedCompression {
+		return errorUnsupportedCompressionType, -1
+	}
+	if err != nil {
+		return errorCorruptMessage, -1
+	}
+	if len(values) == 0 {
+		return errorNone, -1
+	}
+
+	first, _, err := c.server.Backend.PushDatapoints(topic, values, ack)
+	if err != nil {
+		log.Println("Error pushing datapoints:", err.Error())
+		return errorUnknownServerError, -1
+	}
+	return errorNone, kafkaOffset(first)
+}
+
+type fetchPartition struct {
+	topic    string
+	offset   int64
+	maxBytes int64
+	// the response of the partition
+	errorCode  int16
+	first      int64
+	last       int64
+	datapoints []backend.OffsetDatapoint
+}
+
+// fetch reads the datapoints following the offsets. If there are fewer bytes
+// than the consumer asked for, it waits until datapoints are pushed to one of
+// the pipelines or the maximum wait time passed.
+func (c *connection) fetch(version int16, d *decoder) []byte {
+	// replica id
+	d.int32()
+	maxWait := time.Duration(d.int32()) * time.Millisecond
+	minBytes := int64(d.int32())
+	maxBytes := int64(d.int32())
+	// isolation level, there are no transactions
+	d.int8()
+	if version >= 7 {
+		// fetch sessions aren't supported, every fetch is a full fetch
+		d.int32()
+		d.int32()
+	}
+
+	var topics []string
+	partitions := make(map[string][]*fetchPartition)
+	topicCount := d.arrayLength()
+	for i := 0; i < topicCount; i++ {
+		topic := d.string()
+		topics = append(topics, topic)
+		partitionCount := d.arrayLength()
+		for j := 0; j < partitionCount; j++ {
+			p := &fetchPartition{topic: topic}
+			index := d.int32()
+			if version >= 9 {
+				// current leader epoch
+				d.int32()
+			}
+			p.offset = d.int64()
+			if version >= 5 {
+				// log start offset of followers
+				d.int64()
+			}
+			p.maxBytes = int64(d.int32())
+			if index != 0 || !c.pipelineExists(topic) {
+				p.errorCode = errorUnknownTopicOrPartition
+			}
+			partitions[topic] = append(partitions[topic], p)
+		}
+	}
+	if version >= 7 {
+		forgotten := d.arrayLength()
+		for i := 0; i < forgotten && d.err == nil; i++ {
+			d.string()
+			for j := d.arrayLength(); j > 0; j-- {
+				d.int32()
+			}
+		}
+	}
+	if version >= 11 {
+		// rack id
+		d.string()
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	if maxWait > maxFetchWait {
+		maxWait = maxFetchWait
+	}
+	deadline := time.Now().Add(maxWait)
+	var cases []reflect.SelectCase
+	if maxWait > 0 && minBytes > 0 {
+		for topic := range partitions {
+			notifications := c.server.Backend.Subscribe(topic)
+			defer c.server.Backend.Unsubscribe(topic, notifications)
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(notifications)})
+		}
+	}
+
+	for {
+		bytes := c.readPartitions(topics, partitions, maxBytes)
+		wait := deadline.Sub(time.Now())
+		if bytes >= minBytes || len(cases) == 0 || wait <= 0 {
+			break
+		}
+		timer := time.NewTimer(wait)
+		chosen, _, _ := reflect.Select(append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)}))
+		timer.Stop()
+		if chosen == len(cases) {
+			c.readPartitions(topics, partitions, maxBytes)
+			break
+		}
+	}
+
+	e := &encoder{}
+	// throttle time
+	e.int32(0)
+	if version >= 7 {
+		e.int16(errorNone)
+		// session id
+		e.int32(0)
+	}
+	e.arrayLength(len(topics))
+	for _, topic := range topics {
+		e.string(topic)
+		e.arrayLength(len(partitions[topic]))
+		for _, p := range partitions[topic] {
+			e.int32(0)
+			e.int16(p.errorCode)
+			// high watermark, last stable offset and log start offset
+			e.int64(p.last)
+			e.int64(p.last)
+			if version >= 5 {
+				e.int64(p.first)
+			}
+			// aborted transactions
+			e.arrayLength(0)
+			if version >= 11 {
+				// preferred read replica
+				e.int32(-1)
+			}
+			e.bytes(encodeRecords(p.datapoints))
+		}
+	}
+	return e.data
+}
+
+// readPartitions reads the datapoints of the partitions within the limits of
+// the fetch and returns their size. Partitions already read are left alone.
+func (c *connection) readPartitions(topics []string, partitions map[string][]*fetchPartition, maxBytes int64) int64 {
+	var bytes int64
+	for _, topic := range topics {
+		for _, p := range partitions[topic] {
+			if len(p.datapoints) == 0 && p.errorCode == errorNone && (maxBytes <= 0 || bytes < maxBytes) {
+				c.readPartition(p)
+			}
+			for _, datapoint := range p.datapoints {
+				bytes += int64(len(datapoint.Value))
+			}
+		}
+	}
+	return bytes
+}
+
+func (c *connection) readPartition(p *fetchPartition) {
+	var err error
+	p.first, p.last, err = c.server.Backend.DatapointOffsets(p.topic)
+	if err != nil {
+		log.Println("Error retrieving datapoint offsets:", err.Error())
+		p.errorCode = errorUnknownServerError
+		return
+	}
+	// the Kafka offset of the next record is the Turbine offset of the
+	// datapoint before it
+	if p.offset < p.first || p.offset > p.last {
+		p.errorCode = errorOffsetOutOfRange
+		return
+	}
+
+	p.datapoints, err = c.server.Backend.ReadDatapoints(p.topic, p.offset, backend.PopLimit{Max: c.server.MaxPop, MaxBytes: p.maxBytes})
+	if err != nil {
+		log.Println("Error reading datapoints:", err.Error())
+		p.errorCode = errorUnknownServerError
+	}
+}
+
+// listOffsets answers the earliest and the latest offset of partitions,
+// looking up offsets by the time of the records isn't supported
+func (c *connection) listOffsets(version int16, d *decoder) []byte {
+	// replica id
+	d.int32()
+	if version >= 2 {
+		// isolation level
+		d.int8()
+	}
+
+	e := &encoder{}
+	if version >= 2 {
+		// throttle time
+		e.int32(0)
+	}
+	topics := d.arrayLength()
+	e.arrayLength(topics)
+	for i := 0; i < topics; i++ {
+		topic := d.string()
+		e.string(topic)
+		partitions := d.arrayLength()
+		e.arrayLength(partitions)
+		for j := 0; j < partitions; j++ {
+			partition := d.int32()
+			if version >= 4 {
+				// current leader epoch
+				d.int32()
+			}
+			timestamp := d.int64()
+			if version == 0 {
+				// max number of offsets
+				d.int32()
+			}
+			if d.err != nil {
+				return nil
+			}
+
+			errorCode, offset := c.listOffset(topic, partition, timestamp)
+			e.int32(partition)
+			e.int16(errorCode)
+			if version == 0 {
+				if errorCode == errorNone {
+					e.arrayLength(1)
+					e.int64(offset)
+				} else {
+					e.arrayLength(0)
+				}
+				continue
+			}
+			// timestamp
+			e.int64(-1)
+			e.int64(offset)
+			if version >= 4 {
+				// leader epoch
+				e.int32(0)
+			}
+		}
+	}
+	return e.data
+}
+
+func (c *connection) listOffset(topic string, partition int32, timestamp int64) (int16, int64) {
+	if partition != 0 || !c.pipelineExists(topic) {
+		return errorUnknownTopicOrPartition, -1
+	}
+	if timestamp != latestTimestamp && timestamp != earliestTimestamp {
+		return errorUnsupportedForMessageFormat, -1
+	}
+
+	first, last, err := c.server.Backend.DatapointOffsets(topic)
+	if err != nil {
+		log.Println("Error retrieving datapoint offsets:", err.Error())
+		return errorUnknownServerError, -1
+	}
+	if timestamp == earliestTimestamp {
+		return errorNone, first
+	}
+	return errorNone, last
+}
+
+// metadata describes the requested pipelines as topics led by this broker,
+// without topics it describes all of them. Topics are never created.
+func (c *connection) metadata(version int16, d *decoder) []byte {
+	topics := d.arrayLength()
+	var names []string
+	for i := 0; i < topics; i++ {
+		names = append(names, d.string())
+	}
+	if version >= 4 {
+		// allow auto topic creation
+		d.boolean()
+	}
+	if version >= 8 {
+		// include cluster and topic authorized operations
+		d.boolean()
+		d.boolean()
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	errorCodes := make(map[string]int16)
+	if topics <= 0 && (version == 0 || topics < 0) {
+		pipelines, err := c.server.Backend.GetPipelines()
+		if err != nil {
+			log.Println("Error retrieving pipelines:", err.Error())
+		}
+		for _, pipeline := range pipelines {
+			names = append(names, pipeline.Id)
+		}
+	} else {
+		for _, name := range names {
+			if !c.pipelineExists(name) {
+				errorCodes[name] = errorUnknownTopicOrPartition
+			}
+		}
+	}
+
+	e := &encoder{}
+	if version >= 3 {
+		// throttle time
+		e.int32(0)
+	}
+	e.arrayLength(1)
+	c.broker(e)
+	if version >= 1 {
+		// rack
+		e.nullString()
+	}
+	if version >= 2 {
+		e.string(clusterId)
+	}
+	if version >= 1 {
+		// controller id
+		e.int32(nodeId)
+	}
+
+	e.arrayLength(len(names))
+	for _, name := range names {
+		errorCode := errorCodes[name]
+		e.int16(errorCode)
+		e.string(name)
+		if version >= 1 {
+			// is internal
+			e.boolean(false)
+		}
+		if errorCode != errorNone {
+			e.arrayLength(0)
+		} else {
+			e.arrayLength(1)
+			e.int16(errorNone)
+			// partition index and leader
+			e.int32(0)
+			e.int32(nodeId)
+			if version >= 7 {
+				// leader epoch
+				e.int32(0)
+			}
+			// replicas and in sync replicas
+			e.int32Array(nodeId)
+			e.int32Array(nodeId)
+			if version >= 5 {
+				// offline replicas
+				e.int32Array()
+			}
+		}
+		if version >= 8 {
+			e.int32(authorizedOperationsOmitted)
+		}
+	}
+	if version >= 8 {
+		e.int32(authorizedOperationsOmitted)
+	}
+	return e.data
+}
+
+// offsetCommit moves the consumer named like the group to the committed
+// offsets. Unlike a Turbine commit, a Kafka commit may move the consumer back.
+func (c *connection) offsetCommit(version int16, d *decoder) []byte {
+	group := d.string()
+	if version >= 1 {
+		// generation and member id
+		d.int32()
+		d.string()
+	}
+	if version >= 7 {
+		// group instance id
+		d.nullableString()
+	}
+	if version >= 2 && version <= 4 {
+		// retention time
+		d.int64()
+	}
+
+	e := &encoder{}
+	if version >= 3 {
+		// throttle time
+		e.int32(0)
+	}
+	topics := d.arrayLength()
+	e.arrayLength(topics)
+	for i := 0; i < topics; i++ {
+		topic := d.string()
+		e.string(topic)
+		partitions := d.arrayLength()
+		e.arrayLength(partitions)
+		for j := 0; j < partitions; j++ {
+			partition := d.int32()
+			offset := d.int64()
+			if version >= 6 {
+				// committed leader epoch
+				d.int32()
+			}
+			if version == 1 {
+				// commit timestamp
+				d.int64()
+			}
+			// metadata isn't kept
+			d.nullableString()
+			if d.err != nil {
+				return nil
+			}
+
+			e.int32(partition)
+			e.int16(c.commit(topic, partition, group, offset))
+		}
+	}
+	return e.data
+}
+
+func (c *connection) commit(topic string, partition int32, group string, offset int64) int16 {
+	if partition != 0 || !c.pipelineExists(topic) {
+		return errorUnknownTopicOrPartition
+	}
+	if offset < 0 {
+		return errorOffsetOutOfRange
+	}
+
+	if _, err := c.server.Backend.CreateConsumer(topic, group); err != nil && err != backend.ErrConsumerExists {
+		log.Println("Error creating consumer:", err.Error())
+		return errorUnknownServerError
+	}
+	// seeking to an offset makes the datapoint at that offset the next one
+	// read, which is the datapoint following the committed Kafka offset
+	_, err := c.server.Backend.SeekConsumer(topic, group, backend.Seek{Position: backend.SeekOffset, Offset: offset + 1})
+	if err == backend.ErrInvalidOffset {
+		return errorOffsetOutOfRange
+	}
+	if err != nil {
+		log.Println("Error seeking consumer:", err.Error())
+		return errorUnknownServerError
+	}
+	return errorNone
+}
+
+// offsetFetch answers the pointers of the consumers named like the group,
+// -1 if there is no such consumer yet
+func (c *connection) offsetFetch(version int16, d *decoder) []byte {
+	group := d.string()
+
+	e := &encoder{}
+	if version >= 3 {
+		// throttle time
+		e.int32(0)
+	}
+	// all topics with committed offsets are asked for with a null array,
+	// which would mean looking through all pipelines, so none are answered
+	topics := d.arrayLength()
+	if topics < 0 {
+		topics = 0
+	}
+	e.arrayLength(topics)
+	for i := 0; i < topics; i++ {
+		topic := d.string()
+		e.string(topic)
+		partitions := d.arrayLength()
+		if partitions < 0 {
+			partitions = 0
+		}
+		e.arrayLength(partitions)
+		for j := 0; j < partitions; j++ {
+			partition := d.int32()
+			if d.err != nil {
+				return nil
+			}
+
+			errorCode, offset := c.committed(topic, partition, group)
+			e.int32(partition)
+			e.int64(offset)
+			if version >= 5 {
+				// committed leader epoch
+				e.int32(-1)
+			}
+			// metadata
+			e.string("")
+			e.int16(errorCode)
+		}
+	}
+	if version >= 2 {
+		e.int16(errorNone)
+	}
+	return e.data
+}
+
+func (c *connection) committed(topic string, partition int32, group string) (int16, int64) {
+	if partition != 0 || !c.pipelineExists(topic) {
+		return errorUnknownTopicOrPartition, -1
+	}
+
+	consumers, err := c.server.Backend.GetConsumers(topic)
+	if err != nil {
+		log.Println("Error retrieving consumers:", err.Error())
+		return errorUnknownServerError, -1
+	}
+	for _, consumer := range consumers {
+		if consumer.Id == group {
+			return errorNone, consumer.Offset
+		}
+	}
+	return errorNone, -1
+}
+
+// findCoordinator names this broker as coordinator of every group
+func (c *connection) findCoordinator(version int16, d *decoder) []byte {
+	// key
+	d.string()
+	if version >= 1 {
+		// key type
+		d.int8()
+	}
+
+	e := &encoder{}
+	if version >= 1 {
+		// throttle time
+		e.int32(0)
+	}
+	e.int16(errorNone)
+	if version >= 1 {
+		// error message
+		e.nullString()
+	}
+	c.broker(e)
+	return e.data
+}
+
+// broker writes the node id, host and port of this broker. The address the
+// client connected to is the one announced, there is no other.
+func (c *connection) broker(e *encoder) {
+	host, port, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	portNumber, _ := strconv.Atoi(port)
+	e.int32(nodeId)
+	e.string(host)
+	e.int32(int32(portNumber))
+}
+
+func (c *connection) pipelineExists(id string) bool {
+	if id == "" {
+		return false
+	}
+	if checked, ok := c.pipelines[id]; ok && time.Since(checked) < pipelineCacheTimeout {
+		return true
+	}
+	if _, err := c.server.Backend.GetPipeline(id); err != nil {
+		return false
+	}
+	c.pipelines[id] = time.Now()
+	return true
+}
+
+// kafkaOffset returns the Kafka offset of the datapoint with the Turbine offset
+func kafkaOffset(offset int64) int64 {
+	return offset - 1
+}
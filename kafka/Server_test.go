@@ -0,0 +1,233 @@
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// how long a test waits for a response
+const testTimeout = 5 * time.Second
+
+// testClient sends requests to a connection served over a pipe
+type testClient struct {
+	t             *testing.T
+	conn          net.Conn
+	reader        *bufio.Reader
+	correlationId int32
+	served        chan struct{}
+}
+
+func dial(t *testing.T, s *Server) *testClient {
+	client, server := net.Pipe()
+	c := &testClient{t: t, conn: client, reader: bufio.NewReader(client), served: make(chan struct{})}
+	go func() {
+		s.serve(server)
+		close(c.served)
+	}()
+	return c
+}
+
+// send writes the request with its header at once, a pipe blocks on writes
+// until they are read
+func (c *testClient) send(apiKey int16, version int16, body []byte) {
+	c.correlationId++
+	e := &encoder{}
+	e.int32(int32(10 + len("test") + len(body)))
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(c.correlationId)
+	e.string("test")
+	e.data = append(e.data, body...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := c.conn.Write(e.data); err != nil {
+		c.t.Fatalf("Sending request %d failed: %s", apiKey, err.Error())
+	}
+}
+
+// request sends the request and returns the body of the response
+func (c *testClient) request(apiKey int16, version int16, body []byte) *decoder {
+	c.send(apiKey, version, body)
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		c.t.Fatalf("Reading the response to request %d failed: %s", apiKey, err.Error())
+	}
+	if correlationId := int32(binary.BigEndian.Uint32(header[4:])); correlationId != c.correlationId {
+		c.t.Fatalf("expected the response to request %d but got %d", c.correlationId, correlationId)
+	}
+	body = make([]byte, binary.BigEndian.Uint32(header)-4)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		c.t.Fatalf("Reading the response to request %d failed: %s", apiKey, err.Error())
+	}
+	return &decoder{data: body}
+}
+
+// produce sends the records to partition 0 of the topic with acks=1 and
+// returns the error code and the base offset of the partition
+func (c *testClient) produce(topic string, records []byte) (int16, int64) {
+	e := &encoder{}
+	e.nullString()
+	e.int16(1)
+	e.int32(1000)
+	e.arrayLength(1)
+	e.string(topic)
+	e.arrayLength(1)
+	e.int32(0)
+	e.bytes(records)
+
+	d := c.request(apiProduce, 3, e.data)
+	if topics, name, partitions, partition := d.arrayLength(), d.string(), d.arrayLength(), d.int32(); topics != 1 || name != topic || partitions != 1 || partition != 0 {
+		c.t.Fatalf("produce answered %d topics %s with %d partitions %d", topics, name, partitions, partition)
+	}
+	errorCode, baseOffset := d.int16(), d.int64()
+	if d.err != nil {
+		c.t.Fatalf("malformed produce response: %s", d.err.Error())
+	}
+	return errorCode, baseOffset
+}
+
+// fetch reads partition 0 of the topic from the offset without waiting and
+// returns the error code, the high watermark and the values of the records
+func (c *testClient) fetch(topic string, offset int64) (int16, int64, []string) {
+	e := &encoder{}
+	e.int32(-1)
+	e.int32(0)
+	e.int32(0)
+	e.int32(1024 * 1024)
+	e.int8(0)
+	e.arrayLength(1)
+	e.string(topic)
+	e.arrayLength(1)
+	e.int32(0)
+	e.int64(offset)
+	e.int32(1024 * 1024)
+
+	d := c.request(apiFetch, 4, e.data)
+	// throttle time
+	d.int32()
+	if topics, name, partitions, partition := d.arrayLength(), d.string(), d.arrayLength(), d.int32(); topics != 1 || name != topic || partitions != 1 || partition != 0 {
+		c.t.Fatalf("fetch answered %d topics %s with %d partitions %d", topics, name, partitions, partition)
+	}
+	errorCode, highWatermark := d.int16(), d.int64()
+	// last stable offset and aborted transactions
+	d.int64()
+	d.arrayLength()
+	records := d.bytes()
+	if d.err != nil {
+		c.t.Fatalf("malformed fetch response: %s", d.err.Error())
+	}
+	values, err := decodeRecords(records)
+	if err != nil {
+		c.t.Fatalf("fetch answered corrupt records: %s", err.Error())
+	}
+	return errorCode, highWatermark, values
+}
+
+func (c *testClient) close() {
+	c.conn.Close()
+	<-c.served
+}
+
+func createPipeline(t *testing.T, b backend.Backend) *backend.Pipeline {
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "kafka"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	return pipeline
+}
+
+func records(values ...string) []byte {
+	var datapoints []backend.OffsetDatapoint
+	for i, value := range values {
+		datapoints = append(datapoints, backend.OffsetDatapoint{Offset: int64(i + 1), Value: value})
+	}
+	return encodeRecords(datapoints)
+}
+
+// TestProduceFetch verifies that records are stored as datapoints and read
+// back at their Kafka offsets
+func TestProduceFetch(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := createPipeline(t, b)
+	c := dial(t, &Server{Backend: b})
+	defer c.close()
+
+	if errorCode, baseOffset := c.produce(pipeline.Id, records("Event 1", "Event 2")); errorCode != errorNone || baseOffset != 0 {
+		t.Fatalf("produce answered error %d and base offset %d", errorCode, baseOffset)
+	}
+	if errorCode, baseOffset := c.produce(pipeline.Id, records("Event 3")); errorCode != errorNone || baseOffset != 2 {
+		t.Fatalf("produce answered error %d and base offset %d", errorCode, baseOffset)
+	}
+
+	tests := []struct {
+		offset    int64
+		errorCode int16
+		values    string
+	}{
+		{0, errorNone, "[Event 1 Event 2 Event 3]"},
+		{2, errorNone, "[Event 3]"},
+		{3, errorNone, "[]"},
+		{4, errorOffsetOutOfRange, "[]"},
+		{-1, errorOffsetOutOfRange, "[]"},
+	}
+	for _, test := range tests {
+		errorCode, highWatermark, values := c.fetch(pipeline.Id, test.offset)
+		if errorCode != test.errorCode || fmt.Sprint(values) != test.values {
+			t.Errorf("fetching offset %d answered error %d and %q instead of error %d and %s", test.offset, errorCode, values, test.errorCode, test.values)
+		}
+		if errorCode == errorNone && highWatermark != 3 {
+			t.Errorf("fetching offset %d answered the high watermark %d", test.offset, highWatermark)
+		}
+	}
+}
+
+func TestProduceErrors(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := createPipeline(t, b)
+	c := dial(t, &Server{Backend: b})
+	defer c.close()
+
+	if errorCode, _ := c.produce("unknown", records("Event 1")); errorCode != errorUnknownTopicOrPartition {
+		t.Fatalf("producing to an unknown topic answered error %d", errorCode)
+	}
+	corrupt := records("Event 1")
+	corrupt[len(corrupt)-1]++
+	if errorCode, _ := c.produce(pipeline.Id, corrupt); errorCode != errorCorruptMessage {
+		t.Fatalf("producing corrupt records answered error %d", errorCode)
+	}
+	if errorCode, _, values := c.fetch(pipeline.Id, 0); errorCode != errorNone || len(values) != 0 {
+		t.Fatalf("expected no datapoints but fetched %q with error %d", values, errorCode)
+	}
+}
+
+// TestMalformedRequest verifies that a request ending early ends the connection
+func TestMalformedRequest(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := createPipeline(t, b)
+	c := dial(t, &Server{Backend: b})
+	defer c.close()
+
+	e := &encoder{}
+	e.nullString()
+	e.int16(1)
+	e.int32(1000)
+	e.arrayLength(1)
+	e.string(pipeline.Id)
+	e.arrayLength(1)
+	e.int32(0)
+	// records claiming more bytes than sent
+	e.int32(100)
+	c.send(apiProduce, 3, e.data)
+
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to be closed but reading returned %v", err)
+	}
+}
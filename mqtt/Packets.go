@@ -0,0 +1,174 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// control packet types of MQTT 3.1.1
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// return codes of the connack packet
+const (
+	connectAccepted             = 0
+	connectUnacceptableProtocol = 1
+	connectIdentifierRejected   = 2
+)
+
+// return code of the suback packet for rejected topic filters
+const subscribeFailure = 0x80
+
+// maximum size of a packet without its fixed header
+const maxPacketSize = 16 * 1024 * 1024
+
+var errMalformedPacket = errors.New("malformed packet")
+
+// packet is a control packet, flags are the lower four bits of its fixed header
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// the remaining length is encoded in up to four bytes, seven bits each
+	var length, multiplier int = 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errMalformedPacket
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(digit&127) * multiplier
+		multiplier *= 128
+		if digit&128 == 0 {
+			break
+		}
+	}
+	if length > maxPacketSize {
+		return nil, fmt.Errorf("packet of %d bytes exceeds the maximum of %d bytes", length, maxPacketSize)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &packet{kind: header >> 4, flags: header & 15, body: body}, nil
+}
+
+func writePacket(w io.Writer, kind byte, flags byte, body []byte) error {
+	header := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 128
+		}
+		header = append(header, digit)
+		if length == 0 {
+			break
+		}
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// decoder reads the fields of a packet body, the first error sticks
+type decoder struct {
+	body []byte
+	err  error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.body) < 1 {
+		d.err = errMalformedPacket
+		return 0
+	}
+	value := d.body[0]
+	d.body = d.body[1:]
+	return value
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.body) < 2 {
+		d.err = errMalformedPacket
+		return 0
+	}
+	value := binary.BigEndian.Uint16(d.body)
+	d.body = d.body[2:]
+	return value
+}
+
+func (d *decoder) bytes() []byte {
+	length := int(d.uint16())
+	if d.err != nil || len(d.body) < length {
+		d.err = errMalformedPacket
+		return nil
+	}
+	value := d.body[:length]
+	d.body = d.body[length:]
+	return value
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// rest returns the remaining bytes, e.g. the payload of a publish packet
+func (d *decoder) rest() []byte {
+	value := d.body
+	d.body = nil
+	return value
+}
+
+// encoder builds a packet body
+type encoder struct {
+	body []byte
+}
+
+func (e *encoder) byte(value byte) {
+	e.body = append(e.body, value)
+}
+
+func (e *encoder) uint16(value uint16) {
+	e.body = append(e.body, byte(value>>8), byte(value))
+}
+
+func (e *encoder) string(value string) {
+	e.uint16(uint16(len(value)))
+	e.body = append(e.body, value...)
+}
+
+func (e *encoder) raw(value []byte) {
+	e.body = append(e.body, value...)
+}
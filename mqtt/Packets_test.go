@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadPacket(t *testing.T) {
+	tests := []struct {
+		input string
+		kind  byte
+		flags byte
+		body  string
+		err   error
+	}{
+		{"\xc0\x00", packetPingreq, 0, "", nil},
+		{"\x32\x03abc", packetPublish, 2, "abc", nil},
+		{"\x30\x80\x01" + strings.Repeat("a", 128), packetPublish, 0, strings.Repeat("a", 128), nil},
+		// the remaining length takes at most four bytes
+		{"\x30\xff\xff\xff\xff\x01", 0, 0, "", errMalformedPacket},
+		{"\x30\xff\xff\xff\x7f", 0, 0, "", fmt.Errorf("packet of 268435455 bytes exceeds the maximum of %d bytes", maxPacketSize)},
+		{"\x30\x03ab", 0, 0, "", io.ErrUnexpectedEOF},
+		{"\x30\x80", 0, 0, "", io.EOF},
+		{"", 0, 0, "", io.EOF},
+	}
+
+	for _, test := range tests {
+		p, err := readPacket(bufio.NewReader(strings.NewReader(test.input)))
+		if fmt.Sprint(err) != fmt.Sprint(test.err) {
+			t.Errorf("readPacket(%.20q) returned %v instead of %v", test.input, err, test.err)
+			continue
+		}
+		if err == nil && (p.kind != test.kind || p.flags != test.flags || string(p.body) != test.body) {
+			t.Errorf("readPacket(%.20q) returned %d %d %.20q instead of %d %d %.20q", test.input, p.kind, p.flags, p.body, test.kind, test.flags, test.body)
+		}
+	}
+}
+
+// TestWritePacket checks the remaining length at the limits of its encoding
+func TestWritePacket(t *testing.T) {
+	for _, length := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152} {
+		body := bytes.Repeat([]byte{'a'}, length)
+		var buffer bytes.Buffer
+		if err := writePacket(&buffer, packetPublish, 3, body); err != nil {
+			t.Fatalf("writePacket failed: %s", err.Error())
+		}
+		p, err := readPacket(bufio.NewReader(&buffer))
+		if err != nil || p.kind != packetPublish || p.flags != 3 || !bytes.Equal(p.body, body) {
+			t.Errorf("packet with a body of %d bytes didn't survive the round trip: %v", length, err)
+		}
+		if buffer.Len() != 0 {
+			t.Errorf("%d bytes left after reading a packet with a body of %d bytes", buffer.Len(), length)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	e := encoder{}
+	e.string("turbine/a")
+	e.uint16(42)
+	e.byte(1)
+	e.raw([]byte("payload"))
+
+	d := &decoder{body: e.body}
+	if topic, id, qos, rest := d.string(), d.uint16(), d.byte(), d.rest(); d.err != nil || topic != "turbine/a" || id != 42 || qos != 1 || string(rest) != "payload" {
+		t.Fatalf("decoded %q %d %d %q, %v", topic, id, qos, rest, d.err)
+	}
+
+	malformed := []string{
+		"",
+		"\x00",
+		// a string claiming more bytes than left
+		"\x00\x05abc",
+	}
+	for _, body := range malformed {
+		d := &decoder{body: []byte(body)}
+		d.string()
+		// the first error sticks, even if there were enough bytes for a byte
+		d.byte()
+		if d.err != errMalformedPacket {
+			t.Errorf("decoding %q returned %v", body, d.err)
+		}
+	}
+}
@@ -0,0 +1,587 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"github.com/satori/go.uuid"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// topics of the form turbine/<pipeline> map to pipelines
+const topicPrefix = "turbine/"
+
+// how many datapoints are sent to a subscriber before waiting for its acknowledgements
+const maxInflight = 10
+
+// subscribers read again after this interval even without a notification,
+// datapoints may have been pushed through another Turbine server
+const pollInterval = 15 * time.Second
+
+// how long a client may take to send its connect packet
+const connectTimeout = 10 * time.Second
+
+const writeTimeout = 10 * time.Second
+
+// Server is an MQTT 3.1.1 front-end of the backend. Publishing to
+// turbine/<pipeline> pushes a datapoint, subscribing to it consumes the
+// pipeline with the client id as consumer. As the consumer pointer is kept
+// by the backend, a client subscribing again continues where it left off.
+type Server struct {
+	Backend backend.Backend
+
+	mutex       sync.Mutex
+	connections map[string]*connection
+	// pipelines and granted qos subscribed by clients without clean session
+	sessions map[string]map[string]byte
+}
+
+func NewServer(b backend.Backend) *Server {
+	return &Server{
+		Backend:     b,
+		connections: make(map[string]*connection),
+		sessions:    make(map[string]map[string]byte),
+	}
+}
+
+func (s *Server) ListenAndServe(bind string) error {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	c := &connection{
+		server:        s,
+		conn:          conn,
+		reader:        bufio.NewReader(conn),
+		inflight:      make(map[uint16]*subscription),
+		subscriptions: make(map[string]*subscription),
+		consumed:      make(map[string]bool),
+		received:      make(map[uint16]bool),
+	}
+	defer c.close()
+
+	if err := c.connect(); err != nil {
+		log.Println("Error connecting mqtt client:", err.Error())
+		return
+	}
+
+	for {
+		if c.keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+
+		p, err := readPacket(c.reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading from mqtt client %s: %s", c.clientId, err.Error())
+			}
+			break
+		}
+		if p.kind == packetDisconnect {
+			// the will is only published if the client didn't disconnect
+			c.will = nil
+			break
+		}
+		if err := c.handle(p); err != nil {
+			log.Printf("Error handling packet of mqtt client %s: %s", c.clientId, err.Error())
+			break
+		}
+	}
+
+	if c.will != nil {
+		if err := c.push(c.will.topic, c.will.payload, false); err != nil {
+			log.Printf("Error publishing will of mqtt client %s: %s", c.clientId, err.Error())
+		}
+	}
+}
+
+// register makes the connection the one of its client id, closing any other
+// connection of that client. It returns the subscriptions of the session to
+// resume, if there is one, with clean session those of the discarded one.
+func (s *Server) register(c *connection) (bool, map[string]byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if existing, ok := s.connections[c.clientId]; ok {
+		existing.conn.Close()
+	}
+	s.connections[c.clientId] = c
+
+	if c.cleanSession {
+		discarded := s.sessions[c.clientId]
+		delete(s.sessions, c.clientId)
+		return false, discarded
+	}
+	subscriptions, ok := s.sessions[c.clientId]
+	if !ok {
+		s.sessions[c.clientId] = make(map[string]byte)
+	}
+	return ok, subscriptions
+}
+
+// unregister returns false if another connection of the client replaced it
+func (s *Server) unregister(c *connection) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.connections[c.clientId] != c {
+		return false
+	}
+	delete(s.connections, c.clientId)
+	return true
+}
+
+// saveSession remembers the subscriptions of clients without clean session
+func (s *Server) saveSession(c *connection) {
+	if c.cleanSession {
+		return
+	}
+
+	c.mutex.Lock()
+	subscriptions := make(map[string]byte)
+	for pipelineId, subscription := range c.subscriptions {
+		subscriptions[pipelineId] = subscription.qos
+	}
+	c.mutex.Unlock()
+
+	s.mutex.Lock()
+	s.sessions[c.clientId] = subscriptions
+	s.mutex.Unlock()
+}
+
+type will struct {
+	topic   string
+	payload []byte
+}
+
+// subscription delivers the datapoints of one pipeline to the client
+type subscription struct {
+	pipelineId string
+	qos        byte
+	acks       chan uint16
+	stop       chan struct{}
+	// closed once the delivery returned
+	done chan struct{}
+}
+
+type connection struct {
+	server       *Server
+	conn         net.Conn
+	reader       *bufio.Reader
+	clientId     string
+	cleanSession bool
+	keepAlive    time.Duration
+	will         *will
+
+	writeMutex sync.Mutex
+
+	mutex         sync.Mutex
+	packetId      uint16
+	inflight      map[uint16]*subscription
+	subscriptions map[string]*subscription
+	// pipelines consumed during the connection, the consumers of a clean
+	// session are deleted once it ends
+	consumed   map[string]bool
+	delivering sync.WaitGroup
+
+	// packet ids of qos 2 publications received but not released yet, so
+	// publications sent again aren't pushed twice
+	received map[uint16]bool
+}
+
+func (c *connection) connect() error {
+	c.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := readPacket(c.reader)
+	if err != nil {
+		return err
+	}
+	if p.kind != packetConnect {
+		return errors.New("expected connect packet")
+	}
+
+	d := &decoder{body: p.body}
+	protocol := d.string()
+	level := d.byte()
+	flags := d.byte()
+	keepAlive := d.uint16()
+	clientId := d.string()
+	if flags&4 != 0 {
+		c.will = &will{topic: d.string(), payload: d.bytes()}
+	}
+	// there is no authentication, username and password are ignored
+	if flags&128 != 0 {
+		d.string()
+	}
+	if flags&64 != 0 {
+		d.bytes()
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	if protocol != "MQTT" || level != 4 {
+		c.connack(false, connectUnacceptableProtocol)
+		return fmt.Errorf("unsupported protocol %s level %d", protocol, level)
+	}
+	c.cleanSession = flags&2 != 0
+	if clientId == "" {
+		if !c.cleanSession {
+			c.connack(false, connectIdentifierRejected)
+			return errors.New("client id is required without clean session")
+		}
+		clientId = fmt.Sprintf("%s", uuid.NewV4())
+	}
+	c.clientId = clientId
+	c.keepAlive = time.Duration(keepAlive) * time.Second
+
+	sessionPresent, subscriptions := c.server.register(c)
+	if c.cleanSession {
+		// a clean session starts over, the consumers of a previous session are
+		// discarded instead of resumed
+		for pipelineId := range subscriptions {
+			c.deleteConsumer(pipelineId)
+		}
+		subscriptions = nil
+	}
+	if err := c.connack(sessionPresent, connectAccepted); err != nil {
+		return err
+	}
+	for pipelineId, qos := range subscriptions {
+		c.subscribe(pipelineId, qos)
+	}
+	return nil
+}
+
+func (c *connection) connack(sessionPresent bool, returnCode byte) error {
+	e := encoder{}
+	if sessionPresent {
+		e.byte(1)
+	} else {
+		e.byte(0)
+	}
+	e.byte(returnCode)
+	return c.write(packetConnack, 0, e.body)
+}
+
+func (c *connection) handle(p *packet) error {
+	d := &decoder{body: p.body}
+	switch p.kind {
+	case packetPublish:
+		return c.publish(p)
+	case packetPuback:
+		id := d.uint16()
+		if d.err != nil {
+			return d.err
+		}
+		c.acknowledge(id)
+		return nil
+	case packetPubrel:
+		id := d.uint16()
+		if d.err != nil {
+			return d.err
+		}
+		delete(c.received, id)
+		return c.write(packetPubcomp, 0, p.body[:2])
+	case packetSubscribe:
+		id := d.uint16()
+		e := encoder{}
+		e.uint16(id)
+		for d.err == nil && len(d.body) > 0 {
+			filter := d.string()
+			qos := d.byte()
+			if d.err == nil {
+				e.byte(c.subscribeTopic(filter, qos))
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+		c.server.saveSession(c)
+		return c.write(packetSuback, 0, e.body)
+	case packetUnsubscribe:
+		id := d.uint16()
+		for d.err == nil && len(d.body) > 0 {
+			if pipelineId, ok := pipelineOf(d.string()); ok {
+				c.unsubscribe(pipelineId)
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+		c.server.saveSession(c)
+		e := encoder{}
+		e.uint16(id)
+		return c.write(packetUnsuback, 0, e.body)
+	case packetPingreq:
+		return c.write(packetPingresp, 0, nil)
+	}
+	return fmt.Errorf("unexpected packet type %d", p.kind)
+}
+
+// publish pushes the payload of a publish packet. Publications with qos 1 or
+// 2 are acknowledged once the datapoint is stored, if storing fails the
+// connection is closed so the client publishes again.
+func (c *connection) publish(p *packet) error {
+	qos := (p.flags >> 1) & 3
+	d := &decoder{body: p.body}
+	topic := d.string()
+	var id uint16
+	if qos > 0 {
+		id = d.uint16()
+	}
+	payload := d.rest()
+	if d.err != nil || qos > 2 {
+		return errMalformedPacket
+	}
+
+	e := encoder{}
+	e.uint16(id)
+	if qos == 2 && c.received[id] {
+		return c.write(packetPubrec, 0, e.body)
+	}
+
+	if err := c.push(topic, payload, qos > 0); err != nil {
+		return err
+	}
+
+	switch qos {
+	case 1:
+		return c.write(packetPuback, 0, e.body)
+	case 2:
+		c.received[id] = true
+		return c.write(packetPubrec, 0, e.body)
+	}
+	return nil
+}
+
+func (c *connection) push(topic string, payload []byte, ack bool) error {
+	pipelineId, ok := pipelineOf(topic)
+	if !ok {
+		log.Printf("Dropping message of mqtt client %s to topic %s", c.clientId, topic)
+		return nil
+	}
+	_, err := c.server.Backend.PushDatapoint(pipelineId, string(payload), ack)
+	return err
+}
+
+// subscribeTopic starts delivering the pipeline of the topic filter and
+// returns the granted qos. Wildcards aren't supported and qos 2 is
+// downgraded to 1.
+func (c *connection) subscribeTopic(filter string, qos byte) byte {
+	pipelineId, ok := pipelineOf(filter)
+	if !ok || qos > 2 {
+		return subscribeFailure
+	}
+	if _, err := c.server.Backend.GetPipeline(pipelineId); err != nil {
+		log.Printf("Rejecting subscription of mqtt client %s to %s: %s", c.clientId, filter, err.Error())
+		return subscribeFailure
+	}
+
+	if qos > 1 {
+		qos = 1
+	}
+	c.subscribe(pipelineId, qos)
+	return qos
+}
+
+// subscribe replaces any existing subscription of the pipeline. Both would
+// read from the same consumer, so the delivery of the existing one has to
+// return first.
+func (c *connection) subscribe(pipelineId string, qos byte) {
+	c.unsubscribe(pipelineId)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s := &subscription{
+		pipelineId: pipelineId,
+		qos:        qos,
+		acks:       make(chan uint16, maxInflight),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	c.subscriptions[pipelineId] = s
+	c.consumed[pipelineId] = true
+	c.delivering.Add(1)
+	go c.deliver(s)
+}
+
+// unsubscribe stops the subscription of the pipeline and returns once its
+// delivery returned, so no publication follows
+func (c *connection) unsubscribe(pipelineId string) {
+	c.mutex.Lock()
+	s, ok := c.subscriptions[pipelineId]
+	if ok {
+		close(s.stop)
+		delete(c.subscriptions, pipelineId)
+		for id, inflight := range c.inflight {
+			if inflight == s {
+				delete(c.inflight, id)
+			}
+		}
+	}
+	// the delivery takes the mutex for packet ids
+	c.mutex.Unlock()
+
+	if ok {
+		<-s.done
+	}
+}
+
+// deliver sends the datapoints of the pipeline to the client. The consumer
+// pointer moves over them once the client acknowledged all of them, with
+// qos 0 right after sending them.
+func (c *connection) deliver(s *subscription) {
+	defer c.delivering.Done()
+	defer close(s.done)
+	notifications := c.server.Backend.Subscribe(s.pipelineId)
+	defer c.server.Backend.Unsubscribe(s.pipelineId, notifications)
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
+	topic := topicPrefix + s.pipelineId
+	for {
+		datapoints, err := c.server.Backend.PeekDatapoints(s.pipelineId, c.clientId, backend.PopLimit{Max: maxInflight})
+		if err != nil {
+			log.Printf("Error retrieving datapoints for mqtt client %s: %s", c.clientId, err.Error())
+			c.conn.Close()
+			return
+		}
+
+		if len(datapoints) == 0 {
+			select {
+			case <-notifications:
+			case <-poll.C:
+			case <-s.stop:
+				return
+			}
+			continue
+		}
+
+		pending := 0
+		for _, datapoint := range datapoints {
+			e := encoder{}
+			e.string(topic)
+			if s.qos > 0 {
+				e.uint16(c.inflightId(s))
+				pending++
+			}
+			e.raw([]byte(datapoint.Value))
+			if err := c.write(packetPublish, s.qos<<1, e.body); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+		for ; pending > 0; pending-- {
+			select {
+			case <-s.acks:
+			case <-s.stop:
+				return
+			}
+		}
+
+		if err := c.server.Backend.CommitOffset(s.pipelineId, c.clientId, datapoints[len(datapoints)-1].Offset); err != nil {
+			log.Printf("Error committing offset of mqtt client %s: %s", c.clientId, err.Error())
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// inflightId returns an unused packet id for a publication to the client
+func (c *connection) inflightId(s *subscription) uint16 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for {
+		c.packetId++
+		if _, used := c.inflight[c.packetId]; c.packetId != 0 && !used {
+			c.inflight[c.packetId] = s
+			return c.packetId
+		}
+	}
+}
+
+func (c *connection) acknowledge(id uint16) {
+	c.mutex.Lock()
+	s, ok := c.inflight[id]
+	delete(c.inflight, id)
+	c.mutex.Unlock()
+
+	if ok {
+		select {
+		case s.acks <- id:
+		case <-s.stop:
+		}
+	}
+}
+
+func (c *connection) write(kind byte, flags byte, body []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writePacket(c.conn, kind, flags, body)
+}
+
+func (c *connection) close() {
+	c.conn.Close()
+
+	c.mutex.Lock()
+	for pipelineId, s := range c.subscriptions {
+		close(s.stop)
+		delete(c.subscriptions, pipelineId)
+	}
+	c.mutex.Unlock()
+
+	if c.clientId != "" && c.server.unregister(c) && c.cleanSession {
+		// deliveries register the consumer when peeking, so the consumers are
+		// deleted once all of them returned
+		c.delivering.Wait()
+		for pipelineId := range c.consumed {
+			c.deleteConsumer(pipelineId)
+		}
+	}
+}
+
+// deleteConsumer deletes the consumer of the client, if it consumed the
+// pipeline at all
+func (c *connection) deleteConsumer(pipelineId string) {
+	_, err := c.server.Backend.DeleteConsumer(pipelineId, c.clientId)
+	if err != nil && err != backend.ErrConsumerNotFound && err != backend.ErrPipelineNotFound {
+		log.Printf("Error deleting consumer of mqtt client %s: %s", c.clientId, err.Error())
+	}
+}
+
+// pipelineOf returns the pipeline of a topic, topics with wildcards or more
+// levels don't map to a pipeline
+func pipelineOf(topic string) (string, bool) {
+	if !strings.HasPrefix(topic, topicPrefix) {
+		return "", false
+	}
+	pipelineId := topic[len(topicPrefix):]
+	if pipelineId == "" || strings.ContainsAny(pipelineId, "/+#") {
+		return "", false
+	}
+	return pipelineId, true
+}
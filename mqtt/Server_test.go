@@ -0,0 +1,410 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+// how long a test waits for a packet or the backend
+const testTimeout = 5 * time.Second
+
+// testClient speaks MQTT to a connection served over a pipe
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	served chan struct{}
+}
+
+func dial(t *testing.T, s *Server) *testClient {
+	client, server := net.Pipe()
+	c := &testClient{t: t, conn: client, reader: bufio.NewReader(client), served: make(chan struct{})}
+	go func() {
+		s.serve(server)
+		close(c.served)
+	}()
+	return c
+}
+
+// connect connects with the client id, expecting the return code
+func (c *testClient) connect(clientId string, cleanSession bool, returnCode byte) (sessionPresent bool) {
+	e := encoder{}
+	e.string("MQTT")
+	e.byte(4)
+	if cleanSession {
+		e.byte(2)
+	} else {
+		e.byte(0)
+	}
+	e.uint16(0)
+	e.string(clientId)
+	c.send(packetConnect, 0, e.body)
+
+	connack := c.expect(packetConnack)
+	if len(connack.body) != 2 || connack.body[1] != returnCode {
+		c.t.Fatalf("expected connack with return code %d but got %v", returnCode, connack.body)
+	}
+	return connack.body[0] == 1
+}
+
+// send writes the packet at once, a pipe blocks on writes until they are read
+func (c *testClient) send(kind byte, flags byte, body []byte) {
+	var buffer bytes.Buffer
+	writePacket(&buffer, kind, flags, body)
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := c.conn.Write(buffer.Bytes()); err != nil {
+		c.t.Fatalf("Sending packet %d failed: %s", kind, err.Error())
+	}
+}
+
+func (c *testClient) read() (*packet, error) {
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	return readPacket(c.reader)
+}
+
+func (c *testClient) expect(kind byte) *packet {
+	p, err := c.read()
+	if err != nil {
+		c.t.Fatalf("expected packet %d but reading failed: %s", kind, err.Error())
+	}
+	if p.kind != kind {
+		c.t.Fatalf("expected packet %d but got %d %v", kind, p.kind, p.body)
+	}
+	return p
+}
+
+func (c *testClient) publish(topic string, qos byte, id uint16, payload string) {
+	e := encoder{}
+	e.string(topic)
+	if qos > 0 {
+		e.uint16(id)
+	}
+	e.raw([]byte(payload))
+	c.send(packetPublish, qos<<1, e.body)
+}
+
+// subscribe returns the granted qos of every filter
+func (c *testClient) subscribe(id uint16, filters map[string]byte) []byte {
+	var topics []string
+	for topic := range filters {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	e := encoder{}
+	e.uint16(id)
+	for _, topic := range topics {
+		e.string(topic)
+		e.byte(filters[topic])
+	}
+	c.send(packetSubscribe, 2, e.body)
+
+	suback := c.expect(packetSuback)
+	d := &decoder{body: suback.body}
+	if ackedId := d.uint16(); d.err != nil || ackedId != id {
+		c.t.Fatalf("suback acknowledged %d instead of %d", ackedId, id)
+	}
+	return d.rest()
+}
+
+// expectPublish returns the packet id and payload of the next publication
+func (c *testClient) expectPublish(qos byte) (uint16, string) {
+	p := c.expect(packetPublish)
+	d := &decoder{body: p.body}
+	topic := d.string()
+	var id uint16
+	if qos > 0 {
+		id = d.uint16()
+	}
+	payload := d.rest()
+	if d.err != nil || (p.flags>>1)&3 != qos {
+		c.t.Fatalf("malformed publication to %s with flags %d", topic, p.flags)
+	}
+	return id, string(payload)
+}
+
+func (c *testClient) close() {
+	c.conn.Close()
+	<-c.served
+}
+
+func packetId(id uint16) []byte {
+	e := encoder{}
+	e.uint16(id)
+	return e.body
+}
+
+func createPipeline(t *testing.T, b backend.Backend) *backend.Pipeline {
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "mqtt"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	return pipeline
+}
+
+// consumerOffset returns the offset of the consumer, -1 if it doesn't exist
+func consumerOffset(t *testing.T, b backend.Backend, pipelineId string, consumerId string) int64 {
+	consumers, err := b.GetConsumers(pipelineId)
+	if err != nil {
+		t.Fatalf("GetConsumers failed: %s", err.Error())
+	}
+	for _, consumer := range consumers {
+		if consumer.Id == consumerId {
+			return consumer.Offset
+		}
+	}
+	return -1
+}
+
+func awaitOffset(t *testing.T, b backend.Backend, pipelineId string, consumerId string, offset int64) {
+	deadline := time.Now().Add(testTimeout)
+	for consumerOffset(t, b, pipelineId, consumerId) != offset {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected offset %d of consumer %s but got %d", offset, consumerId, consumerOffset(t, b, pipelineId, consumerId))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	s := NewServer(backend.NewMemoryBackend())
+
+	c := dial(t, s)
+	e := encoder{}
+	e.string("MQIsdp")
+	e.byte(3)
+	e.byte(2)
+	e.uint16(0)
+	e.string("client")
+	c.send(packetConnect, 0, e.body)
+	if connack := c.expect(packetConnack); connack.body[1] != connectUnacceptableProtocol {
+		t.Fatalf("MQTT 3.1 was answered with %v", connack.body)
+	}
+	c.close()
+
+	// only clean sessions may leave the client id to the server
+	c = dial(t, s)
+	c.connect("", false, connectIdentifierRejected)
+	c.close()
+
+	c = dial(t, s)
+	c.connect("", true, connectAccepted)
+	c.send(packetPingreq, 0, nil)
+	c.expect(packetPingresp)
+	c.close()
+
+	// anything but a connect packet ends the connection
+	c = dial(t, s)
+	c.send(packetPingreq, 0, nil)
+	if p, err := c.read(); err == nil {
+		t.Fatalf("expected the connection to be closed but got packet %d", p.kind)
+	}
+	c.close()
+}
+
+// TestPublish verifies the acknowledgements of the qos levels and that qos 2
+// publications sent again aren't pushed twice
+func TestPublish(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := createPipeline(t, b)
+	c := dial(t, NewServer(b))
+	defer c.close()
+	c.connect("publisher", true, connectAccepted)
+	topic := topicPrefix + pipeline.Id
+
+	c.publish(topic, 0, 0, "qos 0")
+	c.publish(topic, 1, 1, "qos 1")
+	if puback := c.expect(packetPuback); string(puback.body) != string(packetId(1)) {
+		t.Fatalf("puback acknowledged %v", puback.body)
+	}
+	c.publish(topic, 2, 2, "qos 2")
+	c.expect(packetPubrec)
+	c.publish(topic, 2, 2, "qos 2")
+	c.expect(packetPubrec)
+	c.send(packetPubrel, 2, packetId(2))
+	if pubcomp := c.expect(packetPubcomp); string(pubcomp.body) != string(packetId(2)) {
+		t.Fatalf("pubcomp acknowledged %v", pubcomp.body)
+	}
+	// topics not mapping to a pipeline are dropped
+	c.publish("other/topic", 1, 3, "dropped")
+	c.expect(packetPuback)
+
+	datapoints, err := b.PopDatapoint(pipeline.Id, "reader", backend.PopLimit{})
+	if err != nil || fmt.Sprint(datapoints) != "[qos 0 qos 1 qos 2]" {
+		t.Fatalf("expected the publications once each but got %q, %v", datapoints, err)
+	}
+}
+
+// TestSubscribe verifies that the consumer pointer of a qos 1 subscription
+// only moves once the client acknowledged the publications
+func TestSubscribe(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := createPipeline(t, b)
+	c := dial(t, NewServer(b))
+	defer c.close()
+	c.connect("subscriber", true, connectAccepted)
+
+	granted := c.subscribe(1, map[string]byte{
+		topicPrefix + pipeline.Id: 2,
+		topicPrefix + "unknown":   1,
+		"turbine/#":               1,
+	})
+	// qos 2 is downgraded, topics are sorted: turbine/#, the pipeline, unknown
+	if fmt.Sprint(granted) != fmt.Sprint([]byte{subscribeFailure, 1, subscribeFailure}) {
+		t.Fatalf("suback granted %v", granted)
+	}
+
+	if _, _, err := b.PushDatapoints(pipeline.Id, []string{"Event 1", "Event 2"}, true); err != nil {
+		t.Fatalf("PushDatapoints failed: %s", err.Error())
+	}
+	var ids []uint16
+	for _, expected := range []string{"Event 1", "Event 2"} {
+		id, payload := c.expectPublish(1)
+		if payload != expected {
+			t.Fatalf("expected %s but got %s", expected, payload)
+		}
+		ids = append(ids, id)
+	}
+
+	c.send(packetPuback, 0, packetId(ids[0]))
+	time.Sleep(50 * time.Millisecond)
+	if offset := consumerOffset(t, b, pipeline.Id, "subscriber"); offset != 0 {
+		t.Fatalf("expected the pointer to wait for all acknowledgements but got offset %d", offset)
+	}
+	c.send(packetPuback, 0, packetId(ids[1]))
+	awaitOffset(t, b, pipeline.Id, "subscriber", 2)
+
+	c.send(packetUnsubscribe, 2, append(packetId(2), encodeString(topicPrefix+pipeline.Id)...))
+	c.expect(packetUnsuback)
+	if _, _, err := b.PushDatapoints(pipeline.Id, []string{"Event 3"}, true); err != nil {
+		t.Fatalf("PushDatapoints failed: %s", err.Error())
+	}
+	c.send(packetPingreq, 0, nil)
+	c.expect(packetPingresp)
+}
+
+func encodeString(value string) []byte {
+	e := encoder{}
+	e.string(value)
+	return e.body
+}
+
+// TestResubscribe subscribes again while datapoints are delivered, the
+// replaced subscription must stop before the new one reads from the consumer
+func TestResubscribe(t *testing.T) {
+	const datapoints = 200
+
+	b := backend.NewMemoryBackend()
+	pipeline := createPipeline(t, b)
+	var values []string
+	for i := 0; i < datapoints; i++ {
+		values = append(values, fmt.Sprintf("%03d", i))
+	}
+	if _, _, err := b.PushDatapoints(pipeline.Id, values, true); err != nil {
+		t.Fatalf("PushDatapoints failed: %s", err.Error())
+	}
+
+	c := dial(t, NewServer(b))
+	defer c.close()
+	c.connect("resubscriber", true, connectAccepted)
+
+	received := make(chan string, datapoints*2)
+	subacks := make(chan struct{}, 10)
+	go func() {
+		for {
+			p, err := c.read()
+			if err != nil {
+				close(received)
+				return
+			}
+			switch p.kind {
+			case packetPublish:
+				d := &decoder{body: p.body}
+				d.string()
+				received <- string(d.rest())
+			case packetSuback:
+				subacks <- struct{}{}
+			}
+		}
+	}()
+
+	filter := encodeString(topicPrefix + pipeline.Id)
+	for i := uint16(1); i <= 5; i++ {
+		c.send(packetSubscribe, 2, append(append(packetId(i), filter...), 0))
+		<-subacks
+	}
+
+	seen := make(map[string]bool)
+	for len(seen) < datapoints {
+		select {
+		case value := <-received:
+			if seen[value] {
+				t.Fatalf("datapoint %s was delivered twice", value)
+			}
+			seen[value] = true
+		case <-time.After(testTimeout):
+			t.Fatalf("received %d of %d datapoints", len(seen), datapoints)
+		}
+	}
+	awaitOffset(t, b, pipeline.Id, "resubscriber", datapoints)
+}
+
+// TestSessions verifies that sessions without clean session are resumed and
+// that the consumers of clean sessions end with them
+func TestSessions(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := createPipeline(t, b)
+	s := NewServer(b)
+	topic := topicPrefix + pipeline.Id
+
+	c := dial(t, s)
+	if c.connect("durable", false, connectAccepted) {
+		t.Fatal("expected no session on the first connect")
+	}
+	c.subscribe(1, map[string]byte{topic: 0})
+	// the delivery registers the consumer
+	awaitOffset(t, b, pipeline.Id, "durable", 0)
+	c.close()
+	if consumerOffset(t, b, pipeline.Id, "durable") != 0 {
+		t.Fatal("expected the consumer of the durable session to remain")
+	}
+
+	if _, err := b.PushDatapoint(pipeline.Id, "Event 1", true); err != nil {
+		t.Fatalf("PushDatapoint failed: %s", err.Error())
+	}
+	c = dial(t, s)
+	if !c.connect("durable", false, connectAccepted) {
+		t.Fatal("expected the session to be present")
+	}
+	// the subscription is resumed without subscribing again
+	if _, payload := c.expectPublish(0); payload != "Event 1" {
+		t.Fatalf("expected Event 1 but got %s", payload)
+	}
+	awaitOffset(t, b, pipeline.Id, "durable", 1)
+	c.close()
+
+	// a clean session discards the previous one together with its consumer
+	c = dial(t, s)
+	if c.connect("durable", true, connectAccepted) {
+		t.Fatal("expected no session with clean session")
+	}
+	if offset := consumerOffset(t, b, pipeline.Id, "durable"); offset != -1 {
+		t.Fatalf("expected the consumer of the discarded session to be deleted but got offset %d", offset)
+	}
+	c.subscribe(1, map[string]byte{topic: 0})
+	// the new consumer reads the pipeline from the start
+	if _, payload := c.expectPublish(0); payload != "Event 1" {
+		t.Fatalf("expected Event 1 but got %s", payload)
+	}
+	awaitOffset(t, b, pipeline.Id, "durable", 1)
+	c.close()
+	if offset := consumerOffset(t, b, pipeline.Id, "durable"); offset != -1 {
+		t.Fatalf("expected the consumer of the clean session to be deleted but got offset %d", offset)
+	}
+}
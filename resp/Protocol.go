@@ -0,0 +1,107 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maximum size of a bulk string, just like the payload of a datapoint
+const maxBulkSize = 16 * 1024 * 1024
+
+// maximum amount of arguments of a command
+const maxArguments = 1024 * 1024
+
+// maximum size of all bulk strings of a command, which covers the largest
+// batch a client may push at once
+const maxCommandSize = 64 * 1024 * 1024
+
+// maximum size of a line, which bounds inline commands, like Redis does
+const maxLineSize = 64 * 1024
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads a command either as array of bulk strings, the way
+// clients send commands, or inline as a line of words typed e.g. into telnet
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > maxArguments {
+		return nil, errProtocol
+	}
+	arguments := make([]string, 0, count)
+	total := 0
+	for i := 0; i < count; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkSize || total+size > maxCommandSize {
+			return nil, errProtocol
+		}
+		total += size
+
+		// the bulk string is followed by CRLF
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(r, bulk); err != nil {
+			return nil, err
+		}
+		arguments = append(arguments, string(bulk[:size]))
+	}
+	return arguments, nil
+}
+
+// readLine reads a line of at most maxLineSize bytes
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		fragment, err := r.ReadSlice('\n')
+		if len(line)+len(fragment) > maxLineSize {
+			return "", errProtocol
+		}
+		line = append(line, fragment...)
+		if err == nil {
+			return strings.TrimRight(string(line), "\r\n"), nil
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+}
+
+func writeSimpleString(w *bufio.Writer, value string) {
+	fmt.Fprintf(w, "+%s\r\n", value)
+}
+
+func writeError(w *bufio.Writer, message string) {
+	fmt.Fprintf(w, "-ERR %s\r\n", message)
+}
+
+func writeInteger(w *bufio.Writer, value int64) {
+	fmt.Fprintf(w, ":%d\r\n", value)
+}
+
+func writeBulkString(w *bufio.Writer, value string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(value), value)
+}
+
+func writeArray(w *bufio.Writer, values []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(values))
+	for _, value := range values {
+		writeBulkString(w, value)
+	}
+}
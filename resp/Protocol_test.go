@@ -0,0 +1,56 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		input     string
+		arguments []string
+		err       error
+	}{
+		{"*2\r\n$5\r\nTPUSH\r\n$1\r\na\r\n", []string{"TPUSH", "a"}, nil},
+		{"TPOP pipeline consumer\r\n", []string{"TPOP", "pipeline", "consumer"}, nil},
+		{"*0\r\n", []string{}, nil},
+		{"*-5\r\n", nil, errProtocol},
+		{"*1\r\n$-1\r\n", nil, errProtocol},
+		{"*1\r\n:1\r\n", nil, errProtocol},
+		{"PING " + strings.Repeat("a", maxLineSize) + "\r\n", nil, errProtocol},
+		{"*1\r\n$" + strings.Repeat("1", maxLineSize) + "\r\n", nil, errProtocol},
+	}
+
+	for _, test := range tests {
+		arguments, err := readCommand(bufio.NewReader(strings.NewReader(test.input)))
+		if err != test.err || strings.Join(arguments, " ") != strings.Join(test.arguments, " ") {
+			t.Errorf("readCommand(%.20q) returned %q, %v instead of %q, %v", test.input, arguments, err, test.arguments, test.err)
+		}
+	}
+}
+
+// TestReadCommandSize verifies that the bulk strings of a command may each
+// stay below the maximum but not add up to more than maxCommandSize
+func TestReadCommandSize(t *testing.T) {
+	bulk := bytes.Repeat([]byte{'a'}, maxBulkSize)
+	header := "$" + strconv.Itoa(maxBulkSize) + "\r\n"
+	command := func(count int) io.Reader {
+		readers := []io.Reader{strings.NewReader("*" + strconv.Itoa(count) + "\r\n")}
+		for i := 0; i < count; i++ {
+			readers = append(readers, strings.NewReader(header), bytes.NewReader(bulk), strings.NewReader("\r\n"))
+		}
+		return io.MultiReader(readers...)
+	}
+
+	count := maxCommandSize / maxBulkSize
+	if arguments, err := readCommand(bufio.NewReader(command(count))); err != nil || len(arguments) != count {
+		t.Fatalf("readCommand of %d bulk strings returned %d arguments, %v", count, len(arguments), err)
+	}
+	if _, err := readCommand(bufio.NewReader(command(count + 1))); err != errProtocol {
+		t.Fatalf("readCommand of %d bulk strings returned %v instead of %v", count+1, err, errProtocol)
+	}
+}
@@ -0,0 +1,150 @@
+package resp
+
+import (
+	"bufio"
+	"github.com/cgrotz/turbine.go/backend"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Server speaks the Redis protocol, so redis-cli and Redis client libraries
+// can push and pop datapoints:
+//
+//	TPUSH pipeline payload [payload ...]   pushes the payloads and returns the offset of the last one
+//	TPOP pipeline consumer [count]         pops up to count datapoints, 10 by default
+type Server struct {
+	Backend backend.Backend
+	// upper bound of the count of pops
+	MaxPop int64
+}
+
+func (s *Server) ListenAndServe(bind string) error {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		arguments, err := readCommand(reader)
+		if err != nil {
+			if err == errProtocol {
+				writeError(writer, err.Error())
+				writer.Flush()
+			} else if err != io.EOF {
+				log.Println("Error reading resp command:", err.Error())
+			}
+			return
+		}
+		if len(arguments) == 0 {
+			continue
+		}
+
+		quit := s.execute(writer, arguments)
+		// pipelined commands are answered at once
+		if reader.Buffered() == 0 || quit {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// execute answers the command, it returns true if the client quits
+func (s *Server) execute(w *bufio.Writer, arguments []string) bool {
+	switch strings.ToUpper(arguments[0]) {
+	case "TPUSH":
+		s.push(w, arguments[1:])
+	case "TPOP":
+		s.pop(w, arguments[1:])
+	case "PING":
+		if len(arguments) > 1 {
+			writeBulkString(w, arguments[1])
+		} else {
+			writeSimpleString(w, "PONG")
+		}
+	case "ECHO":
+		if len(arguments) != 2 {
+			writeError(w, "wrong number of arguments for 'echo' command")
+			return false
+		}
+		writeBulkString(w, arguments[1])
+	case "QUIT":
+		writeSimpleString(w, "OK")
+		return true
+	case "COMMAND":
+		// redis-cli asks for the documentation of the commands on start
+		writeArray(w, nil)
+	case "SELECT", "CLIENT":
+		// client libraries set up their connection with these
+		writeSimpleString(w, "OK")
+	default:
+		writeError(w, "unknown command '"+arguments[0]+"'")
+	}
+	return false
+}
+
+// push stores the payloads and waits until they are stored, so the offset of
+// the last datapoint can be returned
+func (s *Server) push(w *bufio.Writer, arguments []string) {
+	if len(arguments) < 2 {
+		writeError(w, "wrong number of arguments for 'tpush' command")
+		return
+	}
+
+	_, last, err := s.Backend.PushDatapoints(arguments[0], arguments[1:], true)
+	if err != nil {
+		log.Println("Error pushing datapoints:", err.Error())
+		writeError(w, err.Error())
+		return
+	}
+	writeInteger(w, last)
+}
+
+func (s *Server) pop(w *bufio.Writer, arguments []string) {
+	if len(arguments) != 2 && len(arguments) != 3 {
+		writeError(w, "wrong number of arguments for 'tpop' command")
+		return
+	}
+
+	limit := backend.PopLimit{}
+	if len(arguments) == 3 {
+		count, err := strconv.ParseInt(arguments[2], 10, 64)
+		if err != nil || count <= 0 {
+			writeError(w, "count is not a positive integer")
+			return
+		}
+		limit.Max = count
+	}
+	if s.MaxPop > 0 && limit.Max > s.MaxPop {
+		limit.Max = s.MaxPop
+	}
+
+	datapoints, err := s.Backend.PopDatapoint(arguments[0], arguments[1], limit)
+	if err != nil {
+		log.Println("Error popping datapoints:", err.Error())
+		writeError(w, err.Error())
+		return
+	}
+	writeArray(w, datapoints)
+}
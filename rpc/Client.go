@@ -0,0 +1,135 @@
+package rpc
+
+import (
+	"context"
+	"github.com/cgrotz/turbine.go/backend"
+	"google.golang.org/grpc"
+)
+
+// Client calls the Turbine service, e.g. over a connection opened with
+//
+//	conn, err := grpc.NewClient("turbine:3001", grpc.WithTransportCredentials(insecure.NewCredentials()))
+//	client := rpc.NewClient(conn)
+type Client struct {
+	conn grpc.ClientConnInterface
+}
+
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{conn: conn}
+}
+
+func (c *Client) invoke(ctx context.Context, method string, request interface{}, response interface{}) error {
+	return c.conn.Invoke(ctx, "/"+serviceName+"/"+method, request, response, grpc.ForceCodec(codec{}))
+}
+
+func (c *Client) ListPipelines(ctx context.Context) ([]backend.Pipeline, error) {
+	response := &ListPipelinesResponse{}
+	err := c.invoke(ctx, "ListPipelines", &ListPipelinesRequest{}, response)
+	return response.Pipelines, err
+}
+
+func (c *Client) GetPipeline(ctx context.Context, id string) (*backend.Pipeline, error) {
+	pipeline := &backend.Pipeline{}
+	if err := c.invoke(ctx, "GetPipeline", &PipelineRequest{Id: id}, pipeline); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (c *Client) CreatePipeline(ctx context.Context, pipeline *backend.Pipeline) (*backend.Pipeline, error) {
+	created := &backend.Pipeline{}
+	if err := c.invoke(ctx, "CreatePipeline", pipeline, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// UpdatePipeline updates the pipeline with the id of the given pipeline
+func (c *Client) UpdatePipeline(ctx context.Context, pipeline *backend.Pipeline) (*backend.Pipeline, error) {
+	updated := &backend.Pipeline{}
+	if err := c.invoke(ctx, "UpdatePipeline", pipeline, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (c *Client) DeletePipeline(ctx context.Context, id string) (bool, error) {
+	response := &DeletePipelineResponse{}
+	err := c.invoke(ctx, "DeletePipeline", &PipelineRequest{Id: id}, response)
+	return response.Deleted, err
+}
+
+func (c *Client) GetStatistic(ctx context.Context, id string) (*backend.PipelineStatistic, error) {
+	statistic := &backend.PipelineStatistic{}
+	if err := c.invoke(ctx, "GetStatistic", &PipelineRequest{Id: id}, statistic); err != nil {
+		return nil, err
+	}
+	return statistic, nil
+}
+
+// Push pushes a datapoint and returns its offset, which may be 0 unless ack
+// is set, see backend.Backend.PushDatapoint
+func (c *Client) Push(ctx context.Context, pipelineId string, payload []byte, ack bool) (int64, error) {
+	response := &PushResponse{}
+	err := c.invoke(ctx, "Push", &PushRequest{PipelineId: pipelineId, Payload: payload, Ack: ack}, response)
+	return response.Offset, err
+}
+
+// PushStream pushes the datapoints sent over one stream
+type PushStream struct {
+	stream grpc.ClientStream
+}
+
+func (c *Client) PushStream(ctx context.Context) (*PushStream, error) {
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[0], "/"+serviceName+"/PushStream", grpc.ForceCodec(codec{}))
+	if err != nil {
+		return nil, err
+	}
+	return &PushStream{stream: stream}, nil
+}
+
+func (s *PushStream) Send(pipelineId string, payload []byte, ack bool) error {
+	return s.stream.SendMsg(&PushRequest{PipelineId: pipelineId, Payload: payload, Ack: ack})
+}
+
+// CloseAndRecv ends the stream and returns how many datapoints were pushed
+func (s *PushStream) CloseAndRecv() (*PushStreamResponse, error) {
+	if err := s.stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	response := &PushStreamResponse{}
+	if err := s.stream.RecvMsg(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// ConsumeStream receives the datapoints of a consumer
+type ConsumeStream struct {
+	stream grpc.ClientStream
+}
+
+// Consume starts streaming the datapoints of the consumer, at most max of them
+// are read at once. The stream ends when the context is cancelled.
+func (c *Client) Consume(ctx context.Context, pipelineId string, consumerId string, max int64) (*ConsumeStream, error) {
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[1], "/"+serviceName+"/Consume", grpc.ForceCodec(codec{}))
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&ConsumeRequest{PipelineId: pipelineId, ConsumerId: consumerId, Max: max}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &ConsumeStream{stream: stream}, nil
+}
+
+// Recv blocks until the next datapoint arrives
+func (s *ConsumeStream) Recv() (*backend.OffsetDatapoint, error) {
+	datapoint := &backend.OffsetDatapoint{}
+	if err := s.stream.RecvMsg(datapoint); err != nil {
+		return nil, err
+	}
+	return datapoint, nil
+}
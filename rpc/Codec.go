@@ -0,0 +1,350 @@
+package rpc
+
+import (
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+)
+
+// codec encodes the messages of turbine.proto in the protobuf wire format, so
+// clients generated from turbine.proto can talk to the server, without
+// generated code on the Go side
+type codec struct{}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case *ListPipelinesRequest:
+		return nil, nil
+	case *ListPipelinesResponse:
+		var b []byte
+		for i := range m.Pipelines {
+			b = appendMessage(b, 1, appendPipeline(nil, &m.Pipelines[i]))
+		}
+		return b, nil
+	case *PipelineRequest:
+		return appendString(nil, 1, m.Id), nil
+	case *backend.Pipeline:
+		return appendPipeline(nil, m), nil
+	case *DeletePipelineResponse:
+		return appendBool(nil, 1, m.Deleted), nil
+	case *backend.PipelineStatistic:
+		return appendStatistic(nil, m), nil
+	case *PushRequest:
+		b := appendString(nil, 1, m.PipelineId)
+		b = appendBytes(b, 2, m.Payload)
+		return appendBool(b, 3, m.Ack), nil
+	case *PushResponse:
+		return appendInt(nil, 1, m.Offset), nil
+	case *PushStreamResponse:
+		b := appendInt(nil, 1, m.Count)
+		return appendInt(b, 2, m.Last), nil
+	case *ConsumeRequest:
+		b := appendString(nil, 1, m.PipelineId)
+		b = appendString(b, 2, m.ConsumerId)
+		return appendInt(b, 3, m.Max), nil
+	case *backend.OffsetDatapoint:
+		b := appendInt(nil, 1, m.Offset)
+		return appendBytes(b, 2, []byte(m.Value)), nil
+	}
+	return nil, fmt.Errorf("rpc: unknown message %T", v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	switch m := v.(type) {
+	case *ListPipelinesRequest:
+		return decodeFields(data, func(f field) error { return nil })
+	case *ListPipelinesResponse:
+		return decodeFields(data, func(f field) error {
+			if f.num == 1 {
+				pipeline := backend.Pipeline{}
+				if err := decodePipeline(f.bytes, &pipeline); err != nil {
+					return err
+				}
+				m.Pipelines = append(m.Pipelines, pipeline)
+			}
+			return nil
+		})
+	case *PipelineRequest:
+		return decodeFields(data, func(f field) error {
+			if f.num == 1 {
+				m.Id = string(f.bytes)
+			}
+			return nil
+		})
+	case *backend.Pipeline:
+		return decodePipeline(data, m)
+	case *DeletePipelineResponse:
+		return decodeFields(data, func(f field) error {
+			if f.num == 1 {
+				m.Deleted = f.varint != 0
+			}
+			return nil
+		})
+	case *backend.PipelineStatistic:
+		return decodeStatistic(data, m)
+	case *PushRequest:
+		return decodeFields(data, func(f field) error {
+			switch f.num {
+			case 1:
+				m.PipelineId = string(f.bytes)
+			case 2:
+				m.Payload = append([]byte(nil), f.bytes...)
+			case 3:
+				m.Ack = f.varint != 0
+			}
+			return nil
+		})
+	case *PushResponse:
+		return decodeFields(data, func(f field) error {
+			if f.num == 1 {
+				m.Offset = int64(f.varint)
+			}
+			return nil
+		})
+	case *PushStreamResponse:
+		return decodeFields(data, func(f field) error {
+			switch f.num {
+			case 1:
+				m.Count = int64(f.varint)
+			case 2:
+				m.Last = int64(f.varint)
+			}
+			return nil
+		})
+	case *ConsumeRequest:
+		return decodeFields(data, func(f field) error {
+			switch f.num {
+			case 1:
+				m.PipelineId = string(f.bytes)
+			case 2:
+				m.ConsumerId = string(f.bytes)
+			case 3:
+				m.Max = int64(f.varint)
+			}
+			return nil
+		})
+	case *backend.OffsetDatapoint:
+		return decodeFields(data, func(f field) error {
+			switch f.num {
+			case 1:
+				m.Offset = int64(f.varint)
+			case 2:
+				m.Value = string(f.bytes)
+			}
+			return nil
+		})
+	}
+	return fmt.Errorf("rpc: unknown message %T", v)
+}
+
+func appendPipeline(b []byte, p *backend.Pipeline) []byte {
+	b = appendString(b, 1, p.Id)
+	b = appendString(b, 2, p.Name)
+	b = appendString(b, 3, p.Description)
+	b = appendMessage(b, 4, appendStatistic(nil, &p.PipelineStatistic))
+	for _, consumer := range p.Consumers {
+		c := appendString(nil, 1, consumer.Id)
+		c = appendInt(c, 2, consumer.UnreadElements)
+		c = appendInt(c, 3, consumer.Offset)
+		b = appendMessage(b, 5, c)
+	}
+	if p.Retention != nil {
+		r := appendInt(nil, 1, p.Retention.MaxAge)
+		r = appendInt(r, 2, p.Retention.MaxDatapoints)
+		r = appendInt(r, 3, p.Retention.MaxBytes)
+		r = appendBool(r, 4, p.Retention.DeleteConsumed)
+		b = appendMessage(b, 6, r)
+	}
+	if p.DeadLetter != nil {
+		d := appendString(nil, 1, p.DeadLetter.Pipeline)
+		d = appendInt(d, 2, p.DeadLetter.MaxDeliveries)
+		b = appendMessage(b, 7, d)
+	}
+	return b
+}
+
+func decodePipeline(data []byte, p *backend.Pipeline) error {
+	return decodeFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			p.Id = string(f.bytes)
+		case 2:
+			p.Name = string(f.bytes)
+		case 3:
+			p.Description = string(f.bytes)
+		case 4:
+			return decodeStatistic(f.bytes, &p.PipelineStatistic)
+		case 5:
+			consumer := backend.Consumer{}
+			err := decodeFields(f.bytes, func(f field) error {
+				switch f.num {
+				case 1:
+					consumer.Id = string(f.bytes)
+				case 2:
+					consumer.UnreadElements = int64(f.varint)
+				case 3:
+					consumer.Offset = int64(f.varint)
+				}
+				return nil
+			})
+			p.Consumers = append(p.Consumers, consumer)
+			return err
+		case 6:
+			p.Retention = &backend.RetentionPolicy{}
+			return decodeFields(f.bytes, func(f field) error {
+				switch f.num {
+				case 1:
+					p.Retention.MaxAge = int64(f.varint)
+				case 2:
+					p.Retention.MaxDatapoints = int64(f.varint)
+				case 3:
+					p.Retention.MaxBytes = int64(f.varint)
+				case 4:
+					p.Retention.DeleteConsumed = f.varint != 0
+				}
+				return nil
+			})
+		case 7:
+			p.DeadLetter = &backend.DeadLetterPolicy{}
+			return decodeFields(f.bytes, func(f field) error {
+				switch f.num {
+				case 1:
+					p.DeadLetter.Pipeline = string(f.bytes)
+				case 2:
+					p.DeadLetter.MaxDeliveries = int64(f.varint)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func appendStatistic(b []byte, s *backend.PipelineStatistic) []byte {
+	b = appendInt(b, 1, s.Today)
+	if s.ChangeRate != 0 {
+		b = protowire.AppendTag(b, 2, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(s.ChangeRate))
+	}
+	for _, element := range s.Statistics {
+		e := appendString(nil, 1, element.Date)
+		e = appendInt(e, 2, element.Intake)
+		b = appendMessage(b, 3, e)
+	}
+	return b
+}
+
+func decodeStatistic(data []byte, s *backend.PipelineStatistic) error {
+	return decodeFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			s.Today = int64(f.varint)
+		case 2:
+			s.ChangeRate = math.Float64frombits(f.varint)
+		case 3:
+			element := backend.PipelineStatisticElement{}
+			err := decodeFields(f.bytes, func(f field) error {
+				switch f.num {
+				case 1:
+					element.Date = string(f.bytes)
+				case 2:
+					element.Intake = int64(f.varint)
+				}
+				return nil
+			})
+			s.Statistics = append(s.Statistics, element)
+			return err
+		}
+		return nil
+	})
+}
+
+// proto3 leaves out fields with default values
+
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendBytes(b []byte, num protowire.Number, value []byte) []byte {
+	if len(value) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+func appendInt(b []byte, num protowire.Number, value int64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(value))
+}
+
+func appendBool(b []byte, num protowire.Number, value bool) []byte {
+	if !value {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+// appendMessage appends an embedded message, which is kept even if it is empty
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+// field is a decoded field, varint holds the value of numeric fields
+// including fixed size ones, bytes the value of strings and messages
+type field struct {
+	num    protowire.Number
+	varint uint64
+	bytes  []byte
+}
+
+// decodeFields calls decode for every field of the message, unknown fields
+// are left to decode to skip
+func decodeFields(data []byte, decode func(f field) error) error {
+	for len(data) > 0 {
+		num, kind, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		f := field{num: num}
+		switch kind {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			f.varint, n = protowire.ConsumeFixed64(data)
+		case protowire.Fixed32Type:
+			var value uint32
+			value, n = protowire.ConsumeFixed32(data)
+			f.varint = uint64(value)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, kind, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if err := decode(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
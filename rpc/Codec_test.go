@@ -0,0 +1,155 @@
+package rpc
+
+import (
+	"github.com/cgrotz/turbine.go/backend"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var scalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"double": descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+}
+
+// loadProto builds the descriptor of the messages of turbine.proto, which
+// only declare scalar, message and repeated fields, so the codec is tested
+// against the file the clients of other languages are generated from
+func loadProto(t *testing.T) protoreflect.FileDescriptor {
+	source, err := ioutil.ReadFile("turbine.proto")
+	if err != nil {
+		t.Fatalf("Reading turbine.proto failed: %s", err.Error())
+	}
+	text := regexp.MustCompile(`//.*`).ReplaceAllString(string(source), "")
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("turbine.proto"),
+		Package: proto.String("turbine.v1"),
+		Syntax:  proto.String("proto3"),
+	}
+	fields := regexp.MustCompile(`(repeated\s+)?(\w+)\s+(\w+)\s*=\s*(\d+);`)
+	for _, m := range regexp.MustCompile(`message\s+(\w+)\s*\{([^}]*)\}`).FindAllStringSubmatch(text, -1) {
+		message := &descriptorpb.DescriptorProto{Name: proto.String(m[1])}
+		for _, f := range fields.FindAllStringSubmatch(m[2], -1) {
+			number, _ := strconv.Atoi(f[4])
+			field := &descriptorpb.FieldDescriptorProto{
+				Name:   proto.String(f[3]),
+				Number: proto.Int32(int32(number)),
+				Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}
+			if f[1] != "" {
+				field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			}
+			if kind, ok := scalarTypes[f[2]]; ok {
+				field.Type = kind.Enum()
+			} else {
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				field.TypeName = proto.String(".turbine.v1." + f[2])
+			}
+			message.Field = append(message.Field, field)
+		}
+		file.MessageType = append(file.MessageType, message)
+	}
+
+	descriptor, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatalf("Building the descriptor of turbine.proto failed: %s", err.Error())
+	}
+	return descriptor
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	descriptor := loadProto(t)
+	tests := []struct {
+		message string
+		value   interface{}
+		// the message in the JSON mapping of protobuf
+		json string
+	}{
+		{"ListPipelinesRequest", &ListPipelinesRequest{}, `{}`},
+		{"ListPipelinesResponse", &ListPipelinesResponse{Pipelines: []backend.Pipeline{{Id: "a"}, {Id: "b", Name: "sensors"}}},
+			`{"pipelines": [{"id": "a", "statistic": {}}, {"id": "b", "name": "sensors", "statistic": {}}]}`},
+		{"PipelineRequest", &PipelineRequest{Id: "a"}, `{"id": "a"}`},
+		{"Pipeline", &backend.Pipeline{
+			Id:          "a",
+			Name:        "sensors",
+			Description: "readings",
+			PipelineStatistic: backend.PipelineStatistic{
+				Today:      3,
+				ChangeRate: -0.5,
+				Statistics: []backend.PipelineStatisticElement{{Date: "2026-10-17", Intake: 6}, {Date: "2026-10-18", Intake: 3}},
+			},
+			Consumers:  []backend.Consumer{{Id: "c1", UnreadElements: 2, Offset: 1}, {Id: "c2"}},
+			Retention:  &backend.RetentionPolicy{MaxAge: 3600, MaxDatapoints: 1000, MaxBytes: 1 << 40, DeleteConsumed: true},
+			DeadLetter: &backend.DeadLetterPolicy{Pipeline: "b", MaxDeliveries: 5},
+		}, `{
+			"id": "a", "name": "sensors", "description": "readings",
+			"statistic": {"today": 3, "changeRate": -0.5, "statistics": [{"date": "2026-10-17", "intake": 6}, {"date": "2026-10-18", "intake": 3}]},
+			"consumers": [{"id": "c1", "unreadElements": 2, "offset": 1}, {"id": "c2"}],
+			"retention": {"maxAge": 3600, "maxDatapoints": 1000, "maxBytes": 1099511627776, "deleteConsumed": true},
+			"deadLetter": {"pipeline": "b", "maxDeliveries": 5}
+		}`},
+		{"Pipeline", &backend.Pipeline{Retention: &backend.RetentionPolicy{}}, `{"statistic": {}, "retention": {}}`},
+		{"DeletePipelineResponse", &DeletePipelineResponse{Deleted: true}, `{"deleted": true}`},
+		{"PipelineStatistic", &backend.PipelineStatistic{Today: 1, ChangeRate: 2}, `{"today": 1, "changeRate": 2}`},
+		{"PushRequest", &PushRequest{PipelineId: "a", Payload: []byte{0, 1, 255}, Ack: true}, `{"pipelineId": "a", "payload": "AAH/", "ack": true}`},
+		{"PushResponse", &PushResponse{Offset: 42}, `{"offset": 42}`},
+		{"PushStreamResponse", &PushStreamResponse{Count: 2, Last: 43}, `{"count": 2, "last": 43}`},
+		{"ConsumeRequest", &ConsumeRequest{PipelineId: "a", ConsumerId: "c1", Max: 100}, `{"pipelineId": "a", "consumerId": "c1", "max": 100}`},
+		{"Datapoint", &backend.OffsetDatapoint{Offset: 7, Value: "Event 7"}, `{"offset": 7, "payload": "RXZlbnQgNw=="}`},
+		// int64 fields are encoded as ten byte varints when negative
+		{"Datapoint", &backend.OffsetDatapoint{Offset: -1}, `{"offset": -1}`},
+	}
+
+	for _, test := range tests {
+		message := descriptor.Messages().ByName(protoreflect.Name(test.message))
+		if message == nil {
+			t.Fatalf("turbine.proto has no message %s", test.message)
+		}
+		expected := dynamicpb.NewMessage(message)
+		if err := protojson.Unmarshal([]byte(test.json), expected); err != nil {
+			t.Fatalf("Invalid JSON of %s: %s", test.message, err.Error())
+		}
+
+		// the codec encodes what clients generated from turbine.proto decode
+		data, err := codec{}.Marshal(test.value)
+		if err != nil {
+			t.Errorf("Marshal(%+v) failed: %s", test.value, err.Error())
+			continue
+		}
+		decoded := dynamicpb.NewMessage(message)
+		if err := proto.Unmarshal(data, decoded); err != nil {
+			t.Errorf("Marshal(%+v) returned an invalid %s: %s", test.value, test.message, err.Error())
+			continue
+		}
+		if !proto.Equal(decoded, expected) {
+			t.Errorf("Marshal(%+v) returned %s instead of %s", test.value, protojson.Format(decoded), protojson.Format(expected))
+		}
+
+		// and decodes what they encode
+		data, err = proto.Marshal(expected)
+		if err != nil {
+			t.Fatalf("Marshalling %s failed: %s", test.message, err.Error())
+		}
+		value := reflect.New(reflect.TypeOf(test.value).Elem()).Interface()
+		if err := (codec{}).Unmarshal(data, value); err != nil {
+			t.Errorf("Unmarshal of %s failed: %s", protojson.Format(expected), err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(value, test.value) {
+			t.Errorf("Unmarshal of %s returned %+v instead of %+v", protojson.Format(expected), value, test.value)
+		}
+	}
+}
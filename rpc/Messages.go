@@ -0,0 +1,46 @@
+package rpc
+
+import (
+	"github.com/cgrotz/turbine.go/backend"
+)
+
+// The messages of turbine.proto without a counterpart in the backend, pipelines,
+// statistics and datapoints are exchanged as backend types.
+
+type ListPipelinesRequest struct{}
+
+type ListPipelinesResponse struct {
+	Pipelines []backend.Pipeline
+}
+
+type PipelineRequest struct {
+	Id string
+}
+
+type DeletePipelineResponse struct {
+	Deleted bool
+}
+
+type PushRequest struct {
+	PipelineId string
+	Payload    []byte
+	// wait until the datapoint is stored, otherwise the offset may be 0
+	Ack bool
+}
+
+type PushResponse struct {
+	Offset int64
+}
+
+type PushStreamResponse struct {
+	Count int64
+	// offset of the last datapoint if every push was acknowledged
+	Last int64
+}
+
+type ConsumeRequest struct {
+	PipelineId string
+	ConsumerId string
+	// maximum amount of datapoints read at once
+	Max int64
+}
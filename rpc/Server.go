@@ -0,0 +1,254 @@
+package rpc
+
+import (
+	"context"
+	"github.com/cgrotz/turbine.go/backend"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+const serviceName = "turbine.v1.Turbine"
+
+// consumers read again after this interval even without a notification,
+// datapoints may have been pushed through another Turbine server
+const pollInterval = 15 * time.Second
+
+// Server implements the Turbine service of turbine.proto on top of the
+// backend, just like the REST interface
+type Server struct {
+	Backend backend.Backend
+	// upper bound of the max parameter of consumers
+	MaxPop int64
+}
+
+func (s *Server) ListenAndServe(bind string) error {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	server.RegisterService(&serviceDesc, s)
+	return server.Serve(listener)
+}
+
+func (s *Server) ListPipelines(ctx context.Context, request *ListPipelinesRequest) (*ListPipelinesResponse, error) {
+	pipelines, err := s.Backend.GetPipelines()
+	if err != nil {
+		return nil, statusError("Error retrieving pipelines:", err)
+	}
+	return &ListPipelinesResponse{Pipelines: pipelines}, nil
+}
+
+func (s *Server) GetPipeline(ctx context.Context, request *PipelineRequest) (*backend.Pipeline, error) {
+	pipeline, err := s.Backend.GetPipeline(request.Id)
+	if err != nil {
+		return nil, statusError("Error retrieving pipeline:", err)
+	}
+	return pipeline, nil
+}
+
+func (s *Server) CreatePipeline(ctx context.Context, pipeline *backend.Pipeline) (*backend.Pipeline, error) {
+	if err := backend.ValidatePipeline(s.Backend, pipeline.Id, pipeline); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	pipeline, err := s.Backend.CreatePipeline(pipeline)
+	if err != nil {
+		return nil, statusError("Error saving pipeline:", err)
+	}
+	return pipeline, nil
+}
+
+func (s *Server) UpdatePipeline(ctx context.Context, pipeline *backend.Pipeline) (*backend.Pipeline, error) {
+	if err := backend.ValidatePipeline(s.Backend, pipeline.Id, pipeline); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	pipeline, err := s.Backend.UpdatePipeline(pipeline.Id, pipeline)
+	if err != nil {
+		return nil, statusError("Error updating pipeline:", err)
+	}
+	return pipeline, nil
+}
+
+func (s *Server) DeletePipeline(ctx context.Context, request *PipelineRequest) (*DeletePipelineResponse, error) {
+	deleted, err := s.Backend.DeletePipeline(request.Id)
+	if err != nil {
+		return nil, statusError("Error deleting pipeline:", err)
+	}
+	return &DeletePipelineResponse{Deleted: deleted}, nil
+}
+
+func (s *Server) GetStatistic(ctx context.Context, request *PipelineRequest) (*backend.PipelineStatistic, error) {
+	statistic, err := s.Backend.RetrievePipelineStatistic(request.Id)
+	if err != nil {
+		return nil, statusError("Error retrieving statistic:", err)
+	}
+	return statistic, nil
+}
+
+func (s *Server) Push(ctx context.Context, request *PushRequest) (*PushResponse, error) {
+	offset, err := s.Backend.PushDatapoint(request.PipelineId, string(request.Payload), request.Ack)
+	if err != nil {
+		return nil, statusError("Error pushing datapoint:", err)
+	}
+	return &PushResponse{Offset: offset}, nil
+}
+
+// PushStream pushes every datapoint of the stream, a failing push ends the
+// stream and the datapoints sent after it aren't pushed
+func (s *Server) PushStream(stream grpc.ServerStream) error {
+	response := &PushStreamResponse{}
+	for {
+		request := &PushRequest{}
+		err := stream.RecvMsg(request)
+		if err == io.EOF {
+			return stream.SendMsg(response)
+		}
+		if err != nil {
+			return err
+		}
+
+		offset, err := s.Backend.PushDatapoint(request.PipelineId, string(request.Payload), request.Ack)
+		if err != nil {
+			return statusError("Error pushing datapoint:", err)
+		}
+		response.Count++
+		if offset != 0 {
+			response.Last = offset
+		}
+	}
+}
+
+// Consume streams the datapoints of the consumer until the client cancels the
+// call. The consumer pointer moves over the datapoints once they are sent.
+func (s *Server) Consume(request *ConsumeRequest, stream grpc.ServerStream) error {
+	if request.ConsumerId == "" {
+		return status.Error(codes.InvalidArgument, "missing consumer")
+	}
+	limit := backend.PopLimit{Max: request.Max}
+	if s.MaxPop > 0 && limit.Max > s.MaxPop {
+		limit.Max = s.MaxPop
+	}
+
+	// subscribe before the first read, so no datapoint pushed in between is missed
+	notifications := s.Backend.Subscribe(request.PipelineId)
+	defer s.Backend.Unsubscribe(request.PipelineId, notifications)
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
+	for {
+		datapoints, err := s.Backend.PeekDatapoints(request.PipelineId, request.ConsumerId, limit)
+		if err != nil {
+			return statusError("Error retrieving datapoints:", err)
+		}
+
+		if len(datapoints) > 0 {
+			for i := range datapoints {
+				if err := stream.SendMsg(&datapoints[i]); err != nil {
+					return err
+				}
+			}
+			if err := s.Backend.CommitOffset(request.PipelineId, request.ConsumerId, datapoints[len(datapoints)-1].Offset); err != nil {
+				return statusError("Error committing offset:", err)
+			}
+			continue
+		}
+
+		select {
+		case <-notifications:
+		case <-poll.C:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// statusError returns the status matching the error returned by the backend
+func statusError(message string, err error) error {
+	switch err {
+	case backend.ErrPipelineNotFound, backend.ErrConsumerNotFound, backend.ErrLeaseNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case backend.ErrConsumerExists:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case backend.ErrInvalidOffset, backend.ErrInvalidSeek:
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	log.Println(message, err.Error())
+	return status.Error(codes.Internal, err.Error())
+}
+
+// unaryMethod describes a unary method of the service, call invokes the
+// method of the Server with the decoded request
+func unaryMethod(name string, request func() interface{}, call func(s *Server, ctx context.Context, request interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, decode func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := request()
+			if err := decode(in); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, in interface{}) (interface{}, error) {
+				return call(srv.(*Server), ctx, in)
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + name}, handler)
+		},
+	}
+}
+
+// serviceDesc takes the place of the code protoc would generate from turbine.proto
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("ListPipelines", func() interface{} { return &ListPipelinesRequest{} }, func(s *Server, ctx context.Context, request interface{}) (interface{}, error) {
+			return s.ListPipelines(ctx, request.(*ListPipelinesRequest))
+		}),
+		unaryMethod("GetPipeline", func() interface{} { return &PipelineRequest{} }, func(s *Server, ctx context.Context, request interface{}) (interface{}, error) {
+			return s.GetPipeline(ctx, request.(*PipelineRequest))
+		}),
+		unaryMethod("CreatePipeline", func() interface{} { return &backend.Pipeline{} }, func(s *Server, ctx context.Context, request interface{}) (interface{}, error) {
+			return s.CreatePipeline(ctx, request.(*backend.Pipeline))
+		}),
+		unaryMethod("UpdatePipeline", func() interface{} { return &backend.Pipeline{} }, func(s *Server, ctx context.Context, request interface{}) (interface{}, error) {
+			return s.UpdatePipeline(ctx, request.(*backend.Pipeline))
+		}),
+		unaryMethod("DeletePipeline", func() interface{} { return &PipelineRequest{} }, func(s *Server, ctx context.Context, request interface{}) (interface{}, error) {
+			return s.DeletePipeline(ctx, request.(*PipelineRequest))
+		}),
+		unaryMethod("GetStatistic", func() interface{} { return &PipelineRequest{} }, func(s *Server, ctx context.Context, request interface{}) (interface{}, error) {
+			return s.GetStatistic(ctx, request.(*PipelineRequest))
+		}),
+		unaryMethod("Push", func() interface{} { return &PushRequest{} }, func(s *Server, ctx context.Context, request interface{}) (interface{}, error) {
+			return s.Push(ctx, request.(*PushRequest))
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "PushStream",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*Server).PushStream(stream)
+			},
+			ClientStreams: true,
+		},
+		{
+			StreamName: "Consume",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				request := &ConsumeRequest{}
+				if err := stream.RecvMsg(request); err != nil {
+					return err
+				}
+				return srv.(*Server).Consume(request, stream)
+			},
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rpc/turbine.proto",
+}
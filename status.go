@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"github.com/cgrotz/turbine.go/client"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// how long the status command waits for the server
+const statusTimeout = 30 * time.Second
+
+// status prints the status of a running server, or with --direct the status
+// read from Redis, and exits with 1 if Redis can't be reached
+func status(c *cli.Context) {
+	var status *backend.Status
+	var err error
+	if c.Bool("direct") {
+		status, err = readDirectStatus(c.GlobalString("backend"), c.GlobalString("redisUrl"))
+	} else {
+		baseUrl := c.String("url")
+		if baseUrl == "" {
+			baseUrl = bindUrl(c.GlobalString("bind"))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+		defer cancel()
+		status, err = client.NewClient(baseUrl).GetStatus(ctx)
+	}
+	if err != nil {
+		log.Fatal("Error retrieving status: ", err.Error())
+	}
+
+	if c.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(status)
+	} else {
+		printStatus(os.Stdout, status)
+	}
+	if status.Redis != nil && !status.Redis.Connected {
+		os.Exit(1)
+	}
+}
+
+// readDirectStatus reads the status of a Redis backend without a server,
+// other backends are only known to the server using them
+func readDirectStatus(name string, redisUrl string) (*backend.Status, error) {
+	var b backend.Backend
+	switch name {
+	case "redis":
+		b = backend.RedisBackend{RedisUrl: redisUrl, Broker: backend.NewBroker()}
+	case "redis-streams":
+		// connecting fails if Redis is unreachable, which the status reports
+		b, _ = backend.NewRedisStreamsBackend(redisUrl)
+	default:
+		return nil, fmt.Errorf("the status of the %s backend can only be read from a running server", name)
+	}
+
+	status, err := backend.ReadStatus(b)
+	if err != nil {
+		return nil, err
+	}
+	status.Backend = name
+	return status, nil
+}
+
+// bindUrl returns the url of a server listening on the bind, e.g.
+// http://localhost:3000 for :3000
+func bindUrl(bind string) string {
+	if strings.HasPrefix(bind, ":") {
+		bind = "localhost" + bind
+	}
+	return "http://" + bind
+}
+
+func printStatus(w io.Writer, status *backend.Status) {
+	fmt.Fprintf(w, "backend:  %s\n", status.Backend)
+	if status.Redis != nil {
+		if status.Redis.Connected {
+			memory := formatBytes(status.Redis.UsedMemory)
+			if status.Redis.MaxMemory > 0 {
+				memory += " of " + formatBytes(status.Redis.MaxMemory)
+			}
+			fmt.Fprintf(w, "redis:    connected, version %s, %s used\n", status.Redis.Version, memory)
+		} else {
+			fmt.Fprintf(w, "redis:    unreachable, %s\n", status.Redis.Error)
+		}
+	}
+	if status.Writers != nil {
+		fmt.Fprintf(w, "writers:  %d of %d busy\n", status.Writers.Busy, status.Writers.Size)
+	}
+	if status.Pipelines == nil {
+		return
+	}
+
+	fmt.Fprintln(w)
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "PIPELINE\tNAME\tDATAPOINTS\tLAST OFFSET\tTODAY")
+	for _, pipeline := range status.Pipelines {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\n", pipeline.Id, pipeline.Name, pipeline.Datapoints, pipeline.LastOffset, pipeline.Today)
+	}
+	table.Flush()
+
+	fmt.Fprintln(w)
+	table = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "PIPELINE\tCONSUMER\tOFFSET\tUNREAD")
+	for _, pipeline := range status.Pipelines {
+		for _, consumer := range pipeline.Consumers {
+			fmt.Fprintf(table, "%s\t%s\t%d\t%d\n", pipeline.Id, consumer.Id, consumer.Offset, consumer.UnreadElements)
+		}
+	}
+	table.Flush()
+}
+
+// formatBytes returns the size in the largest unit that keeps it at least 1
+func formatBytes(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
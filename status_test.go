@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"github.com/cgrotz/turbine.go/backend"
+	"testing"
+)
+
+func TestPrintStatus(t *testing.T) {
+	tests := []struct {
+		status backend.Status
+		output string
+	}{
+		{
+			backend.Status{Backend: "memory", Pipelines: []backend.PipelineStatus{}},
+			"backend:  memory\n\nPIPELINE  NAME  DATAPOINTS  LAST OFFSET  TODAY\n\nPIPELINE  CONSUMER  OFFSET  UNREAD\n",
+		},
+		{
+			backend.Status{
+				Backend: "redis",
+				Redis:   &backend.RedisStatus{Connected: true, Version: "7.2.4", UsedMemory: 1536, MaxMemory: 1 << 30},
+				Writers: &backend.WriterStatus{Size: 4, Busy: 1},
+				Pipelines: []backend.PipelineStatus{{
+					Id:         "p1",
+					Name:       "Sensors",
+					Datapoints: 10,
+					LastOffset: 12,
+					Today:      3,
+					Consumers:  []backend.Consumer{{Id: "consumer1", Offset: 5, UnreadElements: 7}},
+				}},
+			},
+			"backend:  redis\n" +
+				"redis:    connected, version 7.2.4, 1.5 KB of 1.0 GB used\n" +
+				"writers:  1 of 4 busy\n" +
+				"\n" +
+				"PIPELINE  NAME     DATAPOINTS  LAST OFFSET  TODAY\n" +
+				"p1        Sensors  10          12           3\n" +
+				"\n" +
+				"PIPELINE  CONSUMER   OFFSET  UNREAD\n" +
+				"p1        consumer1  5       7\n",
+		},
+		{
+			// the pipelines are left out if Redis is unreachable
+			backend.Status{Backend: "redis-streams", Redis: &backend.RedisStatus{Error: "connection refused"}},
+			"backend:  redis-streams\nredis:    unreachable, connection refused\n",
+		},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		printStatus(&output, &test.status)
+		if output.String() != test.output {
+			t.Errorf("printStatus printed\n%s\ninstead of\n%s", output.String(), test.output)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		size   int64
+		output string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{5 * 1024 * 1024, "5.0 MB"},
+		{1 << 50, "1024.0 TB"},
+	}
+	for _, test := range tests {
+		if output := formatBytes(test.size); output != test.output {
+			t.Errorf("formatBytes(%d) returned %s instead of %s", test.size, output, test.output)
+		}
+	}
+}
+
+// TestReadDirectStatus verifies that both Redis backends report an
+// unreachable Redis as disconnected
+func TestReadDirectStatus(t *testing.T) {
+	for _, name := range []string{"redis", "redis-streams"} {
+		status, err := readDirectStatus(name, "tcp://127.0.0.1:1")
+		if err != nil {
+			t.Errorf("readDirectStatus of %s failed: %s", name, err.Error())
+			continue
+		}
+		if status.Backend != name || status.Redis == nil || status.Redis.Connected {
+			t.Errorf("expected a disconnected status of %s but got %+v with %+v", name, status, status.Redis)
+		}
+	}
+
+	if _, err := readDirectStatus("file", ""); err == nil {
+		t.Error("expected the status of the file backend to be read from the server only")
+	}
+}
@@ -0,0 +1,185 @@
+package stomp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maximum size of a frame body, just like the payload of a datapoint
+const maxBodySize = 16 * 1024 * 1024
+
+// maximum amount of headers of a frame
+const maxHeaders = 1000
+
+// maximum size of the command and header lines
+const maxLineSize = 64 * 1024
+
+var errMalformedFrame = errors.New("malformed frame")
+
+type frame struct {
+	command string
+	headers map[string]string
+	body    []byte
+}
+
+func newFrame(command string, headers ...string) *frame {
+	f := &frame{command: command, headers: make(map[string]string)}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.headers[headers[i]] = headers[i+1]
+	}
+	return f
+}
+
+// readFrame reads the next frame, skipping the end of lines clients send as
+// heart-beats
+func readFrame(r *bufio.Reader) (*frame, error) {
+	var command string
+	for command == "" {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		command = line
+	}
+
+	// headers of CONNECT frames aren't escaped, for clients of STOMP 1.0
+	escaped := command != "CONNECT"
+	f := newFrame(command)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		if len(f.headers) >= maxHeaders {
+			return nil, errMalformedFrame
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, errMalformedFrame
+		}
+		name, value := line[:colon], line[colon+1:]
+		if escaped {
+			if name, err = unescape(name); err != nil {
+				return nil, err
+			}
+			if value, err = unescape(value); err != nil {
+				return nil, err
+			}
+		}
+		// only the first of repeated headers counts
+		if _, ok := f.headers[name]; !ok {
+			f.headers[name] = value
+		}
+	}
+
+	if contentLength, ok := f.headers["content-length"]; ok {
+		size, err := strconv.Atoi(contentLength)
+		if err != nil || size < 0 || size > maxBodySize {
+			return nil, errMalformedFrame
+		}
+		// the body is followed by the NULL octet
+		f.body = make([]byte, size+1)
+		if _, err := io.ReadFull(r, f.body); err != nil {
+			return nil, err
+		}
+		if f.body[size] != 0 {
+			return nil, errMalformedFrame
+		}
+		f.body = f.body[:size]
+		return f, nil
+	}
+
+	body, err := readUntil(r, 0, maxBodySize+1)
+	if err != nil {
+		return nil, err
+	}
+	f.body = body[:len(body)-1]
+	return f, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := readUntil(r, '\n', maxLineSize)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// readUntil reads up to and including the delimiter, failing once more than
+// max bytes arrived without it instead of buffering whatever the client sends
+func readUntil(r *bufio.Reader, delimiter byte, max int) ([]byte, error) {
+	var data []byte
+	for {
+		fragment, err := r.ReadSlice(delimiter)
+		if len(data)+len(fragment) > max {
+			return nil, errMalformedFrame
+		}
+		data = append(data, fragment...)
+		if err == nil {
+			return data, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+}
+
+func writeFrame(w *bufio.Writer, f *frame) error {
+	w.WriteString(f.command)
+	w.WriteByte('\n')
+	for name, value := range f.headers {
+		if f.command == "CONNECTED" {
+			w.WriteString(name + ":" + value + "\n")
+		} else {
+			w.WriteString(escape(name) + ":" + escape(value) + "\n")
+		}
+	}
+	if f.body != nil {
+		w.WriteString("content-length:" + strconv.Itoa(len(f.body)) + "\n")
+	}
+	w.WriteByte('\n')
+	w.Write(f.body)
+	w.WriteByte(0)
+	return w.Flush()
+}
+
+var escaper = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+func unescape(value string) (string, error) {
+	if !strings.Contains(value, "\\") {
+		return value, nil
+	}
+	unescaped := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			unescaped = append(unescaped, value[i])
+			continue
+		}
+		if i++; i == len(value) {
+			return "", errMalformedFrame
+		}
+		switch value[i] {
+		case '\\':
+			unescaped = append(unescaped, '\\')
+		case 'r':
+			unescaped = append(unescaped, '\r')
+		case 'n':
+			unescaped = append(unescaped, '\n')
+		case 'c':
+			unescaped = append(unescaped, ':')
+		default:
+			return "", errMalformedFrame
+		}
+	}
+	return string(unescaped), nil
+}
@@ -0,0 +1,36 @@
+package stomp
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		input   string
+		command string
+		body    string
+		err     error
+	}{
+		{"SEND\ndestination:/pipeline/a\n\nEvent 1\x00", "SEND", "Event 1", nil},
+		{"\n\r\nSEND\r\ncontent-length:3\r\n\r\na\x00b\x00", "SEND", "a\x00b", nil},
+		{"SEND\ncontent-length:3\n\nabcd\x00", "", "", errMalformedFrame},
+		{"SEND\ncontent-length:-1\n\n\x00", "", "", errMalformedFrame},
+		{"SEND\nno header\n\n\x00", "", "", errMalformedFrame},
+		{"SEND\n\n" + strings.Repeat("a", maxBodySize+1) + "\x00", "", "", errMalformedFrame},
+		{"SEND\ndestination:" + strings.Repeat("a", maxLineSize) + "\n\n\x00", "", "", errMalformedFrame},
+		{strings.Repeat("a", maxLineSize+1), "", "", errMalformedFrame},
+	}
+
+	for _, test := range tests {
+		f, err := readFrame(bufio.NewReader(strings.NewReader(test.input)))
+		if err != test.err {
+			t.Errorf("readFrame(%.20q) returned %v instead of %v", test.input, err, test.err)
+			continue
+		}
+		if err == nil && (f.command != test.command || string(f.body) != test.body) {
+			t.Errorf("readFrame(%.20q) returned %s %q instead of %s %q", test.input, f.command, f.body, test.command, test.body)
+		}
+	}
+}
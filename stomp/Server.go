@@ -0,0 +1,570 @@
+package stomp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"github.com/satori/go.uuid"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// destinations of the form /pipeline/<id> map to pipelines
+const destinationPrefix = "/pipeline/"
+
+// how many datapoints are sent to a subscriber before waiting for its
+// acknowledgements, unless the subscription sets a prefetch-count
+const defaultPrefetch = 10
+
+// subscribers read again after this interval even without a notification,
+// datapoints may have been pushed through another Turbine server
+const pollInterval = 15 * time.Second
+
+// datapoints a client didn't accept are sent again after this delay
+const nackDelay = time.Second
+
+// how often the server is willing to send and expects heart-beats
+const heartBeat = 10 * time.Second
+
+// how long a client may take to send its CONNECT frame
+const connectTimeout = 10 * time.Second
+
+const writeTimeout = 10 * time.Second
+
+// acknowledgement modes of a subscription
+const (
+	ackAuto             = "auto"
+	ackClient           = "client"
+	ackClientIndividual = "client-individual"
+)
+
+// Server is a STOMP 1.2 front-end of the backend. Sending to
+// /pipeline/<id> pushes a datapoint, subscribing to it consumes the pipeline
+// with the consumer named by the consumer header of the subscription. With
+// the ack modes client and client-individual the consumer pointer moves over
+// the datapoints the client acknowledged, with auto right after sending them.
+type Server struct {
+	Backend backend.Backend
+}
+
+func NewServer(b backend.Backend) *Server {
+	return &Server{Backend: b}
+}
+
+func (s *Server) ListenAndServe(bind string) error {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	c := &connection{
+		server:        s,
+		conn:          conn,
+		reader:        bufio.NewReader(conn),
+		writer:        bufio.NewWriter(conn),
+		inflight:      make(map[string]*message),
+		subscriptions: make(map[string]*subscription),
+		done:          make(chan struct{}),
+	}
+	defer c.close()
+
+	if err := c.connect(); err != nil {
+		log.Println("Error connecting stomp client:", err.Error())
+		return
+	}
+
+	for {
+		if c.readTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+
+		f, err := readFrame(c.reader)
+		if err != nil {
+			if err == errMalformedFrame {
+				c.error(nil, err.Error())
+			} else if err != io.EOF {
+				log.Printf("Error reading from stomp client %s: %s", c.session, err.Error())
+			}
+			return
+		}
+		if f.command == "DISCONNECT" {
+			c.receipt(f)
+			return
+		}
+		if err := c.handle(f); err != nil {
+			c.error(f, err.Error())
+			return
+		}
+		if err := c.receipt(f); err != nil {
+			return
+		}
+	}
+}
+
+// subscription delivers the datapoints of one pipeline to the client
+type subscription struct {
+	id         string
+	pipelineId string
+	consumerId string
+	ack        string
+	prefetch   int64
+	acks       chan acknowledgement
+	stop       chan struct{}
+	// closed once the delivery returned
+	done chan struct{}
+}
+
+type acknowledgement struct {
+	offset int64
+	nack   bool
+}
+
+// message is a datapoint sent to the client and not acknowledged yet
+type message struct {
+	subscription *subscription
+	offset       int64
+}
+
+type connection struct {
+	server      *Server
+	conn        net.Conn
+	reader      *bufio.Reader
+	session     string
+	readTimeout time.Duration
+	done        chan struct{}
+
+	writeMutex sync.Mutex
+	writer     *bufio.Writer
+
+	mutex         sync.Mutex
+	ackId         uint64
+	inflight      map[string]*message
+	subscriptions map[string]*subscription
+}
+
+func (c *connection) connect() error {
+	c.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	f, err := readFrame(c.reader)
+	if err != nil {
+		return err
+	}
+	if f.command != "CONNECT" && f.command != "STOMP" {
+		c.error(f, "expected CONNECT frame")
+		return fmt.Errorf("expected CONNECT frame, got %s", f.command)
+	}
+
+	supported := false
+	for _, version := range strings.Split(f.headers["accept-version"], ",") {
+		supported = supported || strings.TrimSpace(version) == "1.2"
+	}
+	if !supported {
+		c.write(newFrame("ERROR", "version", "1.2", "message", "supported protocol versions are 1.2"))
+		return errors.New("client doesn't support STOMP 1.2")
+	}
+
+	// the client sends heart-beats every cx and wants to receive them every
+	// cy milliseconds, zero meaning not at all
+	var cx, cy int64
+	if beats := strings.Split(f.headers["heart-beat"], ","); len(beats) == 2 {
+		cx, _ = strconv.ParseInt(strings.TrimSpace(beats[0]), 10, 64)
+		cy, _ = strconv.ParseInt(strings.TrimSpace(beats[1]), 10, 64)
+	}
+	if cx > 0 {
+		c.readTimeout = maxDuration(heartBeat, time.Duration(cx)*time.Millisecond) * 3 / 2
+	}
+	if cy > 0 {
+		go c.sendHeartBeats(maxDuration(heartBeat, time.Duration(cy)*time.Millisecond))
+	}
+
+	// there is no authentication, login and passcode are ignored
+	c.session = fmt.Sprintf("%s", uuid.NewV4())
+	millis := strconv.FormatInt(int64(heartBeat/time.Millisecond), 10)
+	return c.write(newFrame("CONNECTED",
+		"version", "1.2",
+		"server", "turbine",
+		"session", c.session,
+		"heart-beat", millis+","+millis))
+}
+
+func (c *connection) handle(f *frame) error {
+	if _, ok := f.headers["transaction"]; ok {
+		return errors.New("transactions are not supported")
+	}
+
+	switch f.command {
+	case "SEND":
+		return c.send(f)
+	case "SUBSCRIBE":
+		return c.subscribe(f)
+	case "UNSUBSCRIBE":
+		id, ok := f.headers["id"]
+		if !ok {
+			return errors.New("missing id header")
+		}
+		c.unsubscribe(id)
+		return nil
+	case "ACK", "NACK":
+		id, ok := f.headers["id"]
+		if !ok {
+			return errors.New("missing id header")
+		}
+		c.acknowledge(id, f.command == "NACK")
+		return nil
+	case "BEGIN", "COMMIT", "ABORT":
+		return errors.New("transactions are not supported")
+	}
+	return fmt.Errorf("unknown command %s", f.command)
+}
+
+// send pushes the body of the frame. If the client asks for a receipt the
+// datapoint is stored before the receipt is sent.
+func (c *connection) send(f *frame) error {
+	pipelineId, err := pipelineOf(f.headers["destination"])
+	if err != nil {
+		return err
+	}
+	_, receipt := f.headers["receipt"]
+	if _, err := c.server.Backend.PushDatapoint(pipelineId, string(f.body), receipt); err != nil {
+		log.Printf("Error pushing datapoint of stomp client %s: %s", c.session, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *connection) subscribe(f *frame) error {
+	id, ok := f.headers["id"]
+	if !ok {
+		return errors.New("missing id header")
+	}
+	pipelineId, err := pipelineOf(f.headers["destination"])
+	if err != nil {
+		return err
+	}
+	// subscription ids are only unique within a connection, defaulting to them
+	// would make the subscriptions of different clients share a consumer
+	consumerId, ok := f.headers["consumer"]
+	if !ok || consumerId == "" {
+		return errors.New("missing consumer header")
+	}
+	if _, err := c.server.Backend.GetPipeline(pipelineId); err != nil {
+		return err
+	}
+
+	s := &subscription{
+		id:         id,
+		pipelineId: pipelineId,
+		consumerId: consumerId,
+		ack:        f.headers["ack"],
+		prefetch:   defaultPrefetch,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	switch s.ack {
+	case "":
+		s.ack = ackAuto
+	case ackAuto, ackClient, ackClientIndividual:
+	default:
+		return fmt.Errorf("unknown ack mode %s", s.ack)
+	}
+	if prefetch, ok := f.headers["prefetch-count"]; ok {
+		if s.prefetch, err = strconv.ParseInt(prefetch, 10, 64); err != nil || s.prefetch <= 0 {
+			return errors.New("prefetch-count is not a positive integer")
+		}
+	}
+	s.acks = make(chan acknowledgement, s.prefetch)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.subscriptions[id]; ok {
+		return fmt.Errorf("subscription %s already exists", id)
+	}
+	c.subscriptions[id] = s
+	go c.deliver(s)
+	return nil
+}
+
+// unsubscribe stops the subscription and returns once its delivery returned,
+// so no MESSAGE follows the UNSUBSCRIBE
+func (c *connection) unsubscribe(id string) {
+	c.mutex.Lock()
+	s, ok := c.subscriptions[id]
+	if ok {
+		close(s.stop)
+		delete(c.subscriptions, id)
+		c.forget(s)
+	}
+	// the delivery takes the mutex for ack ids
+	c.mutex.Unlock()
+
+	if ok {
+		<-s.done
+	}
+}
+
+// deliver sends the datapoints of the pipeline to the client as messages.
+// Datapoints the client didn't acknowledge are sent again once the client
+// subscribes again, even on another connection.
+func (c *connection) deliver(s *subscription) {
+	defer close(s.done)
+	notifications := c.server.Backend.Subscribe(s.pipelineId)
+	defer c.server.Backend.Unsubscribe(s.pipelineId, notifications)
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
+	destination := destinationPrefix + s.pipelineId
+	for {
+		datapoints, err := c.server.Backend.PeekDatapoints(s.pipelineId, s.consumerId, backend.PopLimit{Max: s.prefetch})
+		if err != nil {
+			log.Printf("Error retrieving datapoints for stomp client %s: %s", c.session, err.Error())
+			c.conn.Close()
+			return
+		}
+
+		if len(datapoints) == 0 {
+			select {
+			case <-notifications:
+			case <-poll.C:
+			case <-s.stop:
+				return
+			}
+			continue
+		}
+
+		for _, datapoint := range datapoints {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			offset := strconv.FormatInt(datapoint.Offset, 10)
+			f := newFrame("MESSAGE",
+				"subscription", s.id,
+				"message-id", offset,
+				"destination", destination)
+			if s.ack != ackAuto {
+				f.headers["ack"] = c.inflightId(s, datapoint.Offset)
+			}
+			f.body = []byte(datapoint.Value)
+			if err := c.write(f); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+
+		if s.ack == ackAuto {
+			if !c.commit(s, datapoints[len(datapoints)-1].Offset) {
+				return
+			}
+			continue
+		}
+		if !c.await(s, datapoints) {
+			return
+		}
+	}
+}
+
+// await moves the consumer pointer forward as the client acknowledges the
+// datapoints sent. It returns false if the subscription ends meanwhile.
+func (c *connection) await(s *subscription, datapoints []backend.OffsetDatapoint) bool {
+	acknowledged := make(map[int64]bool)
+	next := 0
+	for next < len(datapoints) {
+		select {
+		case a := <-s.acks:
+			if a.nack {
+				// the pointer stays in front of the datapoint, so it is sent again
+				c.mutex.Lock()
+				c.forget(s)
+				c.mutex.Unlock()
+				select {
+				case <-time.After(nackDelay):
+				case <-s.stop:
+					return false
+				}
+				// acknowledgements of the datapoints sent before must not
+				// count for the ones sent again
+				for {
+					select {
+					case <-s.acks:
+					default:
+						return true
+					}
+				}
+			}
+
+			if s.ack == ackClient {
+				for _, datapoint := range datapoints {
+					if datapoint.Offset <= a.offset {
+						acknowledged[datapoint.Offset] = true
+					}
+				}
+			} else {
+				acknowledged[a.offset] = true
+			}
+
+			first := next
+			for next < len(datapoints) && acknowledged[datapoints[next].Offset] {
+				next++
+			}
+			if next > first && !c.commit(s, datapoints[next-1].Offset) {
+				return false
+			}
+		case <-s.stop:
+			return false
+		}
+	}
+	return true
+}
+
+func (c *connection) commit(s *subscription, offset int64) bool {
+	if err := c.server.Backend.CommitOffset(s.pipelineId, s.consumerId, offset); err != nil {
+		log.Printf("Error committing offset of stomp client %s: %s", c.session, err.Error())
+		c.conn.Close()
+		return false
+	}
+	return true
+}
+
+// inflightId returns the id the client acknowledges a message with
+func (c *connection) inflightId(s *subscription, offset int64) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.ackId++
+	id := strconv.FormatUint(c.ackId, 10)
+	c.inflight[id] = &message{subscription: s, offset: offset}
+	return id
+}
+
+// acknowledge hands an ACK or NACK to the subscription of the message.
+// Acknowledging with the ack mode client covers all messages sent before.
+// Unknown ids, e.g. of messages sent again, are ignored.
+func (c *connection) acknowledge(id string, nack bool) {
+	c.mutex.Lock()
+	m, ok := c.inflight[id]
+	if ok {
+		delete(c.inflight, id)
+		if m.subscription.ack == ackClient {
+			for other, inflight := range c.inflight {
+				if inflight.subscription == m.subscription && inflight.offset <= m.offset {
+					delete(c.inflight, other)
+				}
+			}
+		}
+	}
+	c.mutex.Unlock()
+
+	if ok {
+		select {
+		case m.subscription.acks <- acknowledgement{offset: m.offset, nack: nack}:
+		case <-m.subscription.stop:
+		}
+	}
+}
+
+// forget drops the messages of the subscription awaiting acknowledgement,
+// the mutex has to be held
+func (c *connection) forget(s *subscription) {
+	for id, inflight := range c.inflight {
+		if inflight.subscription == s {
+			delete(c.inflight, id)
+		}
+	}
+}
+
+func (c *connection) sendHeartBeats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.writeMutex.Lock()
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			c.writer.WriteByte('\n')
+			err := c.writer.Flush()
+			c.writeMutex.Unlock()
+			if err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// receipt confirms that the frame was processed, if the client asked for it
+func (c *connection) receipt(f *frame) error {
+	if receipt, ok := f.headers["receipt"]; ok {
+		return c.write(newFrame("RECEIPT", "receipt-id", receipt))
+	}
+	return nil
+}
+
+// error informs the client about the error, the connection is closed afterwards
+func (c *connection) error(f *frame, message string) {
+	e := newFrame("ERROR", "message", message)
+	if f != nil {
+		if receipt, ok := f.headers["receipt"]; ok {
+			e.headers["receipt-id"] = receipt
+		}
+	}
+	c.write(e)
+}
+
+func (c *connection) write(f *frame) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeFrame(c.writer, f)
+}
+
+func (c *connection) close() {
+	c.conn.Close()
+	close(c.done)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for id, s := range c.subscriptions {
+		close(s.stop)
+		delete(c.subscriptions, id)
+	}
+}
+
+// pipelineOf returns the pipeline of a destination
+func pipelineOf(destination string) (string, error) {
+	pipelineId := strings.TrimPrefix(destination, destinationPrefix)
+	if !strings.HasPrefix(destination, destinationPrefix) || pipelineId == "" || strings.Contains(pipelineId, "/") {
+		return "", fmt.Errorf("destination %s isn't of the form %s<pipeline>", destination, destinationPrefix)
+	}
+	return pipelineId, nil
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
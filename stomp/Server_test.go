@@ -0,0 +1,173 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"net"
+	"testing"
+	"time"
+)
+
+// how long a test waits for a frame
+const testTimeout = 5 * time.Second
+
+// testClient speaks STOMP to a connection served over a pipe
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	served chan struct{}
+}
+
+func dial(t *testing.T, s *Server) *testClient {
+	client, server := net.Pipe()
+	c := &testClient{t: t, conn: client, reader: bufio.NewReader(client), served: make(chan struct{})}
+	go func() {
+		s.serve(server)
+		close(c.served)
+	}()
+
+	c.send(newFrame("CONNECT", "accept-version", "1.2", "host", "turbine"))
+	c.expect("CONNECTED")
+	return c
+}
+
+// send writes the frames at once, so the server reads them in one go
+func (c *testClient) send(frames ...*frame) {
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	for _, f := range frames {
+		writeFrame(writer, f)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := c.conn.Write(buffer.Bytes()); err != nil {
+		c.t.Fatalf("Sending %s failed: %s", frames[0].command, err.Error())
+	}
+}
+
+func (c *testClient) expect(command string) *frame {
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	f, err := readFrame(c.reader)
+	if err != nil {
+		c.t.Fatalf("expected %s but reading failed: %s", command, err.Error())
+	}
+	if f.command != command {
+		c.t.Fatalf("expected %s but got %s %v %q", command, f.command, f.headers, f.body)
+	}
+	return f
+}
+
+func (c *testClient) close() {
+	c.conn.Close()
+	<-c.served
+}
+
+func pushDatapoints(t *testing.T, b backend.Backend, count int) *backend.Pipeline {
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "stomp"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	for i := 1; i <= count; i++ {
+		if _, err := b.PushDatapoint(pipeline.Id, fmt.Sprintf("Event %d", i), true); err != nil {
+			t.Fatalf("PushDatapoint failed: %s", err.Error())
+		}
+	}
+	return pipeline
+}
+
+func consumerOffset(t *testing.T, b backend.Backend, pipelineId string, consumerId string) int64 {
+	consumers, err := b.GetConsumers(pipelineId)
+	if err != nil {
+		t.Fatalf("GetConsumers failed: %s", err.Error())
+	}
+	for _, consumer := range consumers {
+		if consumer.Id == consumerId {
+			return consumer.Offset
+		}
+	}
+	return 0
+}
+
+// TestUnsubscribe verifies that no MESSAGE follows the receipt of an
+// UNSUBSCRIBE, even while the delivery is sending a batch
+func TestUnsubscribe(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := pushDatapoints(t, b, 100)
+	c := dial(t, NewServer(b))
+	defer c.close()
+
+	c.send(newFrame("SUBSCRIBE", "id", "0", "destination", destinationPrefix+pipeline.Id, "consumer", "consumer1", "prefetch-count", "50"))
+	c.expect("MESSAGE")
+	c.send(newFrame("UNSUBSCRIBE", "id", "0", "receipt", "unsubscribed"))
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+		f, err := readFrame(c.reader)
+		if err != nil {
+			t.Fatalf("expected the receipt but reading failed: %s", err.Error())
+		}
+		if f.command == "RECEIPT" {
+			break
+		}
+		if f.command != "MESSAGE" {
+			t.Fatalf("expected MESSAGE or RECEIPT but got %s", f.command)
+		}
+	}
+
+	c.send(newFrame("SEND", "destination", destinationPrefix+pipeline.Id, "receipt", "sent"))
+	if receipt := c.expect("RECEIPT"); receipt.headers["receipt-id"] != "sent" {
+		t.Fatalf("expected the receipt of the SEND but got %v", receipt.headers)
+	}
+}
+
+// TestNack verifies that the datapoints are sent again after a NACK and that
+// acknowledgements sent along with it don't move the consumer over them
+func TestNack(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := pushDatapoints(t, b, 2)
+	c := dial(t, NewServer(b))
+	defer c.close()
+
+	c.send(newFrame("SUBSCRIBE", "id", "0", "destination", destinationPrefix+pipeline.Id, "consumer", "consumer1", "ack", ackClient))
+	first, second := c.expect("MESSAGE"), c.expect("MESSAGE")
+	// acknowledging the second message covers the first one in the ack mode client
+	c.send(newFrame("NACK", "id", first.headers["ack"]), newFrame("ACK", "id", second.headers["ack"]))
+
+	for _, value := range []string{"Event 1", "Event 2"} {
+		if message := c.expect("MESSAGE"); string(message.body) != value {
+			t.Fatalf("expected %s to be sent again but got %q", value, message.body)
+		}
+	}
+	// the receipt of a frame sent afterwards shows the acknowledgements are processed
+	c.send(newFrame("SEND", "destination", destinationPrefix+pipeline.Id, "receipt", "sent"))
+	c.expect("RECEIPT")
+	if offset := consumerOffset(t, b, pipeline.Id, "consumer1"); offset != 0 {
+		t.Fatalf("expected the consumer to stay in front of the datapoints sent again but got offset %d", offset)
+	}
+}
+
+func TestSubscribeErrors(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline := pushDatapoints(t, b, 0)
+
+	tests := []struct {
+		headers []string
+		message string
+	}{
+		{[]string{"destination", destinationPrefix + pipeline.Id, "consumer", "consumer1"}, "missing id header"},
+		{[]string{"id", "0", "destination", destinationPrefix + pipeline.Id}, "missing consumer header"},
+		{[]string{"id", "0", "destination", "/queue/a", "consumer", "consumer1"}, "destination /queue/a isn't of the form /pipeline/<pipeline>"},
+		{[]string{"id", "0", "destination", destinationPrefix + "unknown", "consumer", "consumer1"}, backend.ErrPipelineNotFound.Error()},
+		{[]string{"id", "0", "destination", destinationPrefix + pipeline.Id, "consumer", "consumer1", "ack", "never"}, "unknown ack mode never"},
+		{[]string{"id", "0", "destination", destinationPrefix + pipeline.Id, "consumer", "consumer1", "prefetch-count", "0"}, "prefetch-count is not a positive integer"},
+	}
+	for _, test := range tests {
+		c := dial(t, NewServer(b))
+		c.send(newFrame("SUBSCRIBE", test.headers...))
+		if e := c.expect("ERROR"); e.headers["message"] != test.message {
+			t.Errorf("expected the error %q but got %q", test.message, e.headers["message"])
+		}
+		c.close()
+	}
+}
@@ -1,22 +1,34 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"github.com/cgrotz/turbine.go/amqp"
 	"github.com/cgrotz/turbine.go/backend"
+	"github.com/cgrotz/turbine.go/kafka"
+	"github.com/cgrotz/turbine.go/mqtt"
+	"github.com/cgrotz/turbine.go/resp"
+	"github.com/cgrotz/turbine.go/rpc"
+	"github.com/cgrotz/turbine.go/stomp"
 	"github.com/rcrowley/go-metrics"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/gorilla/mux"
 )
 
 func main() {
-	//mqtt.Run()
 	app := cli.NewApp()
 	app.Name = "turbined"
 	app.Usage = "message queue for the cloud"
@@ -26,20 +38,54 @@ func main() {
 			ShortName: "r",
 			Usage:     "run the Turbine server",
 			Action: func(c *cli.Context) {
-				run(c.GlobalInt("writers"), c.GlobalString("redisUrl"), c.GlobalString("bind"))
+				run(Config{
+					Backend:           c.GlobalString("backend"),
+					Writers:           c.GlobalInt("writers"),
+					RedisUrl:          c.GlobalString("redisUrl"),
+					DataDir:           c.GlobalString("dataDir"),
+					Bind:              c.GlobalString("bind"),
+					Retention:         c.GlobalString("retention"),
+					RetentionInterval: c.GlobalInt("retentionInterval"),
+					MaxPop:            c.GlobalInt("maxPop"),
+					MqttBind:          c.GlobalString("mqttBind"),
+					GrpcBind:          c.GlobalString("grpcBind"),
+					RespBind:          c.GlobalString("respBind"),
+					AmqpBind:          c.GlobalString("amqpBind"),
+					StompBind:         c.GlobalString("stompBind"),
+					KafkaBind:         c.GlobalString("kafkaBind"),
+				})
 			},
 		},
 		{
 			Name:      "status",
 			ShortName: "s",
 			Usage:     "show cluster status",
-			Action: func(c *cli.Context) {
-				println("status")
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "url",
+					Value: "",
+					Usage: "address of the running server, e.g. 'http://localhost:3000', derived from the http bind unless set",
+				},
+				cli.BoolFlag{
+					Name:  "direct",
+					Usage: "read the status from Redis instead of a running server",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the status as json",
+				},
 			},
+			Action: status,
 		},
 	}
 
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "backend",
+			Value:  "redis",
+			Usage:  "storage backend for pipelines, either 'redis', 'redis-streams', 'file' or 'memory'",
+			EnvVar: "TURBINE_BACKEND",
+		},
 		cli.StringFlag{
 			Name:   "bind",
 			Value:  ":3000",
@@ -58,16 +104,110 @@ func main() {
 			Usage:  "addresses of redis, e.g. tcp://127.0.0.1:6379",
 			EnvVar: "REDIS_PORT_6379_TCP",
 		},
+		cli.StringFlag{
+			Name:   "dataDir",
+			Value:  "data",
+			Usage:  "directory of the file backend, e.g. '/var/lib/turbine'",
+			EnvVar: "TURBINE_DATA_DIR",
+		},
+		cli.StringFlag{
+			Name:   "retention",
+			Value:  "",
+			Usage:  "json file with the retention policies of the pipelines, e.g. '/etc/turbine/retention.json'",
+			EnvVar: "TURBINE_RETENTION",
+		},
+		cli.IntFlag{
+			Name:   "retentionInterval",
+			Value:  60,
+			Usage:  "seconds between two runs of the retention cleanup",
+			EnvVar: "TURBINE_RETENTION_INTERVAL",
+		},
+		cli.IntFlag{
+			Name:   "maxPop",
+			Value:  1000,
+			Usage:  "maximum amount of datapoints a consumer may pop at once",
+			EnvVar: "TURBINE_MAX_POP",
+		},
+		cli.StringFlag{
+			Name:   "mqttBind",
+			Value:  "",
+			Usage:  "bind of the MQTT listener, e.g. ':1883', disabled unless set",
+			EnvVar: "TURBINE_MQTT_BIND",
+		},
+		cli.StringFlag{
+			Name:   "grpcBind",
+			Value:  "",
+			Usage:  "bind of the gRPC interface, e.g. ':3001', disabled unless set",
+			EnvVar: "TURBINE_GRPC_BIND",
+		},
+		cli.StringFlag{
+			Name:   "respBind",
+			Value:  "",
+			Usage:  "bind of the listener speaking the Redis protocol, e.g. ':6380', disabled unless set",
+			EnvVar: "TURBINE_RESP_BIND",
+		},
+		cli.StringFlag{
+			Name:   "amqpBind",
+			Value:  "",
+			Usage:  "bind of the AMQP 0-9-1 listener for publishers, e.g. ':5672', disabled unless set",
+			EnvVar: "TURBINE_AMQP_BIND",
+		},
+		cli.StringFlag{
+			Name:   "stompBind",
+			Value:  "",
+			Usage:  "bind of the STOMP 1.2 listener, e.g. ':61613', disabled unless set",
+			EnvVar: "TURBINE_STOMP_BIND",
+		},
+		cli.StringFlag{
+			Name:   "kafkaBind",
+			Value:  "",
+			Usage:  "bind of the listener speaking the Kafka protocol, e.g. ':9092', disabled unless set",
+			EnvVar: "TURBINE_KAFKA_BIND",
+		},
 	}
 
 	app.Run(os.Args)
 }
 
+// how long a lease is held unless the member asks for another timeout
+const defaultVisibilityTimeout = 30 * time.Second
+
+// how often idle event streams send a comment to keep the connection open
+const streamKeepAlive = 15 * time.Second
+
+// upper bound of the wait parameter of pops
+const maxPopWait = 5 * time.Minute
+
+// maximum size of a single line of a newline delimited batch
+const maxDatapointSize = 16 * 1024 * 1024
+
 type Server struct {
 	Backend backend.Backend
+	// name of the backend as configured, shown in the status
+	BackendName string
+	// upper bound of the max parameter of pops
+	MaxPop int64
 }
 
-func run(writers int, address string, binding string) {
+// Config holds the settings of the Turbine server
+type Config struct {
+	Backend           string
+	Writers           int
+	RedisUrl          string
+	DataDir           string
+	Bind              string
+	Retention         string
+	RetentionInterval int
+	MaxPop            int
+	MqttBind          string
+	GrpcBind          string
+	RespBind          string
+	AmqpBind          string
+	StompBind         string
+	KafkaBind         string
+}
+
+func run(config Config) {
 	println("___________          ___.   .__")
 	println("\\__    ___/_ ________\\_ |__ |__| ____   ____")
 	println("  |    | |  |  \\_  __ \\ __ \\|  |/    \\_/ __ \\")
@@ -76,26 +216,103 @@ func run(writers int, address string, binding string) {
 	println("                          \\/        \\/     \\/")
 
 	log.Println("printing configuration")
-	log.Printf("redis: %s", address)
-	log.Printf("http bind to: %s", binding)
-	log.Printf("writers: %d", writers)
+	log.Printf("backend: %s", config.Backend)
+	log.Printf("redis: %s", config.RedisUrl)
+	log.Printf("data directory: %s", config.DataDir)
+	log.Printf("http bind to: %s", config.Bind)
+	log.Printf("writers: %d", config.Writers)
+	log.Printf("retention policies: %s", config.Retention)
+	log.Printf("maximum pop: %d", config.MaxPop)
+	log.Printf("mqtt bind to: %s", config.MqttBind)
+	log.Printf("grpc bind to: %s", config.GrpcBind)
+	log.Printf("resp bind to: %s", config.RespBind)
+	log.Printf("amqp bind to: %s", config.AmqpBind)
+	log.Printf("stomp bind to: %s", config.StompBind)
+	log.Printf("kafka bind to: %s", config.KafkaBind)
 
 	go metrics.Log(metrics.DefaultRegistry, 10e9, log.New(os.Stdout, "metrics: ", log.Lmicroseconds))
 
-	server := &Server{}
-	redisBackend := backend.RedisBackend{RedisUrl: address, Datapoints: make(chan *backend.Datapoint)}
-	server.Backend = backend.Backend(redisBackend)
+	server := &Server{BackendName: config.Backend, MaxPop: int64(config.MaxPop)}
+	switch config.Backend {
+	case "memory":
+		server.Backend = backend.Backend(backend.NewMemoryBackend())
+	case "file":
+		fileBackend, err := backend.NewFileBackend(config.DataDir, backend.DefaultSegmentSize)
+		if err != nil {
+			log.Fatal("Unable to open data directory:", err.Error())
+		}
+		server.Backend = backend.Backend(fileBackend)
+	case "redis":
+		redisBackend := backend.RedisBackend{RedisUrl: config.RedisUrl, Datapoints: make(chan *backend.Datapoint), Broker: backend.NewBroker(), Writers: &backend.WriterPool{}}
+		server.Backend = backend.Backend(redisBackend)
 
-	hash, err := redisBackend.StartScripting()
-	if err != nil {
-		log.Fatal("Unable to load scripts to redis")
+		_, err := redisBackend.StartScripting()
+		if err != nil {
+			log.Fatal("Unable to load scripts to redis")
+		}
+
+		t := metrics.NewTimer()
+		metrics.Register("messageloop", t)
+		// Initialize writers
+		for i := 1; i < config.Writers+1; i++ {
+			go redisBackend.Start(t, redisBackend.Datapoints)
+		}
+	case "redis-streams":
+		streamsBackend, err := backend.NewRedisStreamsBackend(config.RedisUrl)
+		if err != nil {
+			log.Fatal("Unable to load scripts to redis")
+		}
+		server.Backend = backend.Backend(streamsBackend)
+	default:
+		log.Fatalf("Unknown backend \"%s\"", config.Backend)
 	}
 
-	t := metrics.NewTimer()
-	metrics.Register("messageloop", t)
-	// Initialize writers
-	for i := 1; i < writers+1; i++ {
-		go redisBackend.Start(t, hash, redisBackend.Datapoints)
+	// pipelines may define their own retention policy, so the job always runs
+	if config.RetentionInterval < 1 {
+		log.Fatalf("Retention interval must be at least 1 second, got %d", config.RetentionInterval)
+	}
+	retention := backend.Retention{Backend: server.Backend, Interval: time.Duration(config.RetentionInterval) * time.Second}
+	if config.Retention != "" {
+		policies, err := backend.ReadRetentionPolicies(config.Retention)
+		if err != nil {
+			log.Fatal("Unable to read retention policies:", err.Error())
+		}
+		retention.Policies = policies
+	}
+	go retention.Run()
+
+	if config.MqttBind != "" {
+		go func() {
+			log.Fatal(mqtt.NewServer(server.Backend).ListenAndServe(config.MqttBind))
+		}()
+	}
+	if config.GrpcBind != "" {
+		rpcServer := &rpc.Server{Backend: server.Backend, MaxPop: server.MaxPop}
+		go func() {
+			log.Fatal(rpcServer.ListenAndServe(config.GrpcBind))
+		}()
+	}
+	if config.RespBind != "" {
+		respServer := &resp.Server{Backend: server.Backend, MaxPop: server.MaxPop}
+		go func() {
+			log.Fatal(respServer.ListenAndServe(config.RespBind))
+		}()
+	}
+	if config.AmqpBind != "" {
+		go func() {
+			log.Fatal(amqp.NewServer(server.Backend).ListenAndServe(config.AmqpBind))
+		}()
+	}
+	if config.StompBind != "" {
+		go func() {
+			log.Fatal(stomp.NewServer(server.Backend).ListenAndServe(config.StompBind))
+		}()
+	}
+	if config.KafkaBind != "" {
+		kafkaServer := &kafka.Server{Backend: server.Backend, MaxPop: server.MaxPop}
+		go func() {
+			log.Fatal(kafkaServer.ListenAndServe(config.KafkaBind))
+		}()
 	}
 
 	// Rest Interface
@@ -109,27 +326,39 @@ func run(writers int, address string, binding string) {
 	r.Path("/api/v1/pipelines/{id}").Methods("PUT").HandlerFunc(server.updatePipeline)
 	r.Path("/api/v1/pipelines/{id}").Methods("DELETE").HandlerFunc(server.deletePipeline)
 
+	// Consumers
+	r.Path("/api/v1/pipelines/{id}/consumers").Methods("GET").HandlerFunc(server.listConsumers)
+	r.Path("/api/v1/pipelines/{id}/consumers").Methods("POST").HandlerFunc(server.createConsumer)
+	r.Path("/api/v1/pipelines/{id}/consumers/{consumer}").Methods("DELETE").HandlerFunc(server.deleteConsumer)
+	r.Path("/api/v1/pipelines/{id}/consumers/{consumer}/seek").Methods("POST").HandlerFunc(server.seekConsumer)
+	r.Path("/api/v1/pipelines/{id}/consumers/{consumer}/commit").Methods("POST").HandlerFunc(server.commitOffset)
+	r.Path("/api/v1/pipelines/{id}/consumers/{consumer}/leases/{lease}/ack").Methods("POST").HandlerFunc(server.ackLease)
+	r.Path("/api/v1/pipelines/{id}/consumers/{consumer}/leases/{lease}/nack").Methods("POST").HandlerFunc(server.nackLease)
+
 	// Pipeline statistics
 	r.Path("/api/v1/pipelines/{id}/statistics").Methods("GET").HandlerFunc(server.getPipelineStatistics)
 
 	// Datapoint Endpoints
-	// TODO not sure how to solve that yet...
 	r.Path("/api/v1/pipelines/{id}/datapoints").Headers("Accept", "text/event-stream").Methods("GET").HandlerFunc(server.stream)
 	r.Path("/api/v1/pipelines/{id}/datapoints").Methods("GET").HandlerFunc(server.popDatapoint)
 	r.Path("/api/v1/pipelines/{id}/datapoints").Methods("POST").HandlerFunc(server.pushDatapoint)
+	r.Path("/api/v1/pipelines/{id}/datapoints/batch").Methods("POST").HandlerFunc(server.pushDatapoints)
+	r.Path("/api/v1/pipelines/{id}/ws").Methods("GET").HandlerFunc(server.connect)
+
+	// Status
+	r.Path("/api/v1/status").Methods("GET").HandlerFunc(server.getStatus)
 
 	http.Handle("/api/v1/", r)
 	http.Handle("/", http.FileServer(http.Dir("ui/build")))
 
-	http.ListenAndServe(binding, nil)
+	http.ListenAndServe(config.Bind, nil)
 }
 
 func (s *Server) listPipelines(w http.ResponseWriter, r *http.Request) {
 
 	pipelines, err := s.Backend.GetPipelines()
 	if err != nil {
-		log.Fatal("Error retrieving pipeline:", err.Error())
-		http.Error(w, err.Error(), 500)
+		backendError(w, "Error retrieving pipelines:", err)
 		return
 	}
 
@@ -139,12 +368,13 @@ func (s *Server) listPipelines(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) createPipeline(w http.ResponseWriter, r *http.Request) {
 	pipeline := &backend.Pipeline{}
-	decodeBody(w, r, pipeline)
+	if !decodeBody(w, r, pipeline) || !s.validatePipeline(w, pipeline.Id, pipeline) {
+		return
+	}
 
 	pipeline, err := s.Backend.CreatePipeline(pipeline)
 	if err != nil {
-		log.Fatal("Error saving pipeline:", err.Error())
-		http.Error(w, err.Error(), 500)
+		backendError(w, "Error saving pipeline:", err)
 		return
 	}
 
@@ -159,8 +389,7 @@ func (s *Server) getPipeline(w http.ResponseWriter, r *http.Request) {
 
 	pipeline, err := s.Backend.GetPipeline(id)
 	if err != nil {
-		log.Fatal("Error retrieving pipeline:", err.Error())
-		http.Error(w, err.Error(), 500)
+		backendError(w, "Error retrieving pipeline:", err)
 		return
 	}
 
@@ -173,12 +402,13 @@ func (s *Server) updatePipeline(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	pipeline := &backend.Pipeline{}
-	decodeBody(w, r, pipeline)
+	if !decodeBody(w, r, pipeline) || !s.validatePipeline(w, id, pipeline) {
+		return
+	}
 
 	_, err := s.Backend.UpdatePipeline(id, pipeline)
 	if err != nil {
-		log.Fatal("Error retrieving pipeline:", err.Error())
-		http.Error(w, err.Error(), 500)
+		backendError(w, "Error updating pipeline:", err)
 		return
 	}
 
@@ -191,8 +421,7 @@ func (s *Server) deletePipeline(w http.ResponseWriter, r *http.Request) {
 
 	_, err := s.Backend.DeletePipeline(id)
 	if err != nil {
-		log.Fatal("Error deleting pipeline:", err.Error())
-		http.Error(w, err.Error(), 500)
+		backendError(w, "Error deleting pipeline:", err)
 		return
 	}
 
@@ -205,8 +434,7 @@ func (s *Server) getPipelineStatistics(w http.ResponseWriter, r *http.Request) {
 
 	pipelineStatistic, err := s.Backend.RetrievePipelineStatistic(id)
 	if err != nil {
-		log.Fatal("Error retrieving pipeline statistic:", err.Error())
-		http.Error(w, err.Error(), 500)
+		backendError(w, "Error retrieving pipeline statistic:", err)
 		return
 	}
 
@@ -214,6 +442,26 @@ func (s *Server) getPipelineStatistics(w http.ResponseWriter, r *http.Request) {
 	log.Println("Finished HTTP request at ", r.URL.Path)
 }
 
+// getStatus returns the status of the backend and its pipelines, see
+// backend.ReadStatus
+func (s *Server) getStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := backend.ReadStatus(s.Backend)
+	if err != nil {
+		log.Println("Error retrieving status:", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status.Backend = s.BackendName
+
+	marshalResponse(w, r, status)
+	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+// popDatapoint returns the next datapoints of the consumer, at most max of them,
+// which is capped by the server, and no more than max_bytes. With
+// commit=manual the datapoints are returned with their offsets instead, with a
+// member they are leased to that member of the consumer. If there is nothing
+// to read, wait keeps the request open until datapoints are pushed.
 func (s *Server) popDatapoint(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pipelineId := vars["id"]
@@ -221,9 +469,46 @@ func (s *Server) popDatapoint(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	consumerId := query["consumer"]
 	if len(consumerId) > 0 {
-		datapoints, err := s.Backend.PopDatapoint(pipelineId, consumerId[0])
+		limit, err := s.popLimit(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wait, err := popWait(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// members of a consumer lease datapoints, competing for them
+		if member := query.Get("member"); member != "" {
+			s.leaseDatapoints(w, r, pipelineId, consumerId[0], member, limit, wait)
+			return
+		}
+
+		// in manual commit mode the consumer pointer moves once the consumer commits
+		if query.Get("commit") == "manual" {
+			var datapoints []backend.OffsetDatapoint
+			err := s.await(r, pipelineId, wait, func() (bool, error) {
+				datapoints, err = s.Backend.PeekDatapoints(pipelineId, consumerId[0], limit)
+				return len(datapoints) > 0, err
+			})
+			if err != nil {
+				log.Println("Error retrieving datapoints:", err.Error())
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			marshalResponse(w, r, datapoints)
+			return
+		}
+
+		var datapoints []string
+		err = s.await(r, pipelineId, wait, func() (bool, error) {
+			datapoints, err = s.Backend.PopDatapoint(pipelineId, consumerId[0], limit)
+			return len(datapoints) > 0, err
+		})
 		if err != nil {
-			log.Fatal("Error retrieving pipeline:", err.Error())
+			log.Println("Error retrieving pipeline:", err.Error())
 			http.Error(w, err.Error(), 500)
 			return
 		}
@@ -233,109 +518,539 @@ func (s *Server) popDatapoint(w http.ResponseWriter, r *http.Request) {
 	log.Println("Finished HTTP request at ", r.URL.Path)
 }
 
+func (s *Server) listConsumers(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pipelineId := vars["id"]
+
+	consumers, err := s.Backend.GetConsumers(pipelineId)
+	if err != nil {
+		backendError(w, "Error retrieving consumers:", err)
+		return
+	}
+
+	marshalResponse(w, r, consumers)
+	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+func (s *Server) createConsumer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pipelineId := vars["id"]
+
+	consumer := &backend.Consumer{}
+	if !decodeBody(w, r, consumer) {
+		return
+	}
+	if consumer.Id == "" {
+		http.Error(w, "missing consumer id", http.StatusBadRequest)
+		return
+	}
+
+	consumer, err := s.Backend.CreateConsumer(pipelineId, consumer.Id)
+	if err != nil {
+		backendError(w, "Error creating consumer:", err)
+		return
+	}
+
+	w.Header().Add("Location", fmt.Sprintf("/api/v1/pipelines/%s/consumers/%s", pipelineId, consumer.Id))
+	marshalStatusResponse(w, r, http.StatusCreated, consumer)
+	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+func (s *Server) deleteConsumer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pipelineId := vars["id"]
+	consumerId := vars["consumer"]
+
+	_, err := s.Backend.DeleteConsumer(pipelineId, consumerId)
+	if err != nil {
+		backendError(w, "Error deleting consumer:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+// seekConsumer moves the consumer to the beginning, the end, an offset or a
+// timestamp, e.g. to replay or skip datapoints
+func (s *Server) seekConsumer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pipelineId := vars["id"]
+	consumerId := vars["consumer"]
+
+	seek := backend.Seek{}
+	if !decodeBody(w, r, &seek) {
+		return
+	}
+	if err := seek.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	consumer, err := s.Backend.SeekConsumer(pipelineId, consumerId, seek)
+	if err != nil {
+		backendError(w, "Error seeking consumer:", err)
+		return
+	}
+
+	marshalResponse(w, r, consumer)
+	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+// leaseDatapoints answers with a lease of the next datapoints, or 204 if all
+// datapoints are leased or acknowledged
+func (s *Server) leaseDatapoints(w http.ResponseWriter, r *http.Request, pipelineId string, consumerId string, memberId string, limit backend.PopLimit, wait time.Duration) {
+	timeout := defaultVisibilityTimeout
+	if seconds := r.URL.Query().Get("timeout"); seconds != "" {
+		parsed, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil || parsed <= 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout \"%s\"", seconds), http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(parsed) * time.Second
+	}
+
+	var lease *backend.Lease
+	err := s.await(r, pipelineId, wait, func() (bool, error) {
+		var err error
+		lease, err = backend.LeaseWithDeadLetter(s.Backend, pipelineId, consumerId, memberId, limit, timeout)
+		return lease != nil, err
+	})
+	if err != nil {
+		backendError(w, "Error leasing datapoints:", err)
+		return
+	}
+	if lease == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	marshalResponse(w, r, lease)
+	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+func (s *Server) ackLease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pipelineId := vars["id"]
+	consumerId := vars["consumer"]
+	leaseId := vars["lease"]
+
+	if err := s.Backend.AckLease(pipelineId, consumerId, leaseId); err != nil {
+		backendError(w, "Error acknowledging lease:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+// nackLease hands a lease back, its datapoints are delivered again after a
+// backoff or moved to the dead letter pipeline of the pipeline
+func (s *Server) nackLease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pipelineId := vars["id"]
+	consumerId := vars["consumer"]
+	leaseId := vars["lease"]
+
+	if err := s.Backend.NackLease(pipelineId, consumerId, leaseId); err != nil {
+		backendError(w, "Error nacking lease:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+type commitRequest struct {
+	XMLName xml.Name `json:"-" xml:"commit"`
+	Offset  int64    `json:"offset" xml:"offset"`
+}
+
+// commitOffset moves the consumer pointer to the offset of the last datapoint
+// the consumer processed
+func (s *Server) commitOffset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pipelineId := vars["id"]
+	consumerId := vars["consumer"]
+
+	commit := &commitRequest{}
+	if !decodeBody(w, r, commit) {
+		return
+	}
+	if commit.Offset < 0 {
+		http.Error(w, backend.ErrInvalidOffset.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := s.Backend.CommitOffset(pipelineId, consumerId, commit.Offset)
+	if err != nil {
+		backendError(w, "Error committing offset:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+// popWait parses how long a pop waits for datapoints, e.g. wait=30s
+func popWait(query url.Values) (time.Duration, error) {
+	value := query.Get("wait")
+	if value == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 {
+		return 0, fmt.Errorf("invalid wait \"%s\"", value)
+	}
+	if wait > maxPopWait {
+		wait = maxPopWait
+	}
+	return wait, nil
+}
+
+// await calls read until it finds something, the wait elapses or the client
+// goes away. Instead of polling the backend it reads again whenever
+// datapoints are pushed to the pipeline.
+func (s *Server) await(r *http.Request, pipelineId string, wait time.Duration, read func() (bool, error)) error {
+	if wait == 0 {
+		_, err := read()
+		return err
+	}
+
+	// subscribe before the first read, so no datapoint pushed in between is missed
+	notifications := s.Backend.Subscribe(pipelineId)
+	defer s.Backend.Unsubscribe(pipelineId, notifications)
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		found, err := read()
+		if found || err != nil {
+			return err
+		}
+
+		select {
+		case <-notifications:
+		case <-timeout.C:
+			return nil
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *Server) popLimit(query url.Values) (backend.PopLimit, error) {
+	limit := backend.PopLimit{}
+	var err error
+	if max := query.Get("max"); max != "" {
+		limit.Max, err = strconv.ParseInt(max, 10, 64)
+		if err != nil || limit.Max <= 0 {
+			return limit, fmt.Errorf("invalid max \"%s\"", max)
+		}
+	}
+	if s.MaxPop > 0 && limit.Max > s.MaxPop {
+		limit.Max = s.MaxPop
+	}
+	if maxBytes := query.Get("max_bytes"); maxBytes != "" {
+		limit.MaxBytes, err = strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || limit.MaxBytes <= 0 {
+			return limit, fmt.Errorf("invalid max_bytes \"%s\"", maxBytes)
+		}
+	}
+	return limit, nil
+}
+
+// pushDatapoint stores the request body as datapoint. With ack=true the request
+// waits until the datapoint is stored and answers 201 with its location,
+// otherwise backends writing asynchronously answer 202 right away.
 func (s *Server) pushDatapoint(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
+	ack := r.URL.Query().Get("ack") == "true"
 
 	bodyStr, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Fatal("Error opening connection to redis:", err.Error())
+		log.Println("Error reading datapoint:", err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	datapointIndex, err := s.Backend.PushDatapoint(id, string(bodyStr), ack)
+	if err != nil {
+		log.Println("Error pushing datapoint:", err.Error())
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	datapointIndex, err := s.Backend.PushDatapoint(id, string(bodyStr))
+	if datapointIndex == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Add("Location", fmt.Sprintf("/api/v1/pipelines/%s/datapoints/%d", id, datapointIndex))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// pushDatapoints stores a batch of datapoints at once, answering with the range
+// of indexes assigned to them just like pushDatapoint
+func (s *Server) pushDatapoints(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	ack := r.URL.Query().Get("ack") == "true"
+
+	values, err := decodeBatch(r)
+	if err != nil {
+		log.Println("Error decoding batch:", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(values) == 0 {
+		http.Error(w, "batch contains no datapoints", http.StatusBadRequest)
+		return
+	}
+
+	first, last, err := s.Backend.PushDatapoints(id, values, ack)
 	if err != nil {
-		log.Fatal("Error pushing datapoint:", err.Error())
+		log.Println("Error pushing datapoints:", err.Error())
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	w.Header().Add("Location", fmt.Sprintf("http://localhost:3000/api/v1/%s/datapoints/%d", id, datapointIndex))
+	if last == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	marshalStatusResponse(w, r, http.StatusCreated, backend.DatapointRange{First: first, Last: last})
 }
 
+// stream sends the datapoints of the consumer as server-sent events, with the
+// offset of every datapoint as event id. The consumer pointer moves forward
+// once a datapoint is sent, a client reconnecting with Last-Event-ID continues
+// right after the last event it received.
 func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pipelineId := vars["id"]
 
-	if pipelineId != "" {
-		// Make sure that the writer supports flushing.
-		f, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+	query := r.URL.Query()
+	consumerId := query.Get("consumer")
+	if consumerId == "" {
+		http.Error(w, "missing consumer", http.StatusBadRequest)
+		return
+	}
+	limit, err := s.popLimit(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Make sure that the writer supports flushing.
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		offset, err := strconv.ParseInt(lastEventId, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
 			return
 		}
+		if _, err := s.Backend.CreateConsumer(pipelineId, consumerId); err != nil && err != backend.ErrConsumerExists {
+			backendError(w, "Error creating consumer:", err)
+			return
+		}
+		if _, err := s.Backend.SeekConsumer(pipelineId, consumerId, backend.Seek{Position: backend.SeekOffset, Offset: offset + 1}); err != nil {
+			backendError(w, "Error resuming consumer:", err)
+			return
+		}
+	}
 
-		messageChan := make(chan string)
-		// TODO register message/Chan against pipeline, maybe redis pub/sub?
+	// subscribe before the first read, so no datapoint pushed in between is missed
+	notifications := s.Backend.Subscribe(pipelineId)
+	defer s.Backend.Unsubscribe(pipelineId, notifications)
 
-		// Listen to the closing of the http connection via the CloseNotifier
-		notify := w.(http.CloseNotifier).CloseNotify()
-		go func() {
-			<-notify
-			// TODO deregister channel
-			log.Println("HTTP connection just closed.")
-		}()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
 
-		// Add SSE Headers
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
+	// Add SSE Headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	f.Flush()
 
-		for {
-			// Read from our messageChan.
-			msg := <-messageChan
+	for {
+		datapoints, err := s.Backend.PeekDatapoints(pipelineId, consumerId, limit)
+		if err != nil {
+			log.Println("Error retrieving datapoints:", err.Error())
+			return
+		}
 
-			// Write to the ResponseWriter, `w`.
-			fmt.Fprintf(w, "data: Message: %s\n\n", msg)
+		if len(datapoints) > 0 {
+			for _, datapoint := range datapoints {
+				writeEvent(w, datapoint)
+			}
+			f.Flush()
+			if err := s.Backend.CommitOffset(pipelineId, consumerId, datapoints[len(datapoints)-1].Offset); err != nil {
+				log.Println("Error committing offset:", err.Error())
+				return
+			}
+			continue
+		}
 
-			// Flush the response.  This is only possible if
-			// the repsonse supports streaming.
+		select {
+		case <-notifications:
+		case <-keepAlive.C:
+			// comments keep proxies from closing the idle connection
+			fmt.Fprint(w, ": keep-alive\n\n")
 			f.Flush()
+		case <-r.Context().Done():
+			// the client closed the connection
+			log.Println("Finished HTTP request at ", r.URL.Path)
+			return
 		}
 	}
-	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+// event streams end lines with any of CRLF, CR and LF
+var lineEnds = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// writeEvent writes the datapoint as event, every line of the payload becomes
+// a data field of its own. Clients join the fields with LF, so other line
+// ends of the payload arrive as LF.
+func writeEvent(w io.Writer, datapoint backend.OffsetDatapoint) {
+	fmt.Fprintf(w, "id: %d\n", datapoint.Offset)
+	for _, line := range strings.Split(lineEnds.Replace(datapoint.Value), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// backendError answers with the status matching the error returned by the backend
+func backendError(w http.ResponseWriter, message string, err error) {
+	switch err {
+	case backend.ErrPipelineNotFound, backend.ErrConsumerNotFound, backend.ErrLeaseNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case backend.ErrConsumerExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case backend.ErrInvalidOffset, backend.ErrInvalidSeek:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Println(message, err.Error())
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// validatePipeline checks the settings of a pipeline sent by a client, answering
+// with 400 if they are invalid
+func (s *Server) validatePipeline(w http.ResponseWriter, id string, pipeline *backend.Pipeline) bool {
+	if err := backend.ValidatePipeline(s.Backend, id, pipeline); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+type xmlDatapoints struct {
+	XMLName    xml.Name `xml:"datapoints"`
+	Datapoints []string `xml:"datapoint"`
+}
+
+// decodeBatch reads the values of a batch depending on the content type, either
+// a JSON array, an XML list of datapoint elements or one value per line. Values
+// of a JSON array which aren't strings are stored as JSON.
+func decodeBatch(r *http.Request) ([]string, error) {
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch mediaType {
+	case "text/xml", "application/xml":
+		datapoints := xmlDatapoints{}
+		if err := xml.NewDecoder(r.Body).Decode(&datapoints); err != nil {
+			return nil, err
+		}
+		return datapoints.Datapoints, nil
+	case "text/plain", "application/x-ndjson":
+		var values []string
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), maxDatapointSize)
+		for scanner.Scan() {
+			if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+				values = append(values, line)
+			}
+		}
+		return values, scanner.Err()
+	default:
+		var elements []json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&elements); err != nil {
+			return nil, err
+		}
+		values := make([]string, len(elements))
+		for i, element := range elements {
+			var value string
+			if err := json.Unmarshal(element, &value); err != nil {
+				value = string(element)
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
 }
 
 func marshalResponse(w http.ResponseWriter, r *http.Request, obj interface{}) {
+	marshalStatusResponse(w, r, http.StatusOK, obj)
+}
+
+// marshalStatusResponse answers with the status, which is only written once
+// the object is marshalled and the Content-Type is set
+func marshalStatusResponse(w http.ResponseWriter, r *http.Request, status int, obj interface{}) {
 	if len(r.Header["Accept"]) > 0 && r.Header["Accept"][0] == "text/xml" {
 		str, err := xml.Marshal(obj)
 		if err != nil {
-			log.Fatal("Error marshalling pipeline:", err.Error())
+			log.Println("Error marshalling response:", err.Error())
 			http.Error(w, err.Error(), 500)
 			return
 		}
 		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(status)
 		w.Write(str)
 	} else {
 		str, err := json.Marshal(obj)
 		if err != nil {
-			log.Fatal("Error marshalling pipeline:", err.Error())
+			log.Println("Error marshalling response:", err.Error())
 			http.Error(w, err.Error(), 500)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
 		w.Write(str)
 	}
 }
 
-func decodeBody(w http.ResponseWriter, r *http.Request, obj interface{}) {
+// decodeBody decodes the request body, answering with 400 if it is invalid
+func decodeBody(w http.ResponseWriter, r *http.Request, obj interface{}) bool {
 	if len(r.Header["Content-Type"]) > 0 && r.Header["Content-Type"][0] == "text/xml" {
 		decoder := xml.NewDecoder(r.Body)
 		err := decoder.Decode(obj)
 		if err != nil {
-			log.Fatal("ERROR decoding XML - ", err.Error())
-			http.Error(w, err.Error(), 500)
-			return
+			log.Println("ERROR decoding XML - ", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
 		}
 
 	} else {
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(obj)
 		if err != nil {
-			log.Fatal("ERROR decoding JSON - ", err.Error())
-			http.Error(w, err.Error(), 500)
-			return
+			log.Println("ERROR decoding JSON - ", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
 		}
 	}
+	return true
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"github.com/cgrotz/turbine.go/backend"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// parseEvents splits an event stream the way browsers do, on CRLF, CR and LF
+func parseEvents(stream string) []map[string][]string {
+	var events []map[string][]string
+	event := map[string][]string{}
+	for _, line := range regexp.MustCompile("\r\n|\r|\n").Split(stream, -1) {
+		if line == "" {
+			if len(event) > 0 {
+				events = append(events, event)
+			}
+			event = map[string][]string{}
+			continue
+		}
+		field := strings.SplitN(line, ":", 2)
+		if len(field) == 2 {
+			event[field[0]] = append(event[field[0]], strings.TrimPrefix(field[1], " "))
+		}
+	}
+	return events
+}
+
+func TestWriteEvent(t *testing.T) {
+	tests := []struct {
+		value string
+		data  string
+	}{
+		{"Event 1", "Event 1"},
+		{"line 1\nline 2", "line 1\nline 2"},
+		{"line 1\r\nline 2", "line 1\nline 2"},
+		{"Event\rid: 999", "Event\nid: 999"},
+		{"Event\r\rdata: injected", "Event\n\ndata: injected"},
+		{"\n", "\n"},
+	}
+
+	for _, test := range tests {
+		var stream bytes.Buffer
+		writeEvent(&stream, backend.OffsetDatapoint{Offset: 7, Value: test.value})
+		events := parseEvents(stream.String())
+		if len(events) != 1 {
+			t.Errorf("writeEvent(%q) wrote %d events: %q", test.value, len(events), stream.String())
+			continue
+		}
+		id, data := events[0]["id"], strings.Join(events[0]["data"], "\n")
+		if len(id) != 1 || id[0] != "7" || data != test.data {
+			t.Errorf("writeEvent(%q) wrote id %q and data %q instead of 7 and %q", test.value, id, data, test.data)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/cgrotz/turbine.go/backend"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// wsMessage is the JSON message exchanged over the websocket of a pipeline.
+// Clients send push, subscribe and credit messages, the server answers with
+// pushed, subscribed, datapoint and error messages.
+type wsMessage struct {
+	Type string `json:"type"`
+	// chosen by the client and repeated in the answer to its message
+	Id       string `json:"id,omitempty"`
+	Payload  string `json:"payload,omitempty"`
+	Ack      bool   `json:"ack,omitempty"`
+	Consumer string `json:"consumer,omitempty"`
+	Credits  int64  `json:"credits,omitempty"`
+	Offset   int64  `json:"offset,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// connect lets a client push datapoints and consume them over one
+// connection. After subscribing as a consumer, the client receives one
+// datapoint per credit it granted, so it is never sent more than it can take.
+// Like a pop, sending a datapoint moves the consumer pointer over it.
+func (s *Server) connect(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pipelineId := vars["id"]
+
+	if _, err := s.Backend.GetPipeline(pipelineId); err != nil {
+		backendError(w, "Error retrieving pipeline:", err)
+		return
+	}
+
+	// the upgrader answers failed handshakes itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Error upgrading to websocket:", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	incoming := make(chan []byte)
+	go func() {
+		defer close(incoming)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case incoming <- data:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	session := &wsSession{server: s, conn: conn, pipelineId: pipelineId}
+	defer session.unsubscribe()
+	ping := time.NewTicker(streamKeepAlive)
+	defer ping.Stop()
+
+	for {
+		sent, err := session.send()
+		if err != nil {
+			log.Println("Error sending datapoints:", err.Error())
+			return
+		}
+
+		// there may be more to send, so only look for messages in between
+		if sent > 0 {
+			select {
+			case data, ok := <-incoming:
+				if !ok || !session.handle(data) {
+					return
+				}
+			default:
+			}
+			continue
+		}
+
+		select {
+		case data, ok := <-incoming:
+			if !ok || !session.handle(data) {
+				return
+			}
+		case <-session.notifications:
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsSession is the state of one websocket connection, only the goroutine
+// serving the connection uses it
+type wsSession struct {
+	server        *Server
+	conn          *websocket.Conn
+	pipelineId    string
+	consumerId    string
+	credits       int64
+	notifications chan struct{}
+}
+
+// handle answers a message of the client, it returns false if the
+// connection is broken
+func (s *wsSession) handle(data []byte) bool {
+	message := wsMessage{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return s.reply(wsMessage{Type: "error", Error: err.Error()})
+	}
+
+	switch message.Type {
+	case "push":
+		index, err := s.server.Backend.PushDatapoint(s.pipelineId, message.Payload, message.Ack)
+		if err != nil {
+			log.Println("Error pushing datapoint:", err.Error())
+			return s.reply(wsMessage{Type: "error", Id: message.Id, Error: err.Error()})
+		}
+		// the offset is 0 if the datapoint isn't stored yet
+		return s.reply(wsMessage{Type: "pushed", Id: message.Id, Offset: index})
+	case "subscribe":
+		if message.Consumer == "" {
+			return s.reply(wsMessage{Type: "error", Id: message.Id, Error: "missing consumer"})
+		}
+		if s.notifications == nil {
+			s.notifications = s.server.Backend.Subscribe(s.pipelineId)
+		}
+		s.consumerId = message.Consumer
+		return s.reply(wsMessage{Type: "subscribed", Id: message.Id, Consumer: s.consumerId})
+	case "credit":
+		if message.Credits < 1 {
+			return s.reply(wsMessage{Type: "error", Id: message.Id, Error: "credits must be positive"})
+		}
+		s.credits += message.Credits
+		return true
+	}
+	return s.reply(wsMessage{Type: "error", Id: message.Id, Error: "unknown message type \"" + message.Type + "\""})
+}
+
+// send sends as many of the next datapoints of the consumer as the client has
+// credits for and returns how many were sent
+func (s *wsSession) send() (int64, error) {
+	if s.consumerId == "" || s.credits < 1 {
+		return 0, nil
+	}
+
+	limit := backend.PopLimit{Max: s.credits}
+	if s.server.MaxPop > 0 && limit.Max > s.server.MaxPop {
+		limit.Max = s.server.MaxPop
+	}
+	datapoints, err := s.server.Backend.PeekDatapoints(s.pipelineId, s.consumerId, limit)
+	if err != nil || len(datapoints) == 0 {
+		return 0, err
+	}
+
+	for _, datapoint := range datapoints {
+		err := s.conn.WriteJSON(wsMessage{Type: "datapoint", Consumer: s.consumerId, Offset: datapoint.Offset, Payload: datapoint.Value})
+		if err != nil {
+			return 0, err
+		}
+	}
+	s.credits -= int64(len(datapoints))
+	return int64(len(datapoints)), s.server.Backend.CommitOffset(s.pipelineId, s.consumerId, datapoints[len(datapoints)-1].Offset)
+}
+
+func (s *wsSession) reply(message wsMessage) bool {
+	if err := s.conn.WriteJSON(message); err != nil {
+		log.Println("Error writing to websocket:", err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *wsSession) unsubscribe() {
+	if s.notifications != nil {
+		s.server.Backend.Unsubscribe(s.pipelineId, s.notifications)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cgrotz/turbine.go/backend"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// how long a test waits for a message
+const testTimeout = 5 * time.Second
+
+// dialWebsocket serves the websocket endpoint of the backend and connects to
+// the pipeline
+func dialWebsocket(b backend.Backend, pipelineId string) (*websocket.Conn, *http.Response, func()) {
+	server := &Server{Backend: b}
+	r := mux.NewRouter()
+	r.Path("/api/v1/pipelines/{id}/ws").Methods("GET").HandlerFunc(server.connect)
+	httpServer := httptest.NewServer(r)
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/api/v1/pipelines/" + pipelineId + "/ws"
+	conn, response, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		httpServer.Close()
+		return nil, response, nil
+	}
+	return conn, response, func() {
+		conn.Close()
+		httpServer.Close()
+	}
+}
+
+func send(t *testing.T, conn *websocket.Conn, message wsMessage) {
+	conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if err := conn.WriteJSON(message); err != nil {
+		t.Fatalf("Sending %s message failed: %s", message.Type, err.Error())
+	}
+}
+
+func expect(t *testing.T, conn *websocket.Conn, messageType string) wsMessage {
+	message := wsMessage{}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatalf("expected a %s message but reading failed: %s", messageType, err.Error())
+	}
+	if message.Type != messageType {
+		t.Fatalf("expected a %s message but got %+v", messageType, message)
+	}
+	return message
+}
+
+func TestWebsocket(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "websocket"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	conn, _, closeConn := dialWebsocket(b, pipeline.Id)
+	if conn == nil {
+		t.Fatal("Connecting to the websocket failed")
+	}
+	defer closeConn()
+
+	for _, payload := range []string{"Event 1", "Event 2", "Event 3"} {
+		send(t, conn, wsMessage{Type: "push", Id: payload, Payload: payload, Ack: true})
+		if pushed := expect(t, conn, "pushed"); pushed.Id != payload || pushed.Offset == 0 {
+			t.Fatalf("expected the offset of %s but got %+v", payload, pushed)
+		}
+	}
+
+	send(t, conn, wsMessage{Type: "subscribe", Id: "s", Consumer: "consumer1"})
+	if subscribed := expect(t, conn, "subscribed"); subscribed.Id != "s" || subscribed.Consumer != "consumer1" {
+		t.Fatalf("expected the subscription of consumer1 but got %+v", subscribed)
+	}
+	send(t, conn, wsMessage{Type: "credit", Credits: 2})
+	for offset := int64(1); offset <= 2; offset++ {
+		if datapoint := expect(t, conn, "datapoint"); datapoint.Offset != offset || datapoint.Consumer != "consumer1" {
+			t.Fatalf("expected datapoint %d but got %+v", offset, datapoint)
+		}
+	}
+
+	// without credits the datapoint pushed is answered, but not sent
+	send(t, conn, wsMessage{Type: "push", Id: "4", Payload: "Event 4", Ack: true})
+	expect(t, conn, "pushed")
+	send(t, conn, wsMessage{Type: "credit", Credits: 5})
+	for offset := int64(3); offset <= 4; offset++ {
+		if datapoint := expect(t, conn, "datapoint"); datapoint.Offset != offset || datapoint.Payload != fmt.Sprintf("Event %d", offset) {
+			t.Fatalf("expected datapoint %d but got %+v", offset, datapoint)
+		}
+	}
+
+	// the remaining credits are used for datapoints pushed later
+	if _, err := b.PushDatapoint(pipeline.Id, "Event 5", true); err != nil {
+		t.Fatalf("PushDatapoint failed: %s", err.Error())
+	}
+	if datapoint := expect(t, conn, "datapoint"); datapoint.Offset != 5 {
+		t.Fatalf("expected datapoint 5 but got %+v", datapoint)
+	}
+	// the consumer is moved once the datapoints are sent
+	for deadline := time.Now().Add(testTimeout); ; time.Sleep(10 * time.Millisecond) {
+		consumers, err := b.GetConsumers(pipeline.Id)
+		if err == nil && len(consumers) == 1 && consumers[0].Offset == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the consumer to be moved over the datapoints sent but got %+v, %v", consumers, err)
+		}
+	}
+}
+
+func TestWebsocketErrors(t *testing.T) {
+	b := backend.NewMemoryBackend()
+	if _, response, _ := dialWebsocket(b, "unknown"); response == nil || response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected an unknown pipeline to be answered with 404 but got %+v", response)
+	}
+
+	pipeline, err := b.CreatePipeline(&backend.Pipeline{Name: "websocket"})
+	if err != nil {
+		t.Fatalf("CreatePipeline failed: %s", err.Error())
+	}
+	conn, _, closeConn := dialWebsocket(b, pipeline.Id)
+	if conn == nil {
+		t.Fatal("Connecting to the websocket failed")
+	}
+	defer closeConn()
+
+	messages := []wsMessage{
+		{Type: "subscribe", Id: "1"},
+		{Type: "credit", Id: "2", Credits: 0},
+		{Type: "credit", Id: "3", Credits: -1},
+		{Type: "pop", Id: "4"},
+	}
+	for _, message := range messages {
+		send(t, conn, message)
+		if reply := expect(t, conn, "error"); reply.Id != message.Id || reply.Error == "" {
+			t.Fatalf("expected an error for message %s but got %+v", message.Id, reply)
+		}
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	conn.WriteMessage(websocket.TextMessage, []byte("{"))
+	expect(t, conn, "error")
+}